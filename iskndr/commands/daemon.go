@@ -0,0 +1,280 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/igneel64/iskandar/iskndr/internal/config"
+	"github.com/igneel64/iskandar/iskndr/internal/daemon"
+	"github.com/igneel64/iskandar/iskndr/internal/logger"
+	"github.com/igneel64/iskandar/shared/protocol"
+	"github.com/spf13/cobra"
+)
+
+func addSocketFlag(cmd *cobra.Command, socketPath *string) {
+	cmd.Flags().StringVar(socketPath, "socket", daemon.DefaultSocketPath(), "Control socket of the daemon")
+}
+
+func newDaemonCommand() *cobra.Command {
+	var socketPath string
+
+	daemonCmd := &cobra.Command{
+		Use:   "daemon",
+		Short: "Run tunnels in the background",
+		Long: `This command runs tunnels in the background and serves a control API on a Unix socket,
+used by 'iskndr add', 'iskndr ls', 'iskndr rm', 'iskndr logs' and 'iskndr chaos'.
+
+The daemon ignores the hangup of its terminal, so 'iskndr daemon &' keeps the tunnels open after the
+terminal is closed. Stopping the daemon closes all of its tunnels.`,
+		Args:                  cobra.NoArgs,
+		DisableFlagsInUseLine: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logger.Initialize(true, os.Stdout)
+			/* Tunnels inherit the ignored hangup as well. */
+			signal.Ignore(syscall.SIGHUP)
+
+			listener, err := daemon.Listen(socketPath)
+			if err != nil {
+				return err
+			}
+
+			d := daemon.NewDaemon(daemon.Options{})
+			httpServer := &http.Server{Handler: d.Handler(), ReadHeaderTimeout: 10 * time.Second}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			go func() {
+				<-ctx.Done()
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				_ = httpServer.Shutdown(shutdownCtx)
+			}()
+
+			logger.DaemonListening(socketPath)
+			err = httpServer.Serve(listener)
+			d.Close()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		},
+	}
+
+	addSocketFlag(daemonCmd, &socketPath)
+
+	return daemonCmd
+}
+
+func newAddCommand() *cobra.Command {
+	var socketPath string
+	var name string
+
+	addCmd := &cobra.Command{
+		Use:   "add [--name <name>] <destination> [tunnel flags]",
+		Short: "Start a tunnel in the daemon",
+		Long: `This command starts a tunnel in the daemon and prints its name and public URL once it is connected.
+
+Everything after the destination is passed to 'iskndr tunnel', e.g.
+
+  iskndr add --name api 8080 --server tunnel.example.com --path-prefix /api
+
+Relative paths resolve as for 'iskndr tunnel' run here. The tunnel gets ISKNDR_TOKEN, the OTEL_ variables,
+proxy and certificate settings and the webhook secrets named by --verify-webhook and --policy from this
+environment, nothing else.`,
+		Args:                  cobra.MinimumNArgs(1),
+		DisableFlagsInUseLine: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir, err := os.Getwd()
+			if err != nil {
+				return err
+			}
+
+			cmd.SilenceUsage = true
+			tunnel, err := daemon.NewClient(socketPath).Add(cmd.Context(), daemon.AddRequest{
+				Name: name,
+				Args: args,
+				Dir:  dir,
+				Env:  tunnelEnv(args, dir),
+			})
+			if err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(cmd.OutOrStdout(), "%s %s\n", tunnel.Name, tunnel.PublicURL)
+			return nil
+		},
+	}
+
+	/* Flags after the destination belong to the tunnel. */
+	addCmd.Flags().SetInterspersed(false)
+	addCmd.Flags().StringVar(&name, "name", "", "Name to manage the tunnel with (defaults to one derived from the destination)")
+	addSocketFlag(addCmd, &socketPath)
+
+	return addCmd
+}
+
+/* Variables of the connection to the server, OTEL_ variables configure tracing as a whole. */
+var tunnelEnvNames = []string{
+	"ISKNDR_TOKEN",
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy",
+	"SSL_CERT_FILE", "SSL_CERT_DIR",
+}
+
+/*
+tunnelEnv picks the variables a daemon tunnel needs rather than handing the whole environment to the daemon:
+tunnelEnvNames, OTEL_ variables and the webhook secrets named by --verify-webhook and the --policy file.
+*/
+func tunnelEnv(args []string, dir string) []string {
+	names := slices.Clone(tunnelEnvNames)
+
+	flags := newTunnelCommand().Flags()
+	/* Invalid arguments are reported by the tunnel itself. */
+	_ = flags.Parse(args)
+	webhookFlags, _ := flags.GetStringArray("verify-webhook")
+	for _, webhookFlag := range webhookFlags {
+		if name := config.WebhookSecretEnv(webhookFlag); name != "" {
+			names = append(names, name)
+		}
+	}
+	if policyFile, _ := flags.GetString("policy"); policyFile != "" {
+		if !filepath.IsAbs(policyFile) {
+			policyFile = filepath.Join(dir, policyFile)
+		}
+		var trafficPolicy protocol.TrafficPolicy
+		if data, err := os.ReadFile(policyFile); err == nil && json.Unmarshal(data, &trafficPolicy) == nil {
+			names = append(names, trafficPolicy.SecretEnvs()...)
+		}
+	}
+
+	var env []string
+	for _, variable := range os.Environ() {
+		name, _, _ := strings.Cut(variable, "=")
+		if strings.HasPrefix(name, "OTEL_") || slices.Contains(names, name) {
+			env = append(env, variable)
+		}
+	}
+	return env
+}
+
+func newLsCommand() *cobra.Command {
+	var socketPath string
+	var asJSON bool
+
+	lsCmd := &cobra.Command{
+		Use:                   "ls",
+		Short:                 "List the tunnels of the daemon",
+		Args:                  cobra.NoArgs,
+		DisableFlagsInUseLine: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			tunnels, err := daemon.NewClient(socketPath).List(cmd.Context())
+			if err != nil {
+				return err
+			}
+
+			if asJSON {
+				encoder := json.NewEncoder(cmd.OutOrStdout())
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(tunnels)
+			}
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+			_, _ = fmt.Fprintln(w, "NAME\tSTATUS\tPUBLIC URL\tDESTINATION\tREQUESTS\tUPTIME")
+			for _, tunnel := range tunnels {
+				status := tunnel.Status
+				if tunnel.Error != "" {
+					status += ": " + tunnel.Error
+				}
+				uptime := time.Since(tunnel.StartedAt).Round(time.Second)
+				_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", tunnel.Name, status, tunnel.PublicURL, tunnel.Destination, tunnel.Requests, uptime)
+			}
+			return w.Flush()
+		},
+	}
+
+	lsCmd.Flags().BoolVar(&asJSON, "json", false, "Print the tunnels as JSON")
+	addSocketFlag(lsCmd, &socketPath)
+
+	return lsCmd
+}
+
+func newRmCommand() *cobra.Command {
+	var socketPath string
+
+	rmCmd := &cobra.Command{
+		Use:                   "rm <name>...",
+		Short:                 "Stop tunnels of the daemon",
+		Args:                  cobra.MinimumNArgs(1),
+		DisableFlagsInUseLine: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			client := daemon.NewClient(socketPath)
+			var errs []error
+			for _, name := range args {
+				errs = append(errs, client.Remove(cmd.Context(), name))
+			}
+			return errors.Join(errs...)
+		},
+	}
+
+	addSocketFlag(rmCmd, &socketPath)
+
+	return rmCmd
+}
+
+func newLogsCommand() *cobra.Command {
+	var socketPath string
+
+	logsCmd := &cobra.Command{
+		Use:                   "logs <name>",
+		Short:                 "Print the recent log lines of a daemon tunnel",
+		Args:                  cobra.ExactArgs(1),
+		DisableFlagsInUseLine: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			logs, err := daemon.NewClient(socketPath).Logs(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprint(cmd.OutOrStdout(), logs)
+			return err
+		},
+	}
+
+	addSocketFlag(logsCmd, &socketPath)
+
+	return logsCmd
+}
+
+func newChaosCommand() *cobra.Command {
+	var socketPath string
+
+	chaosCmd := &cobra.Command{
+		Use:   "chaos <name>",
+		Short: "Toggle the fault injection of a daemon tunnel",
+		Long: `This command switches the fault injection of a daemon tunnel started with --chaos off, or back on.
+'iskndr logs <name>' shows whether it is enabled now.
+
+A tunnel running in the foreground without the status screen toggles it on SIGUSR1.`,
+		Args:                  cobra.ExactArgs(1),
+		DisableFlagsInUseLine: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			return daemon.NewClient(socketPath).ToggleChaos(cmd.Context(), args[0])
+		},
+	}
+
+	addSocketFlag(chaosCmd, &socketPath)
+
+	return chaosCmd
+}
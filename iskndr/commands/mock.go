@@ -0,0 +1,43 @@
+package commands
+
+import (
+	"github.com/igneel64/iskandar/iskndr/internal/mock"
+	"github.com/igneel64/iskandar/iskndr/internal/upstream"
+	"github.com/spf13/cobra"
+)
+
+func newMockCommand() *cobra.Command {
+	var session tunnelSession
+
+	mockCmd := &cobra.Command{
+		Use:   "mock <file-or-dir>",
+		Short: "Serve mock responses through a tunnel",
+		Long: `This command answers every request with mock responses defined in YAML, without a local application.
+
+The mocks are read from a YAML file or from every .yaml and .yml file of a directory. Requests no mock
+matches get a 404. Use 'iskndr tunnel <destination> --mock <file-or-dir>' to only fall back to the
+mocks while the local application is down.`,
+		Args:                  cobra.ExactArgs(1),
+		DisableFlagsInUseLine: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			restorationHandler := terminalRestoration()
+			defer restorationHandler()
+			if err := session.initOutput(); err != nil {
+				return err
+			}
+
+			handler, err := mock.Load(args[0])
+			if err != nil {
+				return err
+			}
+
+			upstreamMapper := upstream.NewMapper(upstream.Destination{URL: "http://localhost", Handler: handler}, upstream.Options{})
+
+			return session.run(upstreamMapper, "mocks from "+args[0])
+		},
+	}
+
+	session.addFlags(mockCmd)
+
+	return mockCmd
+}
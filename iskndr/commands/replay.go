@@ -0,0 +1,102 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/igneel64/iskandar/iskndr/internal/config"
+	"github.com/igneel64/iskandar/iskndr/internal/har"
+	"github.com/igneel64/iskandar/iskndr/internal/upstream"
+	"github.com/spf13/cobra"
+)
+
+func newReplayCommand() *cobra.Command {
+	var harFile string
+	var upstreamInsecure bool
+
+	replayCmd := &cobra.Command{
+		Use:   "replay <destination> --har <file>",
+		Short: "Replay recorded requests against a local application",
+		Long: `This command sends the requests of a HAR file, e.g. one recorded with 'iskndr tunnel --record', to a local destination
+one after another and compares the response statuses with the recorded ones.
+
+It fails when a request can't be sent or a status differs, so recordings can serve as regression fixtures.
+Redacted headers are not sent.`,
+		Args:                  cobra.ExactArgs(1),
+		DisableFlagsInUseLine: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			destination, err := config.ParseDestination(args[0])
+			if err != nil {
+				return err
+			}
+
+			recording, err := har.Load(harFile)
+			if err != nil {
+				return err
+			}
+
+			upstreamMapper := upstream.NewMapper(destination, upstream.Options{
+				Transport: upstream.TransportOptions{InsecureSkipVerify: upstreamInsecure},
+			})
+
+			cmd.SilenceUsage = true
+			failed := replay(cmd.Context(), cmd.OutOrStdout(), recording.Log.Entries, upstreamMapper)
+			if failed > 0 {
+				return fmt.Errorf("%d of %d replayed requests failed or got a different status", failed, len(recording.Log.Entries))
+			}
+			return nil
+		},
+	}
+
+	replayCmd.Flags().StringVar(&harFile, "har", "", "HAR file with the requests to replay")
+	replayCmd.Flags().BoolVar(&upstreamInsecure, "upstream-insecure", false, "Skip TLS certificate verification for https destinations")
+	if err := replayCmd.MarkFlagRequired("har"); err != nil {
+		panic(err)
+	}
+
+	return replayCmd
+}
+
+/* Sends the entries in order and prints one line per request, returns how many failed. */
+func replay(ctx context.Context, out io.Writer, entries []har.Entry, upstreamMapper *upstream.Mapper) int {
+	failed := 0
+	for idx := range entries {
+		entry := &entries[idx]
+		status, elapsed, err := replayEntry(ctx, entry, upstreamMapper)
+		switch {
+		case err != nil:
+			failed++
+			_, _ = fmt.Fprintf(out, "FAIL %s %s: %v\n", entry.Request.Method, entry.Request.URL, err)
+		case status != entry.Response.Status:
+			failed++
+			_, _ = fmt.Fprintf(out, "FAIL %s %s: %d, recorded %d (%s)\n", entry.Request.Method, entry.Request.URL, status, entry.Response.Status, elapsed.Round(time.Millisecond))
+		default:
+			_, _ = fmt.Fprintf(out, "ok   %s %s: %d (%s)\n", entry.Request.Method, entry.Request.URL, status, elapsed.Round(time.Millisecond))
+		}
+	}
+	return failed
+}
+
+func replayEntry(ctx context.Context, entry *har.Entry, upstreamMapper *upstream.Mapper) (int, time.Duration, error) {
+	requestURI, err := entry.RequestURI()
+	if err != nil {
+		return 0, 0, err
+	}
+	target := upstreamMapper.Resolve(requestURI)
+	req, err := entry.NewRequest(ctx, target.URL)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	started := time.Now()
+	res, err := target.Client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	//nolint:errcheck
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	return res.StatusCode, time.Since(started), nil
+}
@@ -12,6 +12,16 @@ func Execute() error {
 	}
 
 	rootCmd.AddCommand(newTunnelCommand())
+	rootCmd.AddCommand(newShareCommand())
+	rootCmd.AddCommand(newMockCommand())
+	rootCmd.AddCommand(newReplayCommand())
+	rootCmd.AddCommand(newDaemonCommand())
+	rootCmd.AddCommand(newAddCommand())
+	rootCmd.AddCommand(newLsCommand())
+	rootCmd.AddCommand(newRmCommand())
+	rootCmd.AddCommand(newLogsCommand())
+	rootCmd.AddCommand(newChaosCommand())
+	rootCmd.AddCommand(newServerCommand())
 	rootCmd.AddCommand(newVersionCommand())
 
 	return rootCmd.Execute()
@@ -0,0 +1,181 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/igneel64/iskandar/server/logger"
+	"github.com/igneel64/iskandar/server/tunnelserver"
+	"github.com/igneel64/iskandar/shared/tracing"
+	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel"
+)
+
+func newServerCommand() *cobra.Command {
+	var port int
+	var baseDomain string
+	var baseScheme string
+	var maxTunnels int
+	var maxRequestsPerTunnel int
+	var trustedProxies []string
+	var requestIdHeader string
+	var tokens []string
+	var enableLogging bool
+	var logFormat string
+	var logLevel string
+	var accessLogFormat string
+	var h2c bool
+	var eventStreamKeepAlive time.Duration
+	var maxTunnelTTL time.Duration
+	var errorPagesDir string
+	var interstitial bool
+	var policyFile string
+	var tlsCertFile string
+	var tlsKeyFile string
+	var otlpEndpoint string
+	var compression bool
+	var tunnelQuota, tokenQuota tunnelserver.QuotaLimits
+	var maxTunnelsPerToken int
+
+	serverCmd := &cobra.Command{
+		Use:   "server",
+		Short: "Run a tunnel server locally",
+		Long: `This command runs an iskandar tunnel server in the foreground, e.g. for CI jobs or local development.
+
+For production deployments see the tunnel-server Docker image.`,
+		Args:                  cobra.NoArgs,
+		DisableFlagsInUseLine: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			/* The same rule as the tunnel-server's environment, zero would reject every tunnel or request. */
+			for _, limit := range []struct {
+				name  string
+				value int
+			}{
+				{"--max-tunnels", maxTunnels},
+				{"--max-requests-per-tunnel", maxRequestsPerTunnel},
+			} {
+				if limit.value <= 0 {
+					return fmt.Errorf("invalid %s: must be greater than 0", limit.name)
+				}
+			}
+
+			if baseDomain == "" {
+				baseDomain = fmt.Sprintf("localhost.direct:%d", port)
+			}
+
+			publicURLBase, err := url.Parse(baseScheme + "://" + baseDomain)
+			if err != nil {
+				return fmt.Errorf("invalid public URL base: %w", err)
+			}
+
+			shutdownTracing, err := tracing.Setup(context.Background(), tracing.Options{
+				ServiceName: "iskndr-server",
+				Endpoint:    otlpEndpoint,
+				SampleRatio: 1,
+			})
+			if err != nil {
+				return err
+			}
+			defer flushTraces(shutdownTracing)
+
+			ceilings := tunnelserver.DefaultLimitCeilings
+			ceilings.TTL = maxTunnelTTL
+
+			serverLogger := logger.NewLogger(false)
+			if enableLogging {
+				if serverLogger, err = logger.New(logger.Options{Format: logFormat, Level: logLevel}); err != nil {
+					return err
+				}
+			}
+
+			var accessLog logger.AccessLogger
+			if accessLogFormat != "" {
+				if accessLog, err = logger.NewAccessLogger(accessLogFormat, os.Stdout); err != nil {
+					return err
+				}
+			}
+
+			server, err := tunnelserver.NewIskndrServer(publicURLBase,
+				tunnelserver.WithConnectionStore(tunnelserver.NewInMemoryConnectionStore(maxTunnels, tunnelserver.DefaultMaxMessageSize)),
+				tunnelserver.WithRequestManager(tunnelserver.NewInMemoryRequestManager(maxRequestsPerTunnel)),
+				tunnelserver.WithLimits(tunnelserver.DefaultLimits, ceilings),
+				tunnelserver.WithTrustedProxies(trustedProxies...),
+				tunnelserver.WithRequestIdHeader(requestIdHeader),
+				tunnelserver.WithCompression(compression),
+				tunnelserver.WithTokens(tokens...),
+				tunnelserver.WithQuotas(tunnelQuota, tokenQuota, maxTunnelsPerToken),
+				tunnelserver.WithEventStreamKeepAlive(eventStreamKeepAlive),
+				tunnelserver.WithErrorPages(errorPagesDir),
+				tunnelserver.WithInterstitial(interstitial),
+				tunnelserver.WithPolicyFile(policyFile),
+				tunnelserver.WithLogger(serverLogger),
+				tunnelserver.WithAccessLog(accessLog),
+				tunnelserver.WithTracerProvider(otel.GetTracerProvider()),
+			)
+			if err != nil {
+				return err
+			}
+
+			httpServer := tunnelserver.NewHTTPServer(fmt.Sprintf(":%d", port), server, h2c)
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+			go func() {
+				<-ctx.Done()
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				_ = httpServer.Shutdown(shutdownCtx)
+			}()
+
+			serverLogger.ServerStarted(port)
+			if tlsCertFile != "" {
+				err = httpServer.ListenAndServeTLS(tlsCertFile, tlsKeyFile)
+			} else {
+				err = httpServer.ListenAndServe()
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		},
+	}
+
+	serverCmd.Flags().IntVar(&port, "port", 8080, "Port the server listens on")
+	serverCmd.Flags().StringVar(&baseDomain, "base-domain", "", "Base domain for tunnel URLs (default localhost.direct:<port>)")
+	serverCmd.Flags().StringVar(&baseScheme, "base-scheme", "http", "URL scheme for tunnel URLs")
+	serverCmd.Flags().IntVar(&maxTunnels, "max-tunnels", tunnelserver.DefaultMaxTunnels, "Max tunnel connections allowed")
+	serverCmd.Flags().IntVar(&maxRequestsPerTunnel, "max-requests-per-tunnel", tunnelserver.DefaultMaxRequestsPerTunnel, "Max requests processed in parallel per tunnel")
+	serverCmd.Flags().StringSliceVar(&trustedProxies, "trusted-proxies", nil, "IPs or CIDR ranges of proxies whose X-Forwarded-* headers are trusted")
+	serverCmd.Flags().StringVar(&requestIdHeader, "request-id-header", tunnelserver.DefaultRequestIdHeader, "Header carrying the request ID to the local application and back to the public client")
+	serverCmd.Flags().StringSliceVar(&tokens, "tokens", nil, "API tokens CLIs must connect with, anyone can connect when empty")
+	serverCmd.Flags().Float64Var(&tunnelQuota.RequestsPerSecond, "tunnel-rate-limit", 0, "Requests per second allowed per tunnel (default unlimited)")
+	serverCmd.Flags().IntVar(&tunnelQuota.Burst, "tunnel-rate-burst", 0, "Requests a tunnel may burst above its rate (default one second worth)")
+	serverCmd.Flags().Int64Var(&tunnelQuota.BytesPerDay, "tunnel-daily-bandwidth", 0, "Request and response body bytes per tunnel and UTC day (default unlimited)")
+	serverCmd.Flags().Float64Var(&tokenQuota.RequestsPerSecond, "token-rate-limit", 0, "Requests per second allowed across all tunnels of a token (default unlimited)")
+	serverCmd.Flags().IntVar(&tokenQuota.Burst, "token-rate-burst", 0, "Requests a token may burst above its rate (default one second worth)")
+	serverCmd.Flags().Int64Var(&tokenQuota.BytesPerDay, "token-daily-bandwidth", 0, "Body bytes per token and UTC day (default unlimited)")
+	serverCmd.Flags().IntVar(&maxTunnelsPerToken, "max-tunnels-per-token", 0, "Tunnels a token may have open at once (default unlimited)")
+	serverCmd.Flags().BoolVar(&enableLogging, "logging", true, "Enable logging to stderr")
+	serverCmd.Flags().StringVar(&logFormat, "log-format", logger.FormatConsole, "Log format: 'console' or 'json'")
+	serverCmd.Flags().StringVar(&logLevel, "log-level", "info", "Minimum log level: 'debug', 'info', 'warn' or 'error'")
+	serverCmd.Flags().StringVar(&accessLogFormat, "access-log", "", "Log every public request to stdout: 'combined' or 'json'")
+	serverCmd.Flags().DurationVar(&eventStreamKeepAlive, "event-stream-keepalive", 0, "Send keep-alive comments on Server-Sent Events quiet for this long, e.g. 15s")
+	serverCmd.Flags().DurationVar(&maxTunnelTTL, "max-tunnel-ttl", 0, "Close tunnels after this long, e.g. 8h (default unlimited)")
+	serverCmd.Flags().StringVar(&errorPagesDir, "error-pages", "", "Directory with custom error page templates (e.g. 502.html, error.html, interstitial.html)")
+	serverCmd.Flags().BoolVar(&interstitial, "interstitial", false, "Warn browsers on their first visit of a tunnel")
+	serverCmd.Flags().StringVar(&policyFile, "policy", "", "JSON traffic policy applied to every tunnel")
+	serverCmd.Flags().BoolVar(&compression, "compression", true, "Negotiate permessage-deflate with CLIs that offer it")
+	serverCmd.Flags().BoolVar(&h2c, "h2c", true, "Accept HTTP/2 without TLS (prior knowledge), as used by gRPC clients")
+	serverCmd.Flags().StringVar(&tlsCertFile, "tls-cert", "", "Certificate file to serve TLS and HTTP/2 directly")
+	serverCmd.Flags().StringVar(&tlsKeyFile, "tls-key", "", "Private key file for --tls-cert")
+	serverCmd.Flags().StringVar(&otlpEndpoint, "otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OTLP/HTTP collector receiving a span per public request, e.g. http://localhost:4318 (defaults to $OTEL_EXPORTER_OTLP_ENDPOINT)")
+	serverCmd.MarkFlagsRequiredTogether("tls-cert", "tls-key")
+
+	return serverCmd
+}
@@ -0,0 +1,63 @@
+package commands
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/igneel64/iskandar/iskndr/internal/share"
+	"github.com/igneel64/iskandar/iskndr/internal/upstream"
+	"github.com/spf13/cobra"
+)
+
+func newShareCommand() *cobra.Command {
+	var session tunnelSession
+	var spaFallback bool
+	var basicAuth string
+
+	shareCmd := &cobra.Command{
+		Use:   "share <dir>",
+		Short: "Share a local directory through a tunnel",
+		Long: `This command serves a local directory directly from the CLI through a tunnel, without a separate local server.
+
+Directory listings and range requests are supported. Dotfiles are never served.`,
+		Args:                  cobra.ExactArgs(1),
+		DisableFlagsInUseLine: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			restorationHandler := terminalRestoration()
+			defer restorationHandler()
+			if err := session.initOutput(); err != nil {
+				return err
+			}
+
+			dir, err := filepath.Abs(args[0])
+			if err != nil {
+				return err
+			}
+
+			opts := share.Options{Dir: dir, SPAFallback: spaFallback}
+			if basicAuth != "" {
+				var found bool
+				opts.Username, opts.Password, found = strings.Cut(basicAuth, ":")
+				if !found || opts.Username == "" || opts.Password == "" {
+					return fmt.Errorf("basic auth must be in the form user:password")
+				}
+			}
+
+			handler, err := share.NewHandler(opts)
+			if err != nil {
+				return err
+			}
+
+			upstreamMapper := upstream.NewMapper(upstream.Destination{URL: "http://localhost", Handler: handler}, upstream.Options{})
+
+			return session.run(upstreamMapper, dir)
+		},
+	}
+
+	session.addFlags(shareCmd)
+	shareCmd.Flags().BoolVar(&spaFallback, "spa", false, "Serve index.html for paths that don't exist (single page applications)")
+	shareCmd.Flags().StringVar(&basicAuth, "basic-auth", "", "Require HTTP basic auth, in the form user:password")
+
+	return shareCmd
+}
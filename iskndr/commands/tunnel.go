@@ -1,25 +1,56 @@
 package commands
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"sync/atomic"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/igneel64/iskandar/iskndr/internal/chaos"
 	"github.com/igneel64/iskandar/iskndr/internal/client"
 	"github.com/igneel64/iskandar/iskndr/internal/config"
+	"github.com/igneel64/iskandar/iskndr/internal/events"
+	"github.com/igneel64/iskandar/iskndr/internal/har"
+	"github.com/igneel64/iskandar/iskndr/internal/health"
 	"github.com/igneel64/iskandar/iskndr/internal/logger"
+	"github.com/igneel64/iskandar/iskndr/internal/mock"
 	"github.com/igneel64/iskandar/iskndr/internal/ui"
+	"github.com/igneel64/iskandar/iskndr/internal/upstream"
 	iskWS "github.com/igneel64/iskandar/iskndr/internal/websocket"
 	"github.com/igneel64/iskandar/shared"
+	"github.com/igneel64/iskandar/shared/protocol"
+	"github.com/igneel64/iskandar/shared/tracing"
+	"github.com/igneel64/iskandar/shared/webhook"
 	"github.com/spf13/cobra"
 	"golang.org/x/term"
 )
 
+/* Output formats of the commands that open a tunnel. */
+const (
+	outputTUI  = "tui"
+	outputJSON = "json"
+)
+
 func newTunnelCommand() *cobra.Command {
-	var enableLogging bool
-	var serverUrl string
-	var allowInsecure bool
+	var session tunnelSession
+	var hostHeader string
+	var pathPrefix string
+	var stripPathPrefix string
+	var routeFlags []string
+	var chaosFlags []string
+	var webhookFlags []string
+	var mockSource string
+	var recordFile string
+	var recordOptions har.RecorderOptions
+	var upstreamInsecure bool
+	var upstreamCAFile string
+	var upstreamProtocol string
+	var upstreamFlags []string
+	var balance upstream.BalanceOptions
 
 	tunnelCmd := &cobra.Command{
 		Use:   "tunnel <destination>",
@@ -28,77 +59,423 @@ func newTunnelCommand() *cobra.Command {
 
 The destination can be specified as:
   - port number only (e.g., '8080') - defaults to localhost:8080
-  - host:port (e.g., 'foo.bar:80') - connects to the specified host and port`,
+  - host:port (e.g., 'foo.bar:80') - connects to the specified host and port
+  - https URL (e.g., 'https://localhost:8443') - connects to a local TLS server
+  - unix socket (e.g., 'unix:///var/run/app.sock') - connects to a local Unix socket`,
 		Args:                  cobra.ExactArgs(1),
 		DisableFlagsInUseLine: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			restorationHandler := terminalRestoration()
 			defer restorationHandler()
-			logger.Initialize(enableLogging)
+			if err := session.initOutput(); err != nil {
+				return err
+			}
 
-			destinationAddress, err := config.ParseDestination(args[0])
+			destination, err := config.ParseDestination(args[0])
 			if err != nil {
 				return err
 			}
 
-			serverWSUrl, err := config.ParseServerURL(serverUrl)
+			hostHeader, err = config.ParseHostHeader(hostHeader)
 			if err != nil {
 				return err
 			}
 
-			logger.TunnelStarting(destinationAddress, serverWSUrl)
+			if err = config.ValidatePathPrefix(pathPrefix); err != nil {
+				return err
+			}
+			if err = config.ValidatePathPrefix(stripPathPrefix); err != nil {
+				return err
+			}
 
-			dialer := iskWS.NewWriteSafeWSDialer(serverWSUrl, allowInsecure)
-			c, err := dialer.Dial()
-			if err != nil {
-				logger.TunnelDisconnected(err)
-				return fmt.Errorf("failed to connect to websocket: %w", err)
+			routes := make([]upstream.Route, 0, len(routeFlags))
+			for _, routeFlag := range routeFlags {
+				route, err := config.ParseRoute(routeFlag)
+				if err != nil {
+					return err
+				}
+				routes = append(routes, route)
+			}
+
+			backends := make([]upstream.Backend, 0, len(upstreamFlags))
+			for _, upstreamFlag := range upstreamFlags {
+				backend, err := config.ParseUpstream(upstreamFlag)
+				if err != nil {
+					return err
+				}
+				backends = append(backends, backend)
+			}
+			if err = config.ValidateBalanceStrategy(balance.Strategy, backends); err != nil {
+				return err
 			}
 
-			//nolint:errcheck
-			defer c.Close()
+			if err = config.ValidateUpstreamProtocol(upstreamProtocol, destination); err != nil {
+				return err
+			}
+			for _, route := range routes {
+				if err = config.ValidateUpstreamProtocol(upstreamProtocol, route.Destination); err != nil {
+					return err
+				}
+			}
+			for _, backend := range backends {
+				if err = config.ValidateUpstreamProtocol(upstreamProtocol, backend.Destination); err != nil {
+					return err
+				}
+			}
 
-			client := client.NewIskndrClient(c)
+			transportOptions := upstream.TransportOptions{InsecureSkipVerify: upstreamInsecure, Protocol: upstreamProtocol}
+			if upstreamCAFile != "" {
+				if transportOptions.RootCAs, err = config.LoadCertPool(upstreamCAFile); err != nil {
+					return err
+				}
+			}
 
-			regMsg, err := client.Register()
-			if err != nil {
-				logger.TunnelDisconnected(err)
-				return fmt.Errorf("failed to read register tunnel message: %w", err)
+			chaosRules := make([]chaos.Rule, 0, len(chaosFlags))
+			for _, chaosFlag := range chaosFlags {
+				rule, err := config.ParseChaosRule(chaosFlag)
+				if err != nil {
+					return err
+				}
+				chaosRules = append(chaosRules, rule)
 			}
-			logger.TunnelConnected(regMsg.Subdomain)
+			session.chaos = chaos.NewInjector(chaosRules)
 
-			var program *tea.Program
-			if !enableLogging {
-				program = ui.InitUi(destinationAddress, serverUrl, regMsg.Subdomain, Version)
+			for _, webhookFlag := range webhookFlags {
+				rule, err := config.ParseWebhookRule(webhookFlag)
+				if err != nil {
+					return err
+				}
+				session.webhooks = append(session.webhooks, rule)
 			}
 
-			setupShutdownHandler(c, program)
+			upstreamOptions := upstream.Options{
+				Routes:      routes,
+				StripPrefix: stripPathPrefix,
+				AddPrefix:   pathPrefix,
+				HostHeader:  hostHeader,
+				Transport:   transportOptions,
+				Backends:    backends,
+				Balance:     balance,
+			}
+			upstreamOptions.Balance.OnDown = func(destination upstream.Destination, err error) {
+				logger.UpstreamDown(destination.String(), balance.FailTimeout, err)
+			}
+			if mockSource != "" {
+				if upstreamOptions.Fallback, err = mock.Load(mockSource); err != nil {
+					return err
+				}
+			}
+
+			upstreamMapper := upstream.NewMapper(destination, upstreamOptions)
 
-			return client.AcceptRequests(destinationAddress)
+			if recordFile != "" {
+				recordOptions.Version = Version
+				if session.recorder, err = har.NewRecorder(recordFile, recordOptions); err != nil {
+					return err
+				}
+			}
+
+			displayDestination := destination.String()
+			for _, backend := range backends {
+				displayDestination += ", " + backend.Destination.String()
+			}
+			if len(backends) > 0 {
+				displayDestination += " (" + balance.Strategy + ")"
+			}
+
+			err = session.run(upstreamMapper, displayDestination)
+			return errors.Join(err, session.recorder.Close())
 		},
 	}
 
-	tunnelCmd.Flags().StringVar(&serverUrl, "server", "", "Tunnel server URL (e.g., localhost:8080, https://tunnel.example.com).")
-	tunnelCmd.Flags().BoolVar(&enableLogging, "logging", false, "Enable structured logging to stdout")
-	tunnelCmd.Flags().BoolVar(&allowInsecure, "allow-insecure", false, "Skip TLS certificate verification")
-	if err := tunnelCmd.MarkFlagRequired("server"); err != nil {
+	session.addFlags(tunnelCmd)
+	tunnelCmd.Flags().BoolVar(&upstreamInsecure, "upstream-insecure", false, "Skip TLS certificate verification for https destinations")
+	tunnelCmd.Flags().StringVar(&upstreamCAFile, "upstream-ca", "", "PEM file with additional CAs trusted for https destinations")
+	tunnelCmd.Flags().StringVar(&upstreamProtocol, "upstream-proto", upstream.ProtocolHTTP1, "Protocol spoken to the local destination: 'http1', 'h2' (HTTP/2 over TLS) or 'h2c' (HTTP/2 without TLS, e.g. gRPC)")
+	tunnelCmd.Flags().StringVar(&hostHeader, "host-header", upstream.HostHeaderRewrite, "Host header sent to the local destination: 'rewrite' to the destination, 'preserve' the public host or a custom host")
+	tunnelCmd.Flags().StringVar(&pathPrefix, "path-prefix", "", "Prefix added to the path of every request sent to the local destination (e.g., /api)")
+	tunnelCmd.Flags().StringVar(&stripPathPrefix, "strip-path-prefix", "", "Prefix removed from the public path before forwarding (e.g., /public)")
+	tunnelCmd.Flags().StringArrayVar(&routeFlags, "route", nil, "Route a path prefix to another destination, e.g. '/api=3001' (repeatable)")
+	tunnelCmd.Flags().StringArrayVar(&upstreamFlags, "upstream", nil, "Balance requests between the destination and another one, e.g. '3001' or '3001,weight=3' (repeatable)")
+	tunnelCmd.Flags().StringVar(&balance.Strategy, "lb-strategy", upstream.StrategyRoundRobin, "How requests are spread over the destination and --upstream: 'round-robin', 'least-conn' or 'weighted'")
+	tunnelCmd.Flags().BoolVar(&balance.Sticky, "lb-sticky", false, "Keep each visitor on the same destination with a cookie while it is up")
+	tunnelCmd.Flags().IntVar(&balance.MaxFails, "lb-max-fails", upstream.DefaultMaxFails, "Failed requests in a row after which a destination is skipped")
+	tunnelCmd.Flags().DurationVar(&balance.FailTimeout, "lb-fail-timeout", upstream.DefaultFailTimeout, "How long a failing destination is skipped")
+	tunnelCmd.Flags().StringVar(&mockSource, "mock", "", "YAML file or directory of mock responses served while the local destination is unreachable")
+	tunnelCmd.Flags().StringArrayVar(&webhookFlags, "verify-webhook", nil, "Verify webhook signatures before forwarding, e.g. 'scheme=github,secret-env=GITHUB_WEBHOOK_SECRET,path=/webhooks/**' (repeatable, the first matching rule applies)")
+	tunnelCmd.Flags().StringVar(&recordFile, "record", "", "Write every forwarded request and response to this HAR file as it completes")
+	tunnelCmd.Flags().Int64Var(&recordOptions.MaxBodySize, "record-max-body", har.DefaultMaxBodySize, "Bodies longer than this many bytes are truncated in the recording, -1 leaves bodies out")
+	tunnelCmd.Flags().StringArrayVar(&recordOptions.RedactHeaders, "record-redact", nil, "Header redacted in the recording, in addition to Authorization, Proxy-Authorization, Cookie and Set-Cookie (repeatable)")
+	tunnelCmd.Flags().StringVar(&session.healthOptions.Path, "health-path", "", "Check this path of the destination, e.g. /healthz, and have the server answer 503 while it fails")
+	tunnelCmd.Flags().DurationVar(&session.healthOptions.Interval, "health-interval", health.DefaultInterval, "Time between health checks, also the timeout of each check")
+	tunnelCmd.Flags().IntVar(&session.healthOptions.Threshold, "health-threshold", health.DefaultThreshold, "Consecutive checks needed to switch between healthy and unhealthy")
+	tunnelCmd.Flags().DurationVar(&session.waitForUpstream, "wait-for-upstream", 0, "Wait up to this long for the destination to answer (or pass --health-path) before opening the tunnel, e.g. 1m")
+	tunnelCmd.Flags().StringArrayVar(&chaosFlags, "chaos", nil, "Inject faults, e.g. 'path=/api/**,latency=100ms-2s,errors=10%,drop=2%,throttle=64KB' (repeatable, the first matching rule applies)")
+
+	return tunnelCmd
+}
+
+/* Connection settings shared by every command that opens a tunnel. */
+type tunnelSession struct {
+	serverUrl     string
+	enableLogging bool
+	allowInsecure bool
+	compression   bool
+	token         string
+	otlpEndpoint  string
+	output        string
+	urlFile       string
+	policyFile    string
+	limits        protocol.TunnelLimits
+	chaos         *chaos.Injector
+	recorder      *har.Recorder
+	webhooks      []webhook.Rule
+	/* Health checks run when Path is set. */
+	healthOptions   health.Options
+	waitForUpstream time.Duration
+}
+
+func (s *tunnelSession) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&s.serverUrl, "server", "", "Tunnel server URL (e.g., localhost:8080, https://tunnel.example.com).")
+	cmd.Flags().BoolVar(&s.enableLogging, "logging", false, "Enable structured logging to stdout")
+	cmd.Flags().BoolVar(&s.allowInsecure, "allow-insecure", false, "Skip TLS certificate verification")
+	cmd.Flags().BoolVar(&s.compression, "compression", true, "Compress traffic between the CLI and the server when the server supports it")
+	cmd.Flags().StringVar(&s.token, "token", os.Getenv("ISKNDR_TOKEN"), "API token for servers that require one (defaults to $ISKNDR_TOKEN)")
+	cmd.Flags().StringVar(&s.otlpEndpoint, "otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OTLP/HTTP collector receiving a span per forwarded request, e.g. http://localhost:4318 (defaults to $OTEL_EXPORTER_OTLP_ENDPOINT)")
+	cmd.Flags().StringVar(&s.output, "output", outputTUI, "Output format: 'tui' for the status screen (log lines with --logging) or 'json' for newline-delimited JSON events on stdout")
+	cmd.Flags().StringVar(&s.urlFile, "url-file", "", "Write the public URL to this file once the tunnel is connected")
+	cmd.Flags().StringVar(&s.policyFile, "policy", "", "JSON traffic policy (header rules, CORS, redirects, denies) the server applies to the tunnel")
+	cmd.Flags().Int64Var(&s.limits.MaxBodySize, "max-body-size", 0, "Request a maximum request body size in bytes (capped by the server)")
+	cmd.Flags().DurationVar(&s.limits.ResponseTimeout, "response-timeout", 0, "Request a time-to-first-byte timeout, e.g. 3m (capped by the server)")
+	cmd.Flags().DurationVar(&s.limits.StreamIdleTimeout, "stream-idle-timeout", 0, "Request an idle timeout between streamed chunks, e.g. 5m (capped by the server)")
+	cmd.Flags().DurationVar(&s.limits.EventStreamIdleTimeout, "event-stream-idle-timeout", 0, "Request an idle timeout for Server-Sent Events and chunked responses, e.g. 1h (capped by the server)")
+	cmd.Flags().DurationVar(&s.limits.TTL, "ttl", 0, "Close the tunnel after this long, e.g. 2h (capped by the server)")
+	cmd.Flags().Int64Var(&s.limits.MaxUses, "max-uses", 0, "Only admit this many visitors to the public URL, e.g. 1 for a one-time link")
+	if err := cmd.MarkFlagRequired("server"); err != nil {
 		panic(err)
 	}
+}
 
-	return tunnelCmd
+/* Sets up logging and events for the output format, logs go to stderr when stdout carries JSON events. */
+func (s *tunnelSession) initOutput() error {
+	switch s.output {
+	case outputTUI:
+		logger.Initialize(s.enableLogging, os.Stdout)
+	case outputJSON:
+		logger.Initialize(s.enableLogging, os.Stderr)
+		events.Initialize(os.Stdout)
+	default:
+		return fmt.Errorf("output must be '%s' or '%s'", outputTUI, outputJSON)
+	}
+	return nil
 }
 
-func setupShutdownHandler(c *shared.SafeWebSocketConn, program *tea.Program) {
+/* Connects to the tunnel server and forwards requests through the mapper until the tunnel closes. */
+func (s *tunnelSession) run(upstreamMapper *upstream.Mapper, displayDestination string) error {
+	serverWSUrl, err := config.ParseServerURL(s.serverUrl)
+	if err != nil {
+		return err
+	}
+
+	serverWSUrl, err = config.AppendTunnelLimits(serverWSUrl, s.limits)
+	if err != nil {
+		return err
+	}
+
+	var trafficPolicy protocol.TrafficPolicy
+	if s.policyFile != "" {
+		if trafficPolicy, err = protocol.LoadTrafficPolicy(s.policyFile); err != nil {
+			return err
+		}
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Options{
+		ServiceName: "iskndr",
+		Endpoint:    s.otlpEndpoint,
+		SampleRatio: 1,
+	})
+	if err != nil {
+		return err
+	}
+	defer flushTraces(shutdownTracing)
+
+	checker := health.NewChecker(upstreamMapper, s.healthOptions)
+	if s.waitForUpstream > 0 {
+		if err := s.waitForDestination(checker, displayDestination); err != nil {
+			return err
+		}
+	}
+
+	logger.TunnelStarting(displayDestination, serverWSUrl)
+
+	dialer := iskWS.NewWriteSafeWSDialer(serverWSUrl, iskWS.DialerOptions{
+		AllowInsecure: s.allowInsecure,
+		Compression:   s.compression,
+		Token:         s.token,
+		TrafficPolicy: trafficPolicy,
+	})
+	c, err := dialer.Dial(context.Background())
+	if err != nil {
+		logger.TunnelDisconnected(err)
+		events.Disconnected(err)
+		return fmt.Errorf("failed to connect to websocket: %w", err)
+	}
+
+	//nolint:errcheck
+	defer c.Close()
+
+	tunnelClient := client.NewIskndrClient(c, upstreamMapper, client.WithChaos(s.chaos), client.WithRecorder(s.recorder), client.WithWebhooks(s.webhooks))
+
+	regMsg, err := tunnelClient.Register()
+	if err != nil {
+		logger.TunnelDisconnected(err)
+		events.Disconnected(err)
+		return fmt.Errorf("failed to read register tunnel message: %w", err)
+	}
+	logger.TunnelConnected(regMsg.Subdomain)
+	if s.urlFile != "" {
+		if err := writeURLFile(s.urlFile, regMsg.Subdomain); err != nil {
+			return err
+		}
+	}
+	events.Connected(regMsg.Subdomain, displayDestination)
+	if regMsg.Limits != nil {
+		logger.TunnelLimits(*regMsg.Limits)
+	}
+
+	var expiresAt time.Time
+	if regMsg.Limits != nil && regMsg.Limits.TTL > 0 {
+		expiresAt = time.Now().Add(regMsg.Limits.TTL)
+	}
+
+	var program *tea.Program
+	if s.output == outputTUI && !s.enableLogging {
+		program = ui.InitUi(displayDestination, s.serverUrl, regMsg.Subdomain, Version, expiresAt, s.chaos)
+	}
+
+	shuttingDown := setupShutdownHandler(c, program, s.output == outputTUI)
+	setupChaosToggle(s.chaos, program)
+
+	healthCtx, stopHealthChecks := context.WithCancel(context.Background())
+	defer stopHealthChecks()
+	if s.healthOptions.Path != "" {
+		go checker.Run(healthCtx, func(healthy bool, err error) {
+			state := protocol.HealthUnhealthy
+			if healthy {
+				state = protocol.HealthHealthy
+			}
+			logger.UpstreamHealthChanged(healthy, err)
+			events.Health(state, err)
+			if program != nil {
+				program.Send(ui.HealthMsg{Health: state})
+			}
+			if err := tunnelClient.ReportHealth(healthy); err != nil {
+				logger.Error("Failed to report health", err)
+			}
+		})
+	}
+
+	err = tunnelClient.AcceptRequests()
+	if stats, ok := c.Stats(); ok {
+		logger.TunnelTraffic(stats)
+	}
+	if shuttingDown.Load() {
+		events.Disconnected(nil)
+	} else {
+		events.Disconnected(err)
+	}
+
+	var closedErr *client.ServerClosedError
+	if errors.As(err, &closedErr) {
+		if program != nil {
+			program.Quit()
+			program.Wait()
+		}
+		if s.output == outputTUI {
+			fmt.Printf("\n%s\n", closedErr.Reason)
+		}
+		return nil
+	}
+	return err
+}
+
+/* Holds the registration back until the destination is ready, so visitors don't get 502s while it boots. */
+func (s *tunnelSession) waitForDestination(checker *health.Checker, displayDestination string) error {
+	logger.WaitingForUpstream(displayDestination)
+	if s.output == outputTUI && !s.enableLogging {
+		fmt.Printf("Waiting for %s...\n", displayDestination)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.waitForUpstream)
+	defer cancel()
+	if err := checker.Wait(ctx); err != nil {
+		return fmt.Errorf("%s not ready after %s: %w", displayDestination, s.waitForUpstream, err)
+	}
+	return nil
+}
+
+/* Replaces the file in one step, so scripts waiting for it never read a partial URL. */
+func writeURLFile(path, publicURL string) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(publicURL+"\n"), 0o644); err != nil {
+		return fmt.Errorf("failed to write URL file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write URL file: %w", err)
+	}
+	return nil
+}
+
+/* Gives the exporter a moment to send the last spans, an unreachable collector must not hang the exit. */
+func flushTraces(shutdown func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		logger.Error("Failed to flush traces", err)
+	}
+}
+
+/* Closes the tunnel on interrupt, the returned flag tells a deliberate shutdown from a lost connection. */
+func setupShutdownHandler(c *shared.SafeWebSocketConn, program *tea.Program, announce bool) *atomic.Bool {
+	var shuttingDown atomic.Bool
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, os.Interrupt)
 	go func() {
 		<-sigCh
+		shuttingDown.Store(true)
 		if program != nil {
 			program.Quit()
 		}
-		fmt.Println("\nShutting down tunnel...")
+		if announce {
+			fmt.Println("\nShutting down tunnel...")
+		}
 		_ = c.Close()
 	}()
+	return &shuttingDown
+}
+
+/*
+Toggles fault injection on chaos.ToggleSignal, for tunnels run with --logging, --output json or by the
+daemon. The signal is caught without --chaos as well, so it never terminates a tunnel.
+*/
+func setupChaosToggle(injector *chaos.Injector, program *tea.Program) {
+	if chaos.ToggleSignal == nil {
+		return
+	}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, chaos.ToggleSignal)
+	go func() {
+		for range sigCh {
+			if injector == nil {
+				logger.ChaosToggleIgnored()
+				continue
+			}
+			logger.ChaosToggled(injector.Toggle())
+			if program != nil {
+				program.Send(ui.ChaosMsg{})
+			}
+		}
+	}()
 }
 
 func terminalRestoration() func() {
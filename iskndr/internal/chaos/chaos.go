@@ -0,0 +1,121 @@
+/*
+Package chaos injects latency, errors, dropped connections and bandwidth limits into tunnelled
+requests, to test how clients cope with a flaky backend.
+*/
+package chaos
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/igneel64/iskandar/shared/pathmatch"
+)
+
+/* Latency is a delay, fixed when Max is zero, uniform between Min and Max or normal around Mean. */
+type Latency struct {
+	Min    time.Duration
+	Max    time.Duration
+	Mean   time.Duration
+	StdDev time.Duration
+}
+
+func (l Latency) sample() time.Duration {
+	var delay time.Duration
+	switch {
+	case l.StdDev > 0:
+		delay = l.Mean + time.Duration(rand.NormFloat64()*float64(l.StdDev))
+	case l.Max > l.Min:
+		delay = l.Min + rand.N(l.Max-l.Min)
+	default:
+		delay = l.Min
+	}
+	return max(delay, 0)
+}
+
+type Rule struct {
+	/* Path glob as in the pathmatch package, empty matches every path. */
+	Path    string
+	Latency Latency
+	/* Share of requests, between 0 and 1, answered with ErrorStatus without reaching the local application. */
+	ErrorRate   float64
+	ErrorStatus int
+	/* Share of requests whose public connection is dropped without a response. */
+	DropRate float64
+	/* Response bandwidth in bytes per second, zero is unlimited. */
+	Throttle int64
+}
+
+func (r Rule) matches(requestPath string) bool {
+	return pathmatch.Match(r.Path, requestPath)
+}
+
+/* Fault is what happens to a single request. */
+type Fault struct {
+	Delay       time.Duration
+	ErrorStatus int
+	Drop        bool
+	Throttle    int64
+}
+
+/* Injector applies the first rule matching a request's path. It can be switched off and on while running. */
+type Injector struct {
+	rules   []Rule
+	enabled atomic.Bool
+}
+
+/* NewInjector returns an enabled injector, nil without rules. */
+func NewInjector(rules []Rule) *Injector {
+	if len(rules) == 0 {
+		return nil
+	}
+	injector := &Injector{rules: rules}
+	injector.enabled.Store(true)
+	return injector
+}
+
+func (i *Injector) Enabled() bool {
+	return i != nil && i.enabled.Load()
+}
+
+/* Toggle switches the injector off or back on and returns whether it is now enabled. */
+func (i *Injector) Toggle() bool {
+	if i == nil {
+		return false
+	}
+	for {
+		enabled := i.enabled.Load()
+		if i.enabled.CompareAndSwap(enabled, !enabled) {
+			return !enabled
+		}
+	}
+}
+
+/* Plan decides the fault for a request to requestURI, the zero Fault leaves it alone. */
+func (i *Injector) Plan(requestURI string) Fault {
+	if !i.Enabled() {
+		return Fault{}
+	}
+
+	requestPath, _, _ := strings.Cut(requestURI, "?")
+	for _, rule := range i.rules {
+		if !rule.matches(requestPath) {
+			continue
+		}
+
+		fault := Fault{Delay: rule.Latency.sample(), Throttle: rule.Throttle}
+		switch roll := rand.Float64(); {
+		case roll < rule.DropRate:
+			fault.Drop = true
+		case roll < rule.DropRate+rule.ErrorRate:
+			fault.ErrorStatus = rule.ErrorStatus
+			if fault.ErrorStatus == 0 {
+				fault.ErrorStatus = http.StatusServiceUnavailable
+			}
+		}
+		return fault
+	}
+	return Fault{}
+}
@@ -0,0 +1,75 @@
+package chaos
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewInjector(t *testing.T) {
+	assert.Nil(t, NewInjector(nil))
+
+	var injector *Injector
+	assert.False(t, injector.Enabled())
+	assert.False(t, injector.Toggle())
+	assert.Equal(t, Fault{}, injector.Plan("/"))
+}
+
+func TestPlan(t *testing.T) {
+	t.Run("applies the first matching rule", func(t *testing.T) {
+		injector := NewInjector([]Rule{
+			{Path: "/api/**", ErrorRate: 1},
+			{Path: "/*.js", DropRate: 1},
+			{Path: "/users/*/**", ErrorRate: 1, ErrorStatus: http.StatusBadGateway},
+			{Latency: Latency{Min: 50 * time.Millisecond}, Throttle: 1024},
+		})
+		require.NotNil(t, injector)
+
+		assert.Equal(t, Fault{ErrorStatus: http.StatusServiceUnavailable}, injector.Plan("/api"))
+		assert.Equal(t, Fault{ErrorStatus: http.StatusServiceUnavailable}, injector.Plan("/api/users?page=2"))
+		assert.Equal(t, Fault{Drop: true}, injector.Plan("/app.js"))
+		assert.Equal(t, Fault{ErrorStatus: http.StatusBadGateway}, injector.Plan("/users/7/orders"), "the prefix is a glob too")
+		assert.Equal(t, Fault{Delay: 50 * time.Millisecond, Throttle: 1024}, injector.Plan("/apis"))
+	})
+
+	t.Run("uses the configured error status", func(t *testing.T) {
+		injector := NewInjector([]Rule{{ErrorRate: 1, ErrorStatus: http.StatusBadGateway}})
+		assert.Equal(t, http.StatusBadGateway, injector.Plan("/").ErrorStatus)
+	})
+
+	t.Run("leaves unmatched paths alone", func(t *testing.T) {
+		injector := NewInjector([]Rule{{Path: "/slow", Latency: Latency{Min: time.Second}}})
+		assert.Equal(t, Fault{}, injector.Plan("/fast"))
+	})
+
+	t.Run("samples latency within the range", func(t *testing.T) {
+		injector := NewInjector([]Rule{{Latency: Latency{Min: 100 * time.Millisecond, Max: 200 * time.Millisecond}}})
+		for range 100 {
+			delay := injector.Plan("/").Delay
+			assert.GreaterOrEqual(t, delay, 100*time.Millisecond)
+			assert.Less(t, delay, 200*time.Millisecond)
+		}
+	})
+
+	t.Run("never samples a negative latency", func(t *testing.T) {
+		injector := NewInjector([]Rule{{Latency: Latency{Mean: time.Millisecond, StdDev: time.Second}}})
+		for range 100 {
+			assert.GreaterOrEqual(t, injector.Plan("/").Delay, time.Duration(0))
+		}
+	})
+}
+
+func TestToggle(t *testing.T) {
+	injector := NewInjector([]Rule{{DropRate: 1}})
+	assert.True(t, injector.Enabled())
+
+	assert.False(t, injector.Toggle())
+	assert.False(t, injector.Enabled())
+	assert.Equal(t, Fault{}, injector.Plan("/"))
+
+	assert.True(t, injector.Toggle())
+	assert.True(t, injector.Plan("/").Drop)
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package chaos
+
+import "os"
+
+/* Windows has no user signal, fault injection can only be toggled in the status screen there. */
+var ToggleSignal os.Signal
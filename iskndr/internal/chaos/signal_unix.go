@@ -0,0 +1,11 @@
+//go:build unix
+
+package chaos
+
+import (
+	"os"
+	"syscall"
+)
+
+/* ToggleSignal switches the fault injection of a running tunnel, for tunnels without the status screen. */
+var ToggleSignal os.Signal = syscall.SIGUSR1
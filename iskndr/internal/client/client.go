@@ -2,16 +2,31 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	ws "github.com/gorilla/websocket"
+	"github.com/igneel64/iskandar/iskndr/internal/chaos"
+	"github.com/igneel64/iskandar/iskndr/internal/events"
+	"github.com/igneel64/iskandar/iskndr/internal/har"
 	"github.com/igneel64/iskandar/iskndr/internal/logger"
+	"github.com/igneel64/iskandar/iskndr/internal/upstream"
 	"github.com/igneel64/iskandar/shared"
 	"github.com/igneel64/iskandar/shared/protocol"
+	"github.com/igneel64/iskandar/shared/tracing"
+	"github.com/igneel64/iskandar/shared/webhook"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Client interface {
@@ -19,14 +34,60 @@ type Client interface {
 	AcceptRequests() error
 }
 
+/* ServerClosedError is returned by AcceptRequests when the server ends the tunnel, e.g. once its TTL is over. */
+type ServerClosedError struct {
+	Reason string
+}
+
+func (e *ServerClosedError) Error() string {
+	return "tunnel closed by server: " + e.Reason
+}
+
+/* Marks responses made up by the fault injection, so they can't be mistaken for the application's. */
+const chaosHeader = "X-Iskndr-Chaos"
+
+var tracer = otel.Tracer("github.com/igneel64/iskandar/iskndr/internal/client")
+
 type IskndrClient struct {
 	wsConnection *shared.SafeWebSocketConn
+	upstream     *upstream.Mapper
+	chaos        *chaos.Injector
+	recorder     *har.Recorder
+	webhooks     []webhook.Rule
+}
+
+type Option func(*IskndrClient)
+
+/* WithChaos injects the faults of the injector into forwarded requests. */
+func WithChaos(injector *chaos.Injector) Option {
+	return func(i *IskndrClient) {
+		i.chaos = injector
+	}
+}
+
+/* WithRecorder records every forwarded request and its response. */
+func WithRecorder(recorder *har.Recorder) Option {
+	return func(i *IskndrClient) {
+		i.recorder = recorder
+	}
+}
+
+/* WithWebhooks verifies the signatures of requests matching the rules before they are forwarded. */
+func WithWebhooks(rules []webhook.Rule) Option {
+	return func(i *IskndrClient) {
+		i.webhooks = rules
+	}
 }
 
-func NewIskndrClient(wsConnection *shared.SafeWebSocketConn) *IskndrClient {
-	return &IskndrClient{
+func NewIskndrClient(wsConnection *shared.SafeWebSocketConn, upstream *upstream.Mapper, opts ...Option) *IskndrClient {
+	i := &IskndrClient{
 		wsConnection: wsConnection,
+		upstream:     upstream,
 	}
+	for _, opt := range opts {
+		opt(i)
+	}
+	return i
 }
 
 func (i *IskndrClient) Register() (*protocol.RegisterTunnelMessage, error) {
@@ -37,10 +98,15 @@ func (i *IskndrClient) Register() (*protocol.RegisterTunnelMessage, error) {
 	return &regMsg, nil
 }
 
-func (i *IskndrClient) AcceptRequests(destinationAddress string) error {
+func (i *IskndrClient) AcceptRequests() error {
 	for {
 		var requestMsg protocol.Message
 		if err := i.wsConnection.ReadJSON(&requestMsg); err != nil {
+			var closeErr *ws.CloseError
+			if errors.As(err, &closeErr) && closeErr.Code == ws.CloseNormalClosure && closeErr.Text != "" {
+				logger.TunnelClosedByServer(closeErr.Text)
+				return &ServerClosedError{Reason: closeErr.Text}
+			}
 			if ws.IsCloseError(err, ws.CloseNormalClosure) ||
 				errors.Is(err, net.ErrClosed) {
 				return nil
@@ -49,63 +115,115 @@ func (i *IskndrClient) AcceptRequests(destinationAddress string) error {
 			return fmt.Errorf("failed to read request message: %w", err)
 		}
 		logger.RequestReceived(requestMsg.Id, requestMsg.Method, requestMsg.Path)
+		events.Request(requestMsg.Id, requestMsg.Method, requestMsg.Path)
 
-		go i.sendResponse(&requestMsg, destinationAddress)
+		go i.sendResponse(&requestMsg)
 	}
 }
 
-func (i *IskndrClient) sendResponse(requestMsg *protocol.Message, destinationAddress string) {
-	logger.ForwardingToLocal(requestMsg.Id, requestMsg.Method, destinationAddress+requestMsg.Path)
+func (i *IskndrClient) sendResponse(requestMsg *protocol.Message) {
+	target := i.upstream.Resolve(requestMsg.Path)
+	logger.ForwardingToLocal(requestMsg.Id, requestMsg.Method, target.URL)
+
+	/* Continues the trace of the server span, the span covers the call to the local application. */
+	ctx, span := tracer.Start(tracing.Extract(context.Background(), requestMsg.TraceContext), requestMsg.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(requestMsg.Method),
+			semconv.URLFull(target.URL),
+			attribute.String("iskndr.request_id", requestMsg.Id),
+		),
+	)
+	defer span.End()
+
+	i.recorder.Start(requestMsg)
+	defer i.recorder.Finish(requestMsg.Id)
 
-	req, err := http.NewRequest(requestMsg.Method, destinationAddress+requestMsg.Path, bytes.NewReader(requestMsg.Body))
+	if !i.verifyWebhook(requestMsg) {
+		return
+	}
+
+	fault := i.chaos.Plan(requestMsg.Path)
+	if fault != (chaos.Fault{}) {
+		logger.FaultInjected(requestMsg.Id, fault)
+	}
+	if fault.Delay > 0 {
+		time.Sleep(fault.Delay)
+	}
+	switch {
+	case fault.Drop:
+		_ = i.writeResponse(&protocol.Message{Type: "response", Id: requestMsg.Id, Abort: true, Done: true}, true)
+		return
+	case fault.ErrorStatus != 0:
+		_ = i.writeResponse(&protocol.Message{
+			Type:    "response",
+			Id:      requestMsg.Id,
+			Status:  fault.ErrorStatus,
+			Headers: map[string]string{"Content-Type": "text/plain; charset=utf-8", chaosHeader: "error"},
+			Body:    []byte(http.StatusText(fault.ErrorStatus) + "\n"),
+			Done:    true,
+		}, true)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, requestMsg.Method, target.URL, bytes.NewReader(requestMsg.Body))
 
 	if err != nil {
 		logger.ResponseSendFailed(requestMsg.Id, err)
-		_ = i.wsConnection.WriteJSON(&protocol.Message{
-			Type:   "response",
-			Id:     requestMsg.Id,
-			Status: http.StatusInternalServerError,
-			Body:   []byte("Failed to create request"),
-		})
+		span.RecordError(err)
+		i.sendError(requestMsg.Id, http.StatusBadGateway, "The request could not be forwarded to the local application")
 		return
 	}
 
 	for k, v := range requestMsg.Headers {
 		req.Header.Set(k, v)
 	}
+	/* Replaces the visitor's traceparent, the local application becomes a child of this span. */
+	tracing.Propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	/* Go ignores a Host entry in req.Header, by default the Host is the local destination. */
+	if host := i.upstream.Host(requestMsg.Headers["X-Forwarded-Host"]); host != "" {
+		req.Host = host
+	}
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := target.Client.Do(req)
 	if err != nil {
 		logger.LocalRequestFailed(requestMsg.Id, err)
-		_ = i.wsConnection.WriteJSON(&protocol.Message{
-			Type:   "response",
-			Id:     requestMsg.Id,
-			Status: http.StatusBadGateway,
-			Body:   []byte(fmt.Sprintf("Failed to reach local app: %v", err)),
-		})
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "local request failed")
+		i.sendError(requestMsg.Id, localRequestFailedStatus(err), "The local application is not responding, it may be restarting. Try again in a moment.")
 		return
 	}
 
 	//nolint:errcheck
 	defer res.Body.Close()
 
+	span.SetAttributes(semconv.HTTPResponseStatusCode(res.StatusCode))
+	if res.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(res.StatusCode))
+	}
+
 	/* Used for not re-sending extra data, mostly headers, which can be pretty big if response is not done. */
 	firstChunk := true
+	compress := shared.IsCompressible(res.Header.Get("Content-Encoding"), res.Header.Get("Content-Type"))
 
+	/* Every read is sent right away, so Server-Sent Events aren't held back until the buffer fills up. */
 	byteBuffer := make([]byte, 32*1024)
+	if fault.Throttle > 0 {
+		/* Smaller chunks spread a throttled body evenly instead of sending it in bursts. */
+		byteBuffer = byteBuffer[:min(int64(len(byteBuffer)), max(fault.Throttle/10, 512))]
+	}
 	for {
 		byteCount, err := res.Body.Read(byteBuffer)
+		if fault.Throttle > 0 && byteCount > 0 {
+			time.Sleep(time.Duration(byteCount) * time.Second / time.Duration(fault.Throttle))
+		}
 
 		if err != nil && err != io.EOF {
+			span.RecordError(err)
 			if firstChunk {
 				logger.ResponseSendFailed(requestMsg.Id, err)
-				_ = i.wsConnection.WriteJSON(&protocol.Message{
-					Type:   "response",
-					Id:     requestMsg.Id,
-					Status: http.StatusBadGateway,
-					Body:   []byte(fmt.Sprintf("Failed to read response body: %v", err)),
-					Done:   true,
-				})
+				i.sendError(requestMsg.Id, http.StatusBadGateway, "The local application sent an incomplete response")
 			} else {
 				// Already sent status - just log and abort
 				logger.Error("Error reading response body mid-stream", err)
@@ -113,7 +231,8 @@ func (i *IskndrClient) sendResponse(requestMsg *protocol.Message, destinationAdd
 			break
 		}
 
-		if firstChunk || byteCount > 0 {
+		/* The final message is sent even when empty, it closes the response and carries the trailers. */
+		if firstChunk || byteCount > 0 || err == io.EOF {
 			responseMsg := protocol.Message{
 				Type: "response",
 				Id:   requestMsg.Id,
@@ -121,16 +240,24 @@ func (i *IskndrClient) sendResponse(requestMsg *protocol.Message, destinationAdd
 				Done: err == io.EOF,
 			}
 
+			if responseMsg.Done {
+				responseMsg.Trailers = serializeTrailers(res.Trailer)
+			}
+
 			if firstChunk {
 				responseMsg.Status = res.StatusCode
 				responseMsg.Headers = shared.SerializeHeaders(res.Header)
+				responseMsg.Chunked = res.ContentLength < 0
+				if cookies := res.Header.Values("Set-Cookie"); len(cookies) > 1 {
+					responseMsg.SetCookies = cookies
+				}
 				logger.LocalResponseReceived(requestMsg.Id, res.StatusCode, byteCount)
 				firstChunk = false
 			} else {
 				logger.StreamingResponse(requestMsg.Id, byteCount, err == io.EOF)
 			}
 
-			if err = i.wsConnection.WriteJSON(&responseMsg); err != nil {
+			if err = i.writeResponse(&responseMsg, compress); err != nil {
 				logger.ResponseSendFailed(requestMsg.Id, err)
 				break
 			} else if responseMsg.Done {
@@ -145,3 +272,86 @@ func (i *IskndrClient) sendResponse(requestMsg *protocol.Message, destinationAdd
 	}
 
 }
+
+/* Reports whether the request may be forwarded, a failed verification of a rejecting rule answers it with 401. */
+func (i *IskndrClient) verifyWebhook(requestMsg *protocol.Message) bool {
+	requestPath, _, _ := strings.Cut(requestMsg.Path, "?")
+	for _, rule := range i.webhooks {
+		if !rule.Matches(requestPath) {
+			continue
+		}
+
+		header := http.Header{}
+		for k, v := range requestMsg.Headers {
+			header.Set(k, v)
+		}
+		if err := rule.Verifier.Verify(header, requestMsg.Body); err != nil {
+			logger.WebhookVerificationFailed(requestMsg.Id, rule.Verifier.Scheme(), err)
+			if rule.LogOnly {
+				return true
+			}
+			i.sendError(requestMsg.Id, http.StatusUnauthorized, "Invalid webhook signature")
+			return false
+		}
+		logger.WebhookVerified(requestMsg.Id, rule.Verifier.Scheme())
+		return true
+	}
+	return true
+}
+
+/* ReportHealth tells the server whether the local application passes its health checks. */
+func (i *IskndrClient) ReportHealth(healthy bool) error {
+	health := protocol.HealthUnhealthy
+	if healthy {
+		health = protocol.HealthHealthy
+	}
+	return i.wsConnection.WriteJSON(&protocol.Message{Type: "health", Health: health})
+}
+
+/*
+Error responses carry a message fit for public visitors, the server renders it into its error page.
+The underlying error stays in the CLI log, so addresses of the local network don't leak.
+*/
+func (i *IskndrClient) sendError(requestID string, status int, message string) {
+	_ = i.writeResponse(&protocol.Message{
+		Type:   "response",
+		Id:     requestID,
+		Status: status,
+		Body:   []byte(message),
+		Error:  message,
+		Done:   true,
+	}, true)
+}
+
+/* A local application that is too slow is a gateway timeout, anything else a bad gateway. */
+func localRequestFailedStatus(err error) int {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func (i *IskndrClient) writeResponse(msg *protocol.Message, compress bool) error {
+	i.recorder.Record(msg)
+	events.Response(msg)
+	if compress {
+		return i.wsConnection.WriteJSON(msg)
+	}
+	return i.wsConnection.WriteJSONUncompressed(msg)
+}
+
+/* res.Trailer is only complete once the body was read to EOF, declared but unsent trailers have no values. */
+func serializeTrailers(trailer http.Header) map[string]string {
+	var trailers map[string]string
+	for k, v := range trailer {
+		if len(v) == 0 {
+			continue
+		}
+		if trailers == nil {
+			trailers = make(map[string]string)
+		}
+		trailers[k] = strings.Join(v, ", ")
+	}
+	return trailers
+}
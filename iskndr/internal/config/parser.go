@@ -1,43 +1,88 @@
 package config
 
 import (
+	"crypto/x509"
 	"fmt"
+	"net"
 	"net/url"
+	"os"
+	"path"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/igneel64/iskandar/iskndr/internal/chaos"
+	"github.com/igneel64/iskandar/iskndr/internal/upstream"
+	"github.com/igneel64/iskandar/shared/protocol"
+	"github.com/igneel64/iskandar/shared/webhook"
 )
 
-func ParseDestination(destination string) (string, error) {
+func ParseDestination(destination string) (upstream.Destination, error) {
 	if portNum, err := strconv.Atoi(destination); err == nil {
 		if portNum < 1 || portNum > 65535 {
-			return "", fmt.Errorf("port must be between 1 and 65535")
+			return upstream.Destination{}, fmt.Errorf("port must be between 1 and 65535")
+		}
+		return upstream.Destination{URL: fmt.Sprintf("http://localhost:%d", portNum)}, nil
+	}
+
+	if socketPath, ok := strings.CutPrefix(destination, "unix://"); ok {
+		if !strings.HasPrefix(socketPath, "/") {
+			return upstream.Destination{}, fmt.Errorf("unix socket path must be absolute (e.g., unix:///var/run/app.sock)")
 		}
-		return fmt.Sprintf("http://localhost:%d", portNum), nil
+		return upstream.Destination{URL: "http://localhost", SocketPath: socketPath}, nil
 	}
 
-	if !strings.Contains(destination, "://") {
+	explicitScheme := strings.Contains(destination, "://")
+	if !explicitScheme {
 		destination = "http://" + destination
 	}
 
 	destURL, err := url.Parse(destination)
 	if err != nil {
-		return "", fmt.Errorf("invalid destination format: %w", err)
+		return upstream.Destination{}, fmt.Errorf("invalid destination format: %w", err)
+	}
+
+	if destURL.Scheme != "http" && destURL.Scheme != "https" {
+		return upstream.Destination{}, fmt.Errorf("invalid destination scheme: only http://, https:// and unix:// are allowed")
 	}
 
 	port := destURL.Port()
 	if port == "" {
-		return "", fmt.Errorf("port is required in destination")
+		if !explicitScheme {
+			return upstream.Destination{}, fmt.Errorf("port is required in destination")
+		}
+		port = "80"
+		if destURL.Scheme == "https" {
+			port = "443"
+		}
 	}
 
 	portNum, err := strconv.Atoi(port)
 	if err != nil {
-		return "", fmt.Errorf("port must be a number: %w", err)
+		return upstream.Destination{}, fmt.Errorf("port must be a number: %w", err)
 	}
 	if portNum < 1 || portNum > 65535 {
-		return "", fmt.Errorf("port must be between 1 and 65535")
+		return upstream.Destination{}, fmt.Errorf("port must be between 1 and 65535")
 	}
 
-	return fmt.Sprintf("http://%s:%s", destURL.Hostname(), port), nil
+	return upstream.Destination{URL: destURL.Scheme + "://" + net.JoinHostPort(destURL.Hostname(), port)}, nil
+}
+
+/* Loads a PEM bundle of CAs trusted for https destinations on top of the system ones. */
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no valid certificates found in %s", caFile)
+	}
+	return pool, nil
 }
 
 func ParseServerURL(serverURL string) (string, error) {
@@ -67,3 +112,299 @@ func ParseServerURL(serverURL string) (string, error) {
 
 	return scheme + u.Host + "/tunnel/connect", nil
 }
+
+/* Adds the per-tunnel limits the CLI requests from the server as query parameters to the connect URL. */
+func AppendTunnelLimits(serverWSURL string, limits protocol.TunnelLimits) (string, error) {
+	u, err := url.Parse(serverWSURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid server URL: %w", err)
+	}
+
+	query := u.Query()
+	limits.EncodeQuery(query)
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+/* Accepts 'rewrite', 'preserve' or a literal host (optionally with port) to send upstream. */
+func ParseHostHeader(value string) (string, error) {
+	switch value {
+	case upstream.HostHeaderRewrite, upstream.HostHeaderPreserve:
+		return value, nil
+	}
+
+	u, err := url.Parse("http://" + value)
+	if value == "" || err != nil || u.Host != value {
+		return "", fmt.Errorf("invalid host header %q: must be %q, %q or a host name", value, upstream.HostHeaderRewrite, upstream.HostHeaderPreserve)
+	}
+	return value, nil
+}
+
+/* Checks the --upstream-proto value against the destination, h2 needs TLS and h2c must not use it. */
+func ValidateUpstreamProtocol(protocol string, destination upstream.Destination) error {
+	isHTTPS := strings.HasPrefix(destination.URL, "https://")
+
+	switch protocol {
+	case upstream.ProtocolHTTP1:
+		return nil
+	case upstream.ProtocolH2:
+		if !isHTTPS {
+			return fmt.Errorf("upstream protocol %q requires an https destination, use %q for plain http", protocol, upstream.ProtocolH2C)
+		}
+		return nil
+	case upstream.ProtocolH2C:
+		if isHTTPS {
+			return fmt.Errorf("upstream protocol %q can't be used with an https destination, use %q", protocol, upstream.ProtocolH2)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("invalid upstream protocol %q: must be %q, %q or %q", protocol, upstream.ProtocolHTTP1, upstream.ProtocolH2, upstream.ProtocolH2C)
+}
+
+func ValidatePathPrefix(prefix string) error {
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("path prefix must start with '/'")
+	}
+	return nil
+}
+
+/* Parses a route in the form '<path-prefix>=<destination>', e.g. '/api=3001'. */
+func ParseRoute(route string) (upstream.Route, error) {
+	pathPrefix, destination, found := strings.Cut(route, "=")
+	if !found {
+		return upstream.Route{}, fmt.Errorf("invalid route %q: expected <path-prefix>=<destination>", route)
+	}
+
+	if !strings.HasPrefix(pathPrefix, "/") {
+		return upstream.Route{}, fmt.Errorf("invalid route %q: path prefix must start with '/'", route)
+	}
+
+	destinationAddress, err := ParseDestination(destination)
+	if err != nil {
+		return upstream.Route{}, fmt.Errorf("invalid route %q: %w", route, err)
+	}
+
+	return upstream.Route{PathPrefix: pathPrefix, Destination: destinationAddress}, nil
+}
+
+/* Parses an upstream of the default route, a destination optionally followed by a weight, e.g. '3001,weight=3'. */
+func ParseUpstream(spec string) (upstream.Backend, error) {
+	destination, settings, _ := strings.Cut(spec, ",")
+	destinationAddress, err := ParseDestination(destination)
+	if err != nil {
+		return upstream.Backend{}, fmt.Errorf("invalid upstream %q: %w", spec, err)
+	}
+
+	backend := upstream.Backend{Destination: destinationAddress}
+	if settings == "" {
+		return backend, nil
+	}
+	value, found := strings.CutPrefix(settings, "weight=")
+	if !found {
+		return upstream.Backend{}, fmt.Errorf("invalid upstream %q: expected <destination>[,weight=<n>]", spec)
+	}
+	if backend.Weight, err = strconv.Atoi(value); err != nil || backend.Weight < 1 {
+		return upstream.Backend{}, fmt.Errorf("invalid upstream %q: weight must be a positive number", spec)
+	}
+	return backend, nil
+}
+
+func ValidateBalanceStrategy(strategy string, backends []upstream.Backend) error {
+	switch strategy {
+	case upstream.StrategyWeighted:
+		return nil
+	case upstream.StrategyRoundRobin, upstream.StrategyLeastConn:
+		for _, backend := range backends {
+			if backend.Weight != 0 {
+				return fmt.Errorf("upstream weights need the %q strategy, %q ignores them", upstream.StrategyWeighted, strategy)
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("invalid load balancing strategy %q: must be %q, %q or %q", strategy, upstream.StrategyRoundRobin, upstream.StrategyLeastConn, upstream.StrategyWeighted)
+}
+
+/*
+Parses a chaos rule of comma separated settings, e.g. 'path=/api/**,latency=100ms-2s,errors=10%'.
+latency is fixed (300ms), uniform (100ms-2s) or normal (500ms~100ms, mean~standard deviation),
+errors and drop are percentages of requests, status the injected error status and throttle the
+response bandwidth per second (e.g. 64KB).
+*/
+func ParseChaosRule(spec string) (chaos.Rule, error) {
+	var rule chaos.Rule
+	for _, setting := range strings.Split(spec, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(setting), "=")
+		if !found || value == "" {
+			return chaos.Rule{}, fmt.Errorf("invalid chaos rule %q: expected key=value settings", spec)
+		}
+
+		var err error
+		switch key {
+		case "path":
+			if !strings.HasPrefix(value, "/") {
+				err = fmt.Errorf("path must start with '/'")
+			} else if _, err = path.Match(strings.TrimSuffix(value, "/**"), ""); err == nil {
+				rule.Path = value
+			}
+		case "latency":
+			rule.Latency, err = parseLatency(value)
+		case "errors":
+			rule.ErrorRate, err = parsePercentage(value)
+		case "drop":
+			rule.DropRate, err = parsePercentage(value)
+		case "status":
+			rule.ErrorStatus, err = strconv.Atoi(value)
+			if err == nil && (rule.ErrorStatus < 400 || rule.ErrorStatus > 599) {
+				err = fmt.Errorf("status %d is not an error status", rule.ErrorStatus)
+			}
+		case "throttle":
+			rule.Throttle, err = parseByteSize(value)
+		default:
+			err = fmt.Errorf("unknown setting %q", key)
+		}
+		if err != nil {
+			return chaos.Rule{}, fmt.Errorf("invalid chaos rule %q: %w", spec, err)
+		}
+	}
+
+	if rule.ErrorRate+rule.DropRate > 1 {
+		return chaos.Rule{}, fmt.Errorf("invalid chaos rule %q: errors and drop add up to more than 100%%", spec)
+	}
+	return rule, nil
+}
+
+/*
+ParseWebhookRule parses a --verify-webhook value such as 'scheme=github,secret-env=GITHUB_WEBHOOK_SECRET,path=/webhooks/**'.
+Keys are scheme (github, stripe, slack or hmac), secret or secret-env, header (hmac only), path and
+mode, 'reject' (the default) or 'log'.
+*/
+func ParseWebhookRule(spec string) (webhook.Rule, error) {
+	var rule webhook.Rule
+	var opts webhook.Options
+	for _, setting := range strings.Split(spec, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(setting), "=")
+		if !found || value == "" {
+			return webhook.Rule{}, fmt.Errorf("invalid webhook rule %q: expected key=value settings", spec)
+		}
+
+		var err error
+		switch key {
+		case "scheme":
+			opts.Scheme = value
+		case "secret":
+			opts.Secret = value
+		case "secret-env":
+			if opts.Secret = os.Getenv(value); opts.Secret == "" {
+				err = fmt.Errorf("$%s is not set", value)
+			}
+		case "header":
+			opts.Header = value
+		case "path":
+			if !strings.HasPrefix(value, "/") {
+				err = fmt.Errorf("path must start with '/'")
+			} else if _, err = path.Match(strings.TrimSuffix(value, "/**"), ""); err == nil {
+				rule.Path = value
+			}
+		case "mode":
+			switch value {
+			case "reject":
+			case "log":
+				rule.LogOnly = true
+			default:
+				err = fmt.Errorf("mode must be 'reject' or 'log'")
+			}
+		default:
+			err = fmt.Errorf("unknown setting %q", key)
+		}
+		if err != nil {
+			return webhook.Rule{}, fmt.Errorf("invalid webhook rule %q: %w", spec, err)
+		}
+	}
+
+	verifier, err := webhook.NewVerifier(opts)
+	if err != nil {
+		return webhook.Rule{}, fmt.Errorf("invalid webhook rule %q: %w", spec, err)
+	}
+	rule.Verifier = verifier
+	return rule, nil
+}
+
+/* WebhookSecretEnv returns the variable a --verify-webhook value reads its secret from, empty if none. */
+func WebhookSecretEnv(spec string) string {
+	for _, setting := range strings.Split(spec, ",") {
+		if key, value, _ := strings.Cut(strings.TrimSpace(setting), "="); key == "secret-env" {
+			return value
+		}
+	}
+	return ""
+}
+
+func parseLatency(value string) (chaos.Latency, error) {
+	if mean, stdDev, found := strings.Cut(value, "~"); found {
+		meanDuration, err := time.ParseDuration(mean)
+		if err != nil {
+			return chaos.Latency{}, err
+		}
+		stdDevDuration, err := time.ParseDuration(stdDev)
+		if err != nil {
+			return chaos.Latency{}, err
+		}
+		return chaos.Latency{Mean: meanDuration, StdDev: stdDevDuration}, nil
+	}
+
+	if minValue, maxValue, found := strings.Cut(value, "-"); found {
+		minDuration, err := time.ParseDuration(minValue)
+		if err != nil {
+			return chaos.Latency{}, err
+		}
+		maxDuration, err := time.ParseDuration(maxValue)
+		if err != nil {
+			return chaos.Latency{}, err
+		}
+		if maxDuration < minDuration {
+			return chaos.Latency{}, fmt.Errorf("latency range %s ends before it starts", value)
+		}
+		return chaos.Latency{Min: minDuration, Max: maxDuration}, nil
+	}
+
+	fixed, err := time.ParseDuration(value)
+	return chaos.Latency{Min: fixed}, err
+}
+
+/* Accepts '10%' or '10', returned as a share between 0 and 1. */
+func parsePercentage(value string) (float64, error) {
+	percentage, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil {
+		return 0, err
+	}
+	if percentage < 0 || percentage > 100 {
+		return 0, fmt.Errorf("percentage %s is not between 0 and 100", value)
+	}
+	return percentage / 100, nil
+}
+
+/* Accepts a byte count with an optional KB or MB suffix (1024 based). */
+func parseByteSize(value string) (int64, error) {
+	multiplier := int64(1)
+	upper := strings.ToUpper(value)
+	switch {
+	case strings.HasSuffix(upper, "MB"):
+		multiplier, upper = 1024*1024, strings.TrimSuffix(upper, "MB")
+	case strings.HasSuffix(upper, "KB"):
+		multiplier, upper = 1024, strings.TrimSuffix(upper, "KB")
+	case strings.HasSuffix(upper, "B"):
+		upper = strings.TrimSuffix(upper, "B")
+	}
+
+	size, err := strconv.ParseInt(upper, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if size <= 0 {
+		return 0, fmt.Errorf("size %s must be positive", value)
+	}
+	return size * multiplier, nil
+}
@@ -1,80 +1,129 @@
 package config
 
 import (
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/igneel64/iskandar/iskndr/internal/chaos"
+	"github.com/igneel64/iskandar/iskndr/internal/upstream"
+	"github.com/igneel64/iskandar/shared/protocol"
+	"github.com/igneel64/iskandar/shared/webhook"
 )
 
 func TestParseDestination(t *testing.T) {
 	tests := []struct {
 		name    string
 		input   string
-		want    string
+		want    upstream.Destination
 		wantErr bool
 	}{
 		{
 			name:    "port only - valid",
 			input:   "8080",
-			want:    "http://localhost:8080",
+			want:    upstream.Destination{URL: "http://localhost:8080"},
 			wantErr: false,
 		},
 		{
 			name:    "port only - low port",
 			input:   "80",
-			want:    "http://localhost:80",
+			want:    upstream.Destination{URL: "http://localhost:80"},
 			wantErr: false,
 		},
 		{
 			name:    "port only - high port",
 			input:   "65535",
-			want:    "http://localhost:65535",
+			want:    upstream.Destination{URL: "http://localhost:65535"},
 			wantErr: false,
 		},
 		{
 			name:    "host:port - valid",
 			input:   "foo.dev:80",
-			want:    "http://foo.dev:80",
+			want:    upstream.Destination{URL: "http://foo.dev:80"},
 			wantErr: false,
 		},
 		{
 			name:    "host:port - localhost",
 			input:   "localhost:3000",
-			want:    "http://localhost:3000",
+			want:    upstream.Destination{URL: "http://localhost:3000"},
 			wantErr: false,
 		},
 		{
 			name:    "host:port - IP address",
 			input:   "192.168.1.100:8080",
-			want:    "http://192.168.1.100:8080",
+			want:    upstream.Destination{URL: "http://192.168.1.100:8080"},
+			wantErr: false,
+		},
+		{
+			name:    "https with port",
+			input:   "https://localhost:8443",
+			want:    upstream.Destination{URL: "https://localhost:8443"},
+			wantErr: false,
+		},
+		{
+			name:    "https without port",
+			input:   "https://app.test",
+			want:    upstream.Destination{URL: "https://app.test:443"},
+			wantErr: false,
+		},
+		{
+			name:    "http without port",
+			input:   "http://app.test",
+			want:    upstream.Destination{URL: "http://app.test:80"},
+			wantErr: false,
+		},
+		{
+			name:    "IPv6 host:port",
+			input:   "[::1]:3000",
+			want:    upstream.Destination{URL: "http://[::1]:3000"},
+			wantErr: false,
+		},
+		{
+			name:    "unix socket",
+			input:   "unix:///var/run/app.sock",
+			want:    upstream.Destination{URL: "http://localhost", SocketPath: "/var/run/app.sock"},
 			wantErr: false,
 		},
+		{
+			name:    "unix socket - relative path",
+			input:   "unix://app.sock",
+			want:    upstream.Destination{},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported scheme",
+			input:   "ftp://localhost:21",
+			want:    upstream.Destination{},
+			wantErr: true,
+		},
 		{
 			name:    "port only - below range",
 			input:   "0",
-			want:    "",
+			want:    upstream.Destination{},
 			wantErr: true,
 		},
 		{
 			name:    "port only - above range",
 			input:   "65536",
-			want:    "",
+			want:    upstream.Destination{},
 			wantErr: true,
 		},
 		{
 			name:    "invalid - not a number",
 			input:   "abc",
-			want:    "",
+			want:    upstream.Destination{},
 			wantErr: true,
 		},
 		{
 			name:    "host:port - missing port",
 			input:   "foo.dev",
-			want:    "",
+			want:    upstream.Destination{},
 			wantErr: true,
 		},
 		{
 			name:    "host:port - invalid port",
 			input:   "foo.dev:99999",
-			want:    "",
+			want:    upstream.Destination{},
 			wantErr: true,
 		},
 	}
@@ -86,7 +135,7 @@ func TestParseDestination(t *testing.T) {
 				t.Errorf("ParseDestination() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if got != tt.want {
+			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("ParseDestination() = %v, want %v", got, tt.want)
 			}
 		})
@@ -163,3 +212,359 @@ func TestParseServerURL(t *testing.T) {
 		})
 	}
 }
+
+func TestAppendTunnelLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits protocol.TunnelLimits
+		want   string
+	}{
+		{
+			name:   "no limits requested",
+			limits: protocol.TunnelLimits{},
+			want:   "ws://localhost:8080/tunnel/connect",
+		},
+		{
+			name: "all limits requested",
+			limits: protocol.TunnelLimits{
+				MaxBodySize:            1024,
+				ResponseTimeout:        3 * time.Minute,
+				StreamIdleTimeout:      90 * time.Second,
+				EventStreamIdleTimeout: time.Hour,
+				TTL:                    2 * time.Hour,
+				MaxUses:                1,
+			},
+			want: "ws://localhost:8080/tunnel/connect?event_stream_idle_timeout=1h0m0s&max_body_size=1024&max_uses=1&response_timeout=3m0s&stream_idle_timeout=1m30s&ttl=2h0m0s",
+		},
+		{
+			name:   "single limit requested",
+			limits: protocol.TunnelLimits{ResponseTimeout: time.Minute},
+			want:   "ws://localhost:8080/tunnel/connect?response_timeout=1m0s",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AppendTunnelLimits("ws://localhost:8080/tunnel/connect", tt.limits)
+			if err != nil {
+				t.Errorf("AppendTunnelLimits() error = %v", err)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("AppendTunnelLimits() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHostHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "rewrite",
+			input:   "rewrite",
+			want:    upstream.HostHeaderRewrite,
+			wantErr: false,
+		},
+		{
+			name:    "preserve",
+			input:   "preserve",
+			want:    upstream.HostHeaderPreserve,
+			wantErr: false,
+		},
+		{
+			name:    "literal host",
+			input:   "myapp.localhost",
+			want:    "myapp.localhost",
+			wantErr: false,
+		},
+		{
+			name:    "literal host with port",
+			input:   "myapp.localhost:8080",
+			want:    "myapp.localhost:8080",
+			wantErr: false,
+		},
+		{
+			name:    "empty value",
+			input:   "",
+			want:    "",
+			wantErr: true,
+		},
+		{
+			name:    "value with path",
+			input:   "myapp.localhost/path",
+			want:    "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseHostHeader(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseHostHeader() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseHostHeader() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    upstream.Route
+		wantErr bool
+	}{
+		{
+			name:    "path prefix and port",
+			input:   "/api=3001",
+			want:    upstream.Route{PathPrefix: "/api", Destination: upstream.Destination{URL: "http://localhost:3001"}},
+			wantErr: false,
+		},
+		{
+			name:    "path prefix and host:port",
+			input:   "/=web.local:8080",
+			want:    upstream.Route{PathPrefix: "/", Destination: upstream.Destination{URL: "http://web.local:8080"}},
+			wantErr: false,
+		},
+		{
+			name:    "missing separator",
+			input:   "/api",
+			wantErr: true,
+		},
+		{
+			name:    "path prefix without leading slash",
+			input:   "api=3001",
+			wantErr: true,
+		},
+		{
+			name:    "invalid destination",
+			input:   "/api=99999",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRoute(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseRoute() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseRoute() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseUpstream(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    upstream.Backend
+		wantErr bool
+	}{
+		{name: "port", input: "3001", want: upstream.Backend{Destination: upstream.Destination{URL: "http://localhost:3001"}}},
+		{name: "host:port with weight", input: "web.local:8080,weight=3", want: upstream.Backend{Destination: upstream.Destination{URL: "http://web.local:8080"}, Weight: 3}},
+		{name: "unix socket", input: "unix:///var/run/app.sock", want: upstream.Backend{Destination: upstream.Destination{URL: "http://localhost", SocketPath: "/var/run/app.sock"}}},
+		{name: "zero weight", input: "3001,weight=0", wantErr: true},
+		{name: "unknown setting", input: "3001,max-fails=3", wantErr: true},
+		{name: "invalid destination", input: "99999,weight=2", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseUpstream(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseUpstream() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseUpstream() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateBalanceStrategy(t *testing.T) {
+	weighted := []upstream.Backend{{Destination: upstream.Destination{URL: "http://localhost:3001"}, Weight: 3}}
+
+	tests := []struct {
+		name     string
+		strategy string
+		backends []upstream.Backend
+		wantErr  bool
+	}{
+		{name: "round robin", strategy: "round-robin", wantErr: false},
+		{name: "least connections", strategy: "least-conn", wantErr: false},
+		{name: "weighted", strategy: "weighted", backends: weighted, wantErr: false},
+		{name: "weights without weighted", strategy: "round-robin", backends: weighted, wantErr: true},
+		{name: "unknown strategy", strategy: "random", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateBalanceStrategy(tt.strategy, tt.backends)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateBalanceStrategy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateUpstreamProtocol(t *testing.T) {
+	httpDestination := upstream.Destination{URL: "http://localhost:50051"}
+	httpsDestination := upstream.Destination{URL: "https://localhost:8443"}
+	socketDestination := upstream.Destination{URL: "http://localhost", SocketPath: "/var/run/app.sock"}
+
+	tests := []struct {
+		name        string
+		protocol    string
+		destination upstream.Destination
+		wantErr     bool
+	}{
+		{name: "http1 over http", protocol: "http1", destination: httpDestination, wantErr: false},
+		{name: "http1 over https", protocol: "http1", destination: httpsDestination, wantErr: false},
+		{name: "h2 over https", protocol: "h2", destination: httpsDestination, wantErr: false},
+		{name: "h2 over http", protocol: "h2", destination: httpDestination, wantErr: true},
+		{name: "h2c over http", protocol: "h2c", destination: httpDestination, wantErr: false},
+		{name: "h2c over unix socket", protocol: "h2c", destination: socketDestination, wantErr: false},
+		{name: "h2c over https", protocol: "h2c", destination: httpsDestination, wantErr: true},
+		{name: "unknown protocol", protocol: "http3", destination: httpDestination, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateUpstreamProtocol(tt.protocol, tt.destination)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateUpstreamProtocol() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseChaosRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    chaos.Rule
+		wantErr bool
+	}{
+		{
+			name:    "fixed latency",
+			input:   "latency=300ms",
+			want:    chaos.Rule{Latency: chaos.Latency{Min: 300 * time.Millisecond}},
+			wantErr: false,
+		},
+		{
+			name:    "uniform latency on a path",
+			input:   "path=/api/**,latency=100ms-2s",
+			want:    chaos.Rule{Path: "/api/**", Latency: chaos.Latency{Min: 100 * time.Millisecond, Max: 2 * time.Second}},
+			wantErr: false,
+		},
+		{
+			name:    "normal latency",
+			input:   "latency=500ms~100ms",
+			want:    chaos.Rule{Latency: chaos.Latency{Mean: 500 * time.Millisecond, StdDev: 100 * time.Millisecond}},
+			wantErr: false,
+		},
+		{
+			name:    "errors, drops and throttle",
+			input:   "errors=10%, status=502, drop=2.5, throttle=64KB",
+			want:    chaos.Rule{ErrorRate: 0.1, ErrorStatus: 502, DropRate: 0.025, Throttle: 64 * 1024},
+			wantErr: false,
+		},
+		{name: "unknown setting", input: "jitter=10ms", wantErr: true},
+		{name: "missing value", input: "latency", wantErr: true},
+		{name: "path without leading slash", input: "path=api", wantErr: true},
+		{name: "invalid glob", input: "path=/[", wantErr: true},
+		{name: "reversed latency range", input: "latency=2s-100ms", wantErr: true},
+		{name: "percentage over 100", input: "errors=150%", wantErr: true},
+		{name: "errors and drops over 100", input: "errors=60%,drop=50%", wantErr: true},
+		{name: "success status", input: "status=200", wantErr: true},
+		{name: "unknown unit", input: "throttle=64GB", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseChaosRule(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseChaosRule() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseChaosRule() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseWebhookRule(t *testing.T) {
+	t.Setenv("ISKNDR_TEST_WEBHOOK_SECRET", "whsec_test")
+
+	tests := []struct {
+		name        string
+		input       string
+		wantPath    string
+		wantScheme  string
+		wantLogOnly bool
+		wantErr     bool
+	}{
+		{
+			name:       "secret from the environment",
+			input:      "scheme=stripe,secret-env=ISKNDR_TEST_WEBHOOK_SECRET,path=/webhooks/**",
+			wantPath:   "/webhooks/**",
+			wantScheme: webhook.SchemeStripe,
+		},
+		{
+			name:        "generic hmac that only logs failures",
+			input:       "scheme=hmac, secret=s, header=X-Webhook-Signature, mode=log",
+			wantScheme:  webhook.SchemeHMAC,
+			wantLogOnly: true,
+		},
+		{name: "missing scheme", input: "secret=s", wantErr: true},
+		{name: "missing secret", input: "scheme=github", wantErr: true},
+		{name: "unset environment variable", input: "scheme=github,secret-env=ISKNDR_TEST_UNSET", wantErr: true},
+		{name: "unknown mode", input: "scheme=github,secret=s,mode=ignore", wantErr: true},
+		{name: "unknown setting", input: "scheme=github,secret=s,algo=sha1", wantErr: true},
+		{name: "path without leading slash", input: "scheme=github,secret=s,path=hooks", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseWebhookRule(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseWebhookRule() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Path != tt.wantPath || got.Verifier.Scheme() != tt.wantScheme || got.LogOnly != tt.wantLogOnly {
+				t.Errorf("ParseWebhookRule() = %+v, want path %q, scheme %q and log only %v", got, tt.wantPath, tt.wantScheme, tt.wantLogOnly)
+			}
+		})
+	}
+}
+
+func TestWebhookSecretEnv(t *testing.T) {
+	tests := map[string]string{
+		"scheme=stripe,secret-env=STRIPE_WEBHOOK_SECRET,path=/webhooks/**": "STRIPE_WEBHOOK_SECRET",
+		"scheme=hmac, secret-env=HOOK_SECRET , header=X-Signature":         "HOOK_SECRET",
+		"scheme=github,secret=s": "",
+	}
+	for input, want := range tests {
+		if got := WebhookSecretEnv(input); got != want {
+			t.Errorf("WebhookSecretEnv(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
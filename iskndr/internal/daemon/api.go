@@ -0,0 +1,177 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/igneel64/iskandar/iskndr/internal/logger"
+)
+
+/*
+DefaultSocketPath is in $XDG_RUNTIME_DIR when set, otherwise in a directory of the current user in the
+temporary directory, which Listen creates.
+*/
+func DefaultSocketPath() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "iskndr.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("iskndr-%d", os.Getuid()), "daemon.sock")
+}
+
+/*
+Listen opens the control socket in a directory only the current user can access, so the socket is never
+reachable by anyone else, and accepts connections of the current user only. A socket left behind by a
+daemon that didn't shut down cleanly is replaced, a running daemon is an error. Platforms that can't tell
+which user connects to a socket are refused.
+*/
+func Listen(socketPath string) (net.Listener, error) {
+	if peerUid == nil {
+		return nil, fmt.Errorf("the daemon can't check which user connects to its socket on %s", runtime.GOOS)
+	}
+	if err := privateDir(filepath.Dir(socketPath)); err != nil {
+		return nil, err
+	}
+	if conn, err := net.DialTimeout("unix", socketPath, time.Second); err == nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("a daemon is already listening on %s", socketPath)
+	}
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", socketPath, err)
+	}
+	if err := os.Chmod(socketPath, 0o600); err != nil {
+		_ = l.Close()
+		return nil, fmt.Errorf("failed to restrict socket permissions: %w", err)
+	}
+	return &peerListener{Listener: l}, nil
+}
+
+/* privateDir creates the socket directory for the current user, an existing one must be private already. */
+func privateDir(dir string) error {
+	if err := os.Mkdir(dir, 0o700); err != nil && !errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	/* Lstat, so a symlink planted by another user isn't followed. */
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("failed to check socket directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("socket directory %s is not a directory", dir)
+	}
+	return checkPrivate(dir, info)
+}
+
+/* peerListener drops the connections of other users, the daemon starts tunnels with the caller's arguments. */
+type peerListener struct {
+	net.Listener
+}
+
+func (l *peerListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPeer(conn); err != nil {
+			logger.DaemonConnectionRejected(err)
+			_ = conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+/*
+Handler serves the control API:
+
+	GET    /tunnels               list the tunnels
+	POST   /tunnels               start a tunnel from an AddRequest
+	DELETE /tunnels/{name}        stop a tunnel
+	GET    /tunnels/{name}/logs   last log lines as plain text
+	POST   /tunnels/{name}/chaos  toggle the fault injection of a tunnel started with --chaos
+*/
+func (d *Daemon) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /tunnels", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.List())
+	})
+
+	mux.HandleFunc("POST /tunnels", func(w http.ResponseWriter, r *http.Request) {
+		var req AddRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		tunnel, err := d.Add(r.Context(), req)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, tunnel)
+	})
+
+	mux.HandleFunc("DELETE /tunnels/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if err := d.Remove(r.PathValue("name")); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /tunnels/{name}/logs", func(w http.ResponseWriter, r *http.Request) {
+		lines, err := d.Logs(r.PathValue("name"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, line := range lines {
+			_, _ = fmt.Fprintln(w, line)
+		}
+	})
+
+	mux.HandleFunc("POST /tunnels/{name}/chaos", func(w http.ResponseWriter, r *http.Request) {
+		if err := d.ToggleChaos(r.PathValue("name")); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrNameTaken), errors.Is(err, ErrNoChaos), errors.Is(err, ErrNotRunning):
+		status = http.StatusConflict
+	case errors.Is(err, ErrUnsupported):
+		status = http.StatusNotImplemented
+	case errors.Is(err, ErrInvalidName):
+		status = http.StatusBadRequest
+	}
+	http.Error(w, strings.TrimSpace(err.Error()), status)
+}
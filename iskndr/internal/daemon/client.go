@@ -0,0 +1,102 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/* Client talks to a daemon over its control socket. */
+type Client struct {
+	socketPath string
+	http       *http.Client
+}
+
+func NewClient(socketPath string) *Client {
+	return &Client{
+		socketPath: socketPath,
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+func (c *Client) List(ctx context.Context) ([]Tunnel, error) {
+	var tunnels []Tunnel
+	err := c.do(ctx, http.MethodGet, "/tunnels", nil, &tunnels)
+	return tunnels, err
+}
+
+func (c *Client) Add(ctx context.Context, req AddRequest) (Tunnel, error) {
+	var tunnel Tunnel
+	err := c.do(ctx, http.MethodPost, "/tunnels", req, &tunnel)
+	return tunnel, err
+}
+
+func (c *Client) Remove(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/tunnels/"+url.PathEscape(name), nil, nil)
+}
+
+func (c *Client) Logs(ctx context.Context, name string) (string, error) {
+	var logs bytes.Buffer
+	err := c.do(ctx, http.MethodGet, "/tunnels/"+url.PathEscape(name)+"/logs", nil, &logs)
+	return logs.String(), err
+}
+
+func (c *Client) ToggleChaos(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodPost, "/tunnels/"+url.PathEscape(name)+"/chaos", nil, nil)
+}
+
+/* The host is never resolved, every request goes to the socket. */
+func (c *Client) do(ctx context.Context, method, path string, body, result any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "http://iskndr"+path, reqBody)
+	if err != nil {
+		return err
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return fmt.Errorf("no daemon is listening on %s, start one with 'iskndr daemon'", c.socketPath)
+		}
+		return err
+	}
+	//nolint:errcheck
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		message, _ := io.ReadAll(res.Body)
+		return errors.New(strings.TrimSpace(string(message)))
+	}
+
+	switch result := result.(type) {
+	case nil:
+		return nil
+	case io.Writer:
+		_, err = io.Copy(result, res.Body)
+		return err
+	default:
+		return json.NewDecoder(res.Body).Decode(result)
+	}
+}
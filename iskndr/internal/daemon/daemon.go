@@ -0,0 +1,463 @@
+/*
+Package daemon runs tunnels in the background and manages them through a local HTTP API on a Unix socket.
+
+Every tunnel is a child process running `iskndr tunnel --output json`, so tunnels don't share state and
+the daemon follows them through their JSON events. The log lines of a tunnel are kept in memory for
+`iskndr logs`.
+*/
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/igneel64/iskandar/iskndr/internal/chaos"
+	"github.com/igneel64/iskandar/iskndr/internal/events"
+	"github.com/igneel64/iskandar/iskndr/internal/logger"
+)
+
+/* Tunnel states. */
+const (
+	StatusStarting  = "starting"
+	StatusConnected = "connected"
+	StatusExited    = "exited"
+)
+
+const (
+	DefaultStartTimeout = 30 * time.Second
+	DefaultLogLines     = 1000
+	/* How long a removed tunnel gets to close after the interrupt before it is killed. */
+	stopTimeout = 5 * time.Second
+)
+
+var (
+	ErrNotFound    = errors.New("no tunnel with this name")
+	ErrNameTaken   = errors.New("a tunnel with this name already exists")
+	ErrInvalidName = errors.New("tunnel names may only contain letters, digits, '.', '_' and '-'")
+	ErrNoChaos     = errors.New("tunnel runs without --chaos")
+	ErrNotRunning  = errors.New("tunnel is not running")
+	ErrUnsupported = errors.New("toggling fault injection isn't supported on this platform")
+)
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+/* Tunnel describes a managed tunnel in the control API. */
+type Tunnel struct {
+	Name        string    `json:"name"`
+	Destination string    `json:"destination"`
+	Args        []string  `json:"args"`
+	Status      string    `json:"status"`
+	PublicURL   string    `json:"public_url,omitempty"`
+	Requests    int64     `json:"requests"`
+	StartedAt   time.Time `json:"started_at"`
+	Error       string    `json:"error,omitempty"`
+}
+
+/* AddRequest starts a tunnel, Args are the arguments of `iskndr tunnel` starting with the destination. */
+type AddRequest struct {
+	/* Empty derives a name from the destination. */
+	Name string   `json:"name,omitempty"`
+	Args []string `json:"args"`
+	/*
+		Working directory of the caller and the variables of its environment the tunnel needs, so relative paths
+		and variables such as ISKNDR_TOKEN resolve as for a foreground tunnel.
+	*/
+	Dir string   `json:"dir,omitempty"`
+	Env []string `json:"env,omitempty"`
+}
+
+type Options struct {
+	/* Builds the child process for the tunnel arguments, defaults to the tunnel command of this executable. */
+	Command func(args []string) *exec.Cmd
+	/* Zero uses DefaultStartTimeout. */
+	StartTimeout time.Duration
+	/* Log lines kept per tunnel, zero uses DefaultLogLines. */
+	LogLines int
+}
+
+type Daemon struct {
+	opts    Options
+	mu      sync.Mutex
+	tunnels map[string]*process
+}
+
+func NewDaemon(opts Options) *Daemon {
+	if opts.Command == nil {
+		opts.Command = tunnelCommand
+	}
+	if opts.StartTimeout == 0 {
+		opts.StartTimeout = DefaultStartTimeout
+	}
+	if opts.LogLines == 0 {
+		opts.LogLines = DefaultLogLines
+	}
+	return &Daemon{opts: opts, tunnels: map[string]*process{}}
+}
+
+func tunnelCommand(args []string) *exec.Cmd {
+	executable, err := os.Executable()
+	if err != nil {
+		executable = os.Args[0]
+	}
+	return exec.Command(executable, append([]string{"tunnel"}, args...)...)
+}
+
+/* Add starts a tunnel and waits until it is connected, a tunnel failing to connect is not kept. */
+func (d *Daemon) Add(ctx context.Context, req AddRequest) (Tunnel, error) {
+	if len(req.Args) == 0 {
+		return Tunnel{}, errors.New("missing tunnel destination")
+	}
+	if req.Name != "" && !validName.MatchString(req.Name) {
+		return Tunnel{}, ErrInvalidName
+	}
+
+	p := &process{
+		logs:      newLogBuffer(d.opts.LogLines),
+		connected: make(chan struct{}),
+		exited:    make(chan struct{}),
+		info: Tunnel{
+			Destination: req.Args[0],
+			Args:        req.Args,
+			Status:      StatusStarting,
+			StartedAt:   time.Now().UTC(),
+		},
+	}
+
+	args := append(slices.Clone(req.Args), "--output", "json", "--logging")
+	p.cmd = d.opts.Command(args)
+	p.cmd.Dir = req.Dir
+	p.cmd.Env = req.Env
+	p.cmd.Stderr = p.logs
+	stdout, err := p.cmd.StdoutPipe()
+	if err == nil {
+		err = p.cmd.Start()
+	}
+	if err != nil {
+		return Tunnel{}, fmt.Errorf("failed to start tunnel: %w", err)
+	}
+	go func() {
+		p.readEvents(stdout)
+		p.finish(p.cmd.Wait())
+	}()
+
+	/* The name is taken once the process runs, so Remove always has a process to stop. */
+	d.mu.Lock()
+	name, err := d.reserveName(req.Name, req.Args[0])
+	if err == nil {
+		p.mu.Lock()
+		p.info.Name = name
+		p.mu.Unlock()
+		d.tunnels[name] = p
+	}
+	d.mu.Unlock()
+	if err != nil {
+		p.stop()
+		return Tunnel{}, err
+	}
+
+	timer := time.NewTimer(d.opts.StartTimeout)
+	defer timer.Stop()
+	select {
+	case <-p.connected:
+		info := p.snapshot()
+		logger.DaemonTunnelStarted(info.Name, info.PublicURL)
+		return info, nil
+	case <-p.exited:
+		d.forget(name, p)
+		return Tunnel{}, fmt.Errorf("tunnel exited before connecting: %s", p.failure())
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	d.forget(name, p)
+	p.stop()
+	return Tunnel{}, errors.New("tunnel didn't connect in time")
+}
+
+/* Picks a free name, derived from the destination unless one was requested. Requires d.mu. */
+func (d *Daemon) reserveName(requested, destination string) (string, error) {
+	if requested != "" {
+		if _, taken := d.tunnels[requested]; taken {
+			return "", ErrNameTaken
+		}
+		return requested, nil
+	}
+
+	base := nameFromDestination(destination)
+	name := base
+	for n := 2; d.tunnels[name] != nil; n++ {
+		name = fmt.Sprintf("%s-%d", base, n)
+	}
+	return name, nil
+}
+
+/* e.g. 8080 stays 8080, localhost:3000 becomes localhost-3000. */
+func nameFromDestination(destination string) string {
+	destination = strings.TrimPrefix(destination, "unix://")
+	if _, rest, found := strings.Cut(destination, "://"); found {
+		destination = rest
+	}
+	name := strings.Trim(strings.Map(func(r rune) rune {
+		if r < 128 && validName.MatchString(string(r)) {
+			return r
+		}
+		return '-'
+	}, destination), "-._")
+	if name == "" {
+		return "tunnel"
+	}
+	return name
+}
+
+func (d *Daemon) get(name string) (*process, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p, ok := d.tunnels[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return p, nil
+}
+
+/* Drops the process unless it was already removed and the name reused. */
+func (d *Daemon) forget(name string, p *process) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.tunnels[name] == p {
+		delete(d.tunnels, name)
+	}
+}
+
+/* List returns the tunnels sorted by name, exited ones stay listed until they are removed. */
+func (d *Daemon) List() []Tunnel {
+	d.mu.Lock()
+	tunnels := make([]Tunnel, 0, len(d.tunnels))
+	for _, p := range d.tunnels {
+		tunnels = append(tunnels, p.snapshot())
+	}
+	d.mu.Unlock()
+
+	slices.SortFunc(tunnels, func(a, b Tunnel) int { return strings.Compare(a.Name, b.Name) })
+	return tunnels
+}
+
+/* Remove closes a tunnel and forgets it. */
+func (d *Daemon) Remove(name string) error {
+	p, err := d.get(name)
+	if err != nil {
+		return err
+	}
+	d.forget(name, p)
+	p.stop()
+	logger.DaemonTunnelStopped(name)
+	return nil
+}
+
+/* Logs returns the last log lines of a tunnel. */
+func (d *Daemon) Logs(name string) ([]string, error) {
+	p, err := d.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return p.logs.lines(), nil
+}
+
+/* ToggleChaos switches the fault injection of a tunnel started with --chaos off or back on. */
+func (d *Daemon) ToggleChaos(name string) error {
+	p, err := d.get(name)
+	if err != nil {
+		return err
+	}
+	if chaos.ToggleSignal == nil {
+		return ErrUnsupported
+	}
+	if !slices.ContainsFunc(p.snapshot().Args, isChaosFlag) {
+		return fmt.Errorf("%w: %s", ErrNoChaos, name)
+	}
+	select {
+	case <-p.exited:
+		return fmt.Errorf("%w: %s", ErrNotRunning, name)
+	default:
+	}
+	if err := p.cmd.Process.Signal(chaos.ToggleSignal); err != nil {
+		return fmt.Errorf("failed to signal tunnel: %w", err)
+	}
+	return nil
+}
+
+func isChaosFlag(arg string) bool {
+	return arg == "--chaos" || strings.HasPrefix(arg, "--chaos=")
+}
+
+/* Close stops every tunnel, for shutting the daemon down. */
+func (d *Daemon) Close() {
+	d.mu.Lock()
+	processes := make([]*process, 0, len(d.tunnels))
+	for _, p := range d.tunnels {
+		processes = append(processes, p)
+	}
+	clear(d.tunnels)
+	d.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, p := range processes {
+		wg.Go(p.stop)
+	}
+	wg.Wait()
+}
+
+type process struct {
+	mu        sync.Mutex
+	info      Tunnel
+	stopping  bool
+	cmd       *exec.Cmd
+	logs      *logBuffer
+	connected chan struct{}
+	exited    chan struct{}
+}
+
+func (p *process) snapshot() Tunnel {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.info
+}
+
+/* Follows the JSON events of the child, anything else on stdout is kept as a log line. */
+func (p *process) readEvents(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		var event events.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			p.logs.add(scanner.Text())
+			continue
+		}
+
+		p.mu.Lock()
+		switch event.Event {
+		case events.EventConnected:
+			p.info.Status = StatusConnected
+			p.info.PublicURL = event.PublicURL
+			/* Only the first connection ends the wait of Add, a tunnel reporting another one must not close it twice. */
+			select {
+			case <-p.connected:
+			default:
+				close(p.connected)
+			}
+		case events.EventRequest:
+			p.info.Requests++
+		case events.EventDisconnected:
+			p.info.Error = event.Error
+		}
+		p.mu.Unlock()
+	}
+}
+
+/* The error printed by the tunnel command, its usage text follows it and is of no help here. */
+func (p *process) failure() string {
+	lines := p.logs.lines()
+	for i := len(lines) - 1; i >= 0; i-- {
+		if message, found := strings.CutPrefix(lines[i], "Error: "); found {
+			return message
+		}
+	}
+	if info := p.snapshot(); info.Error != "" {
+		return info.Error
+	}
+	return strings.Join(lines[max(0, len(lines)-5):], "\n")
+}
+
+func (p *process) finish(err error) {
+	p.mu.Lock()
+	p.info.Status = StatusExited
+	if p.info.Error == "" && err != nil && !p.stopping {
+		p.info.Error = err.Error()
+	}
+	stopping, connected := p.stopping, p.info.PublicURL != ""
+	name := p.info.Name
+	p.mu.Unlock()
+	close(p.exited)
+
+	if connected && !stopping {
+		logger.DaemonTunnelExited(name, err)
+	}
+}
+
+/* Interrupts the child as Ctrl+C would, so it closes the tunnel cleanly, and kills it if it hangs. */
+func (p *process) stop() {
+	p.mu.Lock()
+	p.stopping = true
+	p.mu.Unlock()
+
+	select {
+	case <-p.exited:
+		return
+	default:
+	}
+
+	if err := p.cmd.Process.Signal(os.Interrupt); err != nil {
+		_ = p.cmd.Process.Kill()
+	}
+	select {
+	case <-p.exited:
+	case <-time.After(stopTimeout):
+		_ = p.cmd.Process.Kill()
+		<-p.exited
+	}
+}
+
+/* logBuffer keeps the last lines written to it. */
+type logBuffer struct {
+	mu      sync.Mutex
+	max     int
+	buf     []string
+	partial []byte
+}
+
+func newLogBuffer(max int) *logBuffer {
+	return &logBuffer{max: max}
+}
+
+func (b *logBuffer) Write(data []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.partial = append(b.partial, data...)
+	for {
+		line, rest, found := strings.Cut(string(b.partial), "\n")
+		if !found {
+			break
+		}
+		b.append(line)
+		b.partial = []byte(rest)
+	}
+	return len(data), nil
+}
+
+func (b *logBuffer) add(line string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.append(line)
+}
+
+/* Requires b.mu. */
+func (b *logBuffer) append(line string) {
+	b.buf = append(b.buf, line)
+	if len(b.buf) > b.max {
+		b.buf = slices.Delete(b.buf, 0, len(b.buf)-b.max)
+	}
+}
+
+func (b *logBuffer) lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Clone(b.buf)
+}
@@ -0,0 +1,236 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/igneel64/iskandar/iskndr/internal/chaos"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/*
+TestHelperProcess stands in for `iskndr tunnel --output json` in the daemon's child processes:
+it connects unless the destination is "fail", logs fault injection toggles and runs until interrupted.
+*/
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("ISKNDR_HELPER_PROCESS") != "1" {
+		return
+	}
+	args := os.Args[slices.Index(os.Args, "--")+1:]
+	if args[0] == "fail" {
+		fmt.Fprintln(os.Stderr, "Error: failed to connect to websocket: connection refused")
+		os.Exit(1)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	if chaos.ToggleSignal != nil {
+		toggle := make(chan os.Signal, 1)
+		signal.Notify(toggle, chaos.ToggleSignal)
+		go func() {
+			for enabled := true; ; {
+				<-toggle
+				enabled = !enabled
+				fmt.Fprintf(os.Stderr, "INF Fault injection toggled enabled=%t\n", enabled)
+			}
+		}()
+	}
+	fmt.Fprintln(os.Stderr, "INF Starting tunnel local_destination="+args[0])
+	fmt.Printf(`{"event":"connected","public_url":"https://%s.tunnel.example.com"}`+"\n", args[0])
+	fmt.Println(`{"event":"request","request_id":"1","method":"GET","path":"/"}`)
+	<-interrupt
+	fmt.Println(`{"event":"disconnected"}`)
+	os.Exit(0)
+}
+
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+	if peerUid == nil {
+		t.Skip("the daemon doesn't run without peer credentials")
+	}
+	d := NewDaemon(Options{
+		Command: func(args []string) *exec.Cmd {
+			return exec.Command(os.Args[0], append([]string{"-test.run=TestHelperProcess", "--"}, args...)...)
+		},
+	})
+	t.Cleanup(d.Close)
+
+	/* Unix socket paths are limited to about 100 bytes, t.TempDir() may be longer. */
+	dir, err := os.MkdirTemp("", "iskndr")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	socketPath := filepath.Join(dir, "d.sock")
+
+	listener, err := Listen(socketPath)
+	require.NoError(t, err)
+	server := &http.Server{Handler: d.Handler()}
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(func() { _ = server.Close() })
+
+	_, err = Listen(socketPath)
+	assert.ErrorContains(t, err, "already listening")
+
+	return NewClient(socketPath)
+}
+
+func TestDaemon(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+	env := append(os.Environ(), "ISKNDR_HELPER_PROCESS=1")
+
+	api, err := client.Add(ctx, AddRequest{Name: "api", Args: []string{"8080", "--server", "localhost:8080"}, Env: env})
+	require.NoError(t, err)
+	assert.Equal(t, "api", api.Name)
+	assert.Equal(t, "https://8080.tunnel.example.com", api.PublicURL)
+	assert.Equal(t, StatusConnected, api.Status)
+
+	unnamed, err := client.Add(ctx, AddRequest{Args: []string{"localhost:3000"}, Env: env})
+	require.NoError(t, err)
+	assert.Equal(t, "localhost-3000", unnamed.Name)
+
+	_, err = client.Add(ctx, AddRequest{Name: "api", Args: []string{"9090"}, Env: env})
+	assert.ErrorContains(t, err, ErrNameTaken.Error())
+	_, err = client.Add(ctx, AddRequest{Name: "../api", Args: []string{"9090"}, Env: env})
+	assert.ErrorContains(t, err, ErrInvalidName.Error())
+	_, err = client.Add(ctx, AddRequest{Args: []string{"fail"}, Env: env})
+	assert.ErrorContains(t, err, "connection refused")
+
+	tunnels, err := client.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, tunnels, 2)
+	assert.Equal(t, "api", tunnels[0].Name)
+	assert.Equal(t, "localhost-3000", tunnels[1].Name)
+
+	logs, err := client.Logs(ctx, "api")
+	require.NoError(t, err)
+	assert.Contains(t, logs, "Starting tunnel local_destination=8080")
+
+	require.NoError(t, client.Remove(ctx, "api"))
+	assert.ErrorContains(t, client.Remove(ctx, "api"), ErrNotFound.Error())
+	_, err = client.Logs(ctx, "api")
+	assert.ErrorContains(t, err, ErrNotFound.Error())
+
+	tunnels, err = client.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, tunnels, 1)
+	assert.Equal(t, int64(1), tunnels[0].Requests)
+}
+
+func TestToggleChaos(t *testing.T) {
+	if chaos.ToggleSignal == nil {
+		t.Skip("fault injection can't be toggled on this platform")
+	}
+	ctx := context.Background()
+	client := newTestClient(t)
+	env := append(os.Environ(), "ISKNDR_HELPER_PROCESS=1")
+
+	_, err := client.Add(ctx, AddRequest{Name: "api", Args: []string{"8080", "--chaos", "drop=2%"}, Env: env})
+	require.NoError(t, err)
+	_, err = client.Add(ctx, AddRequest{Name: "web", Args: []string{"3000"}, Env: env})
+	require.NoError(t, err)
+
+	t.Run("signals a tunnel started with --chaos", func(t *testing.T) {
+		require.NoError(t, client.ToggleChaos(ctx, "api"))
+		assert.Eventually(t, func() bool {
+			logs, err := client.Logs(ctx, "api")
+			return err == nil && strings.Contains(logs, "Fault injection toggled enabled=false")
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("refuses a tunnel without --chaos", func(t *testing.T) {
+		assert.ErrorContains(t, client.ToggleChaos(ctx, "web"), ErrNoChaos.Error())
+	})
+
+	t.Run("refuses an unknown tunnel", func(t *testing.T) {
+		assert.ErrorContains(t, client.ToggleChaos(ctx, "db"), ErrNotFound.Error())
+	})
+}
+
+func TestReadEvents(t *testing.T) {
+	p := &process{logs: newLogBuffer(DefaultLogLines), connected: make(chan struct{})}
+	p.readEvents(strings.NewReader(`{"event":"connected","public_url":"https://a.tunnel.example.com"}
+not an event
+{"event":"connected","public_url":"https://b.tunnel.example.com"}
+{"event":"request","request_id":"1","method":"GET","path":"/"}
+`))
+
+	assert.Equal(t, StatusConnected, p.info.Status)
+	assert.Equal(t, "https://b.tunnel.example.com", p.info.PublicURL)
+	assert.Equal(t, int64(1), p.info.Requests)
+	assert.Equal(t, []string{"not an event"}, p.logs.lines())
+	_, open := <-p.connected
+	assert.False(t, open, "Add stops waiting on the first connection")
+}
+
+func TestListen(t *testing.T) {
+	if peerUid == nil {
+		t.Skip("the daemon doesn't run without peer credentials")
+	}
+	/* Unix socket paths are limited to about 100 bytes, t.TempDir() may be longer. */
+	base, err := os.MkdirTemp("", "iskndr")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(base) })
+
+	t.Run("creates a private socket directory", func(t *testing.T) {
+		listener, err := Listen(filepath.Join(base, "new", "d.sock"))
+		require.NoError(t, err)
+		//nolint:errcheck
+		defer listener.Close()
+
+		info, err := os.Stat(filepath.Join(base, "new"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o700), info.Mode().Perm())
+	})
+
+	t.Run("refuses a directory other users can access", func(t *testing.T) {
+		shared := filepath.Join(base, "shared")
+		require.NoError(t, os.Mkdir(shared, 0o700))
+		require.NoError(t, os.Chmod(shared, 0o777))
+		_, err := Listen(filepath.Join(shared, "d.sock"))
+		assert.ErrorContains(t, err, "accessible to other users")
+		assert.NoFileExists(t, filepath.Join(shared, "d.sock"))
+	})
+
+	t.Run("refuses a symlinked directory", func(t *testing.T) {
+		target := filepath.Join(base, "target")
+		require.NoError(t, os.Mkdir(target, 0o700))
+		require.NoError(t, os.Symlink(target, filepath.Join(base, "link")))
+		_, err := Listen(filepath.Join(base, "link", "d.sock"))
+		assert.ErrorContains(t, err, "not a directory")
+	})
+
+	t.Run("refuses a platform without peer credentials", func(t *testing.T) {
+		defer func(supported func(uintptr) (uint32, error)) { peerUid = supported }(peerUid)
+		peerUid = nil
+		_, err := Listen(filepath.Join(base, "unsupported", "d.sock"))
+		assert.ErrorContains(t, err, "can't check which user connects")
+		assert.NoDirExists(t, filepath.Join(base, "unsupported"))
+	})
+}
+
+func TestClientWithoutDaemon(t *testing.T) {
+	_, err := NewClient(filepath.Join(t.TempDir(), "missing.sock")).List(context.Background())
+	assert.ErrorContains(t, err, "start one with 'iskndr daemon'")
+}
+
+func TestNameFromDestination(t *testing.T) {
+	for destination, name := range map[string]string{
+		"8080":                     "8080",
+		"localhost:3000":           "localhost-3000",
+		"https://localhost:8443":   "localhost-8443",
+		"unix:///var/run/app.sock": "var-run-app-sock",
+		"::":                       "tunnel",
+	} {
+		assert.Equal(t, name, nameFromDestination(destination), destination)
+	}
+}
@@ -0,0 +1,11 @@
+package daemon
+
+import "golang.org/x/sys/unix"
+
+var peerUid = func(fd uintptr) (uint32, error) {
+	cred, err := unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	if err != nil {
+		return 0, err
+	}
+	return cred.Uid, nil
+}
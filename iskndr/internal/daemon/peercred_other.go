@@ -0,0 +1,6 @@
+//go:build !linux && !darwin && !freebsd && !solaris
+
+package daemon
+
+/* Nil where the socket has no peer credentials, Listen refuses to start there. */
+var peerUid func(fd uintptr) (uint32, error)
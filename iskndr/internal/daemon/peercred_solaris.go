@@ -0,0 +1,11 @@
+package daemon
+
+import "golang.org/x/sys/unix"
+
+var peerUid = func(fd uintptr) (uint32, error) {
+	cred, err := unix.GetPeerUcred(fd)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(cred.Geteuid()), nil
+}
@@ -0,0 +1,13 @@
+//go:build darwin || freebsd
+
+package daemon
+
+import "golang.org/x/sys/unix"
+
+var peerUid = func(fd uintptr) (uint32, error) {
+	cred, err := unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	if err != nil {
+		return 0, err
+	}
+	return cred.Uid, nil
+}
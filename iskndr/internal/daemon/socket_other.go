@@ -0,0 +1,19 @@
+//go:build !unix
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+)
+
+/* Listen refuses to start here before these are needed, they fail in case that ever changes. */
+func checkPrivate(dir string, _ fs.FileInfo) error {
+	return fmt.Errorf("can't check the owner of socket directory %s", dir)
+}
+
+func checkPeer(net.Conn) error {
+	return errors.New("can't check the user of the connection")
+}
@@ -0,0 +1,46 @@
+//go:build unix
+
+package daemon
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"syscall"
+)
+
+func checkPrivate(dir string, info fs.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("socket directory %s belongs to another user", dir)
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		return fmt.Errorf("socket directory %s is accessible to other users, restrict it with 'chmod 700 %s'", dir, dir)
+	}
+	return nil
+}
+
+func checkPeer(conn net.Conn) error {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("unexpected %s connection", conn.LocalAddr().Network())
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var uid uint32
+	var credErr error
+	if err := raw.Control(func(fd uintptr) { uid, credErr = peerUid(fd) }); err != nil {
+		return err
+	}
+	if credErr != nil {
+		return fmt.Errorf("failed to read peer credentials: %w", credErr)
+	}
+	if int(uid) != os.Getuid() {
+		return fmt.Errorf("connection of user %d", uid)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+/*
+Package events writes newline-delimited JSON events for scripts and CI jobs driving the CLI,
+one object per line with an "event" name and its fields.
+*/
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/igneel64/iskandar/shared/protocol"
+)
+
+/* Event names. The CLI doesn't reconnect, so disconnected is always the last event. */
+const (
+	EventConnected    = "connected"
+	EventRequest      = "request"
+	EventResponse     = "response"
+	EventHealth       = "health"
+	EventDisconnected = "disconnected"
+)
+
+/* Event is a single line of output, fields that don't apply to an event are left out. */
+type Event struct {
+	Event       string    `json:"event"`
+	Time        time.Time `json:"time"`
+	PublicURL   string    `json:"public_url,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	RequestID   string    `json:"request_id,omitempty"`
+	Method      string    `json:"method,omitempty"`
+	Path        string    `json:"path,omitempty"`
+	Status      int       `json:"status,omitempty"`
+	Health      string    `json:"health,omitempty"`
+	/* Time until the response headers were sent back. */
+	DurationMs float64 `json:"duration_ms,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type emitter struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+	started map[string]time.Time
+}
+
+/* Disabled until Initialize is called, like the logger. */
+var output *emitter
+
+/* Initialize writes events to w, nil disables them. */
+func Initialize(w io.Writer) {
+	if w == nil {
+		output = nil
+		return
+	}
+	output = &emitter{encoder: json.NewEncoder(w), started: map[string]time.Time{}}
+}
+
+func emit(event Event) {
+	if output == nil {
+		return
+	}
+	event.Time = time.Now().UTC()
+
+	output.mu.Lock()
+	defer output.mu.Unlock()
+	_ = output.encoder.Encode(&event)
+}
+
+func Connected(publicURL, destination string) {
+	emit(Event{Event: EventConnected, PublicURL: publicURL, Destination: destination})
+}
+
+func Request(requestID, method, path string) {
+	if output != nil {
+		output.mu.Lock()
+		output.started[requestID] = time.Now()
+		output.mu.Unlock()
+	}
+	emit(Event{Event: EventRequest, RequestID: requestID, Method: method, Path: path})
+}
+
+/* Response reports the first message of a response, later chunks of a streamed body are ignored. */
+func Response(msg *protocol.Message) {
+	if output == nil || (msg.Status == 0 && !msg.Abort) {
+		return
+	}
+
+	output.mu.Lock()
+	started, ok := output.started[msg.Id]
+	delete(output.started, msg.Id)
+	output.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	event := Event{
+		Event:      EventResponse,
+		RequestID:  msg.Id,
+		Status:     msg.Status,
+		DurationMs: float64(time.Since(started).Microseconds()) / 1000,
+		Error:      msg.Error,
+	}
+	if msg.Abort {
+		event.Error = "connection dropped"
+	}
+	emit(event)
+}
+
+func Health(health string, err error) {
+	event := Event{Event: EventHealth, Health: health}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	emit(event)
+}
+
+/* Disconnected reports the end of the tunnel, err is nil when it was closed on purpose. */
+func Disconnected(err error) {
+	event := Event{Event: EventDisconnected}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	emit(event)
+}
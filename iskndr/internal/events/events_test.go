@@ -0,0 +1,69 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/igneel64/iskandar/shared/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decode(t *testing.T, buf *bytes.Buffer) []Event {
+	t.Helper()
+	var events []Event
+	decoder := json.NewDecoder(buf)
+	for decoder.More() {
+		var event Event
+		require.NoError(t, decoder.Decode(&event))
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestEvents(t *testing.T) {
+	var buf bytes.Buffer
+	Initialize(&buf)
+	t.Cleanup(func() { Initialize(nil) })
+
+	Connected("https://abc.example.com", "localhost:3000")
+	Request("req-1", "POST", "/hooks")
+	Response(&protocol.Message{Id: "req-1", Status: 201})
+	Response(&protocol.Message{Id: "req-1", Body: []byte("chunk")})
+	Request("req-2", "GET", "/slow")
+	Response(&protocol.Message{Id: "req-2", Abort: true})
+	Disconnected(errors.New("websocket closed"))
+
+	events := decode(t, &buf)
+	require.Len(t, events, 6)
+
+	assert.Equal(t, EventConnected, events[0].Event)
+	assert.Equal(t, "https://abc.example.com", events[0].PublicURL)
+	assert.Equal(t, "localhost:3000", events[0].Destination)
+	assert.False(t, events[0].Time.IsZero())
+
+	assert.Equal(t, Event{Event: EventRequest, Time: events[1].Time, RequestID: "req-1", Method: "POST", Path: "/hooks"}, events[1])
+
+	assert.Equal(t, EventResponse, events[2].Event)
+	assert.Equal(t, "req-1", events[2].RequestID)
+	assert.Equal(t, 201, events[2].Status)
+	assert.Empty(t, events[2].Error)
+
+	assert.Equal(t, EventResponse, events[4].Event)
+	assert.Equal(t, "connection dropped", events[4].Error)
+
+	assert.Equal(t, EventDisconnected, events[5].Event)
+	assert.Equal(t, "websocket closed", events[5].Error)
+}
+
+func TestEventsDisabled(t *testing.T) {
+	Initialize(nil)
+	assert.NotPanics(t, func() {
+		Connected("https://abc.example.com", "localhost:3000")
+		Request("req-1", "GET", "/")
+		Response(&protocol.Message{Id: "req-1", Status: 200})
+		Disconnected(nil)
+	})
+}
@@ -0,0 +1,177 @@
+/*
+Package har records tunnelled traffic as HAR 1.2 (http://www.softwareishard.com/blog/har-12-spec/)
+and reads recordings back for replaying.
+*/
+package har
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+	"unicode/utf8"
+)
+
+type File struct {
+	Log Log `json:"log"`
+}
+
+type Log struct {
+	Version string  `json:"version"`
+	Creator Creator `json:"creator"`
+	Entries []Entry `json:"entries"`
+}
+
+type Creator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type Entry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	/* Milliseconds from the request to the end of the response. */
+	Time     float64  `json:"time"`
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+	Cache    struct{} `json:"cache"`
+	Timings  Timings  `json:"timings"`
+	Comment  string   `json:"comment,omitempty"`
+}
+
+type Request struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []Cookie    `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	QueryString []NameValue `json:"queryString"`
+	PostData    *PostData   `json:"postData,omitempty"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+type Response struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []Cookie    `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	Content     Content     `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+/* Cookies set by responses, their values are redacted with the Set-Cookie header by default. */
+type Cookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type NameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type PostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	/* Not part of HAR 1.2, set to base64 for binary bodies as content.encoding does for responses. */
+	Encoding string `json:"_encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type Content struct {
+	/* Length of the whole body, Text may be truncated. */
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type Timings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+/* Load reads a HAR file, e.g. one recorded with --record or exported by a browser. */
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HAR: %w", err)
+	}
+	var file File
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid HAR %s: %w", path, err)
+	}
+	return &file, nil
+}
+
+/* Body returns the request body, nil when the entry has none. */
+func (r *Request) Body() ([]byte, error) {
+	if r.PostData == nil {
+		return nil, nil
+	}
+	if r.PostData.Encoding == "base64" {
+		return base64.StdEncoding.DecodeString(r.PostData.Text)
+	}
+	return []byte(r.PostData.Text), nil
+}
+
+/* Text bodies are kept as they are, binary ones are base64 encoded. */
+func encodeBody(body []byte) (text, encoding string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+/* Headers left out of replayed requests, the HTTP client sets them for the new connection. */
+var replaySkippedHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Connection":        true,
+	"Transfer-Encoding": true,
+}
+
+/*
+NewRequest rebuilds the recorded request for a replay to targetURL. Redacted headers are left out,
+so replays of recordings with credentials reach the application unauthenticated.
+*/
+func (e *Entry) NewRequest(ctx context.Context, targetURL string) (*http.Request, error) {
+	body, err := e.Request.Body()
+	if err != nil {
+		return nil, fmt.Errorf("invalid request body: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, e.Request.Method, targetURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range e.Request.Headers {
+		if header.Value == Redacted || replaySkippedHeaders[http.CanonicalHeaderKey(header.Name)] {
+			continue
+		}
+		req.Header.Add(header.Name, header.Value)
+	}
+	return req, nil
+}
+
+/* RequestURI returns the path and query of the recorded request. */
+func (e *Entry) RequestURI() (string, error) {
+	u, err := url.Parse(e.Request.URL)
+	if err != nil {
+		return "", fmt.Errorf("invalid request URL: %w", err)
+	}
+	return u.RequestURI(), nil
+}
@@ -0,0 +1,310 @@
+package har
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/igneel64/iskandar/shared/protocol"
+)
+
+const (
+	/* Value replacing redacted headers, replay doesn't send headers with this value. */
+	Redacted = "[REDACTED]"
+	/* 1 MiB, bodies are truncated past this size unless configured otherwise. */
+	DefaultMaxBodySize = 1 << 20
+)
+
+/* Headers redacted in every recording, they carry credentials. */
+var DefaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+type RecorderOptions struct {
+	/* Bodies longer than this are truncated, zero uses DefaultMaxBodySize and a negative value drops bodies. */
+	MaxBodySize int64
+	/* Headers whose values are replaced, in addition to DefaultRedactedHeaders. */
+	RedactHeaders []string
+	/* Version of the CLI written as the HAR creator. */
+	Version string
+}
+
+/* Closes the entries array, written again after every entry so the file stays a valid HAR. */
+const trailer = "\n    ]\n  }\n}\n"
+
+/*
+Recorder writes the requests forwarded by the client to a HAR file as they finish, so only requests
+in flight are kept in memory and a crash loses nothing that was recorded before.
+*/
+type Recorder struct {
+	maxBodySize int64
+	redact      map[string]bool
+
+	mu      sync.Mutex
+	pending map[string]*pendingEntry
+	file    *os.File
+	/* Offset of the trailer, the next entry is written over it. */
+	end     int64
+	written int
+	/* First failed write, returned by Close. */
+	err error
+}
+
+type pendingEntry struct {
+	entry     Entry
+	started   time.Time
+	firstByte time.Time
+	body      []byte
+	bodySize  int
+}
+
+/* NewRecorder creates the HAR file right away, so an unwritable path fails before the tunnel opens. */
+func NewRecorder(path string, opts RecorderOptions) (*Recorder, error) {
+	r := &Recorder{
+		maxBodySize: opts.MaxBodySize,
+		redact:      map[string]bool{},
+		pending:     map[string]*pendingEntry{},
+	}
+	if r.maxBodySize == 0 {
+		r.maxBodySize = DefaultMaxBodySize
+	}
+	for _, name := range append(slices.Clone(DefaultRedactedHeaders), opts.RedactHeaders...) {
+		r.redact[http.CanonicalHeaderKey(name)] = true
+	}
+
+	creator, err := json.MarshalIndent(Creator{Name: "iskndr", Version: opts.Version}, "    ", "  ")
+	if err != nil {
+		return nil, err
+	}
+	header := "{\n  \"log\": {\n    \"version\": \"1.2\",\n    \"creator\": " + string(creator) + ",\n    \"entries\": ["
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write HAR: %w", err)
+	}
+	if _, err := file.WriteString(header + trailer); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to write HAR: %w", err)
+	}
+	r.file = file
+	r.end = int64(len(header))
+	return r, nil
+}
+
+/* Start records a request received from the server, nil-safe for clients without a recorder. */
+func (r *Recorder) Start(msg *protocol.Message) {
+	if r == nil {
+		return
+	}
+
+	request := Request{
+		Method:      msg.Method,
+		URL:         publicURL(msg),
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     []Cookie{},
+		Headers:     r.headers(msg.Headers),
+		QueryString: []NameValue{},
+		HeadersSize: -1,
+		BodySize:    len(msg.Body),
+	}
+	if u, err := url.Parse(request.URL); err == nil {
+		for name, values := range u.Query() {
+			for _, value := range values {
+				request.QueryString = append(request.QueryString, NameValue{Name: name, Value: value})
+			}
+		}
+		sortNameValues(request.QueryString)
+	}
+	if len(msg.Body) > 0 {
+		body, truncated := r.truncate(msg.Body)
+		request.PostData = &PostData{MimeType: msg.Headers["Content-Type"]}
+		request.PostData.Text, request.PostData.Encoding = encodeBody(body)
+		if truncated {
+			request.PostData.Comment = "truncated"
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending[msg.Id] = &pendingEntry{
+		entry:   Entry{StartedDateTime: time.Now(), Request: request},
+		started: time.Now(),
+	}
+}
+
+/* Record adds a response message sent back for a started request. */
+func (r *Recorder) Record(msg *protocol.Message) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.pending[msg.Id]
+	if !ok {
+		return
+	}
+
+	if msg.Abort {
+		p.entry.Comment = "connection dropped"
+		return
+	}
+	if p.firstByte.IsZero() {
+		/* Several Set-Cookie values come separately, the joined header can't be split again. */
+		headers, setCookies := msg.Headers, msg.SetCookies
+		if len(setCookies) > 0 {
+			headers = maps.Clone(headers)
+			delete(headers, "Set-Cookie")
+		} else if setCookie, ok := headers["Set-Cookie"]; ok {
+			setCookies = []string{setCookie}
+		}
+
+		p.firstByte = time.Now()
+		p.entry.Response = Response{
+			Status:      msg.Status,
+			StatusText:  http.StatusText(msg.Status),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     r.cookies(setCookies),
+			Headers:     r.headers(headers, msg.SetCookies...),
+			RedirectURL: msg.Headers["Location"],
+			HeadersSize: -1,
+		}
+		p.entry.Response.Content.MimeType = msg.Headers["Content-Type"]
+	}
+	p.bodySize += len(msg.Body)
+	if room := r.maxBodySize - int64(len(p.body)); room > 0 {
+		p.body = append(p.body, msg.Body[:min(int64(len(msg.Body)), room)]...)
+	}
+}
+
+/* Finish completes the entry of a request, whether or not its response was sent in full. */
+func (r *Recorder) Finish(requestId string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.pending[requestId]
+	if !ok {
+		return
+	}
+	delete(r.pending, requestId)
+
+	now := time.Now()
+	entry := p.entry
+	entry.Time = milliseconds(now.Sub(p.started))
+	if !p.firstByte.IsZero() {
+		entry.Timings = Timings{Wait: milliseconds(p.firstByte.Sub(p.started)), Receive: milliseconds(now.Sub(p.firstByte))}
+	} else {
+		entry.Timings = Timings{Wait: entry.Time}
+	}
+
+	entry.Response.BodySize = p.bodySize
+	entry.Response.Content.Size = p.bodySize
+	if len(p.body) > 0 {
+		entry.Response.Content.Text, entry.Response.Content.Encoding = encodeBody(p.body)
+	}
+	if len(p.body) < p.bodySize {
+		entry.Response.Content.Comment = "truncated"
+	}
+	r.writeEntry(entry)
+}
+
+/* Close closes the file, requests still in flight are left out. */
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return errors.Join(r.err, r.file.Close())
+}
+
+/* writeEntry appends entry in completion order, HAR viewers sort by startedDateTime. Called with mu held. */
+func (r *Recorder) writeEntry(entry Entry) {
+	if r.err != nil {
+		return
+	}
+	data, err := json.MarshalIndent(entry, "      ", "  ")
+	if err != nil {
+		r.err = err
+		return
+	}
+
+	chunk := ",\n      " + string(data)
+	if r.written == 0 {
+		chunk = chunk[1:]
+	}
+	if _, err := r.file.WriteAt([]byte(chunk+trailer), r.end); err != nil {
+		r.err = fmt.Errorf("failed to write HAR: %w", err)
+		return
+	}
+	r.end += int64(len(chunk))
+	r.written++
+}
+
+func (r *Recorder) truncate(body []byte) ([]byte, bool) {
+	if int64(len(body)) <= r.maxBodySize {
+		return body, false
+	}
+	return body[:max(r.maxBodySize, 0)], true
+}
+
+/* headers lists headers and one Set-Cookie header per value of setCookies. */
+func (r *Recorder) headers(headers map[string]string, setCookies ...string) []NameValue {
+	list := make([]NameValue, 0, len(headers)+len(setCookies))
+	for name, value := range headers {
+		list = append(list, NameValue{Name: name, Value: r.redactValue(name, value)})
+	}
+	for _, value := range setCookies {
+		list = append(list, NameValue{Name: "Set-Cookie", Value: r.redactValue("Set-Cookie", value)})
+	}
+	sortNameValues(list)
+	return list
+}
+
+/* cookies lists the cookies set by a response, with redacted values when Set-Cookie is redacted. */
+func (r *Recorder) cookies(setCookies []string) []Cookie {
+	cookies := []Cookie{}
+	for _, value := range setCookies {
+		cookie, err := http.ParseSetCookie(value)
+		if err != nil {
+			continue
+		}
+		cookies = append(cookies, Cookie{Name: cookie.Name, Value: r.redactValue("Set-Cookie", cookie.Value)})
+	}
+	return cookies
+}
+
+func (r *Recorder) redactValue(name, value string) string {
+	if r.redact[http.CanonicalHeaderKey(name)] {
+		return Redacted
+	}
+	return value
+}
+
+/* The URL the public client requested, as seen through the forwarding headers of the server. */
+func publicURL(msg *protocol.Message) string {
+	scheme, host := msg.Headers["X-Forwarded-Proto"], msg.Headers["X-Forwarded-Host"]
+	if scheme == "" {
+		scheme = "http"
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return scheme + "://" + host + msg.Path
+}
+
+func sortNameValues(list []NameValue) {
+	sort.SliceStable(list, func(a, b int) bool {
+		return strings.ToLower(list[a].Name) < strings.ToLower(list[b].Name)
+	})
+}
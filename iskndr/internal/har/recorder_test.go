@@ -0,0 +1,188 @@
+package har
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/igneel64/iskandar/shared/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRecorder(t *testing.T, opts RecorderOptions) (*Recorder, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "session.har")
+	recorder, err := NewRecorder(path, opts)
+	require.NoError(t, err)
+	return recorder, path
+}
+
+func TestRecorder(t *testing.T) {
+	t.Run("creates an empty recording right away", func(t *testing.T) {
+		_, path := newTestRecorder(t, RecorderOptions{Version: "1.0.0"})
+
+		recording, err := Load(path)
+		require.NoError(t, err)
+		assert.Equal(t, "1.2", recording.Log.Version)
+		assert.Equal(t, Creator{Name: "iskndr", Version: "1.0.0"}, recording.Log.Creator)
+		assert.Empty(t, recording.Log.Entries)
+
+		_, err = NewRecorder(filepath.Join(t.TempDir(), "missing", "session.har"), RecorderOptions{})
+		assert.Error(t, err)
+	})
+
+	t.Run("records streamed responses with redacted headers", func(t *testing.T) {
+		recorder, path := newTestRecorder(t, RecorderOptions{RedactHeaders: []string{"x-api-key"}})
+
+		recorder.Start(&protocol.Message{
+			Id:     "req-1",
+			Method: "POST",
+			Path:   "/orders?b=2&a=1",
+			Headers: map[string]string{
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "abc.tunnel.example.com",
+				"Authorization":     "Bearer secret",
+				"X-Api-Key":         "secret",
+				"Content-Type":      "application/json",
+			},
+			Body: []byte(`{"item":1}`),
+		})
+		recorder.Record(&protocol.Message{Id: "req-1", Status: 201, Headers: map[string]string{"Set-Cookie": "session=1", "Content-Type": "application/json"}, Body: []byte(`{"id":`)})
+		recorder.Record(&protocol.Message{Id: "req-1", Body: []byte(`7}`), Done: true})
+		recorder.Record(&protocol.Message{Id: "unknown", Status: 200})
+		recorder.Finish("req-1")
+		require.NoError(t, recorder.Close())
+
+		recording, err := Load(path)
+		require.NoError(t, err)
+		require.Len(t, recording.Log.Entries, 1)
+		entry := recording.Log.Entries[0]
+
+		assert.Equal(t, "https://abc.tunnel.example.com/orders?b=2&a=1", entry.Request.URL)
+		assert.Equal(t, []NameValue{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}, entry.Request.QueryString)
+		assert.Contains(t, entry.Request.Headers, NameValue{Name: "Authorization", Value: Redacted})
+		assert.Contains(t, entry.Request.Headers, NameValue{Name: "X-Api-Key", Value: Redacted})
+		assert.Equal(t, &PostData{MimeType: "application/json", Text: `{"item":1}`}, entry.Request.PostData)
+
+		assert.Equal(t, 201, entry.Response.Status)
+		assert.Equal(t, "Created", entry.Response.StatusText)
+		assert.Contains(t, entry.Response.Headers, NameValue{Name: "Set-Cookie", Value: Redacted})
+		assert.Equal(t, []Cookie{{Name: "session", Value: Redacted}}, entry.Response.Cookies)
+		assert.Equal(t, Content{Size: 8, MimeType: "application/json", Text: `{"id":7}`}, entry.Response.Content)
+	})
+
+	t.Run("truncates bodies and encodes binary ones", func(t *testing.T) {
+		recorder, path := newTestRecorder(t, RecorderOptions{MaxBodySize: 4})
+
+		recorder.Start(&protocol.Message{Id: "req-1", Method: "PUT", Path: "/upload", Body: []byte("0123456789")})
+		recorder.Record(&protocol.Message{Id: "req-1", Status: 200, Body: []byte{0xff, 0xfe, 0xfd, 0xfc, 0xfb}, Done: true})
+		recorder.Finish("req-1")
+		require.NoError(t, recorder.Close())
+
+		recording, err := Load(path)
+		require.NoError(t, err)
+		entry := recording.Log.Entries[0]
+		assert.Equal(t, &PostData{Text: "0123", Comment: "truncated"}, entry.Request.PostData)
+		assert.Equal(t, 10, entry.Request.BodySize)
+		assert.Equal(t, Content{Size: 5, Text: "//79/A==", Encoding: "base64", Comment: "truncated"}, entry.Response.Content)
+	})
+
+	t.Run("notes dropped connections", func(t *testing.T) {
+		recorder, path := newTestRecorder(t, RecorderOptions{})
+
+		recorder.Start(&protocol.Message{Id: "req-1", Method: "GET", Path: "/"})
+		recorder.Record(&protocol.Message{Id: "req-1", Abort: true, Done: true})
+		recorder.Finish("req-1")
+		require.NoError(t, recorder.Close())
+
+		recording, err := Load(path)
+		require.NoError(t, err)
+		assert.Equal(t, "connection dropped", recording.Log.Entries[0].Comment)
+		assert.Zero(t, recording.Log.Entries[0].Response.Status)
+	})
+
+	t.Run("writes entries as they finish", func(t *testing.T) {
+		recorder, path := newTestRecorder(t, RecorderOptions{})
+
+		for _, id := range []string{"req-1", "req-2"} {
+			recorder.Start(&protocol.Message{Id: id, Method: "GET", Path: "/" + id})
+			recorder.Record(&protocol.Message{Id: id, Status: 200, Done: true})
+			recorder.Finish(id)
+
+			recording, err := Load(path)
+			require.NoError(t, err, "the file stays valid between entries")
+			assert.Equal(t, "http://localhost/"+id, recording.Log.Entries[len(recording.Log.Entries)-1].Request.URL)
+		}
+		recorder.Start(&protocol.Message{Id: "req-3", Method: "GET", Path: "/"})
+		require.NoError(t, recorder.Close())
+
+		recording, err := Load(path)
+		require.NoError(t, err)
+		assert.Len(t, recording.Log.Entries, 2, "requests still in flight are left out")
+	})
+
+	t.Run("keeps every Set-Cookie", func(t *testing.T) {
+		recorder, path := newTestRecorder(t, RecorderOptions{})
+		/* Nothing redacted, to see the values. */
+		recorder.redact = map[string]bool{}
+
+		recorder.Start(&protocol.Message{Id: "req-1", Method: "GET", Path: "/login"})
+		recorder.Record(&protocol.Message{
+			Id:         "req-1",
+			Status:     200,
+			Headers:    map[string]string{"Set-Cookie": "session=1; Path=/, theme=dark", "Content-Type": "text/plain"},
+			SetCookies: []string{"session=1; Path=/", "theme=dark"},
+			Done:       true,
+		})
+		recorder.Finish("req-1")
+		require.NoError(t, recorder.Close())
+
+		recording, err := Load(path)
+		require.NoError(t, err)
+		response := recording.Log.Entries[0].Response
+		assert.Equal(t, []NameValue{
+			{Name: "Content-Type", Value: "text/plain"},
+			{Name: "Set-Cookie", Value: "session=1; Path=/"},
+			{Name: "Set-Cookie", Value: "theme=dark"},
+		}, response.Headers)
+		assert.Equal(t, []Cookie{{Name: "session", Value: "1"}, {Name: "theme", Value: "dark"}}, response.Cookies)
+	})
+
+	t.Run("is a no-op when nil", func(t *testing.T) {
+		var recorder *Recorder
+		recorder.Start(&protocol.Message{Id: "req-1"})
+		recorder.Record(&protocol.Message{Id: "req-1"})
+		recorder.Finish("req-1")
+		assert.NoError(t, recorder.Close())
+	})
+}
+
+func TestEntryNewRequest(t *testing.T) {
+	entry := Entry{Request: Request{
+		Method: "POST",
+		URL:    "https://abc.tunnel.example.com/orders?page=2",
+		Headers: []NameValue{
+			{Name: "Authorization", Value: Redacted},
+			{Name: "Content-Length", Value: "5"},
+			{Name: "X-Trace", Value: "a"},
+			{Name: "X-Trace", Value: "b"},
+		},
+		PostData: &PostData{Text: "aGVsbG8=", Encoding: "base64"},
+	}}
+
+	requestURI, err := entry.RequestURI()
+	require.NoError(t, err)
+	assert.Equal(t, "/orders?page=2", requestURI)
+
+	req, err := entry.NewRequest(context.Background(), "http://localhost:3000"+requestURI)
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:3000/orders?page=2", req.URL.String())
+	assert.Equal(t, http.Header{"X-Trace": {"a", "b"}}, req.Header)
+
+	body, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+}
@@ -0,0 +1,151 @@
+/*
+Package health checks whether the local destination is ready, to hold the tunnel registration back while
+a dev server boots and to have the server answer for an application that went down.
+*/
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/igneel64/iskandar/iskndr/internal/upstream"
+)
+
+const (
+	DefaultInterval  = 5 * time.Second
+	DefaultThreshold = 2
+	/* How often Wait checks while the destination is starting. */
+	waitInterval = 500 * time.Millisecond
+)
+
+type Options struct {
+	/*
+		Path requested on the destination, healthy when it answers with a 2xx or 3xx status.
+		Empty only checks that the destination answers at all, with any status.
+	*/
+	Path string
+	/* Zero uses DefaultInterval, it also bounds each check. */
+	Interval time.Duration
+	/* Consecutive results needed to switch between healthy and unhealthy, zero uses DefaultThreshold. */
+	Threshold int
+}
+
+type Checker struct {
+	upstream *upstream.Mapper
+	opts     Options
+}
+
+func NewChecker(upstreamMapper *upstream.Mapper, opts Options) *Checker {
+	if opts.Interval == 0 {
+		opts.Interval = DefaultInterval
+	}
+	if opts.Threshold == 0 {
+		opts.Threshold = DefaultThreshold
+	}
+	return &Checker{upstream: upstreamMapper, opts: opts}
+}
+
+/*
+Check requests the health path once on every destination of the default route, at the same time. It passes
+when one of them is healthy, the balancer skips the others.
+*/
+func (c *Checker) Check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Interval)
+	defer cancel()
+
+	path := c.opts.Path
+	if path == "" {
+		path = "/"
+	}
+	targets := c.upstream.HealthTargets(path)
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Go(func() { errs[i] = c.check(ctx, target) })
+	}
+	wg.Wait()
+
+	if slices.Contains(errs, nil) {
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Checker) check(ctx context.Context, target upstream.Target) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.URL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := target.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	//nolint:errcheck
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+
+	if c.opts.Path != "" && res.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("health check of %s returned %d", target.URL, res.StatusCode)
+	}
+	return nil
+}
+
+/* Wait returns once a check passes, or with the last error when ctx ends first. */
+func (c *Checker) Wait(ctx context.Context) error {
+	ticker := time.NewTicker(waitInterval)
+	defer ticker.Stop()
+	for {
+		err := c.Check(ctx)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-ticker.C:
+		}
+	}
+}
+
+/*
+Run checks every interval until ctx ends. report is called with the result of the first check and then
+whenever Threshold consecutive checks disagree with the current state.
+*/
+func (c *Checker) Run(ctx context.Context, report func(healthy bool, err error)) {
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+
+	var healthy, known bool
+	streak := 0
+	for {
+		err := c.Check(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		switch {
+		case !known:
+			known, healthy = true, err == nil
+			report(healthy, err)
+		case (err == nil) == healthy:
+			streak = 0
+		default:
+			if streak++; streak >= c.opts.Threshold {
+				healthy, streak = err == nil, 0
+				report(healthy, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
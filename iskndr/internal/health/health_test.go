@@ -0,0 +1,154 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/igneel64/iskandar/iskndr/internal/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/* Serves the health path with the current status, everything else with 404. */
+func newTestDestination(t *testing.T, status *atomic.Int32) *upstream.Mapper {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	t.Cleanup(ts.Close)
+	return upstream.NewMapper(upstream.Destination{URL: ts.URL}, upstream.Options{})
+}
+
+func TestCheck(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	mapper := newTestDestination(t, &status)
+	ctx := context.Background()
+
+	checker := NewChecker(mapper, Options{Path: "/healthz"})
+	assert.NoError(t, checker.Check(ctx))
+	status.Store(http.StatusServiceUnavailable)
+	assert.ErrorContains(t, checker.Check(ctx), "503")
+
+	/* Without a path any answer counts, the 404 of / included. */
+	assert.NoError(t, NewChecker(mapper, Options{}).Check(ctx))
+
+	unreachable := upstream.NewMapper(upstream.Destination{URL: "http://127.0.0.1:1"}, upstream.Options{})
+	assert.Error(t, NewChecker(unreachable, Options{}).Check(ctx))
+}
+
+/* Answers every request with 200, like --mock with a catch-all response. */
+type okFallback struct{}
+
+func (okFallback) ServeHTTP(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+func (okFallback) Matches(r *http.Request) bool                     { return true }
+
+func TestCheckDestinations(t *testing.T) {
+	ctx := context.Background()
+	down := upstream.Destination{URL: "http://127.0.0.1:1"}
+
+	t.Run("ignores the fallback", func(t *testing.T) {
+		mapper := upstream.NewMapper(down, upstream.Options{Fallback: okFallback{}})
+		assert.Error(t, NewChecker(mapper, Options{Path: "/healthz"}).Check(ctx))
+	})
+
+	t.Run("probes every backend directly", func(t *testing.T) {
+		var requests atomic.Int32
+		var paths sync.Map
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			paths.Store(r.URL.Path, true)
+			if r.URL.Path != "/healthz" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			requests.Add(1)
+		}))
+		defer ts.Close()
+
+		var downs atomic.Int32
+		mapper := upstream.NewMapper(down, upstream.Options{
+			AddPrefix: "/api",
+			Backends:  []upstream.Backend{{Destination: upstream.Destination{URL: ts.URL}}},
+			Balance:   upstream.BalanceOptions{OnDown: func(upstream.Destination, error) { downs.Add(1) }},
+		})
+		checker := NewChecker(mapper, Options{Path: "/healthz"})
+		for range 3 {
+			assert.NoError(t, checker.Check(ctx), "one healthy backend is enough")
+		}
+		assert.Equal(t, int32(3), requests.Load(), "every check reaches the backend")
+		_, prefixed := paths.Load("/api/healthz")
+		assert.False(t, prefixed, "--path-prefix isn't applied to the health path")
+		assert.Zero(t, downs.Load(), "the balancer doesn't see the checks")
+
+		unhealthy := upstream.NewMapper(down, upstream.Options{Backends: []upstream.Backend{{Destination: down}}})
+		assert.Error(t, NewChecker(unhealthy, Options{}).Check(ctx))
+	})
+}
+
+func TestWait(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	checker := NewChecker(newTestDestination(t, &status), Options{Path: "/healthz"})
+
+	time.AfterFunc(100*time.Millisecond, func() { status.Store(http.StatusOK) })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, checker.Wait(ctx))
+
+	status.Store(http.StatusServiceUnavailable)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorContains(t, checker.Wait(ctx), "503")
+}
+
+func TestRun(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	checker := NewChecker(newTestDestination(t, &status), Options{Path: "/healthz", Interval: 10 * time.Millisecond, Threshold: 3})
+
+	type report struct {
+		healthy bool
+		err     error
+	}
+	reports := make(chan report, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go checker.Run(ctx, func(healthy bool, err error) { reports <- report{healthy, err} })
+
+	next := func() report {
+		t.Helper()
+		select {
+		case r := <-reports:
+			return r
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "no health report")
+			return report{}
+		}
+	}
+
+	assert.Equal(t, report{healthy: true}, next())
+
+	status.Store(http.StatusServiceUnavailable)
+	unhealthy := next()
+	assert.False(t, unhealthy.healthy)
+	assert.ErrorContains(t, unhealthy.err, "503")
+
+	status.Store(http.StatusOK)
+	assert.Equal(t, report{healthy: true}, next())
+
+	cancel()
+	select {
+	case <-reports:
+		assert.Fail(t, "report after cancel")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -1,26 +1,34 @@
 package logger
 
 import (
+	"io"
 	"os"
 	"time"
 
+	"github.com/igneel64/iskandar/iskndr/internal/chaos"
+	"github.com/igneel64/iskandar/shared"
+	"github.com/igneel64/iskandar/shared/protocol"
 	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
+	"golang.org/x/term"
 )
 
-func Initialize(logToStdout bool) {
-	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+/* Silent until Initialize is called, so embedding the tunnel package doesn't write to stderr. */
+var log = zerolog.Nop()
 
-	if !logToStdout {
-		zerolog.SetGlobalLevel(zerolog.Disabled)
+/* Initialize enables logging to out, stdout unless it carries other output such as JSON events. */
+func Initialize(enabled bool, out io.Writer) {
+	if !enabled {
+		log = zerolog.Nop()
 		return
 	}
 
-	log.Logger = log.Output(zerolog.ConsoleWriter{
-		Out:        os.Stdout,
+	/* No colors in files and pipes, e.g. the logs the daemon keeps of its tunnels. */
+	file, isFile := out.(*os.File)
+	log = zerolog.New(zerolog.ConsoleWriter{
+		Out:        out,
+		NoColor:    !isFile || !term.IsTerminal(int(file.Fd())),
 		TimeFormat: time.RFC3339,
-	})
-	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	}).With().Timestamp().Logger().Level(zerolog.DebugLevel)
 }
 
 func TunnelStarting(destination string, serverURL string) {
@@ -36,12 +44,39 @@ func TunnelConnected(subdomain string) {
 		Msg("Tunnel connected")
 }
 
+func TunnelLimits(limits protocol.TunnelLimits) {
+	log.Info().
+		Int64("max_body_size", limits.MaxBodySize).
+		Dur("response_timeout", limits.ResponseTimeout).
+		Dur("stream_idle_timeout", limits.StreamIdleTimeout).
+		Dur("event_stream_idle_timeout", limits.EventStreamIdleTimeout).
+		Dur("ttl", limits.TTL).
+		Int64("max_uses", limits.MaxUses).
+		Msg("Tunnel limits")
+}
+
 func TunnelDisconnected(err error) {
 	log.Info().
 		Err(err).
 		Msg("Tunnel disconnected")
 }
 
+func TunnelClosedByServer(reason string) {
+	log.Info().
+		Str("reason", reason).
+		Msg("Tunnel closed by server")
+}
+
+func TunnelTraffic(stats shared.TrafficStats) {
+	log.Info().
+		Int64("payload_bytes_sent", stats.PayloadWritten).
+		Int64("payload_bytes_received", stats.PayloadRead).
+		Int64("wire_bytes_sent", stats.WireWritten).
+		Int64("wire_bytes_received", stats.WireRead).
+		Int64("bytes_saved", stats.BytesSaved()).
+		Msg("Tunnel traffic")
+}
+
 func RequestReceived(requestID, method, path string) {
 	log.Debug().
 		Str("request_id", requestID).
@@ -58,6 +93,65 @@ func ForwardingToLocal(requestID, method, localURL string) {
 		Msg("Forwarding to local app")
 }
 
+func FaultInjected(requestID string, fault chaos.Fault) {
+	log.Info().
+		Str("request_id", requestID).
+		Dur("delay", fault.Delay).
+		Int("error_status", fault.ErrorStatus).
+		Bool("drop", fault.Drop).
+		Int64("throttle", fault.Throttle).
+		Msg("Injecting fault")
+}
+
+func WebhookVerified(requestID, scheme string) {
+	log.Info().
+		Str("request_id", requestID).
+		Str("scheme", scheme).
+		Msg("Webhook signature verified")
+}
+
+func WebhookVerificationFailed(requestID, scheme string, err error) {
+	log.Warn().
+		Err(err).
+		Str("request_id", requestID).
+		Str("scheme", scheme).
+		Msg("Webhook signature verification failed")
+}
+
+func WaitingForUpstream(destination string) {
+	log.Info().
+		Str("local_destination", destination).
+		Msg("Waiting for local app")
+}
+
+func UpstreamHealthChanged(healthy bool, err error) {
+	if healthy {
+		log.Info().Msg("Local app healthy")
+		return
+	}
+	log.Warn().
+		Err(err).
+		Msg("Local app unhealthy")
+}
+
+func UpstreamDown(destination string, retryIn time.Duration, err error) {
+	log.Warn().
+		Str("local_destination", destination).
+		Dur("retry_in", retryIn).
+		Err(err).
+		Msg("Skipping unreachable upstream")
+}
+
+func ChaosToggled(enabled bool) {
+	log.Info().
+		Bool("enabled", enabled).
+		Msg("Fault injection toggled")
+}
+
+func ChaosToggleIgnored() {
+	log.Warn().Msg("Ignoring fault injection toggle, the tunnel runs without --chaos")
+}
+
 func LocalRequestFailed(requestID string, err error) {
 	log.Error().
 		Err(err).
@@ -95,6 +189,38 @@ func ResponseSendFailed(requestID string, err error) {
 		Msg("Failed to send response to tunnel")
 }
 
+func DaemonListening(socketPath string) {
+	log.Info().
+		Str("socket", socketPath).
+		Msg("Daemon listening")
+}
+
+func DaemonTunnelStarted(name, publicURL string) {
+	log.Info().
+		Str("tunnel", name).
+		Str("public_url", publicURL).
+		Msg("Tunnel started")
+}
+
+func DaemonTunnelStopped(name string) {
+	log.Info().
+		Str("tunnel", name).
+		Msg("Tunnel stopped")
+}
+
+func DaemonTunnelExited(name string, err error) {
+	log.Warn().
+		Err(err).
+		Str("tunnel", name).
+		Msg("Tunnel exited")
+}
+
+func DaemonConnectionRejected(err error) {
+	log.Warn().
+		Err(err).
+		Msg("Control connection rejected")
+}
+
 func Error(msg string, err error) {
 	log.Error().
 		Err(err).
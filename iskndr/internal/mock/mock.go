@@ -0,0 +1,292 @@
+/*
+Package mock serves canned responses defined in YAML, for tunnels whose local application is down
+or doesn't exist yet.
+
+	# mocks.yaml
+	- request:
+	    method: GET
+	    path: /api/users/{id}
+	    headers:
+	      Authorization: Bearer demo
+	  response:
+	    status: 200
+	    headers:
+	      Content-Type: application/json
+	    body: '{"id": "{{.Params.id}}", "name": "Demo user"}'
+*/
+package mock
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Mock struct {
+	Request  Request  `yaml:"request"`
+	Response Response `yaml:"response"`
+}
+
+/* Request selects the requests a mock answers, empty fields match everything. */
+type Request struct {
+	Method string `yaml:"method"`
+	/*
+		Segments are globs as in path.Match, {name} captures a segment for the body template
+		and a trailing /** matches everything below the prefix.
+	*/
+	Path string `yaml:"path"`
+	/* Headers the request must carry with exactly these values. */
+	Headers map[string]string `yaml:"headers"`
+}
+
+type Response struct {
+	/* 200 when not set. */
+	Status  int               `yaml:"status"`
+	Headers map[string]string `yaml:"headers"`
+	/* Body and BodyFile are Go templates, see TemplateData. BodyFile is relative to the YAML file. */
+	Body     string `yaml:"body"`
+	BodyFile string `yaml:"body_file"`
+}
+
+/* TemplateData is what response bodies can refer to, e.g. {{.Params.id}} or {{.Query.Get "page"}}. */
+type TemplateData struct {
+	Method string
+	Path   string
+	Params map[string]string
+	Query  url.Values
+	Header http.Header
+	Body   string
+}
+
+type compiledMock struct {
+	method   string
+	segments []string
+	headers  http.Header
+	status   int
+	response http.Header
+	body     *template.Template
+}
+
+/* Handler answers requests with the first matching mock. */
+type Handler struct {
+	mocks []compiledMock
+}
+
+/*
+Load reads mocks from a YAML file, or from every .yaml and .yml file of a directory in
+lexical order. Earlier mocks win when several match a request.
+*/
+func Load(source string) (*Handler, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mocks: %w", err)
+	}
+
+	files := []string{source}
+	if info.IsDir() {
+		entries, err := os.ReadDir(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read mocks: %w", err)
+		}
+		files = files[:0]
+		for _, entry := range entries {
+			if ext := filepath.Ext(entry.Name()); !entry.IsDir() && (ext == ".yaml" || ext == ".yml") {
+				files = append(files, filepath.Join(source, entry.Name()))
+			}
+		}
+	}
+
+	h := &Handler{}
+	for _, file := range files {
+		mocks, err := loadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		h.mocks = append(h.mocks, mocks...)
+	}
+	if len(h.mocks) == 0 {
+		return nil, fmt.Errorf("no mocks found in %s", source)
+	}
+	return h, nil
+}
+
+func loadFile(file string) ([]compiledMock, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mocks: %w", err)
+	}
+
+	var mocks []Mock
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&mocks); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid mocks %s: %w", file, err)
+	}
+
+	compiled := make([]compiledMock, 0, len(mocks))
+	for idx, m := range mocks {
+		c, err := compile(m, filepath.Dir(file))
+		if err != nil {
+			return nil, fmt.Errorf("invalid mock %d in %s: %w", idx+1, file, err)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+func compile(m Mock, baseDir string) (compiledMock, error) {
+	if m.Request.Path != "" && !strings.HasPrefix(m.Request.Path, "/") {
+		return compiledMock{}, fmt.Errorf("path %q must start with '/'", m.Request.Path)
+	}
+	segments := strings.Split(strings.TrimPrefix(m.Request.Path, "/"), "/")
+	for idx, segment := range segments {
+		if segment == "**" && idx != len(segments)-1 {
+			return compiledMock{}, fmt.Errorf("path %q: ** is only allowed at the end", m.Request.Path)
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return compiledMock{}, fmt.Errorf("invalid path %q: %w", m.Request.Path, err)
+		}
+	}
+	if m.Request.Path == "" {
+		segments = []string{"**"}
+	}
+
+	status := m.Response.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if status < 100 || status > 599 {
+		return compiledMock{}, fmt.Errorf("invalid status %d", status)
+	}
+
+	body := m.Response.Body
+	if m.Response.BodyFile != "" {
+		if body != "" {
+			return compiledMock{}, errors.New("body and body_file are mutually exclusive")
+		}
+		bodyFile := m.Response.BodyFile
+		if !filepath.IsAbs(bodyFile) {
+			bodyFile = filepath.Join(baseDir, bodyFile)
+		}
+		data, err := os.ReadFile(bodyFile)
+		if err != nil {
+			return compiledMock{}, err
+		}
+		body = string(data)
+	}
+	bodyTemplate, err := template.New("body").Option("missingkey=zero").Parse(body)
+	if err != nil {
+		return compiledMock{}, fmt.Errorf("invalid body template: %w", err)
+	}
+
+	compiled := compiledMock{
+		method:   strings.ToUpper(m.Request.Method),
+		segments: segments,
+		headers:  http.Header{},
+		status:   status,
+		response: http.Header{},
+		body:     bodyTemplate,
+	}
+	for name, value := range m.Request.Headers {
+		compiled.headers.Set(name, value)
+	}
+	for name, value := range m.Response.Headers {
+		compiled.response.Set(name, value)
+	}
+	return compiled, nil
+}
+
+/* Reports whether the mock answers the request and the captured path parameters. */
+func (m *compiledMock) match(r *http.Request) (map[string]string, bool) {
+	if m.method != "" && m.method != r.Method {
+		return nil, false
+	}
+	for name, values := range m.headers {
+		if !slices.Contains(r.Header.Values(name), values[0]) {
+			return nil, false
+		}
+	}
+
+	params := map[string]string{}
+	requestSegments := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	for idx, segment := range m.segments {
+		if segment == "**" {
+			return params, true
+		}
+		if idx >= len(requestSegments) {
+			return nil, false
+		}
+		if name, ok := strings.CutPrefix(segment, "{"); ok && strings.HasSuffix(name, "}") {
+			params[strings.TrimSuffix(name, "}")] = requestSegments[idx]
+			continue
+		}
+		if ok, _ := path.Match(segment, requestSegments[idx]); !ok {
+			return nil, false
+		}
+	}
+	return params, len(requestSegments) == len(m.segments)
+}
+
+func (h *Handler) find(r *http.Request) (*compiledMock, map[string]string) {
+	for idx := range h.mocks {
+		if params, ok := h.mocks[idx].match(r); ok {
+			return &h.mocks[idx], params
+		}
+	}
+	return nil, nil
+}
+
+/* Matches reports whether a mock answers the request, the others get a 404 from ServeHTTP. */
+func (h *Handler) Matches(r *http.Request) bool {
+	m, _ := h.find(r)
+	return m != nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m, params := h.find(r)
+	if m == nil {
+		http.Error(w, "No mock matches "+r.Method+" "+r.URL.Path, http.StatusNotFound)
+		return
+	}
+
+	var requestBody []byte
+	if r.Body != nil {
+		requestBody, _ = io.ReadAll(r.Body)
+	}
+	data := TemplateData{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Params: params,
+		Query:  r.URL.Query(),
+		Header: r.Header,
+		Body:   string(requestBody),
+	}
+
+	var body bytes.Buffer
+	if err := m.body.Execute(&body, data); err != nil {
+		http.Error(w, "Mock body template failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for name, values := range m.response {
+		w.Header()[name] = values
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", http.DetectContentType(body.Bytes()))
+	}
+	w.WriteHeader(m.status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(body.Bytes())
+	}
+}
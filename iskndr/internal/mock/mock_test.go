@@ -0,0 +1,123 @@
+package mock
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testMocks = `
+- request:
+    method: GET
+    path: /api/users/{id}
+    headers:
+      Authorization: Bearer demo
+  response:
+    headers:
+      Content-Type: application/json
+    body: '{"id": "{{.Params.id}}", "page": "{{.Query.Get "page"}}"}'
+- request:
+    method: post
+    path: /api/echo
+  response:
+    status: 201
+    body: 'got {{.Body}}'
+- request:
+    path: /assets/**
+  response:
+    body_file: app.js
+`
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+	return file
+}
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestHandler(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "app.js", "console.log('{{.Path}}')")
+	handler, err := Load(writeFile(t, dir, "mocks.yaml", testMocks))
+	require.NoError(t, err)
+
+	t.Run("renders path parameters and the query", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/api/users/42?page=2", nil)
+		r.Header.Set("Authorization", "Bearer demo")
+
+		w := serve(handler, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		assert.Equal(t, `{"id": "42", "page": "2"}`, w.Body.String())
+	})
+
+	t.Run("requires the headers", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/api/users/42", nil)
+		assert.False(t, handler.Matches(r))
+		assert.Equal(t, http.StatusNotFound, serve(handler, r).Code)
+	})
+
+	t.Run("matches methods case-insensitively and renders the request body", func(t *testing.T) {
+		w := serve(handler, httptest.NewRequest("POST", "/api/echo", strings.NewReader("hello")))
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, "got hello", w.Body.String())
+
+		assert.False(t, handler.Matches(httptest.NewRequest("GET", "/api/echo", nil)))
+	})
+
+	t.Run("serves body files below a prefix", func(t *testing.T) {
+		assert.True(t, handler.Matches(httptest.NewRequest("GET", "/assets", nil)))
+		assert.False(t, handler.Matches(httptest.NewRequest("GET", "/assetsx", nil)))
+
+		w := serve(handler, httptest.NewRequest("GET", "/assets/js/app.js", nil))
+		assert.Equal(t, "console.log('/assets/js/app.js')", w.Body.String())
+		assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+	})
+}
+
+func TestLoad(t *testing.T) {
+	t.Run("reads the YAML files of a directory in order", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFile(t, dir, "b.yml", "- request: {path: /}\n  response: {body: second}\n")
+		writeFile(t, dir, "a.yaml", "- request: {path: /}\n  response: {body: first}\n")
+		writeFile(t, dir, "notes.txt", "not a mock")
+
+		handler, err := Load(dir)
+		require.NoError(t, err)
+		assert.Len(t, handler.mocks, 2)
+		assert.Equal(t, "first", serve(handler, httptest.NewRequest("GET", "/", nil)).Body.String())
+	})
+
+	t.Run("rejects invalid mocks", func(t *testing.T) {
+		dir := t.TempDir()
+		for name, content := range map[string]string{
+			"empty":           "",
+			"unknown field":   "- request: {path: /}\n  respond: {}\n",
+			"relative path":   "- request: {path: api}\n",
+			"bad glob":        "- request: {path: '/['}\n",
+			"inner **":        "- request: {path: '/**/x'}\n",
+			"status":          "- response: {status: 700}\n",
+			"bad template":    "- response: {body: '{{.Params'}\n",
+			"missing file":    "- response: {body_file: missing.json}\n",
+			"body and a file": "- response: {body: x, body_file: mocks.yaml}\n",
+		} {
+			_, err := Load(writeFile(t, dir, "mocks.yaml", content))
+			assert.Error(t, err, name)
+		}
+
+		_, err := Load(filepath.Join(dir, "missing"))
+		assert.Error(t, err)
+	})
+}
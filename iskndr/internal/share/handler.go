@@ -0,0 +1,135 @@
+package share
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+type Options struct {
+	Dir string
+	/* Serve index.html for paths that don't exist, for single page applications. */
+	SPAFallback bool
+	/* When both are set, requests need HTTP basic auth with these credentials. */
+	Username string
+	Password string
+}
+
+/*
+NewHandler serves a local directory with listings and range requests (through http.FileServer).
+Dotfiles are never served so sharing a project build doesn't leak .git or .env contents.
+*/
+func NewHandler(opts Options) (http.Handler, error) {
+	info, err := os.Stat(opts.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot share directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("cannot share %s: not a directory", opts.Dir)
+	}
+
+	root := os.DirFS(opts.Dir)
+	fileServer := http.FileServerFS(hiddenDotfilesFS{root})
+
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if hasDotfileSegment(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+
+		if opts.SPAFallback && !exists(root, r.URL.Path) {
+			r = r.Clone(r.Context())
+			r.URL.Path = "/"
+		}
+
+		fileServer.ServeHTTP(w, r)
+	})
+
+	if opts.Username != "" && opts.Password != "" {
+		handler = basicAuth(handler, opts.Username, opts.Password)
+	}
+
+	return handler, nil
+}
+
+func basicAuth(next http.Handler, username, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		userMatch := subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1
+		passMatch := subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+		if !ok || !userMatch || !passMatch {
+			w.Header().Set("WWW-Authenticate", `Basic realm="iskndr share", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func exists(root fs.FS, urlPath string) bool {
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		return true
+	}
+	_, err := fs.Stat(root, name)
+	return !errors.Is(err, fs.ErrNotExist)
+}
+
+func hasDotfileSegment(urlPath string) bool {
+	for _, segment := range strings.Split(urlPath, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+/* Hides dotfiles from directory listings as well. */
+type hiddenDotfilesFS struct {
+	fs.FS
+}
+
+func (h hiddenDotfilesFS) Open(name string) (fs.File, error) {
+	if hasDotfileSegment(name) && name != "." {
+		return nil, fs.ErrNotExist
+	}
+	file, err := h.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if dir, ok := file.(fs.ReadDirFile); ok && info.IsDir() {
+		return hiddenDotfilesDir{dir}, nil
+	}
+	return file, nil
+}
+
+type hiddenDotfilesDir struct {
+	fs.ReadDirFile
+}
+
+func (d hiddenDotfilesDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, err := d.ReadDirFile.ReadDir(n)
+	visible := entries[:0]
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), ".") {
+			visible = append(visible, entry)
+		}
+	}
+	return visible, err
+}
@@ -0,0 +1,128 @@
+package share
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createShareDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>index</h1>"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "report.txt"), []byte("0123456789"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".env"), []byte("SECRET=1"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "assets"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "assets", "app.js"), []byte("console.log(1)"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "assets", ".hidden"), []byte("hidden"), 0o644))
+	return dir
+}
+
+func serve(t *testing.T, handler http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestNewHandler(t *testing.T) {
+	t.Run("returns error for missing directory", func(t *testing.T) {
+		_, err := NewHandler(Options{Dir: filepath.Join(t.TempDir(), "missing")})
+		assert.Error(t, err)
+	})
+
+	t.Run("returns error for a file", func(t *testing.T) {
+		dir := createShareDir(t)
+		_, err := NewHandler(Options{Dir: filepath.Join(dir, "report.txt")})
+		assert.Error(t, err)
+	})
+
+	t.Run("serves files and directory listings", func(t *testing.T) {
+		handler, err := NewHandler(Options{Dir: createShareDir(t)})
+		require.NoError(t, err)
+
+		rec := serve(t, handler, httptest.NewRequest("GET", "/report.txt", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "0123456789", rec.Body.String())
+
+		rec = serve(t, handler, httptest.NewRequest("GET", "/assets/", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "app.js")
+		assert.NotContains(t, rec.Body.String(), ".hidden")
+	})
+
+	t.Run("supports range requests", func(t *testing.T) {
+		handler, err := NewHandler(Options{Dir: createShareDir(t)})
+		require.NoError(t, err)
+
+		req := httptest.NewRequest("GET", "/report.txt", nil)
+		req.Header.Set("Range", "bytes=2-5")
+		rec := serve(t, handler, req)
+
+		assert.Equal(t, http.StatusPartialContent, rec.Code)
+		assert.Equal(t, "2345", rec.Body.String())
+	})
+
+	t.Run("never serves dotfiles", func(t *testing.T) {
+		handler, err := NewHandler(Options{Dir: createShareDir(t), SPAFallback: true})
+		require.NoError(t, err)
+
+		rec := serve(t, handler, httptest.NewRequest("GET", "/.env", nil))
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+
+		rec = serve(t, handler, httptest.NewRequest("GET", "/assets/.hidden", nil))
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("returns 404 for missing files without SPA fallback", func(t *testing.T) {
+		handler, err := NewHandler(Options{Dir: createShareDir(t)})
+		require.NoError(t, err)
+
+		rec := serve(t, handler, httptest.NewRequest("GET", "/dashboard/settings", nil))
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("falls back to index.html with SPA fallback", func(t *testing.T) {
+		handler, err := NewHandler(Options{Dir: createShareDir(t), SPAFallback: true})
+		require.NoError(t, err)
+
+		rec := serve(t, handler, httptest.NewRequest("GET", "/dashboard/settings", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "<h1>index</h1>", rec.Body.String())
+
+		rec = serve(t, handler, httptest.NewRequest("GET", "/assets/app.js", nil))
+		assert.Equal(t, "console.log(1)", rec.Body.String())
+	})
+
+	t.Run("rejects write methods", func(t *testing.T) {
+		handler, err := NewHandler(Options{Dir: createShareDir(t)})
+		require.NoError(t, err)
+
+		rec := serve(t, handler, httptest.NewRequest("POST", "/report.txt", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	})
+
+	t.Run("requires basic auth when configured", func(t *testing.T) {
+		handler, err := NewHandler(Options{Dir: createShareDir(t), Username: "demo", Password: "s3cret"})
+		require.NoError(t, err)
+
+		rec := serve(t, handler, httptest.NewRequest("GET", "/report.txt", nil))
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.Contains(t, rec.Header().Get("WWW-Authenticate"), "Basic")
+
+		req := httptest.NewRequest("GET", "/report.txt", nil)
+		req.SetBasicAuth("demo", "wrong")
+		rec = serve(t, handler, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+		req = httptest.NewRequest("GET", "/report.txt", nil)
+		req.SetBasicAuth("demo", "s3cret")
+		rec = serve(t, handler, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+}
@@ -2,9 +2,13 @@ package ui
 
 import (
 	"fmt"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/igneel64/iskandar/iskndr/internal/chaos"
+	"github.com/igneel64/iskandar/iskndr/internal/logger"
+	"github.com/igneel64/iskandar/shared/protocol"
 )
 
 var (
@@ -22,6 +26,9 @@ var (
 	successStyle = lipgloss.NewStyle().
 			Foreground(lipgloss.Color("46"))
 
+	failureStyle = lipgloss.NewStyle().
+			Foreground(lipgloss.Color("196"))
+
 	urlStyle = lipgloss.NewStyle().
 			Foreground(lipgloss.Color("86")).
 			Bold(true)
@@ -43,6 +50,19 @@ type Model struct {
 	LocalDestination string
 	PublicURL        string
 	ServerURL        string
+	ExpiresAt        time.Time
+	/* Fault injection, toggled with the c key. Nil when the tunnel runs without --chaos. */
+	Chaos *chaos.Injector
+	/* Result of the health checks, empty without --health-path. */
+	Health string
+}
+
+/* ChaosMsg redraws the fault injection status after it was toggled by a signal. */
+type ChaosMsg struct{}
+
+/* HealthMsg updates the health shown, sent by the health checks. */
+type HealthMsg struct {
+	Health string
 }
 
 func NewModel() Model {
@@ -55,9 +75,16 @@ func (m Model) Init() tea.Cmd {
 
 func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
+	case HealthMsg:
+		m.Health = msg.Health
 	case tea.KeyMsg:
-		if msg.String() == "ctrl+c" {
+		switch msg.String() {
+		case "ctrl+c":
 			return m, tea.Quit
+		case "c":
+			if m.Chaos != nil {
+				logger.ChaosToggled(m.Chaos.Toggle())
+			}
 		}
 	}
 	return m, nil
@@ -75,6 +102,31 @@ func (m Model) View() string {
 	s += fmt.Sprintf("%s %s\n",
 		labelStyle.Render("Tunnel Server "),
 		valueStyle.Render(m.ServerURL))
+	if !m.ExpiresAt.IsZero() {
+		s += fmt.Sprintf("%s %s\n",
+			labelStyle.Render("Expires       "),
+			valueStyle.Render(m.ExpiresAt.Format("Jan 2 15:04")))
+	}
+
+	if m.Health != "" {
+		style := successStyle
+		if m.Health != protocol.HealthHealthy {
+			style = failureStyle
+		}
+		s += fmt.Sprintf("%s %s\n",
+			labelStyle.Render("Local App     "),
+			style.Render(m.Health))
+	}
+
+	if m.Chaos != nil {
+		chaosStatus := "off"
+		if m.Chaos.Enabled() {
+			chaosStatus = "on"
+		}
+		s += fmt.Sprintf("%s %s\n",
+			labelStyle.Render("Chaos         "),
+			valueStyle.Render(chaosStatus+" (press c to toggle)"))
+	}
 
 	s += "\n" + subtitleStyle.Render("Forwarding") + "\n"
 	s += fmt.Sprintf("%s -> %s\n",
@@ -86,13 +138,16 @@ func (m Model) View() string {
 	return s
 }
 
-func InitUi(destinationAddress, serverUrl, subdomain, version string) *tea.Program {
+/* A zero expiresAt means the tunnel doesn't expire, a nil chaos injector hides the fault injection status. */
+func InitUi(destinationAddress, serverUrl, subdomain, version string, expiresAt time.Time, chaos *chaos.Injector) *tea.Program {
 	model := NewModel()
 	model.Status = "online"
 	model.Version = version
 	model.LocalDestination = destinationAddress
 	model.PublicURL = subdomain
 	model.ServerURL = serverUrl
+	model.ExpiresAt = expiresAt
+	model.Chaos = chaos
 
 	program := tea.NewProgram(model)
 	go func() {
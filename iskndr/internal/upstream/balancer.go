@@ -0,0 +1,294 @@
+package upstream
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Strategies spreading the requests of the default route over its destinations. */
+const (
+	StrategyRoundRobin = "round-robin"
+	/* The destination with the fewest requests in flight, open streams included. */
+	StrategyLeastConn = "least-conn"
+	/* Round robin in proportion to the weights, interleaved rather than in bursts. */
+	StrategyWeighted = "weighted"
+)
+
+/* Cookie keeping a visitor on the destination that answered their first request. */
+const StickyCookie = "iskndr_upstream"
+
+const (
+	DefaultMaxFails    = 1
+	DefaultFailTimeout = 10 * time.Second
+)
+
+/* Backend is a destination sharing the requests of the default route with the default destination. */
+type Backend struct {
+	Destination Destination
+	/* Share of the requests with StrategyWeighted, zero counts as 1. */
+	Weight int
+}
+
+type BalanceOptions struct {
+	/* One of the Strategy constants, empty is StrategyRoundRobin. */
+	Strategy string
+	/* Pins each visitor to a destination with StickyCookie while it is up. */
+	Sticky bool
+	/* Failed requests in a row after which a destination is skipped for FailTimeout, zero uses DefaultMaxFails. */
+	MaxFails int
+	/* Zero uses DefaultFailTimeout. */
+	FailTimeout time.Duration
+	/* Called when a destination starts being skipped, e.g. to log it. */
+	OnDown func(destination Destination, err error)
+}
+
+type backend struct {
+	index       int
+	destination Destination
+	scheme      string
+	host        string
+	weight      int
+	transport   http.RoundTripper
+	/* Value of StickyCookie for this destination and the Set-Cookie header pinning a visitor to it. */
+	id        string
+	setCookie string
+
+	/* Guarded by the balancer. */
+	inFlight  int
+	fails     int
+	downUntil time.Time
+	current   int
+}
+
+/*
+balancer sends each request to one destination of a pool. Destinations that fail MaxFails times in a row are
+skipped for FailTimeout, and a request whose connection is refused is retried on the next destination.
+*/
+type balancer struct {
+	backends []*backend
+	opts     BalanceOptions
+	/* Send each destination its own Host, as HostHeaderRewrite does for the default destination. */
+	rewriteHost bool
+
+	mu   sync.Mutex
+	next int
+}
+
+func newBalancer(backends []Backend, transportOpts TransportOptions, opts BalanceOptions, rewriteHost bool) *balancer {
+	if opts.MaxFails == 0 {
+		opts.MaxFails = DefaultMaxFails
+	}
+	if opts.FailTimeout == 0 {
+		opts.FailTimeout = DefaultFailTimeout
+	}
+
+	b := &balancer{opts: opts, rewriteHost: rewriteHost}
+	for i, pooled := range backends {
+		be := &backend{index: i, destination: pooled.Destination, weight: max(pooled.Weight, 1)}
+		be.scheme, be.host, _ = strings.Cut(pooled.Destination.URL, "://")
+		if pooled.Destination.Handler != nil {
+			be.transport = &handlerTransport{handler: pooled.Destination.Handler}
+		} else {
+			be.transport = newTransport(pooled.Destination, transportOpts)
+		}
+
+		hash := fnv.New32a()
+		_, _ = hash.Write([]byte(pooled.Destination.String()))
+		be.id = fmt.Sprintf("%08x", hash.Sum32())
+		be.setCookie = (&http.Cookie{Name: StickyCookie, Value: be.id, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode}).String()
+
+		b.backends = append(b.backends, be)
+	}
+	return b
+}
+
+func (b *balancer) RoundTrip(req *http.Request) (*http.Response, error) {
+	pinned := b.pinned(req)
+	tried := make([]bool, len(b.backends))
+
+	var lastErr error
+	for range b.backends {
+		be := b.pick(pinned, tried)
+		tried[be.index] = true
+
+		routed := req.Clone(req.Context())
+		routed.URL.Scheme, routed.URL.Host = be.scheme, be.host
+		if b.rewriteHost {
+			routed.Host = be.host
+		}
+		if b.opts.Sticky {
+			removeCookie(routed.Header, StickyCookie)
+		}
+		res, err := be.transport.RoundTrip(routed)
+		if err == nil {
+			b.succeeded(be)
+			res.Body = &releasingBody{ReadCloser: res.Body, release: func() { b.release(be) }}
+			if b.opts.Sticky && be != pinned {
+				res.Header.Add("Set-Cookie", be.setCookie)
+			}
+			return res, nil
+		}
+
+		b.failed(be, req, err)
+		if !isDialError(err) {
+			return nil, err
+		}
+		lastErr = err
+		if req, err = rewind(req); err != nil {
+			return nil, lastErr
+		}
+	}
+	return nil, lastErr
+}
+
+/* pinned returns the destination the visitor's StickyCookie points to. */
+func (b *balancer) pinned(req *http.Request) *backend {
+	if !b.opts.Sticky {
+		return nil
+	}
+	cookie, err := req.Cookie(StickyCookie)
+	if err != nil {
+		return nil
+	}
+	for _, be := range b.backends {
+		if be.id == cookie.Value {
+			return be
+		}
+	}
+	return nil
+}
+
+/* pick chooses an untried destination, skipping the ones that are down unless all of them are. */
+func (b *balancer) pick(pinned *backend, tried []bool) *backend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	var chosen *backend
+	if pinned != nil && !tried[pinned.index] && !pinned.downUntil.After(now) {
+		chosen = pinned
+	} else {
+		var candidates, untried []*backend
+		for _, be := range b.backends {
+			if tried[be.index] {
+				continue
+			}
+			untried = append(untried, be)
+			if !be.downUntil.After(now) {
+				candidates = append(candidates, be)
+			}
+		}
+		if len(candidates) == 0 {
+			candidates = untried
+		}
+		chosen = b.choose(candidates)
+	}
+
+	chosen.inFlight++
+	return chosen
+}
+
+func (b *balancer) choose(candidates []*backend) *backend {
+	switch b.opts.Strategy {
+	case StrategyLeastConn:
+		/* Ties rotate like round robin, otherwise an idle pool would always start with the same destination. */
+		start := b.next % len(candidates)
+		b.next++
+		chosen := candidates[start]
+		for i := 1; i < len(candidates); i++ {
+			if be := candidates[(start+i)%len(candidates)]; be.inFlight < chosen.inFlight {
+				chosen = be
+			}
+		}
+		return chosen
+	case StrategyWeighted:
+		/* Smooth weighted round robin: 5,1,1 goes a a b a c a a instead of a a a a a b c. */
+		var chosen *backend
+		total := 0
+		for _, be := range candidates {
+			be.current += be.weight
+			total += be.weight
+			if chosen == nil || be.current > chosen.current {
+				chosen = be
+			}
+		}
+		chosen.current -= total
+		return chosen
+	default:
+		chosen := candidates[b.next%len(candidates)]
+		b.next++
+		return chosen
+	}
+}
+
+func (b *balancer) succeeded(be *backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	be.fails = 0
+	be.downUntil = time.Time{}
+}
+
+func (b *balancer) release(be *backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	be.inFlight--
+}
+
+func (b *balancer) failed(be *backend, req *http.Request, err error) {
+	b.mu.Lock()
+	be.inFlight--
+	/* A public client that went away says nothing about the destination. */
+	if req.Context().Err() != nil {
+		b.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	wasDown := be.downUntil.After(now)
+	be.fails++
+	down := be.fails >= b.opts.MaxFails
+	if down {
+		be.fails = 0
+		be.downUntil = now.Add(b.opts.FailTimeout)
+	}
+	b.mu.Unlock()
+
+	if down && !wasDown && b.opts.OnDown != nil {
+		b.opts.OnDown(be.destination, err)
+	}
+}
+
+/* removeCookie drops a cookie of the balancer from the Cookie headers, the destinations have no use for it. */
+func removeCookie(header http.Header, name string) {
+	lines := header.Values("Cookie")
+	header.Del("Cookie")
+	for _, line := range lines {
+		var kept []string
+		for _, pair := range strings.Split(line, ";") {
+			pair = strings.TrimSpace(pair)
+			if cookieName, _, _ := strings.Cut(pair, "="); pair != "" && cookieName != name {
+				kept = append(kept, pair)
+			}
+		}
+		if len(kept) > 0 {
+			header.Add("Cookie", strings.Join(kept, "; "))
+		}
+	}
+}
+
+/* releasingBody counts a request as in flight until its response body is closed. */
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *releasingBody) Close() error {
+	r.once.Do(r.release)
+	return r.ReadCloser.Close()
+}
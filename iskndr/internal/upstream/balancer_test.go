@@ -0,0 +1,213 @@
+package upstream
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/* Answers every request with its name and the request body. */
+func newNamedDestination(t *testing.T, name string) Destination {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write([]byte(name + string(body)))
+	}))
+	t.Cleanup(server.Close)
+	return Destination{URL: server.URL}
+}
+
+/* Answers every request with the Host and Cookie headers it received. */
+func newEchoDestination(t *testing.T) (Destination, string) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Host + "|" + r.Header.Get("Cookie")))
+	}))
+	t.Cleanup(server.Close)
+	return Destination{URL: server.URL}, strings.TrimPrefix(server.URL, "http://")
+}
+
+func newDownDestination(t *testing.T) Destination {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, listener.Close())
+	return Destination{URL: "http://" + listener.Addr().String()}
+}
+
+/* Sends a request through the mapper's default route and returns the body. */
+func balancedRequest(t *testing.T, mapper *Mapper, cookies ...*http.Cookie) (string, *http.Response) {
+	t.Helper()
+	return balancedRequestWithHost(t, mapper, "", cookies...)
+}
+
+/* Sends a request with the Host the client would set for publicHost, like the tunnel client does. */
+func balancedRequestWithHost(t *testing.T, mapper *Mapper, publicHost string, cookies ...*http.Cookie) (string, *http.Response) {
+	t.Helper()
+	target := mapper.Resolve("/")
+	req, err := http.NewRequest(http.MethodPost, target.URL, strings.NewReader("!"))
+	require.NoError(t, err)
+	if host := mapper.Host(publicHost); host != "" {
+		req.Host = host
+	}
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	res, err := target.Client.Do(req)
+	require.NoError(t, err)
+	//nolint:errcheck
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return string(body), res
+}
+
+func TestBalancer(t *testing.T) {
+	a, b, c := newNamedDestination(t, "a"), newNamedDestination(t, "b"), newNamedDestination(t, "c")
+
+	t.Run("round robin", func(t *testing.T) {
+		mapper := NewMapper(a, Options{Backends: []Backend{{Destination: b}, {Destination: c}}})
+		var got []string
+		for range 6 {
+			body, _ := balancedRequest(t, mapper)
+			got = append(got, body)
+		}
+		assert.Equal(t, []string{"a!", "b!", "c!", "a!", "b!", "c!"}, got)
+	})
+
+	t.Run("weighted", func(t *testing.T) {
+		mapper := NewMapper(a, Options{
+			Backends: []Backend{{Destination: b, Weight: 5}, {Destination: c}},
+			Balance:  BalanceOptions{Strategy: StrategyWeighted},
+		})
+		var got []string
+		for range 7 {
+			body, _ := balancedRequest(t, mapper)
+			got = append(got, strings.TrimSuffix(body, "!"))
+		}
+		assert.Equal(t, []string{"b", "b", "a", "b", "c", "b", "b"}, got)
+	})
+
+	t.Run("least connections", func(t *testing.T) {
+		release := make(chan struct{})
+		busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-release
+		}))
+		defer busy.Close()
+		defer close(release)
+
+		mapper := NewMapper(Destination{URL: busy.URL}, Options{
+			Backends: []Backend{{Destination: b}},
+			Balance:  BalanceOptions{Strategy: StrategyLeastConn},
+		})
+
+		/* The stream keeps the busy destination occupied until its body is closed. */
+		target := mapper.Resolve("/")
+		stream, err := target.Client.Get(target.URL)
+		require.NoError(t, err)
+		for range 3 {
+			body, _ := balancedRequest(t, mapper)
+			assert.Equal(t, "b!", body)
+		}
+		require.NoError(t, stream.Body.Close())
+	})
+
+	t.Run("skips a destination that is down", func(t *testing.T) {
+		var downs []string
+		mapper := NewMapper(newDownDestination(t), Options{
+			Backends: []Backend{{Destination: b}},
+			Balance: BalanceOptions{OnDown: func(destination Destination, err error) {
+				downs = append(downs, destination.URL)
+				assert.True(t, isDialError(err))
+			}},
+		})
+
+		for range 4 {
+			body, _ := balancedRequest(t, mapper)
+			assert.Equal(t, "b!", body, "the request and its body are retried on the next destination")
+		}
+		assert.Len(t, downs, 1)
+	})
+
+	t.Run("tries destinations that are down when all of them are", func(t *testing.T) {
+		mapper := NewMapper(newDownDestination(t), Options{
+			Backends: []Backend{{Destination: newDownDestination(t)}},
+			Balance:  BalanceOptions{FailTimeout: time.Hour},
+		})
+		for range 2 {
+			target := mapper.Resolve("/")
+			_, err := target.Client.Get(target.URL)
+			assert.True(t, isDialError(err))
+		}
+	})
+
+	t.Run("sticky sessions", func(t *testing.T) {
+		down := newDownDestination(t)
+		mapper := NewMapper(a, Options{
+			Backends: []Backend{{Destination: b}, {Destination: down}},
+			Balance:  BalanceOptions{Sticky: true},
+		})
+
+		_, first := balancedRequest(t, mapper)
+		cookies := first.Cookies()
+		require.Len(t, cookies, 1)
+		assert.Equal(t, StickyCookie, cookies[0].Name)
+
+		for range 3 {
+			body, res := balancedRequest(t, mapper, cookies[0])
+			assert.Equal(t, "a!", body)
+			assert.Empty(t, res.Cookies(), "the visitor is pinned already")
+		}
+
+		/* A visitor pinned to a destination that went down moves to another one. */
+		pinnedDown := &http.Cookie{Name: StickyCookie, Value: mapper.routes[0].client.Transport.(*balancer).backends[2].id}
+		body, res := balancedRequest(t, mapper, pinnedDown)
+		assert.Contains(t, []string{"a!", "b!"}, body)
+		require.Len(t, res.Cookies(), 1)
+		assert.NotEqual(t, pinnedDown.Value, res.Cookies()[0].Value)
+	})
+
+	t.Run("sends each destination its own Host when rewriting", func(t *testing.T) {
+		echoA, hostA := newEchoDestination(t)
+		echoB, hostB := newEchoDestination(t)
+
+		for _, hostHeader := range []string{"", HostHeaderRewrite} {
+			mapper := NewMapper(echoA, Options{HostHeader: hostHeader, Backends: []Backend{{Destination: echoB}}})
+			var got []string
+			for range 2 {
+				body, _ := balancedRequestWithHost(t, mapper, "abc.tunnel.example.com")
+				got = append(got, body)
+			}
+			assert.Equal(t, []string{hostA + "|", hostB + "|"}, got)
+		}
+
+		for hostHeader, want := range map[string]string{HostHeaderPreserve: "abc.tunnel.example.com", "app.test": "app.test"} {
+			mapper := NewMapper(echoA, Options{HostHeader: hostHeader, Backends: []Backend{{Destination: echoB}}})
+			for range 2 {
+				body, _ := balancedRequestWithHost(t, mapper, "abc.tunnel.example.com")
+				assert.Equal(t, want+"|", body)
+			}
+		}
+	})
+
+	t.Run("keeps the sticky cookie from the destinations", func(t *testing.T) {
+		echo, host := newEchoDestination(t)
+		mapper := NewMapper(echo, Options{Backends: []Backend{{Destination: echo}}, Balance: BalanceOptions{Sticky: true}})
+		pinned := &http.Cookie{Name: StickyCookie, Value: mapper.routes[0].client.Transport.(*balancer).backends[0].id}
+
+		body, _ := balancedRequest(t, mapper, &http.Cookie{Name: "session", Value: "1"}, pinned, &http.Cookie{Name: "theme", Value: "dark"})
+		assert.Equal(t, host+"|session=1; theme=dark", body)
+
+		body, _ = balancedRequest(t, mapper, pinned)
+		assert.Equal(t, host+"|", body)
+	})
+}
@@ -0,0 +1,32 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+/* A local service requests are forwarded to. */
+type Destination struct {
+	/* Scheme and host used to build request URLs, e.g. https://localhost:8443. */
+	URL string
+	/* When set, connections are made to this Unix socket instead of the URL host. */
+	SocketPath string
+	/* When set, requests are served in-process by this handler instead of going over the network. */
+	Handler http.Handler
+	/* When set, connections are obtained from this function, e.g. in-memory pipes of an embedded listener. */
+	Dial func(ctx context.Context) (net.Conn, error)
+}
+
+func (d Destination) String() string {
+	if d.Handler != nil {
+		return "in-process handler"
+	}
+	if d.Dial != nil {
+		return "in-process listener"
+	}
+	if d.SocketPath != "" {
+		return "unix://" + d.SocketPath
+	}
+	return d.URL
+}
@@ -0,0 +1,95 @@
+package upstream
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+/*
+handlerTransport serves requests with an in-process http.Handler instead of a network call,
+so features like `iskndr share` reuse the same forwarding path as real destinations.
+The body is streamed through a pipe, letting handlers flush partial responses.
+*/
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (t *handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	bodyReader, bodyWriter := io.Pipe()
+	rw := &pipeResponseWriter{
+		header: http.Header{},
+		body:   bodyWriter,
+		ready:  make(chan struct{}),
+	}
+
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				rw.fail(fmt.Errorf("handler panic: %v", v))
+				return
+			}
+			rw.WriteHeader(http.StatusOK)
+			_ = bodyWriter.Close()
+		}()
+		t.handler.ServeHTTP(rw, req)
+	}()
+
+	<-rw.ready
+	if rw.err != nil {
+		return nil, rw.err
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", rw.status, http.StatusText(rw.status)),
+		StatusCode:    rw.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rw.sentHeader,
+		Body:          bodyReader,
+		ContentLength: -1,
+		Request:       req,
+	}, nil
+}
+
+type pipeResponseWriter struct {
+	header     http.Header
+	sentHeader http.Header
+	body       *io.PipeWriter
+	status     int
+	err        error
+	once       sync.Once
+	ready      chan struct{}
+}
+
+func (w *pipeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *pipeResponseWriter) WriteHeader(status int) {
+	w.once.Do(func() {
+		w.status = status
+		w.sentHeader = w.header.Clone()
+		close(w.ready)
+	})
+}
+
+func (w *pipeResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+/* Every write already reaches the reader, nothing is buffered. */
+func (w *pipeResponseWriter) Flush() {
+	w.WriteHeader(http.StatusOK)
+}
+
+func (w *pipeResponseWriter) fail(err error) {
+	w.once.Do(func() {
+		w.err = err
+		close(w.ready)
+	})
+	_ = w.body.CloseWithError(err)
+}
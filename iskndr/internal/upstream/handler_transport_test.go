@@ -0,0 +1,103 @@
+package upstream
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlerTransport(t *testing.T) {
+	t.Run("returns the handler response", func(t *testing.T) {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte("created " + r.URL.Path))
+		})
+
+		client := newClient(Destination{URL: "http://localhost", Handler: handler}, TransportOptions{}, nil)
+		res, err := client.Get("http://localhost/items")
+		require.NoError(t, err)
+		//nolint:errcheck
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+		assert.Equal(t, "text/plain", res.Header.Get("Content-Type"))
+		assert.Equal(t, "created /items", string(body))
+	})
+
+	t.Run("defaults to 200 when the handler writes nothing", func(t *testing.T) {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+		client := newClient(Destination{URL: "http://localhost", Handler: handler}, TransportOptions{}, nil)
+		res, err := client.Get("http://localhost/")
+		require.NoError(t, err)
+		//nolint:errcheck
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	})
+
+	t.Run("streams flushed chunks before the handler returns", func(t *testing.T) {
+		release := make(chan struct{})
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("first"))
+			w.(http.Flusher).Flush()
+			<-release
+			_, _ = w.Write([]byte("second"))
+		})
+
+		client := newClient(Destination{URL: "http://localhost", Handler: handler}, TransportOptions{}, nil)
+		res, err := client.Get("http://localhost/")
+		require.NoError(t, err)
+		//nolint:errcheck
+		defer res.Body.Close()
+
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(res.Body, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "first", string(buf))
+
+		close(release)
+		rest, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "second", string(rest))
+	})
+
+	t.Run("returns an error when the handler panics before responding", func(t *testing.T) {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		})
+
+		client := newClient(Destination{URL: "http://localhost", Handler: handler}, TransportOptions{}, nil)
+		_, err := client.Get("http://localhost/")
+		assert.Error(t, err)
+	})
+
+	t.Run("unblocks the handler when the body is closed early", func(t *testing.T) {
+		done := make(chan struct{})
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer close(done)
+			for {
+				if _, err := w.Write([]byte("data")); err != nil {
+					return
+				}
+			}
+		})
+
+		client := newClient(Destination{URL: "http://localhost", Handler: handler}, TransportOptions{}, nil)
+		res, err := client.Get("http://localhost/")
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("handler still blocked after body was closed")
+		}
+	})
+}
@@ -0,0 +1,159 @@
+package upstream
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+/* Host header modes, any other value is sent as a literal Host. */
+const (
+	HostHeaderRewrite  = "rewrite"
+	HostHeaderPreserve = "preserve"
+)
+
+type Route struct {
+	PathPrefix  string
+	Destination Destination
+}
+
+type Options struct {
+	/* Additional path prefix routes, the default destination serves everything else. */
+	Routes      []Route
+	StripPrefix string
+	AddPrefix   string
+	HostHeader  string
+	Transport   TransportOptions
+	/* Serves requests when their destination can't be reached, nil returns the error. */
+	Fallback Fallback
+	/* More destinations the default route is balanced over, the default destination counts with weight 1. */
+	Backends []Backend
+	Balance  BalanceOptions
+}
+
+/* Target is where a single request should be sent. */
+type Target struct {
+	URL    string
+	Client *http.Client
+}
+
+type route struct {
+	pathPrefix  string
+	destination Destination
+	client      *http.Client
+}
+
+/* Mapper decides which local destination, path and Host a tunnelled request is sent with. */
+type Mapper struct {
+	routes      []route
+	stripPrefix string
+	addPrefix   string
+	hostHeader  string
+	/* The destinations of the default route with plain clients, for health checks. */
+	probes []route
+}
+
+func NewMapper(defaultDestination Destination, opts Options) *Mapper {
+	routes := make([]route, 0, len(opts.Routes)+1)
+	for _, r := range opts.Routes {
+		routes = append(routes, route{
+			pathPrefix:  r.PathPrefix,
+			destination: r.Destination,
+			client:      newClient(r.Destination, opts.Transport, opts.Fallback),
+		})
+	}
+
+	var defaultClient *http.Client
+	if len(opts.Backends) > 0 {
+		pool := append([]Backend{{Destination: defaultDestination}}, opts.Backends...)
+		rewriteHost := opts.HostHeader == "" || opts.HostHeader == HostHeaderRewrite
+		defaultClient = wrapTransport(newBalancer(pool, opts.Transport, opts.Balance, rewriteHost), opts.Fallback)
+	} else {
+		defaultClient = newClient(defaultDestination, opts.Transport, opts.Fallback)
+	}
+	routes = append(routes, route{pathPrefix: "/", destination: defaultDestination, client: defaultClient})
+
+	probes := []route{{destination: defaultDestination, client: newClient(defaultDestination, opts.Transport, nil)}}
+	for _, backend := range opts.Backends {
+		probes = append(probes, route{destination: backend.Destination, client: newClient(backend.Destination, opts.Transport, nil)})
+	}
+
+	/* Longest prefix wins, the default route always matches last. */
+	sort.SliceStable(routes, func(a, b int) bool {
+		return len(routes[a].pathPrefix) > len(routes[b].pathPrefix)
+	})
+
+	return &Mapper{
+		routes:      routes,
+		stripPrefix: strings.TrimSuffix(opts.StripPrefix, "/"),
+		addPrefix:   strings.TrimSuffix(opts.AddPrefix, "/"),
+		hostHeader:  opts.HostHeader,
+		probes:      probes,
+	}
+}
+
+/*
+HealthTargets returns a target for path on the default destination and each of its backends. They are
+requested directly: without the path prefixes, the balancer or the fallback, which would answer for a
+destination that is down.
+*/
+func (m *Mapper) HealthTargets(path string) []Target {
+	targets := make([]Target, 0, len(m.probes))
+	for _, probe := range m.probes {
+		targets = append(targets, Target{URL: probe.destination.URL + path, Client: probe.client})
+	}
+	return targets
+}
+
+/* Resolve returns the local target for a public request URI (path and query). */
+func (m *Mapper) Resolve(requestURI string) Target {
+	path, query, hasQuery := strings.Cut(requestURI, "?")
+
+	matched := m.routes[len(m.routes)-1]
+	for _, r := range m.routes {
+		if hasPathPrefix(path, r.pathPrefix) {
+			matched = r
+			break
+		}
+	}
+
+	if m.stripPrefix != "" && hasPathPrefix(path, m.stripPrefix) {
+		path = strings.TrimPrefix(path, m.stripPrefix)
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+	}
+	if m.addPrefix != "" {
+		path = m.addPrefix + path
+	}
+
+	url := matched.destination.URL + path
+	if hasQuery {
+		url += "?" + query
+	}
+
+	return Target{URL: url, Client: matched.client}
+}
+
+/* Host returns the Host to send upstream, empty means the one of the local destination. */
+func (m *Mapper) Host(publicHost string) string {
+	switch m.hostHeader {
+	case "", HostHeaderRewrite:
+		return ""
+	case HostHeaderPreserve:
+		return publicHost
+	default:
+		return m.hostHeader
+	}
+}
+
+func hasPathPrefix(path, prefix string) bool {
+	if prefix == "" || prefix == "/" {
+		return true
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || path[len(prefix)] == '/'
+}
@@ -0,0 +1,96 @@
+package upstream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMapperResolve(t *testing.T) {
+	tests := []struct {
+		name        string
+		routes      []Route
+		stripPrefix string
+		addPrefix   string
+		requestURI  string
+		want        string
+	}{
+		{
+			name:       "default destination",
+			requestURI: "/users?page=2",
+			want:       "http://localhost:3000/users?page=2",
+		},
+		{
+			name:       "routes by longest path prefix",
+			routes:     []Route{{PathPrefix: "/api", Destination: Destination{URL: "http://localhost:3001"}}, {PathPrefix: "/api/v2", Destination: Destination{URL: "http://localhost:3002"}}},
+			requestURI: "/api/v2/users",
+			want:       "http://localhost:3002/api/v2/users",
+		},
+		{
+			name:       "route prefix matches exact path",
+			routes:     []Route{{PathPrefix: "/api", Destination: Destination{URL: "http://localhost:3001"}}},
+			requestURI: "/api?x=1",
+			want:       "http://localhost:3001/api?x=1",
+		},
+		{
+			name:       "route prefix respects segment boundaries",
+			routes:     []Route{{PathPrefix: "/api", Destination: Destination{URL: "http://localhost:3001"}}},
+			requestURI: "/apidocs",
+			want:       "http://localhost:3000/apidocs",
+		},
+		{
+			name:        "strips path prefix",
+			stripPrefix: "/public",
+			requestURI:  "/public/index.html",
+			want:        "http://localhost:3000/index.html",
+		},
+		{
+			name:        "strips path prefix to root",
+			stripPrefix: "/public/",
+			requestURI:  "/public?x=1",
+			want:        "http://localhost:3000/?x=1",
+		},
+		{
+			name:       "adds path prefix",
+			addPrefix:  "/api",
+			requestURI: "/users",
+			want:       "http://localhost:3000/api/users",
+		},
+		{
+			name:        "strips then adds path prefix",
+			stripPrefix: "/v1",
+			addPrefix:   "/api/",
+			requestURI:  "/v1/users?id=3",
+			want:        "http://localhost:3000/api/users?id=3",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mapper := NewMapper(Destination{URL: "http://localhost:3000"}, Options{
+				Routes:      tt.routes,
+				StripPrefix: tt.stripPrefix,
+				AddPrefix:   tt.addPrefix,
+				HostHeader:  HostHeaderRewrite,
+			})
+			assert.Equal(t, tt.want, mapper.Resolve(tt.requestURI).URL)
+		})
+	}
+}
+
+func TestMapperHost(t *testing.T) {
+	t.Run("rewrite leaves the destination host", func(t *testing.T) {
+		mapper := NewMapper(Destination{URL: "http://localhost:3000"}, Options{HostHeader: HostHeaderRewrite})
+		assert.Equal(t, "", mapper.Host("abc123.tunnel.example.com"))
+	})
+
+	t.Run("preserve keeps the public host", func(t *testing.T) {
+		mapper := NewMapper(Destination{URL: "http://localhost:3000"}, Options{HostHeader: HostHeaderPreserve})
+		assert.Equal(t, "abc123.tunnel.example.com", mapper.Host("abc123.tunnel.example.com"))
+	})
+
+	t.Run("custom value is sent as is", func(t *testing.T) {
+		mapper := NewMapper(Destination{URL: "http://localhost:3000"}, Options{HostHeader: "myapp.localhost"})
+		assert.Equal(t, "myapp.localhost", mapper.Host("abc123.tunnel.example.com"))
+	})
+}
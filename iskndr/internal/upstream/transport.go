@@ -0,0 +1,146 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+/* Protocols spoken to the local destination. */
+const (
+	ProtocolHTTP1 = "http1"
+	/* HTTP/2 over TLS, for https destinations. */
+	ProtocolH2 = "h2"
+	/* HTTP/2 with prior knowledge over plain connections, e.g. local gRPC servers. */
+	ProtocolH2C = "h2c"
+)
+
+type TransportOptions struct {
+	/* Skip certificate verification for https destinations, e.g. dev servers with self-signed certificates. */
+	InsecureSkipVerify bool
+	/* Extra CAs trusted for https destinations, nil uses the system pool. */
+	RootCAs *x509.CertPool
+	/* One of the Protocol constants, empty means HTTP/1.1. */
+	Protocol string
+}
+
+func newTransport(destination Destination, opts TransportOptions) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		MaxIdleConnsPerHost:   32,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		/* Bodies are relayed as they are, the public client negotiates its own encoding. */
+		DisableCompression: true,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: opts.InsecureSkipVerify, //nolint:gosec
+			RootCAs:            opts.RootCAs,
+		},
+	}
+
+	protocols := new(http.Protocols)
+	switch opts.Protocol {
+	case ProtocolH2:
+		protocols.SetHTTP2(true)
+	case ProtocolH2C:
+		protocols.SetUnencryptedHTTP2(true)
+	default:
+		protocols.SetHTTP1(true)
+	}
+	transport.Protocols = protocols
+
+	if destination.SocketPath != "" {
+		socketPath := destination.SocketPath
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+	}
+
+	if destination.Dial != nil {
+		dial := destination.Dial
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dial(ctx)
+		}
+	}
+
+	return transport
+}
+
+/* Fallback answers requests for destinations that are down, e.g. with mocks during a restart of the local application. */
+type Fallback interface {
+	http.Handler
+	/* Matches reports whether the fallback has a response for the request, the others get the dial error. */
+	Matches(r *http.Request) bool
+}
+
+/* fallbackTransport serves requests with the fallback when no connection to the destination can be made. */
+type fallbackTransport struct {
+	next     http.RoundTripper
+	fallback *handlerTransport
+	matches  func(r *http.Request) bool
+}
+
+func (t *fallbackTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if err == nil || !isDialError(err) || !t.matches(req) {
+		return res, err
+	}
+
+	req, bodyErr := rewind(req)
+	if bodyErr != nil {
+		return nil, err
+	}
+	return t.fallback.RoundTrip(req)
+}
+
+/* isDialError reports whether no connection to the destination could be made, so nothing was sent. */
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+/* rewind returns req with a fresh body to send again, the failed attempt may have consumed it already. */
+func rewind(req *http.Request) (*http.Request, error) {
+	if req.GetBody == nil {
+		return req, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Body = body
+	return req, nil
+}
+
+func newClient(destination Destination, opts TransportOptions, fallback Fallback) *http.Client {
+	if destination.Handler != nil {
+		return wrapTransport(&handlerTransport{handler: destination.Handler}, nil)
+	}
+	return wrapTransport(newTransport(destination, opts), fallback)
+}
+
+func wrapTransport(transport http.RoundTripper, fallback Fallback) *http.Client {
+	if fallback != nil {
+		transport = &fallbackTransport{next: transport, fallback: &handlerTransport{handler: fallback}, matches: fallback.Matches}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		/* Redirects belong to the public client, following them here would leak local URLs. */
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
@@ -0,0 +1,202 @@
+package upstream
+
+import (
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewClient(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+			return
+		}
+		_, _ = w.Write([]byte("hello from " + r.URL.Path))
+	})
+
+	t.Run("reaches destination over a Unix socket", func(t *testing.T) {
+		socketPath := filepath.Join(t.TempDir(), "app.sock")
+		listener, err := net.Listen("unix", socketPath)
+		require.NoError(t, err)
+
+		server := httptest.NewUnstartedServer(handler)
+		server.Listener = listener
+		server.Start()
+		defer server.Close()
+
+		destination := Destination{URL: "http://localhost", SocketPath: socketPath}
+		res, err := newClient(destination, TransportOptions{}, nil).Get(destination.URL + "/index")
+		require.NoError(t, err)
+		//nolint:errcheck
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "hello from /index", string(body))
+	})
+
+	t.Run("rejects self-signed https destination by default", func(t *testing.T) {
+		server := httptest.NewTLSServer(handler)
+		defer server.Close()
+
+		_, err := newClient(Destination{URL: server.URL}, TransportOptions{}, nil).Get(server.URL + "/")
+		assert.Error(t, err)
+	})
+
+	t.Run("accepts self-signed https destination when insecure", func(t *testing.T) {
+		server := httptest.NewTLSServer(handler)
+		defer server.Close()
+
+		res, err := newClient(Destination{URL: server.URL}, TransportOptions{InsecureSkipVerify: true}, nil).Get(server.URL + "/")
+		require.NoError(t, err)
+		//nolint:errcheck
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	})
+
+	t.Run("accepts https destination signed by a custom CA", func(t *testing.T) {
+		server := httptest.NewTLSServer(handler)
+		defer server.Close()
+
+		pool := x509.NewCertPool()
+		pool.AddCert(server.Certificate())
+
+		res, err := newClient(Destination{URL: server.URL}, TransportOptions{RootCAs: pool}, nil).Get(server.URL + "/")
+		require.NoError(t, err)
+		//nolint:errcheck
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	})
+
+	t.Run("does not follow redirects", func(t *testing.T) {
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		res, err := newClient(Destination{URL: server.URL}, TransportOptions{}, nil).Get(server.URL + "/redirect")
+		require.NoError(t, err)
+		//nolint:errcheck
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusFound, res.StatusCode)
+		assert.Equal(t, "/elsewhere", res.Header.Get("Location"))
+	})
+
+	protoHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		_, _ = w.Write([]byte(r.Proto))
+		w.Header().Set("Grpc-Status", "0")
+	})
+
+	t.Run("speaks h2c to a plain http destination", func(t *testing.T) {
+		server := httptest.NewUnstartedServer(protoHandler)
+		server.Config.Protocols = new(http.Protocols)
+		server.Config.Protocols.SetUnencryptedHTTP2(true)
+		server.Start()
+		defer server.Close()
+
+		res, err := newClient(Destination{URL: server.URL}, TransportOptions{Protocol: ProtocolH2C}, nil).Get(server.URL + "/")
+		require.NoError(t, err)
+		//nolint:errcheck
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/2.0", string(body))
+		assert.Equal(t, "0", res.Trailer.Get("Grpc-Status"))
+	})
+
+	t.Run("speaks h2 to an https destination", func(t *testing.T) {
+		server := httptest.NewUnstartedServer(protoHandler)
+		server.EnableHTTP2 = true
+		server.StartTLS()
+		defer server.Close()
+
+		res, err := newClient(Destination{URL: server.URL}, TransportOptions{InsecureSkipVerify: true, Protocol: ProtocolH2}, nil).Get(server.URL + "/")
+		require.NoError(t, err)
+		//nolint:errcheck
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/2.0", string(body))
+	})
+
+	t.Run("speaks HTTP/1.1 by default", func(t *testing.T) {
+		server := httptest.NewUnstartedServer(protoHandler)
+		server.EnableHTTP2 = true
+		server.StartTLS()
+		defer server.Close()
+
+		res, err := newClient(Destination{URL: server.URL}, TransportOptions{InsecureSkipVerify: true}, nil).Get(server.URL + "/")
+		require.NoError(t, err)
+		//nolint:errcheck
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/1.1", string(body))
+	})
+}
+
+type testFallback struct {
+	http.Handler
+	path string
+}
+
+func (f *testFallback) Matches(r *http.Request) bool {
+	return r.URL.Path == f.path
+}
+
+func TestFallbackTransport(t *testing.T) {
+	fallback := &testFallback{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			_, _ = w.Write([]byte("fallback " + string(body)))
+		}),
+		path: "/mocked",
+	}
+
+	t.Run("serves matching requests when the destination is down", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		downURL := "http://" + listener.Addr().String()
+		require.NoError(t, listener.Close())
+
+		client := newClient(Destination{URL: downURL}, TransportOptions{}, fallback)
+		res, err := client.Post(downURL+"/mocked", "text/plain", strings.NewReader("body"))
+		require.NoError(t, err)
+		//nolint:errcheck
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "fallback body", string(body))
+
+		_, err = client.Get(downURL + "/other")
+		assert.Error(t, err, "requests without a fallback response get the dial error")
+	})
+
+	t.Run("uses the destination while it is up", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("local"))
+		}))
+		defer server.Close()
+
+		res, err := newClient(Destination{URL: server.URL}, TransportOptions{}, fallback).Get(server.URL + "/mocked")
+		require.NoError(t, err)
+		//nolint:errcheck
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "local", string(body))
+	})
+}
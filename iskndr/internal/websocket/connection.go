@@ -1,39 +1,91 @@
 package websocket
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
 
 	"github.com/gorilla/websocket"
 	"github.com/igneel64/iskandar/shared"
+	"github.com/igneel64/iskandar/shared/protocol"
 )
 
 type Dialer interface {
-	Dial() (*shared.SafeWebSocketConn, error)
+	Dial(ctx context.Context) (*shared.SafeWebSocketConn, error)
 }
 
-func NewWriteSafeWSDialer(serverWSURL string, allowInsecure bool) *WriteSafeWSDialer {
+type DialerOptions struct {
+	/* Skip TLS certificate verification of the tunnel server. */
+	AllowInsecure bool
+	/* Offer permessage-deflate, only used if the server agrees to it during the handshake. */
+	Compression bool
+	/* API token sent as a bearer token, required by servers that restrict who can open tunnels. */
+	Token string
+	/* Sent in the handshake headers, the server validates and applies it. */
+	TrafficPolicy protocol.TrafficPolicy
+}
+
+func NewWriteSafeWSDialer(serverWSURL string, opts DialerOptions) *WriteSafeWSDialer {
 	return &WriteSafeWSDialer{
-		serverWSURL:   serverWSURL,
-		allowInsecure: allowInsecure,
+		serverWSURL: serverWSURL,
+		opts:        opts,
 	}
 }
 
 type WriteSafeWSDialer struct {
-	serverWSURL   string
-	allowInsecure bool
+	serverWSURL string
+	opts        DialerOptions
 }
 
-func (d *WriteSafeWSDialer) Dial() (*shared.SafeWebSocketConn, error) {
-	dialer := websocket.DefaultDialer
-	if d.allowInsecure {
+func (d *WriteSafeWSDialer) Dial(ctx context.Context) (*shared.SafeWebSocketConn, error) {
+	/* Copy so the TLS setting doesn't leak into the package-wide default dialer. */
+	dialer := *websocket.DefaultDialer
+	if d.opts.AllowInsecure {
 		dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	}
+	dialer.EnableCompression = d.opts.Compression
+	/* Counting below TLS shows what the tunnel link really costs, see SafeWebSocketConn.Stats. */
+	dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return shared.NewCountingConn(conn), nil
+	}
 
-	c, _, err := dialer.Dial(d.serverWSURL, nil)
-	if err != nil {
+	header := http.Header{}
+	if d.opts.Token != "" {
+		header.Set("Authorization", "Bearer "+d.opts.Token)
+	}
+	if err := d.opts.TrafficPolicy.EncodeHeader(header); err != nil {
 		return nil, err
 	}
+
+	c, resp, err := dialer.DialContext(ctx, d.serverWSURL, header)
+	if err != nil {
+		return nil, handshakeError(err, resp)
+	}
 	safeWriteConn := shared.NewSafeWebSocketConn(c)
 
 	return safeWriteConn, nil
 }
+
+/* Adds the server's reason (e.g. an invalid token or a tunnel limit) to a rejected handshake. */
+func handshakeError(err error, resp *http.Response) error {
+	if !errors.Is(err, websocket.ErrBadHandshake) || resp == nil {
+		return err
+	}
+	//nolint:errcheck
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if reason := strings.TrimSpace(string(body)); reason != "" {
+		return fmt.Errorf("%w: %s (%s)", err, reason, resp.Status)
+	}
+	return fmt.Errorf("%w (%s)", err, resp.Status)
+}
@@ -1,13 +1,16 @@
 package websocket
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 
 	"github.com/gorilla/websocket"
+	"github.com/igneel64/iskandar/shared/protocol"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestWriteSafeWSDialer_Dial_Success(t *testing.T) {
@@ -37,8 +40,8 @@ func TestWriteSafeWSDialer_Dial_Success(t *testing.T) {
 
 	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
 
-	dialer := NewWriteSafeWSDialer(wsURL, false)
-	conn, err := dialer.Dial()
+	dialer := NewWriteSafeWSDialer(wsURL, DialerOptions{Compression: true})
+	conn, err := dialer.Dial(context.Background())
 
 	assert.NoError(t, err, "Dial should succeed")
 	assert.NotNil(t, conn, "Connection should not be nil")
@@ -46,3 +49,66 @@ func TestWriteSafeWSDialer_Dial_Success(t *testing.T) {
 	//nolint:errcheck
 	conn.Close()
 }
+
+func TestWriteSafeWSDialer_Dial_Token(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "Missing or invalid token", http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		//nolint:errcheck
+		conn.Close()
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	conn, err := NewWriteSafeWSDialer(wsURL, DialerOptions{Token: "secret"}).Dial(context.Background())
+	assert.NoError(t, err, "Dial with the token should succeed")
+	if conn != nil {
+		//nolint:errcheck
+		conn.Close()
+	}
+
+	_, err = NewWriteSafeWSDialer(wsURL, DialerOptions{}).Dial(context.Background())
+	assert.ErrorIs(t, err, websocket.ErrBadHandshake)
+	assert.ErrorContains(t, err, "Missing or invalid token")
+	assert.ErrorContains(t, err, "401")
+}
+
+func TestWriteSafeWSDialer_Dial_TrafficPolicy(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	requests := make(chan *http.Request, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		//nolint:errcheck
+		conn.Close()
+	}))
+	defer server.Close()
+
+	trafficPolicy := protocol.TrafficPolicy{
+		Rules: []protocol.PolicyRule{{Path: "/hooks/github", Webhook: &protocol.WebhookVerification{Scheme: "github", Secret: "secret"}}},
+	}
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/tunnel/connect?ttl=1h0m0s"
+	conn, err := NewWriteSafeWSDialer(wsURL, DialerOptions{TrafficPolicy: trafficPolicy}).Dial(context.Background())
+	require.NoError(t, err)
+	//nolint:errcheck
+	conn.Close()
+
+	r := <-requests
+	parsed, err := protocol.ParseTrafficPolicy(r.Header)
+	require.NoError(t, err)
+	assert.Equal(t, trafficPolicy, parsed)
+	assert.Equal(t, "ttl=1h0m0s", r.URL.RawQuery, "the webhook secret stays out of the URL")
+}
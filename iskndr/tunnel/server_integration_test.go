@@ -0,0 +1,137 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/igneel64/iskandar/server/tunnelserver"
+	"github.com/igneel64/iskandar/shared/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenWithEmbeddedServer(t *testing.T) {
+	publicURLBase, err := url.Parse("http://localhost.direct:8080")
+	require.NoError(t, err)
+
+	server, err := tunnelserver.NewIskndrServer(publicURLBase)
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	l, err := Listen(ctx, ts.URL)
+	require.NoError(t, err)
+	//nolint:errcheck
+	defer l.Close()
+
+	go func() {
+		_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "X-Checksum")
+			_, _ = w.Write([]byte("hello from " + r.URL.Path))
+			w.Header().Set("X-Checksum", "abc123")
+		}))
+	}()
+
+	publicURL, err := url.Parse(l.URL())
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("GET", ts.URL+"/webhook", nil)
+	require.NoError(t, err)
+	req.Host = publicURL.Host
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	//nolint:errcheck
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello from /webhook", string(body))
+	assert.Equal(t, "abc123", resp.Trailer.Get("X-Checksum"))
+}
+
+func TestListenClosesWhenTunnelExpires(t *testing.T) {
+	publicURLBase, err := url.Parse("http://localhost.direct:8080")
+	require.NoError(t, err)
+
+	server, err := tunnelserver.NewIskndrServer(publicURLBase)
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	l, err := Listen(ctx, ts.URL, WithLimits(protocol.TunnelLimits{TTL: 50 * time.Millisecond}))
+	require.NoError(t, err)
+	//nolint:errcheck
+	defer l.Close()
+
+	_, err = l.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestListenWithPolicy(t *testing.T) {
+	publicURLBase, err := url.Parse("http://localhost.direct:8080")
+	require.NoError(t, err)
+
+	server, err := tunnelserver.NewIskndrServer(publicURLBase)
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	l, err := Listen(context.Background(), ts.URL, WithPolicy(protocol.TrafficPolicy{
+		Rules: []protocol.PolicyRule{
+			{Methods: []string{"DELETE"}, Deny: &protocol.PolicyDeny{}},
+			{RequestHeaders: &protocol.HeaderRules{Set: map[string]string{"X-Env": "staging"}}},
+		},
+		CORS: &protocol.CORSPolicy{AllowOrigins: []string{"https://partner.example.com"}},
+	}))
+	require.NoError(t, err)
+	//nolint:errcheck
+	defer l.Close()
+
+	go func() {
+		_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(r.Header.Get("X-Env")))
+		}))
+	}()
+
+	publicURL, err := url.Parse(l.URL())
+	require.NoError(t, err)
+
+	do := func(method string) (*http.Response, string) {
+		req, err := http.NewRequest(method, ts.URL+"/orders", nil)
+		require.NoError(t, err)
+		req.Host = publicURL.Host
+		req.Header.Set("Origin", "https://partner.example.com")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		//nolint:errcheck
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	resp, body := do("GET")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "staging", body)
+	assert.Equal(t, "https://partner.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+
+	resp, _ = do("DELETE")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
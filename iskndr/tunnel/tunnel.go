@@ -0,0 +1,215 @@
+/*
+Package tunnel opens iskndr tunnels from Go programs and tests.
+
+	l, err := tunnel.Listen(ctx, "https://tunnel.example.com")
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	go http.Serve(l, webhookHandler)
+	fmt.Println("public URL:", l.URL())
+
+The returned Listener is a net.Listener, so it also works with httptest.Server
+by assigning it to the server's Listener field before calling Start.
+*/
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/igneel64/iskandar/iskndr/internal/client"
+	"github.com/igneel64/iskandar/iskndr/internal/config"
+	"github.com/igneel64/iskandar/iskndr/internal/upstream"
+	iskWS "github.com/igneel64/iskandar/iskndr/internal/websocket"
+	"github.com/igneel64/iskandar/shared"
+	"github.com/igneel64/iskandar/shared/protocol"
+	"github.com/igneel64/iskandar/shared/webhook"
+)
+
+type options struct {
+	allowInsecure      bool
+	disableCompression bool
+	token              string
+	limits             protocol.TunnelLimits
+	trafficPolicy      protocol.TrafficPolicy
+	hostHeader         string
+	webhooks           []webhook.Rule
+}
+
+type Option func(*options)
+
+/* WithAllowInsecure skips TLS certificate verification of the tunnel server. */
+func WithAllowInsecure() Option {
+	return func(o *options) {
+		o.allowInsecure = true
+	}
+}
+
+/* WithoutCompression turns off permessage-deflate on the tunnel link. */
+func WithoutCompression() Option {
+	return func(o *options) {
+		o.disableCompression = true
+	}
+}
+
+/* WithToken authenticates with an API token, for servers that restrict who can open tunnels. */
+func WithToken(token string) Option {
+	return func(o *options) {
+		o.token = token
+	}
+}
+
+/* WithLimits requests per-tunnel body size and timeouts, capped by the server. */
+func WithLimits(limits protocol.TunnelLimits) Option {
+	return func(o *options) {
+		o.limits = limits
+	}
+}
+
+/* WithPolicy has the server rewrite headers, answer CORS, redirect or deny requests before they reach the tunnel. */
+func WithPolicy(trafficPolicy protocol.TrafficPolicy) Option {
+	return func(o *options) {
+		o.trafficPolicy = trafficPolicy
+	}
+}
+
+/*
+WithHostHeader sets the Host seen by the served handler: "preserve" (the default) keeps
+the public tunnel host, "rewrite" uses an internal placeholder, any other value is sent as is.
+*/
+func WithHostHeader(hostHeader string) Option {
+	return func(o *options) {
+		o.hostHeader = hostHeader
+	}
+}
+
+/*
+WithWebhooks verifies webhook signatures before requests reach the served handler. The first rule matching
+a request's path applies, failed verifications are answered with 401 unless the rule is LogOnly.
+*/
+func WithWebhooks(rules ...webhook.Rule) Option {
+	return func(o *options) {
+		o.webhooks = rules
+	}
+}
+
+/* Listener accepts the requests arriving through a tunnel as in-memory connections. */
+type Listener struct {
+	publicURL string
+	wsConn    *shared.SafeWebSocketConn
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+/*
+Listen opens a tunnel on the server at serverURL (e.g. localhost:8080 or https://tunnel.example.com).
+The context only bounds connecting and registering the tunnel, use Close to shut it down.
+*/
+func Listen(ctx context.Context, serverURL string, opts ...Option) (*Listener, error) {
+	o := options{hostHeader: upstream.HostHeaderPreserve}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	hostHeader, err := config.ParseHostHeader(o.hostHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	serverWSURL, err := config.ParseServerURL(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	serverWSURL, err = config.AppendTunnelLimits(serverWSURL, o.limits)
+	if err != nil {
+		return nil, err
+	}
+
+	wsConn, err := iskWS.NewWriteSafeWSDialer(serverWSURL, iskWS.DialerOptions{
+		AllowInsecure: o.allowInsecure,
+		Compression:   !o.disableCompression,
+		Token:         o.token,
+		TrafficPolicy: o.trafficPolicy,
+	}).Dial(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to websocket: %w", err)
+	}
+
+	l := &Listener{
+		wsConn: wsConn,
+		conns:  make(chan net.Conn),
+		done:   make(chan struct{}),
+	}
+
+	mapper := upstream.NewMapper(upstream.Destination{URL: "http://iskndr.tunnel", Dial: l.dial}, upstream.Options{HostHeader: hostHeader})
+	tunnelClient := client.NewIskndrClient(wsConn, mapper, client.WithWebhooks(o.webhooks))
+
+	regMsg, err := tunnelClient.Register()
+	if err != nil {
+		_ = wsConn.Close()
+		return nil, fmt.Errorf("failed to read register tunnel message: %w", err)
+	}
+	l.publicURL = regMsg.Subdomain
+
+	go func() {
+		_ = tunnelClient.AcceptRequests()
+		_ = l.Close()
+	}()
+
+	return l, nil
+}
+
+/* URL is the public URL assigned to the tunnel. */
+func (l *Listener) URL() string {
+	return l.publicURL
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+/* Close shuts the tunnel down, pending and future requests fail. */
+func (l *Listener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.wsConn.Close()
+	})
+	return err
+}
+
+func (l *Listener) Addr() net.Addr {
+	return tunnelAddr(l.publicURL)
+}
+
+/* Every tunnelled connection is one end of an in-memory pipe handed to Accept. */
+func (l *Listener) dial(ctx context.Context) (net.Conn, error) {
+	serverSide, clientSide := net.Pipe()
+	select {
+	case l.conns <- serverSide:
+		return clientSide, nil
+	case <-l.done:
+		_ = serverSide.Close()
+		_ = clientSide.Close()
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		_ = serverSide.Close()
+		_ = clientSide.Close()
+		return nil, ctx.Err()
+	}
+}
+
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "iskndr" }
+func (a tunnelAddr) String() string  { return string(a) }
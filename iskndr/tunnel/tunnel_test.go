@@ -0,0 +1,229 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/igneel64/iskandar/shared/protocol"
+	"github.com/igneel64/iskandar/shared/webhook"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/* Minimal stand-in for the tunnel server: registers the tunnel and relays the given requests. */
+func newFakeTunnelServer(t *testing.T, requests []protocol.Message) (*httptest.Server, chan []protocol.Message) {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	responses := make(chan []protocol.Message, len(requests))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		//nolint:errcheck
+		defer conn.Close()
+
+		if err := conn.WriteJSON(&protocol.RegisterTunnelMessage{Subdomain: "http://abc123.localhost.direct:8080"}); err != nil {
+			return
+		}
+
+		for _, request := range requests {
+			if err := conn.WriteJSON(&request); err != nil {
+				return
+			}
+
+			var messages []protocol.Message
+			for {
+				var msg protocol.Message
+				if err := conn.ReadJSON(&msg); err != nil {
+					return
+				}
+				messages = append(messages, msg)
+				if msg.Done {
+					break
+				}
+			}
+			responses <- messages
+		}
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server, responses
+}
+
+func responseBody(messages []protocol.Message) string {
+	var body strings.Builder
+	for _, msg := range messages {
+		body.Write(msg.Body)
+	}
+	return body.String()
+}
+
+func TestListen(t *testing.T) {
+	t.Run("serves tunnelled requests with http.Serve", func(t *testing.T) {
+		server, responses := newFakeTunnelServer(t, []protocol.Message{
+			{Type: "request", Id: "req-1", Method: "POST", Path: "/webhook?source=test", Body: []byte("payload"), Headers: map[string]string{"X-Forwarded-Host": "abc123.localhost.direct:8080"}},
+			{Type: "request", Id: "req-2", Method: "GET", Path: "/second"},
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		l, err := Listen(ctx, server.URL)
+		require.NoError(t, err)
+		//nolint:errcheck
+		defer l.Close()
+
+		assert.Equal(t, "http://abc123.localhost.direct:8080", l.URL())
+		assert.Equal(t, "http://abc123.localhost.direct:8080", l.Addr().String())
+
+		go func() {
+			_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Seen-Host", r.Host)
+				w.WriteHeader(http.StatusAccepted)
+				_, _ = w.Write([]byte(r.Method + " " + r.URL.RequestURI()))
+			}))
+		}()
+
+		first := <-responses
+		require.NotEmpty(t, first)
+		assert.Equal(t, "req-1", first[0].Id)
+		assert.Equal(t, http.StatusAccepted, first[0].Status)
+		assert.Equal(t, "abc123.localhost.direct:8080", first[0].Headers["X-Seen-Host"])
+		assert.Equal(t, "POST /webhook?source=test", responseBody(first))
+
+		second := <-responses
+		require.NotEmpty(t, second)
+		assert.Equal(t, "GET /second", responseBody(second))
+	})
+
+	t.Run("works as an httptest.Server listener", func(t *testing.T) {
+		server, responses := newFakeTunnelServer(t, []protocol.Message{
+			{Type: "request", Id: "req-1", Method: "GET", Path: "/health"},
+		})
+
+		l, err := Listen(context.Background(), server.URL)
+		require.NoError(t, err)
+
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		}))
+		ts.Listener = l
+		ts.Start()
+		defer ts.Close()
+
+		messages := <-responses
+		assert.Equal(t, http.StatusOK, messages[0].Status)
+		assert.Equal(t, "ok", responseBody(messages))
+	})
+
+	t.Run("accept returns an error after close", func(t *testing.T) {
+		server, _ := newFakeTunnelServer(t, nil)
+
+		l, err := Listen(context.Background(), server.URL)
+		require.NoError(t, err)
+		require.NoError(t, l.Close())
+
+		_, err = l.Accept()
+		assert.ErrorIs(t, err, net.ErrClosed)
+	})
+
+	t.Run("returns error when the server is unreachable", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		_, err := Listen(ctx, "127.0.0.1:1")
+		assert.Error(t, err)
+	})
+
+	t.Run("returns error for an invalid host header option", func(t *testing.T) {
+		_, err := Listen(context.Background(), "localhost:8080", WithHostHeader(""))
+		assert.Error(t, err)
+	})
+}
+
+func TestListenContinuesTrace(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+
+	server, responses := newFakeTunnelServer(t, []protocol.Message{
+		{
+			Type:         "request",
+			Id:           "req-1",
+			Method:       "GET",
+			Path:         "/orders",
+			Headers:      map[string]string{"Traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-1111111111111111-01"},
+			TraceContext: map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		},
+	})
+
+	l, err := Listen(context.Background(), server.URL)
+	require.NoError(t, err)
+	//nolint:errcheck
+	defer l.Close()
+
+	go func() {
+		_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Seen-Traceparent", r.Header.Get("Traceparent"))
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+	}()
+
+	messages := <-responses
+	require.Eventually(t, func() bool { return len(spans.Ended()) == 1 }, time.Second, 10*time.Millisecond)
+	span := spans.Ended()[0]
+	assert.Equal(t, trace.SpanKindClient, span.SpanKind())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", span.Parent().SpanID().String(), "the server span is the parent")
+	assert.Equal(t, codes.Error, span.Status().Code)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+span.SpanContext().SpanID().String()+"-01", messages[0].Headers["X-Seen-Traceparent"])
+}
+
+func TestListenWithWebhooks(t *testing.T) {
+	server, responses := newFakeTunnelServer(t, []protocol.Message{
+		{Type: "request", Id: "req-1", Method: "POST", Path: "/hooks/github", Body: []byte("Hello, World!")},
+		{Type: "request", Id: "req-2", Method: "POST", Path: "/hooks/github", Body: []byte("Hello, World!"), Headers: map[string]string{
+			"X-Hub-Signature-256": "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17",
+		}},
+		{Type: "request", Id: "req-3", Method: "POST", Path: "/other", Body: []byte("unsigned")},
+	})
+
+	verifier, err := webhook.NewVerifier(webhook.Options{Scheme: webhook.SchemeGitHub, Secret: "It's a Secret to Everybody"})
+	require.NoError(t, err)
+
+	l, err := Listen(context.Background(), server.URL, WithWebhooks(webhook.Rule{Path: "/hooks/**", Verifier: verifier}))
+	require.NoError(t, err)
+	//nolint:errcheck
+	defer l.Close()
+
+	go func() {
+		_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("delivered"))
+		}))
+	}()
+
+	rejected := <-responses
+	assert.Equal(t, http.StatusUnauthorized, rejected[0].Status)
+	assert.Equal(t, "Invalid webhook signature", rejected[0].Error)
+
+	assert.Equal(t, "delivered", responseBody(<-responses))
+	assert.Equal(t, "delivered", responseBody(<-responses), "paths without a rule aren't verified")
+}
@@ -0,0 +1,46 @@
+package shared
+
+import (
+	"mime"
+	"strings"
+)
+
+/* Media types that are compressed by their format, deflating them again only costs CPU. */
+var compressedMediaTypes = map[string]bool{
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/zip":              true,
+	"application/zstd":             true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/vnd.rar":          true,
+	"application/pdf":              true,
+	"font/woff":                    true,
+	"font/woff2":                   true,
+}
+
+/*
+IsCompressible reports whether a body described by these headers is worth compressing on the tunnel link.
+Bodies with a Content-Encoding (gzip, br, ...) and compressed media types such as images or archives are not.
+*/
+func IsCompressible(contentEncoding, contentType string) bool {
+	if encoding := strings.TrimSpace(contentEncoding); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+
+	switch {
+	case mediaType == "image/svg+xml":
+		return true
+	case strings.HasPrefix(mediaType, "image/"), strings.HasPrefix(mediaType, "video/"), strings.HasPrefix(mediaType, "audio/"):
+		return false
+	}
+
+	return !compressedMediaTypes[mediaType]
+}
@@ -0,0 +1,93 @@
+package shared
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/igneel64/iskandar/shared/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsCompressible(t *testing.T) {
+	tests := []struct {
+		name            string
+		contentEncoding string
+		contentType     string
+		want            bool
+	}{
+		{name: "json", contentType: "application/json; charset=utf-8", want: true},
+		{name: "html", contentType: "text/html", want: true},
+		{name: "svg", contentType: "image/svg+xml", want: true},
+		{name: "missing content type", want: true},
+		{name: "identity encoding", contentEncoding: "identity", contentType: "text/plain", want: true},
+		{name: "gzip encoded", contentEncoding: "gzip", contentType: "application/json", want: false},
+		{name: "brotli encoded", contentEncoding: "br", contentType: "text/html", want: false},
+		{name: "png", contentType: "image/png", want: false},
+		{name: "video", contentType: "video/mp4", want: false},
+		{name: "zip archive", contentType: "application/zip", want: false},
+		{name: "woff2 font", contentType: "font/woff2", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, IsCompressible(tt.contentEncoding, tt.contentType))
+		})
+	}
+}
+
+func TestSafeWebSocketConnStats(t *testing.T) {
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		//nolint:errcheck
+		defer conn.Close()
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(messageType, data); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	var counting *CountingConn
+	dialer.NetDial = func(network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		counting = NewCountingConn(conn)
+		return counting, nil
+	}
+
+	wsConn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	conn := NewSafeWebSocketConn(wsConn)
+	//nolint:errcheck
+	defer conn.Close()
+
+	body := []byte(strings.Repeat(`{"name":"Peter","city":"Perlepes"},`, 2000))
+	require.NoError(t, conn.WriteJSON(&protocol.Message{Type: "response", Id: "1", Body: body}))
+
+	var echoed protocol.Message
+	require.NoError(t, conn.ReadJSON(&echoed))
+	assert.Equal(t, body, echoed.Body)
+
+	stats, ok := conn.Stats()
+	require.True(t, ok)
+	assert.Equal(t, stats.PayloadWritten, stats.PayloadRead)
+	assert.Less(t, stats.WireWritten, stats.PayloadWritten)
+	assert.Positive(t, stats.BytesSaved())
+}
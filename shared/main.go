@@ -1,9 +1,12 @@
 package shared
 
 import (
+	"encoding/json"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/igneel64/iskandar/shared/protocol"
@@ -22,28 +25,80 @@ func SerializeHeaders(headers http.Header) map[string]string {
 type SafeWebSocketConn struct {
 	conn *websocket.Conn
 	mu   sync.Mutex
+
+	/* Set when the underlying connection counts its bytes, see CountingConn. */
+	wire           *CountingConn
+	payloadWritten atomic.Int64
+	payloadRead    atomic.Int64
 }
 
 func NewSafeWebSocketConn(conn *websocket.Conn) *SafeWebSocketConn {
 	return &SafeWebSocketConn{
 		conn: conn,
+		wire: findCountingConn(conn.NetConn()),
 	}
 }
 
+/* WriteRegistrationMsg goes through the write lock too, the tunnel may already receive requests. */
+func (s *SafeWebSocketConn) WriteRegistrationMsg(msg *protocol.RegisterTunnelMessage) error {
+	return s.writeJSON(msg, true)
+}
+
 func (s *SafeWebSocketConn) WriteJSON(msg *protocol.Message) error {
+	return s.writeJSON(msg, true)
+}
+
+/* WriteJSONUncompressed skips permessage-deflate for messages carrying already compressed bodies. */
+func (s *SafeWebSocketConn) WriteJSONUncompressed(msg *protocol.Message) error {
+	return s.writeJSON(msg, false)
+}
+
+func (s *SafeWebSocketConn) writeJSON(v any, compress bool) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	/* Only has an effect when compression was negotiated during the handshake. */
+	s.conn.EnableWriteCompression(compress)
 	/* Consider adding a s.conn.SetWriteDeadline(...) if we want faster timeout */
-	return s.conn.WriteJSON(msg)
+	if err := s.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		return err
+	}
+	s.payloadWritten.Add(int64(len(data)))
+	return nil
 }
 
 /* Reads are not thread safe, as it is not needed for now. */
 func (s *SafeWebSocketConn) ReadRegistrationMsg(msg *protocol.RegisterTunnelMessage) error {
-	return s.conn.ReadJSON(msg)
+	return s.readJSON(msg)
 }
 
 func (s *SafeWebSocketConn) ReadJSON(msg *protocol.Message) error {
-	return s.conn.ReadJSON(msg)
+	return s.readJSON(msg)
+}
+
+func (s *SafeWebSocketConn) readJSON(v any) error {
+	_, data, err := s.conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	s.payloadRead.Add(int64(len(data)))
+	return json.Unmarshal(data, v)
+}
+
+/* Stats reports the tunnel traffic so far, ok is false when wire bytes aren't counted. */
+func (s *SafeWebSocketConn) Stats() (stats TrafficStats, ok bool) {
+	stats.PayloadWritten = s.payloadWritten.Load()
+	stats.PayloadRead = s.payloadRead.Load()
+	if s.wire == nil {
+		return stats, false
+	}
+	stats.WireWritten = s.wire.written.Load()
+	stats.WireRead = s.wire.read.Load()
+	return stats, true
 }
 
 func (s *SafeWebSocketConn) Close() error {
@@ -51,3 +106,16 @@ func (s *SafeWebSocketConn) Close() error {
 	defer s.mu.Unlock()
 	return s.conn.Close()
 }
+
+/*
+Shutdown asks the peer to close the connection, telling it why (e.g. the tunnel expired).
+Reads fail after the grace period if the peer never answers.
+*/
+func (s *SafeWebSocketConn) Shutdown(reason string, grace time.Duration) error {
+	deadline := time.Now().Add(grace)
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason)
+	if err := s.conn.WriteControl(websocket.CloseMessage, msg, deadline); err != nil {
+		return err
+	}
+	return s.conn.SetReadDeadline(deadline)
+}
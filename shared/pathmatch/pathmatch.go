@@ -0,0 +1,42 @@
+/*
+Package pathmatch matches request paths against the path globs of traffic policy, webhook and chaos rules:
+a glob as in path.Match, where a trailing /** also matches everything below the prefix.
+*/
+package pathmatch
+
+import (
+	"path"
+	"strings"
+)
+
+/* Match reports whether requestPath matches pattern, an empty pattern matches every path. */
+func Match(pattern, requestPath string) bool {
+	if pattern == "" {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "/**"); ok {
+		_, ok := MatchPrefix(prefix, requestPath)
+		return ok
+	}
+	ok, _ := path.Match(pattern, requestPath)
+	return ok
+}
+
+/*
+MatchPrefix reports whether requestPath is prefix or below it and returns the rest of the path below it.
+Each segment of prefix is a glob, e.g. /users/* matches /users/1/orders with the rest /orders.
+*/
+func MatchPrefix(prefix, requestPath string) (string, bool) {
+	segments := strings.Count(prefix, "/")
+	parts := strings.SplitN(requestPath, "/", segments+2)
+	if len(parts) < segments+1 {
+		return "", false
+	}
+	if ok, _ := path.Match(prefix, strings.Join(parts[:segments+1], "/")); !ok {
+		return "", false
+	}
+	if len(parts) > segments+1 {
+		return "/" + parts[segments+1], true
+	}
+	return "", true
+}
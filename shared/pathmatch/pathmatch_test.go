@@ -0,0 +1,45 @@
+package pathmatch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{pattern: "", path: "/anything", want: true},
+		{pattern: "/hooks/github", path: "/hooks/github", want: true},
+		{pattern: "/hooks/github", path: "/hooks/github/x", want: false},
+		{pattern: "/hooks/*", path: "/hooks/stripe", want: true},
+		{pattern: "/api/**", path: "/api", want: true},
+		{pattern: "/api/**", path: "/api/v1/orders", want: true},
+		{pattern: "/api/**", path: "/apiv1", want: false},
+		{pattern: "/**", path: "/", want: true},
+		{pattern: "/users/*/**", path: "/users/1/orders", want: true},
+		{pattern: "/users/*/**", path: "/users/1", want: true},
+		{pattern: "/users/*/**", path: "/users", want: false},
+		{pattern: "/hooks/*/**", path: "/hooks/github/push", want: true},
+		{pattern: "/hooks/*/**", path: "/other/github/push", want: false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, Match(tt.pattern, tt.path), "%s %s", tt.pattern, tt.path)
+	}
+}
+
+func TestMatchPrefix(t *testing.T) {
+	rest, ok := MatchPrefix("/users/*", "/users/1/orders/7")
+	assert.True(t, ok)
+	assert.Equal(t, "/orders/7", rest)
+
+	rest, ok = MatchPrefix("/users/*", "/users/1")
+	assert.True(t, ok)
+	assert.Empty(t, rest)
+
+	_, ok = MatchPrefix("/users/*", "/accounts/1")
+	assert.False(t, ok)
+}
@@ -1,9 +1,31 @@
 package protocol
 
+import "time"
+
 type RegisterTunnelMessage struct {
-	Subdomain string `json:"subdomain"`
+	Subdomain string        `json:"subdomain"`
+	Limits    *TunnelLimits `json:"limits,omitempty"`
+}
+
+/* Zero values mean "not set", the server fills them in with its own defaults. */
+type TunnelLimits struct {
+	MaxBodySize       int64         `json:"max_body_size,omitempty"`
+	ResponseTimeout   time.Duration `json:"response_timeout,omitempty"`
+	StreamIdleTimeout time.Duration `json:"stream_idle_timeout,omitempty"`
+	/* Idle timeout for Server-Sent Events (text/event-stream) and chunked responses, other responses use StreamIdleTimeout. */
+	EventStreamIdleTimeout time.Duration `json:"event_stream_idle_timeout,omitempty"`
+	/* Lifetime of the tunnel, the server closes it afterwards. Zero keeps it open as long as the connection. */
+	TTL time.Duration `json:"ttl,omitempty"`
+	/* Number of distinct visitors the public URL admits, later visitors get 410 Gone. Zero is unlimited. */
+	MaxUses int64 `json:"max_uses,omitempty"`
 }
 
+/* States of the local application reported in health messages. */
+const (
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
 type Message struct {
 	Type    string            `json:"type"`
 	Id      string            `json:"id"`
@@ -13,4 +35,18 @@ type Message struct {
 	Headers map[string]string `json:"headers,omitempty"`
 	Body    []byte            `json:"body,omitempty"`
 	Done    bool              `json:"done,omitempty"`
+	/* Every Set-Cookie of a response with several, they can't be joined into one header like other values. */
+	SetCookies []string `json:"set_cookies,omitempty"`
+	/* Set by the CLI on the first message of a response without Content-Length, e.g. chunked or long-polling ones. */
+	Chunked bool `json:"chunked,omitempty"`
+	/* Response trailers (e.g. grpc-status), only sent with the final message. */
+	Trailers map[string]string `json:"trailers,omitempty"`
+	/* Set by the CLI when the local application couldn't answer, the server shows its error page with this message instead of the body. */
+	Error string `json:"error,omitempty"`
+	/* Set by the CLI to drop the public connection without a response, e.g. when injecting faults. */
+	Abort bool `json:"abort,omitempty"`
+	/* Sent by the CLI in "health" messages when it runs health checks, the server answers for an unhealthy application. */
+	Health string `json:"health,omitempty"`
+	/* W3C trace context (traceparent, tracestate) of the server span, so the CLI can continue the trace. */
+	TraceContext map[string]string `json:"trace_context,omitempty"`
 }
@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+/* Query parameters the CLI may add to the /tunnel/connect URL to request per-tunnel overrides. */
+const (
+	QueryMaxBodySize       = "max_body_size"
+	QueryResponseTimeout   = "response_timeout"
+	QueryStreamIdleTimeout = "stream_idle_timeout"
+
+	QueryEventStreamIdleTimeout = "event_stream_idle_timeout"
+	QueryTTL                    = "ttl"
+	QueryMaxUses                = "max_uses"
+)
+
+func (l TunnelLimits) EncodeQuery(q url.Values) {
+	if l.MaxBodySize > 0 {
+		q.Set(QueryMaxBodySize, strconv.FormatInt(l.MaxBodySize, 10))
+	}
+	if l.ResponseTimeout > 0 {
+		q.Set(QueryResponseTimeout, l.ResponseTimeout.String())
+	}
+	if l.StreamIdleTimeout > 0 {
+		q.Set(QueryStreamIdleTimeout, l.StreamIdleTimeout.String())
+	}
+	if l.EventStreamIdleTimeout > 0 {
+		q.Set(QueryEventStreamIdleTimeout, l.EventStreamIdleTimeout.String())
+	}
+	if l.TTL > 0 {
+		q.Set(QueryTTL, l.TTL.String())
+	}
+	if l.MaxUses > 0 {
+		q.Set(QueryMaxUses, strconv.FormatInt(l.MaxUses, 10))
+	}
+}
+
+func ParseTunnelLimits(q url.Values) (TunnelLimits, error) {
+	var limits TunnelLimits
+	var err error
+
+	if v := q.Get(QueryMaxBodySize); v != "" {
+		if limits.MaxBodySize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return TunnelLimits{}, fmt.Errorf("invalid %s: %w", QueryMaxBodySize, err)
+		}
+	}
+	if v := q.Get(QueryResponseTimeout); v != "" {
+		if limits.ResponseTimeout, err = time.ParseDuration(v); err != nil {
+			return TunnelLimits{}, fmt.Errorf("invalid %s: %w", QueryResponseTimeout, err)
+		}
+	}
+	if v := q.Get(QueryStreamIdleTimeout); v != "" {
+		if limits.StreamIdleTimeout, err = time.ParseDuration(v); err != nil {
+			return TunnelLimits{}, fmt.Errorf("invalid %s: %w", QueryStreamIdleTimeout, err)
+		}
+	}
+	if v := q.Get(QueryEventStreamIdleTimeout); v != "" {
+		if limits.EventStreamIdleTimeout, err = time.ParseDuration(v); err != nil {
+			return TunnelLimits{}, fmt.Errorf("invalid %s: %w", QueryEventStreamIdleTimeout, err)
+		}
+	}
+	if v := q.Get(QueryTTL); v != "" {
+		if limits.TTL, err = time.ParseDuration(v); err != nil {
+			return TunnelLimits{}, fmt.Errorf("invalid %s: %w", QueryTTL, err)
+		}
+	}
+	if v := q.Get(QueryMaxUses); v != "" {
+		if limits.MaxUses, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return TunnelLimits{}, fmt.Errorf("invalid %s: %w", QueryMaxUses, err)
+		}
+	}
+
+	return limits, nil
+}
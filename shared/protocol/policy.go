@@ -0,0 +1,153 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+/*
+Handshake header carrying the CLI's traffic policy as JSON. Webhook secrets are part of the policy,
+so it is kept out of the connect URL, which ends up in access logs.
+*/
+const HeaderPolicy = "X-Iskndr-Policy"
+
+/*
+TrafficPolicy transforms traffic at the edge. Rules are evaluated in order for every public request,
+a deny or redirect answers the request without forwarding it, header changes of all matching rules add up.
+*/
+type TrafficPolicy struct {
+	Rules []PolicyRule `json:"rules,omitempty"`
+	CORS  *CORSPolicy  `json:"cors,omitempty"`
+}
+
+type PolicyRule struct {
+	/* Methods and Path select the requests, an empty selector matches everything. */
+	Methods []string `json:"methods,omitempty"`
+	/* Glob as in path.Match, a trailing /** also matches everything below the prefix. */
+	Path string `json:"path,omitempty"`
+
+	Deny            *PolicyDeny          `json:"deny,omitempty"`
+	Redirect        *PolicyRedirect      `json:"redirect,omitempty"`
+	RequestHeaders  *HeaderRules         `json:"request_headers,omitempty"`
+	ResponseHeaders *HeaderRules         `json:"response_headers,omitempty"`
+	Webhook         *WebhookVerification `json:"webhook,omitempty"`
+}
+
+type PolicyDeny struct {
+	/* 403 when not set. */
+	Status  int    `json:"status,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type PolicyRedirect struct {
+	/* Path or URL to redirect to, for /** rules the rest of the path is appended. */
+	To string `json:"to"`
+	/* 302 when not set. */
+	Status int `json:"status,omitempty"`
+}
+
+/* WebhookVerification rejects requests without a valid signature with 401, see the webhook package. */
+type WebhookVerification struct {
+	/* github, stripe, slack or hmac. */
+	Scheme string `json:"scheme"`
+	Secret string `json:"secret,omitempty"`
+	/* Environment variable with the secret, read where the policy file is loaded so it isn't sent around. */
+	SecretEnv string `json:"secret_env,omitempty"`
+	/* Signature header of the hmac scheme. */
+	Header string `json:"header,omitempty"`
+}
+
+/* Header changes are applied in the order remove, set, add. */
+type HeaderRules struct {
+	Remove []string          `json:"remove,omitempty"`
+	Set    map[string]string `json:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty"`
+}
+
+/* CORSPolicy answers preflight requests at the edge and adds the CORS headers to responses. */
+type CORSPolicy struct {
+	/* Origins allowed to read responses, "*" allows any. */
+	AllowOrigins     []string `json:"allow_origins"`
+	AllowMethods     []string `json:"allow_methods,omitempty"`
+	AllowHeaders     []string `json:"allow_headers,omitempty"`
+	ExposeHeaders    []string `json:"expose_headers,omitempty"`
+	AllowCredentials bool     `json:"allow_credentials,omitempty"`
+	/* Seconds browsers may cache a preflight answer. */
+	MaxAge int `json:"max_age,omitempty"`
+}
+
+/* LoadTrafficPolicy reads a JSON policy file, unknown fields are rejected to catch typos. */
+func LoadTrafficPolicy(path string) (TrafficPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return TrafficPolicy{}, fmt.Errorf("failed to read policy: %w", err)
+	}
+	policy, err := decodeTrafficPolicy(data)
+	if err != nil {
+		return TrafficPolicy{}, fmt.Errorf("invalid policy %s: %w", path, err)
+	}
+
+	for idx := range policy.Rules {
+		verification := policy.Rules[idx].Webhook
+		if verification == nil || verification.SecretEnv == "" {
+			continue
+		}
+		if verification.Secret = os.Getenv(verification.SecretEnv); verification.Secret == "" {
+			return TrafficPolicy{}, fmt.Errorf("invalid policy %s: webhook secret $%s is not set", path, verification.SecretEnv)
+		}
+		verification.SecretEnv = ""
+	}
+	return policy, nil
+}
+
+/* SecretEnvs lists the variables the webhook rules read their secrets from, before LoadTrafficPolicy resolves them. */
+func (p TrafficPolicy) SecretEnvs() []string {
+	var names []string
+	for _, rule := range p.Rules {
+		if rule.Webhook != nil && rule.Webhook.SecretEnv != "" {
+			names = append(names, rule.Webhook.SecretEnv)
+		}
+	}
+	return names
+}
+
+func (p TrafficPolicy) IsEmpty() bool {
+	return len(p.Rules) == 0 && p.CORS == nil
+}
+
+func (p TrafficPolicy) EncodeHeader(h http.Header) error {
+	if p.IsEmpty() {
+		return nil
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	h.Set(HeaderPolicy, string(data))
+	return nil
+}
+
+func ParseTrafficPolicy(h http.Header) (TrafficPolicy, error) {
+	v := h.Get(HeaderPolicy)
+	if v == "" {
+		return TrafficPolicy{}, nil
+	}
+	policy, err := decodeTrafficPolicy([]byte(v))
+	if err != nil {
+		return TrafficPolicy{}, fmt.Errorf("invalid %s: %w", HeaderPolicy, err)
+	}
+	return policy, nil
+}
+
+func decodeTrafficPolicy(data []byte) (TrafficPolicy, error) {
+	var policy TrafficPolicy
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&policy); err != nil {
+		return TrafficPolicy{}, err
+	}
+	return policy, nil
+}
@@ -0,0 +1,70 @@
+/*
+Package tracing sets up OpenTelemetry tracing for the server and the CLI, and carries the W3C
+trace context of a request through the tunnel.
+*/
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+/* Propagator reads and writes the traceparent, tracestate and baggage headers. */
+var Propagator propagation.TextMapPropagator = propagation.NewCompositeTextMapPropagator(
+	propagation.TraceContext{},
+	propagation.Baggage{},
+)
+
+type Options struct {
+	ServiceName string
+	/* OTLP/HTTP collector, e.g. http://localhost:4318. Tracing stays off when empty. */
+	Endpoint string
+	/* Share of new traces that are recorded, between 0 and 1. Traces started upstream keep their decision. */
+	SampleRatio float64
+}
+
+/*
+Setup installs a global tracer provider exporting spans to the collector. The returned function
+flushes pending spans and must be called before exiting.
+*/
+func Setup(ctx context.Context, opts Options) (shutdown func(context.Context) error, err error) {
+	if opts.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(opts.Endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(opts.ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+/* Inject returns the trace context of ctx to send along with a tunnelled message, nil without a trace. */
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	Propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+/* Extract continues the trace of a tunnelled message. */
+func Extract(ctx context.Context, traceContext map[string]string) context.Context {
+	return Propagator.Extract(ctx, propagation.MapCarrier(traceContext))
+}
@@ -0,0 +1,60 @@
+package shared
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+/* CountingConn counts the bytes going through a connection, i.e. what the tunnel link actually costs. */
+type CountingConn struct {
+	net.Conn
+	read    atomic.Int64
+	written atomic.Int64
+}
+
+func NewCountingConn(conn net.Conn) *CountingConn {
+	return &CountingConn{Conn: conn}
+}
+
+func (c *CountingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *CountingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+/* Finds a CountingConn below conn, looking through wrappers such as *tls.Conn. */
+func findCountingConn(conn net.Conn) *CountingConn {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *CountingConn:
+			return c
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+/*
+TrafficStats compares the JSON messages exchanged over a tunnel with the bytes on the wire.
+Wire bytes include WebSocket framing, the handshake and TLS, so tiny messages can cost more than their payload.
+*/
+type TrafficStats struct {
+	PayloadWritten int64
+	PayloadRead    int64
+	WireWritten    int64
+	WireRead       int64
+}
+
+/* BytesSaved is the difference between payload and wire bytes in both directions. */
+func (t TrafficStats) BytesSaved() int64 {
+	return t.PayloadWritten + t.PayloadRead - t.WireWritten - t.WireRead
+}
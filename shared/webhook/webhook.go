@@ -0,0 +1,218 @@
+/*
+Package webhook verifies the HMAC signatures webhook providers put on their requests, so forged or
+misconfigured deliveries are caught before they reach the application.
+*/
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/igneel64/iskandar/shared/pathmatch"
+)
+
+/* Signature schemes. */
+const (
+	/* X-Hub-Signature-256: sha256=<hex HMAC of the body>. */
+	SchemeGitHub = "github"
+	/* Stripe-Signature: t=<unix time>,v1=<hex HMAC of "t.body">. */
+	SchemeStripe = "stripe"
+	/* X-Slack-Signature: v0=<hex HMAC of "v0:timestamp:body">, with X-Slack-Request-Timestamp. */
+	SchemeSlack = "slack"
+	/* A hex or base64 HMAC-SHA256 of the body in a configurable header, optionally prefixed with sha256=. */
+	SchemeHMAC = "hmac"
+)
+
+const (
+	DefaultHMACHeader = "X-Signature"
+	/* How old a timestamped signature may be, as recommended by Stripe and Slack. */
+	DefaultTolerance = 5 * time.Minute
+)
+
+var (
+	ErrMissingSignature = errors.New("missing signature")
+	ErrInvalidSignature = errors.New("signature doesn't match")
+	ErrExpiredSignature = errors.New("signature timestamp outside the tolerance")
+)
+
+type Options struct {
+	Scheme string
+	Secret string
+	/* Header carrying the signature, only for SchemeHMAC. */
+	Header string
+	/* Zero uses DefaultTolerance. */
+	Tolerance time.Duration
+}
+
+type Verifier struct {
+	scheme    string
+	secret    []byte
+	header    string
+	tolerance time.Duration
+	now       func() time.Time
+}
+
+func NewVerifier(opts Options) (*Verifier, error) {
+	switch opts.Scheme {
+	case SchemeGitHub, SchemeStripe, SchemeSlack:
+		if opts.Header != "" {
+			return nil, fmt.Errorf("the %s scheme has a fixed signature header", opts.Scheme)
+		}
+	case SchemeHMAC:
+	default:
+		return nil, fmt.Errorf("unknown webhook scheme %q, expected github, stripe, slack or hmac", opts.Scheme)
+	}
+	if opts.Secret == "" {
+		return nil, errors.New("webhook secret is empty")
+	}
+
+	v := &Verifier{
+		scheme:    opts.Scheme,
+		secret:    []byte(opts.Secret),
+		header:    http.CanonicalHeaderKey(opts.Header),
+		tolerance: opts.Tolerance,
+		now:       time.Now,
+	}
+	if v.header == "" && v.scheme == SchemeHMAC {
+		v.header = DefaultHMACHeader
+	}
+	if v.tolerance == 0 {
+		v.tolerance = DefaultTolerance
+	}
+	return v, nil
+}
+
+func (v *Verifier) Scheme() string {
+	return v.scheme
+}
+
+/* Verify checks the signature of a request with the given headers and body. */
+func (v *Verifier) Verify(header http.Header, body []byte) error {
+	switch v.scheme {
+	case SchemeGitHub:
+		return v.verifyPrefixed(header.Get("X-Hub-Signature-256"), "sha256=", body)
+	case SchemeStripe:
+		return v.verifyStripe(header.Get("Stripe-Signature"), body)
+	case SchemeSlack:
+		return v.verifySlack(header.Get("X-Slack-Signature"), header.Get("X-Slack-Request-Timestamp"), body)
+	default:
+		return v.verifyHMAC(header.Get(v.header), body)
+	}
+}
+
+func (v *Verifier) sign(parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, v.secret)
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
+
+func (v *Verifier) verifyPrefixed(signature, prefix string, parts ...[]byte) error {
+	if signature == "" {
+		return ErrMissingSignature
+	}
+	hexSignature, ok := strings.CutPrefix(signature, prefix)
+	if !ok {
+		return ErrInvalidSignature
+	}
+	decoded, err := hex.DecodeString(hexSignature)
+	if err != nil || !hmac.Equal(decoded, v.sign(parts...)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func (v *Verifier) verifyStripe(signature string, body []byte) error {
+	if signature == "" {
+		return ErrMissingSignature
+	}
+
+	var timestamp string
+	var signatures []string
+	for _, item := range strings.Split(signature, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(item), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	if timestamp == "" || len(signatures) == 0 {
+		return ErrInvalidSignature
+	}
+	if err := v.checkTimestamp(timestamp); err != nil {
+		return err
+	}
+
+	/* Stripe sends one v1 signature per active secret while a secret is rolled. */
+	expected := v.sign([]byte(timestamp), []byte("."), body)
+	for _, candidate := range signatures {
+		if decoded, err := hex.DecodeString(candidate); err == nil && hmac.Equal(decoded, expected) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+func (v *Verifier) verifySlack(signature, timestamp string, body []byte) error {
+	if signature == "" || timestamp == "" {
+		return ErrMissingSignature
+	}
+	if err := v.checkTimestamp(timestamp); err != nil {
+		return err
+	}
+	return v.verifyPrefixed(signature, "v0=", []byte("v0:"+timestamp+":"), body)
+}
+
+func (v *Verifier) verifyHMAC(signature string, body []byte) error {
+	if signature == "" {
+		return ErrMissingSignature
+	}
+	signature = strings.TrimPrefix(signature, "sha256=")
+
+	expected := v.sign(body)
+	if decoded, err := hex.DecodeString(signature); err == nil && hmac.Equal(decoded, expected) {
+		return nil
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(signature); err == nil && hmac.Equal(decoded, expected) {
+		return nil
+	}
+	return ErrInvalidSignature
+}
+
+/* Timestamps guard against replays of captured deliveries. */
+func (v *Verifier) checkTimestamp(timestamp string) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	age := v.now().Sub(time.Unix(seconds, 0))
+	if math.Abs(float64(age)) > float64(v.tolerance) {
+		return ErrExpiredSignature
+	}
+	return nil
+}
+
+/* Rule verifies the requests to matching paths. */
+type Rule struct {
+	/* Path glob as in the pathmatch package, empty matches every path. */
+	Path     string
+	Verifier *Verifier
+	/* Failed verifications are only logged and the request is forwarded anyway. */
+	LogOnly bool
+}
+
+func (r Rule) Matches(requestPath string) bool {
+	return pathmatch.Match(r.Path, requestPath)
+}
@@ -0,0 +1,109 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestVerifier(t *testing.T, opts Options, now time.Time) *Verifier {
+	t.Helper()
+	v, err := NewVerifier(opts)
+	require.NoError(t, err)
+	v.now = func() time.Time { return now }
+	return v
+}
+
+func hexHMAC(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestNewVerifier(t *testing.T) {
+	for name, opts := range map[string]Options{
+		"unknown scheme":   {Scheme: "gitlab", Secret: "s"},
+		"empty secret":     {Scheme: SchemeGitHub},
+		"header on github": {Scheme: SchemeGitHub, Secret: "s", Header: "X-Signature"},
+	} {
+		_, err := NewVerifier(opts)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	body := []byte("Hello, World!")
+
+	t.Run("github", func(t *testing.T) {
+		v := newTestVerifier(t, Options{Scheme: SchemeGitHub, Secret: "It's a Secret to Everybody"}, now)
+
+		/* The example of GitHub's documentation. */
+		header := http.Header{"X-Hub-Signature-256": {"sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"}}
+		assert.NoError(t, v.Verify(header, body))
+		assert.ErrorIs(t, v.Verify(header, []byte("Hello, World?")), ErrInvalidSignature)
+		assert.ErrorIs(t, v.Verify(http.Header{}, body), ErrMissingSignature)
+	})
+
+	t.Run("stripe", func(t *testing.T) {
+		v := newTestVerifier(t, Options{Scheme: SchemeStripe, Secret: "whsec_test"}, now)
+		signature := hexHMAC("whsec_test", timestamp+"."+string(body))
+
+		header := http.Header{"Stripe-Signature": {"t=" + timestamp + ",v1=" + hexHMAC("old", "x") + ",v1=" + signature}}
+		assert.NoError(t, v.Verify(header, body))
+
+		header.Set("Stripe-Signature", "t="+timestamp+",v0="+signature)
+		assert.ErrorIs(t, v.Verify(header, body), ErrInvalidSignature)
+
+		stale := strconv.FormatInt(now.Add(-10*time.Minute).Unix(), 10)
+		header.Set("Stripe-Signature", "t="+stale+",v1="+hexHMAC("whsec_test", stale+"."+string(body)))
+		assert.ErrorIs(t, v.Verify(header, body), ErrExpiredSignature)
+	})
+
+	t.Run("slack", func(t *testing.T) {
+		v := newTestVerifier(t, Options{Scheme: SchemeSlack, Secret: "signing"}, now)
+		header := http.Header{
+			"X-Slack-Signature":         {"v0=" + hexHMAC("signing", "v0:"+timestamp+":"+string(body))},
+			"X-Slack-Request-Timestamp": {timestamp},
+		}
+		assert.NoError(t, v.Verify(header, body))
+
+		header.Set("X-Slack-Request-Timestamp", strconv.FormatInt(now.Unix()+1, 10))
+		assert.ErrorIs(t, v.Verify(header, body), ErrInvalidSignature)
+
+		header.Del("X-Slack-Request-Timestamp")
+		assert.ErrorIs(t, v.Verify(header, body), ErrMissingSignature)
+	})
+
+	t.Run("generic hmac in hex or base64", func(t *testing.T) {
+		v := newTestVerifier(t, Options{Scheme: SchemeHMAC, Secret: "s", Header: "x-webhook-signature"}, now)
+		signature := hexHMAC("s", string(body))
+
+		assert.NoError(t, v.Verify(http.Header{"X-Webhook-Signature": {signature}}, body))
+		assert.NoError(t, v.Verify(http.Header{"X-Webhook-Signature": {"sha256=" + signature}}, body))
+
+		raw, err := hex.DecodeString(signature)
+		require.NoError(t, err)
+		assert.NoError(t, v.Verify(http.Header{"X-Webhook-Signature": {base64.StdEncoding.EncodeToString(raw)}}, body))
+
+		assert.ErrorIs(t, v.Verify(http.Header{DefaultHMACHeader: {signature}}, body), ErrMissingSignature)
+	})
+}
+
+func TestRuleMatches(t *testing.T) {
+	assert.True(t, Rule{}.Matches("/anything"))
+	assert.True(t, Rule{Path: "/webhooks/**"}.Matches("/webhooks/github"))
+	assert.False(t, Rule{Path: "/webhooks/**"}.Matches("/webhooksx"))
+	assert.True(t, Rule{Path: "/hooks/*"}.Matches("/hooks/stripe"))
+	assert.False(t, Rule{Path: "/hooks/*"}.Matches("/hooks/stripe/events"))
+	assert.True(t, Rule{Path: "/hooks/*/**"}.Matches("/hooks/stripe/events"), "the prefix is a glob too")
+}
@@ -1,6 +1,14 @@
 package config
 
-import "github.com/caarlos0/env/v11"
+import (
+	"fmt"
+	"time"
+
+	"github.com/caarlos0/env/v11"
+	"github.com/igneel64/iskandar/server/internal/quota"
+	"github.com/igneel64/iskandar/server/logger"
+	"github.com/igneel64/iskandar/shared/protocol"
+)
 
 type Config struct {
 	BaseScheme           string `env:"ISKNDR_BASE_SCHEME" envDefault:"http"`
@@ -9,6 +17,70 @@ type Config struct {
 	Logging              bool   `env:"ISKNDR_LOGGING" envDefault:"true"`
 	MaxTunnels           int    `env:"ISKNDR_MAX_TUNNELS" envDefault:"100"`
 	MaxRequestsPerTunnel int    `env:"ISKNDR_MAX_REQUESTS_PER_TUNNEL" envDefault:"50"`
+	MaxMessageSize       int64  `env:"ISKNDR_MAX_MESSAGE_SIZE" envDefault:"4194304"`
+	Compression          bool   `env:"ISKNDR_COMPRESSION" envDefault:"true"`
+	H2C                  bool   `env:"ISKNDR_H2C" envDefault:"true"`
+
+	/* Server log and per-request access log, written to stderr and stdout unless a file is set. */
+	LogFormat     string `env:"ISKNDR_LOG_FORMAT" envDefault:"console"`
+	LogLevel      string `env:"ISKNDR_LOG_LEVEL" envDefault:"info"`
+	LogFile       string `env:"ISKNDR_LOG_FILE"`
+	AccessLog     string `env:"ISKNDR_ACCESS_LOG"`
+	AccessLogFile string `env:"ISKNDR_ACCESS_LOG_FILE"`
+	/* Log files are rotated once they reach LogMaxSize megabytes, 0 never rotates them. */
+	LogMaxSize    int `env:"ISKNDR_LOG_MAX_SIZE" envDefault:"0"`
+	LogMaxBackups int `env:"ISKNDR_LOG_MAX_BACKUPS" envDefault:"5"`
+	LogMaxAge     int `env:"ISKNDR_LOG_MAX_AGE" envDefault:"0"`
+
+	/* OTLP/HTTP collector receiving a span per public request, tracing is off when empty. */
+	OTLPEndpoint     string  `env:"ISKNDR_OTLP_ENDPOINT"`
+	TraceSampleRatio float64 `env:"ISKNDR_TRACE_SAMPLE_RATIO" envDefault:"1"`
+
+	/* Serve TLS (and HTTP/2) directly instead of behind a TLS terminating proxy. */
+	TLSCertFile string `env:"ISKNDR_TLS_CERT_FILE"`
+	TLSKeyFile  string `env:"ISKNDR_TLS_KEY_FILE"`
+
+	/* Directory with custom error page templates and whether browsers get a warning page on their first visit. */
+	ErrorPagesDir string `env:"ISKNDR_ERROR_PAGES_DIR"`
+	Interstitial  bool   `env:"ISKNDR_INTERSTITIAL" envDefault:"false"`
+
+	/* Header carrying the request ID to the local application and back, IDs from trusted proxies are kept. */
+	RequestIdHeader string `env:"ISKNDR_REQUEST_ID_HEADER" envDefault:"X-Request-Id"`
+
+	/* JSON traffic policy applied to every tunnel ahead of the rules sent by CLIs. */
+	PolicyFile string `env:"ISKNDR_POLICY_FILE"`
+
+	/* API tokens accepted from CLIs, connecting is open to anyone when empty. */
+	Tokens []string `env:"ISKNDR_TOKENS" envSeparator:","`
+
+	/* Request rate (per second) and bandwidth (body bytes per UTC day) limits, 0 means unlimited. */
+	TunnelRateLimit      float64 `env:"ISKNDR_TUNNEL_RATE_LIMIT" envDefault:"0"`
+	TunnelRateBurst      int     `env:"ISKNDR_TUNNEL_RATE_BURST" envDefault:"0"`
+	TunnelDailyBandwidth int64   `env:"ISKNDR_TUNNEL_DAILY_BANDWIDTH" envDefault:"0"`
+	TokenRateLimit       float64 `env:"ISKNDR_TOKEN_RATE_LIMIT" envDefault:"0"`
+	TokenRateBurst       int     `env:"ISKNDR_TOKEN_RATE_BURST" envDefault:"0"`
+	TokenDailyBandwidth  int64   `env:"ISKNDR_TOKEN_DAILY_BANDWIDTH" envDefault:"0"`
+	MaxTunnelsPerToken   int     `env:"ISKNDR_MAX_TUNNELS_PER_TOKEN" envDefault:"0"`
+
+	/* IPs or CIDR ranges of reverse proxies in front of the server whose X-Forwarded-* headers are trusted. */
+	TrustedProxies []string `env:"ISKNDR_TRUSTED_PROXIES" envSeparator:","`
+
+	/* Defaults applied to every tunnel, the CLI may request different values up to the ceilings below. */
+	MaxBodySize            int64         `env:"ISKNDR_MAX_BODY_SIZE" envDefault:"4194304"`
+	ResponseTimeout        time.Duration `env:"ISKNDR_RESPONSE_TIMEOUT" envDefault:"30s"`
+	StreamIdleTimeout      time.Duration `env:"ISKNDR_STREAM_IDLE_TIMEOUT" envDefault:"30s"`
+	EventStreamIdleTimeout time.Duration `env:"ISKNDR_EVENT_STREAM_IDLE_TIMEOUT" envDefault:"10m"`
+	TunnelTTL              time.Duration `env:"ISKNDR_TUNNEL_TTL" envDefault:"0s"`
+
+	MaxBodySizeCeiling            int64         `env:"ISKNDR_MAX_BODY_SIZE_CEILING" envDefault:"33554432"`
+	ResponseTimeoutCeiling        time.Duration `env:"ISKNDR_RESPONSE_TIMEOUT_CEILING" envDefault:"5m"`
+	StreamIdleTimeoutCeiling      time.Duration `env:"ISKNDR_STREAM_IDLE_TIMEOUT_CEILING" envDefault:"10m"`
+	EventStreamIdleTimeoutCeiling time.Duration `env:"ISKNDR_EVENT_STREAM_IDLE_TIMEOUT_CEILING" envDefault:"24h"`
+	/* Maximum lifetime of any tunnel, 0 lets tunnels live as long as their connection. */
+	TunnelTTLCeiling time.Duration `env:"ISKNDR_TUNNEL_TTL_CEILING" envDefault:"0s"`
+
+	/* Interval of keep-alive comments sent on quiet text/event-stream responses, 0 disables them. */
+	EventStreamKeepAlive time.Duration `env:"ISKNDR_EVENT_STREAM_KEEPALIVE" envDefault:"0s"`
 }
 
 func LoadConfigFromEnv() (*Config, error) {
@@ -16,6 +88,79 @@ func LoadConfigFromEnv() (*Config, error) {
 	if err := env.Parse(cfg); err != nil {
 		return nil, err
 	}
+	if err := cfg.validateLimits(); err != nil {
+		return nil, err
+	}
 
 	return cfg, nil
 }
+
+/*
+Zero or negative limits would reject every tunnel or body or time out every request, TTLs and quotas are the only
+limits that can be 0.
+*/
+func (c *Config) validateLimits() error {
+	for _, limit := range []struct {
+		name  string
+		value int64
+	}{
+		{"ISKNDR_MAX_TUNNELS", int64(c.MaxTunnels)},
+		{"ISKNDR_MAX_REQUESTS_PER_TUNNEL", int64(c.MaxRequestsPerTunnel)},
+		{"ISKNDR_MAX_BODY_SIZE", c.MaxBodySize},
+		{"ISKNDR_MAX_BODY_SIZE_CEILING", c.MaxBodySizeCeiling},
+		{"ISKNDR_RESPONSE_TIMEOUT", int64(c.ResponseTimeout)},
+		{"ISKNDR_RESPONSE_TIMEOUT_CEILING", int64(c.ResponseTimeoutCeiling)},
+		{"ISKNDR_STREAM_IDLE_TIMEOUT", int64(c.StreamIdleTimeout)},
+		{"ISKNDR_STREAM_IDLE_TIMEOUT_CEILING", int64(c.StreamIdleTimeoutCeiling)},
+		{"ISKNDR_EVENT_STREAM_IDLE_TIMEOUT", int64(c.EventStreamIdleTimeout)},
+		{"ISKNDR_EVENT_STREAM_IDLE_TIMEOUT_CEILING", int64(c.EventStreamIdleTimeoutCeiling)},
+	} {
+		if limit.value <= 0 {
+			return fmt.Errorf("invalid %s: must be greater than 0", limit.name)
+		}
+	}
+	return nil
+}
+
+func (c *Config) LimitsPolicy() LimitsPolicy {
+	return LimitsPolicy{
+		Defaults: protocol.TunnelLimits{
+			MaxBodySize:            c.MaxBodySize,
+			ResponseTimeout:        c.ResponseTimeout,
+			StreamIdleTimeout:      c.StreamIdleTimeout,
+			EventStreamIdleTimeout: c.EventStreamIdleTimeout,
+			TTL:                    c.TunnelTTL,
+		},
+		Ceilings: protocol.TunnelLimits{
+			MaxBodySize:            c.MaxBodySizeCeiling,
+			ResponseTimeout:        c.ResponseTimeoutCeiling,
+			StreamIdleTimeout:      c.StreamIdleTimeoutCeiling,
+			EventStreamIdleTimeout: c.EventStreamIdleTimeoutCeiling,
+			TTL:                    c.TunnelTTLCeiling,
+		},
+	}
+}
+
+func (c *Config) LogRotation() logger.Rotation {
+	return logger.Rotation{
+		MaxSizeMB:  c.LogMaxSize,
+		MaxBackups: c.LogMaxBackups,
+		MaxAgeDays: c.LogMaxAge,
+	}
+}
+
+func (c *Config) QuotaPolicy() quota.Policy {
+	return quota.Policy{
+		Tunnel: quota.Limits{
+			RequestsPerSecond: c.TunnelRateLimit,
+			Burst:             c.TunnelRateBurst,
+			BytesPerDay:       c.TunnelDailyBandwidth,
+		},
+		Token: quota.Limits{
+			RequestsPerSecond: c.TokenRateLimit,
+			Burst:             c.TokenRateBurst,
+			BytesPerDay:       c.TokenDailyBandwidth,
+		},
+		MaxTunnelsPerToken: c.MaxTunnelsPerToken,
+	}
+}
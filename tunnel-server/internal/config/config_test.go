@@ -0,0 +1,30 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfigFromEnv(t *testing.T) {
+	cfg, err := LoadConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, int64(4194304), cfg.MaxBodySize)
+
+	for _, setting := range []struct{ name, value string }{
+		{"ISKNDR_MAX_TUNNELS", "0"},
+		{"ISKNDR_MAX_REQUESTS_PER_TUNNEL", "-1"},
+		{"ISKNDR_MAX_BODY_SIZE", "0"},
+		{"ISKNDR_MAX_BODY_SIZE", "-1"},
+		{"ISKNDR_RESPONSE_TIMEOUT", "0s"},
+		{"ISKNDR_STREAM_IDLE_TIMEOUT", "-5s"},
+		{"ISKNDR_RESPONSE_TIMEOUT_CEILING", "0s"},
+	} {
+		t.Run(setting.name+"="+setting.value, func(t *testing.T) {
+			t.Setenv(setting.name, setting.value)
+			_, err := LoadConfigFromEnv()
+			assert.ErrorContains(t, err, "invalid "+setting.name)
+		})
+	}
+}
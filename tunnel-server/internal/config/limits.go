@@ -0,0 +1,44 @@
+package config
+
+import (
+	"time"
+
+	"github.com/igneel64/iskandar/shared/protocol"
+)
+
+type LimitsPolicy struct {
+	Defaults protocol.TunnelLimits
+	Ceilings protocol.TunnelLimits
+}
+
+/* Resolve returns the effective limits for a tunnel, falling back to the defaults for anything not requested. */
+func (p LimitsPolicy) Resolve(requested protocol.TunnelLimits) protocol.TunnelLimits {
+	return protocol.TunnelLimits{
+		MaxBodySize:            resolveLimit(requested.MaxBodySize, p.Defaults.MaxBodySize, p.Ceilings.MaxBodySize),
+		ResponseTimeout:        resolveLimit(requested.ResponseTimeout, p.Defaults.ResponseTimeout, p.Ceilings.ResponseTimeout),
+		StreamIdleTimeout:      resolveLimit(requested.StreamIdleTimeout, p.Defaults.StreamIdleTimeout, p.Ceilings.StreamIdleTimeout),
+		EventStreamIdleTimeout: resolveLimit(requested.EventStreamIdleTimeout, p.Defaults.EventStreamIdleTimeout, p.Ceilings.EventStreamIdleTimeout),
+		TTL:                    resolveTTL(requested.TTL, p.Defaults.TTL, p.Ceilings.TTL),
+		MaxUses:                resolveLimit(requested.MaxUses, p.Defaults.MaxUses, p.Ceilings.MaxUses),
+	}
+}
+
+func resolveLimit[T int64 | time.Duration](requested, fallback, ceiling T) T {
+	value := fallback
+	if requested > 0 {
+		value = requested
+	}
+	if ceiling > 0 && value > ceiling {
+		value = ceiling
+	}
+	return value
+}
+
+/* Unlike the other limits a zero TTL is unlimited, which a ceiling caps as well. */
+func resolveTTL(requested, fallback, ceiling time.Duration) time.Duration {
+	value := resolveLimit(requested, fallback, ceiling)
+	if ceiling > 0 && value <= 0 {
+		value = ceiling
+	}
+	return value
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/igneel64/iskandar/shared/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimitsPolicyResolve(t *testing.T) {
+	policy := LimitsPolicy{
+		Defaults: protocol.TunnelLimits{
+			MaxBodySize:            4 * 1024 * 1024,
+			ResponseTimeout:        30 * time.Second,
+			StreamIdleTimeout:      30 * time.Second,
+			EventStreamIdleTimeout: 10 * time.Minute,
+		},
+		Ceilings: protocol.TunnelLimits{
+			MaxBodySize:            32 * 1024 * 1024,
+			ResponseTimeout:        5 * time.Minute,
+			StreamIdleTimeout:      10 * time.Minute,
+			EventStreamIdleTimeout: 24 * time.Hour,
+		},
+	}
+
+	t.Run("uses defaults when nothing is requested", func(t *testing.T) {
+		assert.Equal(t, policy.Defaults, policy.Resolve(protocol.TunnelLimits{}))
+	})
+
+	t.Run("uses requested values within ceilings", func(t *testing.T) {
+		requested := protocol.TunnelLimits{
+			MaxBodySize:            8 * 1024 * 1024,
+			ResponseTimeout:        3 * time.Minute,
+			StreamIdleTimeout:      time.Second,
+			EventStreamIdleTimeout: time.Hour,
+		}
+		assert.Equal(t, requested, policy.Resolve(requested))
+	})
+
+	t.Run("caps requested values at ceilings", func(t *testing.T) {
+		requested := protocol.TunnelLimits{
+			MaxBodySize:            1024 * 1024 * 1024,
+			ResponseTimeout:        time.Hour,
+			StreamIdleTimeout:      time.Hour,
+			EventStreamIdleTimeout: 7 * 24 * time.Hour,
+		}
+		assert.Equal(t, policy.Ceilings, policy.Resolve(requested))
+	})
+
+	t.Run("mixes requested and default values", func(t *testing.T) {
+		result := policy.Resolve(protocol.TunnelLimits{ResponseTimeout: 2 * time.Minute})
+		assert.Equal(t, policy.Defaults.MaxBodySize, result.MaxBodySize)
+		assert.Equal(t, 2*time.Minute, result.ResponseTimeout)
+		assert.Equal(t, policy.Defaults.StreamIdleTimeout, result.StreamIdleTimeout)
+	})
+
+	t.Run("caps an unlimited TTL at the ceiling", func(t *testing.T) {
+		assert.Zero(t, policy.Resolve(protocol.TunnelLimits{}).TTL)
+
+		capped := policy
+		capped.Ceilings.TTL = 8 * time.Hour
+		assert.Equal(t, 8*time.Hour, capped.Resolve(protocol.TunnelLimits{}).TTL)
+		assert.Equal(t, 8*time.Hour, capped.Resolve(protocol.TunnelLimits{TTL: -time.Hour}).TTL)
+		assert.Equal(t, 2*time.Hour, capped.Resolve(protocol.TunnelLimits{TTL: 2 * time.Hour}).TTL)
+		assert.Equal(t, 8*time.Hour, capped.Resolve(protocol.TunnelLimits{TTL: 48 * time.Hour}).TTL)
+	})
+
+	t.Run("falls back to the defaults for zero and negative requests", func(t *testing.T) {
+		for _, requested := range []int64{0, -1} {
+			resolved := policy.Resolve(protocol.TunnelLimits{
+				MaxBodySize:            requested,
+				ResponseTimeout:        time.Duration(requested),
+				StreamIdleTimeout:      time.Duration(requested),
+				EventStreamIdleTimeout: time.Duration(requested),
+				MaxUses:                requested,
+			})
+			assert.Equal(t, policy.Defaults, resolved, "requested %d", requested)
+		}
+	})
+
+	t.Run("keeps zero defaults of limits other than the TTL under a ceiling", func(t *testing.T) {
+		zeroDefaults := LimitsPolicy{Ceilings: policy.Ceilings}
+		zeroDefaults.Ceilings.MaxUses = 10
+		for _, requested := range []int64{0, -1} {
+			resolved := zeroDefaults.Resolve(protocol.TunnelLimits{
+				MaxBodySize:            requested,
+				ResponseTimeout:        time.Duration(requested),
+				StreamIdleTimeout:      time.Duration(requested),
+				EventStreamIdleTimeout: time.Duration(requested),
+				MaxUses:                requested,
+			})
+			assert.Equal(t, protocol.TunnelLimits{}, resolved, "requested %d", requested)
+		}
+	})
+
+	t.Run("passes max uses through", func(t *testing.T) {
+		assert.Equal(t, int64(1), policy.Resolve(protocol.TunnelLimits{MaxUses: 1}).MaxUses)
+	})
+}
@@ -0,0 +1,179 @@
+/*
+Package errorpage renders the pages public visitors see when the server can't proxy their request,
+as HTML, JSON or plain text depending on the Accept header.
+*/
+package errorpage
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//go:embed templates/*.html
+var defaultTemplates embed.FS
+
+const (
+	errorTemplate        = "error.html"
+	interstitialTemplate = "interstitial.html"
+)
+
+type ErrorData struct {
+	Status  int    `json:"status"`
+	Title   string `json:"title"`
+	Message string `json:"message"`
+}
+
+type InterstitialData struct {
+	Host        string
+	ContinueURL string
+}
+
+/* Renderer holds one template per status code, falling back to a generic error template. */
+type Renderer struct {
+	pages        map[int]*template.Template
+	fallback     *template.Template
+	interstitial *template.Template
+}
+
+/* Default renders the built-in pages. */
+func Default() *Renderer {
+	return &Renderer{
+		pages:        make(map[int]*template.Template),
+		fallback:     template.Must(template.ParseFS(defaultTemplates, "templates/"+errorTemplate)),
+		interstitial: template.Must(template.ParseFS(defaultTemplates, "templates/"+interstitialTemplate)),
+	}
+}
+
+/*
+Load reads custom templates from dir: <status>.html (e.g. 502.html) for a single status code,
+error.html for every other status and interstitial.html for the first-visit warning.
+Templates missing from dir keep the built-in pages.
+*/
+func Load(dir string) (*Renderer, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read error pages: %w", err)
+	}
+
+	r := Default()
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != ".html" {
+			continue
+		}
+
+		tmpl, err := template.ParseFiles(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("invalid error page %s: %w", name, err)
+		}
+
+		switch name {
+		case errorTemplate:
+			r.fallback = tmpl
+		case interstitialTemplate:
+			r.interstitial = tmpl
+		default:
+			status, err := strconv.Atoi(strings.TrimSuffix(name, ".html"))
+			if err != nil || http.StatusText(status) == "" {
+				return nil, fmt.Errorf("invalid error page %s: expected <status>.html, error.html or interstitial.html", name)
+			}
+			r.pages[status] = tmpl
+		}
+	}
+	return r, nil
+}
+
+/* WriteError answers with an error page in the format preferred by the visitor. */
+func (r *Renderer) WriteError(w http.ResponseWriter, req *http.Request, status int, message string) {
+	data := ErrorData{Status: status, Title: http.StatusText(status), Message: message}
+
+	switch Negotiate(req.Header.Get("Accept")) {
+	case FormatHTML:
+		tmpl, ok := r.pages[status]
+		if !ok {
+			tmpl = r.fallback
+		}
+		if !writeHTML(w, status, tmpl, data) {
+			http.Error(w, message, status)
+		}
+	case FormatJSON:
+		body, _ := json.Marshal(map[string]ErrorData{"error": data})
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(status)
+		_, _ = w.Write(body)
+	default:
+		http.Error(w, message, status)
+	}
+}
+
+/* WriteInterstitial shows the first-visit warning for host, continuing to continueURL. */
+func (r *Renderer) WriteInterstitial(w http.ResponseWriter, host, continueURL string) {
+	if !writeHTML(w, http.StatusOK, r.interstitial, InterstitialData{Host: host, ContinueURL: continueURL}) {
+		http.Error(w, "Failed to render page", http.StatusInternalServerError)
+	}
+}
+
+/* Renders into a buffer first, so a broken custom template doesn't leave a half written page. */
+func writeHTML(w http.ResponseWriter, status int, tmpl *template.Template, data any) bool {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return false
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_, _ = w.Write(buf.Bytes())
+	return true
+}
+
+type Format int
+
+const (
+	FormatText Format = iota
+	FormatHTML
+	FormatJSON
+)
+
+/*
+Negotiate picks HTML or JSON when the Accept header explicitly asks for it, the highest quality
+wins. Anything else, like the wildcard sent by curl, gets plain text.
+*/
+func Negotiate(accept string) Format {
+	best, bestQuality := FormatText, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+
+		var format Format
+		switch mediaType {
+		case "text/html", "application/xhtml+xml":
+			format = FormatHTML
+		case "application/json":
+			format = FormatJSON
+		default:
+			continue
+		}
+		if quality > bestQuality {
+			best, bestQuality = format, quality
+		}
+	}
+	return best
+}
@@ -0,0 +1,109 @@
+package errorpage
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   Format
+	}{
+		{"", FormatText},
+		{"*/*", FormatText},
+		{"text/plain", FormatText},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", FormatHTML},
+		{"application/json", FormatJSON},
+		{"application/json, text/plain, */*", FormatJSON},
+		{"text/html;q=0.5, application/json", FormatJSON},
+		{"application/json;q=0.1, text/html;q=0.9", FormatHTML},
+		{"text/html;q=oops", FormatText},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			assert.Equal(t, tt.want, Negotiate(tt.accept))
+		})
+	}
+}
+
+func writeError(r *Renderer, accept string, status int, message string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", accept)
+	rec := httptest.NewRecorder()
+	r.WriteError(rec, req, status, message)
+	return rec
+}
+
+func TestWriteError(t *testing.T) {
+	t.Run("renders the built-in HTML page", func(t *testing.T) {
+		rec := writeError(Default(), "text/html", http.StatusBadGateway, "The <local> app is restarting")
+		assert.Equal(t, http.StatusBadGateway, rec.Code)
+		assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+		assert.Contains(t, rec.Body.String(), "Bad Gateway")
+		assert.Contains(t, rec.Body.String(), "The &lt;local&gt; app is restarting")
+	})
+
+	t.Run("renders JSON", func(t *testing.T) {
+		rec := writeError(Default(), "application/json", http.StatusNotFound, "No tunnel found for subdomain")
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+		var body map[string]ErrorData
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		assert.Equal(t, ErrorData{Status: 404, Title: "Not Found", Message: "No tunnel found for subdomain"}, body["error"])
+	})
+
+	t.Run("falls back to plain text", func(t *testing.T) {
+		rec := writeError(Default(), "*/*", http.StatusGatewayTimeout, "timeout waiting for tunnel response")
+		assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+		assert.Equal(t, "timeout waiting for tunnel response\n", rec.Body.String())
+	})
+}
+
+func TestLoad(t *testing.T) {
+	t.Run("uses custom pages per status and keeps the defaults", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "502.html"), []byte("<h1>Acme is restarting: {{.Message}}</h1>"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte("ignored"), 0o644))
+
+		r, err := Load(dir)
+		require.NoError(t, err)
+
+		assert.Equal(t, "<h1>Acme is restarting: down</h1>", writeError(r, "text/html", http.StatusBadGateway, "down").Body.String())
+		assert.Contains(t, writeError(r, "text/html", http.StatusNotFound, "missing").Body.String(), "Served through an iskandar tunnel")
+
+		rec := httptest.NewRecorder()
+		r.WriteInterstitial(rec, "abc.tunnel.example.com", "/__iskndr/continue?next=%2F")
+		assert.Contains(t, rec.Body.String(), "abc.tunnel.example.com")
+	})
+
+	t.Run("rejects unknown template names", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "oops.html"), []byte("x"), 0o644))
+
+		_, err := Load(dir)
+		assert.ErrorContains(t, err, "oops.html")
+	})
+
+	t.Run("rejects invalid templates", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "error.html"), []byte("{{.Message"), 0o644))
+
+		_, err := Load(dir)
+		assert.ErrorContains(t, err, "error.html")
+	})
+
+	t.Run("returns error for a missing directory", func(t *testing.T) {
+		_, err := Load(filepath.Join(t.TempDir(), "missing"))
+		assert.Error(t, err)
+	})
+}
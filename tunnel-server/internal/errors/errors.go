@@ -20,3 +20,12 @@ func (e *TunnelNotRespondingError) Error() string {
 	return "tunnel did not respond"
 }
 func (e *TunnelNotRespondingError) StatusCode() int { return http.StatusBadGateway }
+
+/* LocalAppError is an error response the CLI sent because the local application couldn't answer. */
+type LocalAppError struct {
+	Status  int
+	Message string
+}
+
+func (e *LocalAppError) Error() string   { return e.Message }
+func (e *LocalAppError) StatusCode() int { return e.Status }
@@ -0,0 +1,200 @@
+package forwarded
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const (
+	HeaderForwardedFor   = "X-Forwarded-For"
+	HeaderForwardedProto = "X-Forwarded-Proto"
+	HeaderForwardedHost  = "X-Forwarded-Host"
+	HeaderForwarded      = "Forwarded"
+)
+
+/* Proxies (e.g. nginx in front of the server) whose forwarding headers we keep instead of overwriting. */
+type TrustedProxies struct {
+	prefixes []netip.Prefix
+}
+
+func ParseTrustedProxies(values []string) (*TrustedProxies, error) {
+	trusted := &TrustedProxies{}
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", value, err)
+			}
+			trusted.prefixes = append(trusted.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", value, err)
+		}
+		trusted.prefixes = append(trusted.prefixes, prefix.Masked())
+	}
+	return trusted, nil
+}
+
+func (t *TrustedProxies) Contains(addr netip.Addr) bool {
+	if t == nil || !addr.IsValid() {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range t.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Apply sets X-Forwarded-For/Proto/Host and RFC 7239 Forwarded on the headers sent to the tunnel.
+Incoming values are only kept when the direct peer is a trusted proxy, otherwise they are replaced
+so public clients cannot spoof their address.
+*/
+func Apply(headers http.Header, r *http.Request, trusted *TrustedProxies) {
+	remoteIP := remoteAddr(r.RemoteAddr)
+	fromTrustedProxy := trusted.Contains(remoteIP)
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	host := r.Host
+
+	if fromTrustedProxy {
+		if v := firstValue(headers.Get(HeaderForwardedProto)); v != "" {
+			proto = v
+		}
+		if v := firstValue(headers.Get(HeaderForwardedHost)); v != "" {
+			host = v
+		}
+		/* Most proxies only send X-Forwarded-For, keep the chain visible in Forwarded as well. */
+		if headers.Get(HeaderForwarded) == "" && headers.Get(HeaderForwardedFor) != "" {
+			headers.Set(HeaderForwarded, forwardedChain(headers.Get(HeaderForwardedFor)))
+		}
+	} else {
+		headers.Del(HeaderForwardedFor)
+		headers.Del(HeaderForwarded)
+	}
+
+	clientIP := ""
+	if remoteIP.IsValid() {
+		clientIP = remoteIP.Unmap().String()
+	}
+
+	if clientIP != "" {
+		if prior := headers.Get(HeaderForwardedFor); prior != "" {
+			headers.Set(HeaderForwardedFor, prior+", "+clientIP)
+		} else {
+			headers.Set(HeaderForwardedFor, clientIP)
+		}
+	}
+	headers.Set(HeaderForwardedProto, proto)
+	headers.Set(HeaderForwardedHost, host)
+
+	element := forwardedElement(remoteIP, proto, host)
+	if prior := headers.Get(HeaderForwarded); prior != "" {
+		headers.Set(HeaderForwarded, prior+", "+element)
+	} else {
+		headers.Set(HeaderForwarded, element)
+	}
+}
+
+/* FromTrustedProxy reports whether the request's direct peer is one of the trusted proxies. */
+func FromTrustedProxy(r *http.Request, trusted *TrustedProxies) bool {
+	return trusted.Contains(remoteAddr(r.RemoteAddr))
+}
+
+/*
+ClientIP is the address of the public client. Behind trusted proxies it is the last address in
+X-Forwarded-For that isn't a trusted proxy itself.
+*/
+func ClientIP(r *http.Request, trusted *TrustedProxies) string {
+	remoteIP := remoteAddr(r.RemoteAddr)
+	if !remoteIP.IsValid() {
+		return r.RemoteAddr
+	}
+	if !trusted.Contains(remoteIP) {
+		return remoteIP.Unmap().String()
+	}
+
+	hops := strings.Split(r.Header.Get(HeaderForwardedFor), ",")
+	for idx := len(hops) - 1; idx >= 0; idx-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[idx]))
+		if err != nil {
+			break
+		}
+		remoteIP = hop
+		if !trusted.Contains(hop) {
+			break
+		}
+	}
+	return remoteIP.Unmap().String()
+}
+
+func forwardedElement(remoteIP netip.Addr, proto, host string) string {
+	return "for=" + forwardedNode(remoteIP) + ";proto=" + proto + ";host=" + quoteIfNeeded(host)
+}
+
+func forwardedChain(forwardedFor string) string {
+	elements := []string{}
+	for _, value := range strings.Split(forwardedFor, ",") {
+		addr, err := netip.ParseAddr(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+		elements = append(elements, "for="+forwardedNode(addr))
+	}
+	return strings.Join(elements, ", ")
+}
+
+func forwardedNode(addr netip.Addr) string {
+	if !addr.IsValid() {
+		return "unknown"
+	}
+	addr = addr.Unmap()
+	if addr.Is6() {
+		return `"[` + addr.String() + `]"`
+	}
+	return addr.String()
+}
+
+/* RFC 7239 values containing a colon (host:port) must be sent as quoted strings. */
+func quoteIfNeeded(value string) string {
+	if strings.ContainsAny(value, ":[]") {
+		return `"` + value + `"`
+	}
+	return value
+}
+
+func remoteAddr(remote string) netip.Addr {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr
+}
+
+func firstValue(value string) string {
+	if idx := strings.Index(value, ","); idx != -1 {
+		value = value[:idx]
+	}
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,148 @@
+package forwarded
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	t.Run("parses addresses and CIDR ranges", func(t *testing.T) {
+		trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8", " 127.0.0.1 ", "", "::1"})
+		require.NoError(t, err)
+
+		assert.True(t, trusted.Contains(netip.MustParseAddr("10.1.2.3")))
+		assert.True(t, trusted.Contains(netip.MustParseAddr("127.0.0.1")))
+		assert.True(t, trusted.Contains(netip.MustParseAddr("::1")))
+		assert.False(t, trusted.Contains(netip.MustParseAddr("192.168.1.1")))
+	})
+
+	t.Run("matches IPv4-mapped IPv6 addresses", func(t *testing.T) {
+		trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8"})
+		require.NoError(t, err)
+
+		assert.True(t, trusted.Contains(netip.MustParseAddr("::ffff:10.0.0.1")))
+	})
+
+	t.Run("returns error for invalid values", func(t *testing.T) {
+		_, err := ParseTrustedProxies([]string{"not-an-ip"})
+		assert.Error(t, err)
+
+		_, err = ParseTrustedProxies([]string{"10.0.0.0/99"})
+		assert.Error(t, err)
+	})
+
+	t.Run("nil trusted proxies trust nobody", func(t *testing.T) {
+		var trusted *TrustedProxies
+		assert.False(t, trusted.Contains(netip.MustParseAddr("127.0.0.1")))
+	})
+}
+
+func TestApply(t *testing.T) {
+	t.Run("sets headers from the direct connection", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/callback", nil)
+		r.RemoteAddr = "203.0.113.7:51234"
+		r.Host = "abc123.tunnel.example.com"
+
+		headers := r.Header.Clone()
+		Apply(headers, r, nil)
+
+		assert.Equal(t, "203.0.113.7", headers.Get(HeaderForwardedFor))
+		assert.Equal(t, "http", headers.Get(HeaderForwardedProto))
+		assert.Equal(t, "abc123.tunnel.example.com", headers.Get(HeaderForwardedHost))
+		assert.Equal(t, "for=203.0.113.7;proto=http;host=abc123.tunnel.example.com", headers.Get(HeaderForwarded))
+	})
+
+	t.Run("uses https for TLS connections", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.TLS = &tls.ConnectionState{}
+
+		headers := r.Header.Clone()
+		Apply(headers, r, nil)
+
+		assert.Equal(t, "https", headers.Get(HeaderForwardedProto))
+	})
+
+	t.Run("replaces spoofed headers from untrusted peers", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "203.0.113.7:51234"
+		r.Host = "abc123.localhost.direct:8080"
+		r.Header.Set(HeaderForwardedFor, "1.2.3.4")
+		r.Header.Set(HeaderForwardedProto, "https")
+		r.Header.Set(HeaderForwardedHost, "evil.example.com")
+		r.Header.Set(HeaderForwarded, "for=1.2.3.4")
+
+		headers := r.Header.Clone()
+		Apply(headers, r, nil)
+
+		assert.Equal(t, "203.0.113.7", headers.Get(HeaderForwardedFor))
+		assert.Equal(t, "http", headers.Get(HeaderForwardedProto))
+		assert.Equal(t, "abc123.localhost.direct:8080", headers.Get(HeaderForwardedHost))
+		assert.Equal(t, `for=203.0.113.7;proto=http;host="abc123.localhost.direct:8080"`, headers.Get(HeaderForwarded))
+	})
+
+	t.Run("appends to headers from trusted proxies", func(t *testing.T) {
+		trusted, err := ParseTrustedProxies([]string{"172.16.0.0/12"})
+		require.NoError(t, err)
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "172.18.0.2:40000"
+		r.Host = "abc123.tunnel.example.com"
+		r.Header.Set(HeaderForwardedFor, "198.51.100.1")
+		r.Header.Set(HeaderForwardedProto, "https")
+		r.Header.Set(HeaderForwardedHost, "abc123.tunnel.example.com")
+
+		headers := r.Header.Clone()
+		Apply(headers, r, trusted)
+
+		assert.Equal(t, "198.51.100.1, 172.18.0.2", headers.Get(HeaderForwardedFor))
+		assert.Equal(t, "https", headers.Get(HeaderForwardedProto))
+		assert.Equal(t, "abc123.tunnel.example.com", headers.Get(HeaderForwardedHost))
+		assert.Equal(t, "for=198.51.100.1, for=172.18.0.2;proto=https;host=abc123.tunnel.example.com", headers.Get(HeaderForwarded))
+	})
+
+	t.Run("quotes IPv6 addresses in Forwarded", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "[2001:db8::1]:443"
+		r.Host = "abc123.tunnel.example.com"
+
+		headers := r.Header.Clone()
+		Apply(headers, r, nil)
+
+		assert.Equal(t, "2001:db8::1", headers.Get(HeaderForwardedFor))
+		assert.Equal(t, `for="[2001:db8::1]";proto=http;host=abc123.tunnel.example.com`, headers.Get(HeaderForwarded))
+	})
+
+	t.Run("does not modify the original request headers", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/", nil)
+		headers := r.Header.Clone()
+		Apply(headers, r, nil)
+
+		assert.Empty(t, r.Header.Get(HeaderForwardedFor))
+		assert.Equal(t, http.Header{}, r.Header)
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+
+	request := func(remoteAddr, forwardedFor string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			r.Header.Set(HeaderForwardedFor, forwardedFor)
+		}
+		return r
+	}
+
+	assert.Equal(t, "203.0.113.7", ClientIP(request("203.0.113.7:5000", "1.2.3.4"), trusted), "untrusted peers can't spoof")
+	assert.Equal(t, "1.2.3.4", ClientIP(request("10.0.0.2:5000", "1.2.3.4"), trusted))
+	assert.Equal(t, "1.2.3.4", ClientIP(request("10.0.0.2:5000", "9.9.9.9, 1.2.3.4, 10.0.0.1"), trusted))
+	assert.Equal(t, "10.0.0.2", ClientIP(request("10.0.0.2:5000", ""), trusted))
+}
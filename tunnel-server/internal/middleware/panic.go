@@ -3,13 +3,17 @@ package middleware
 import (
 	"net/http"
 
-	"github.com/igneel64/iskandar/server/internal/logger"
+	"github.com/igneel64/iskandar/server/logger"
 )
 
 func PanicRecoveryMiddleware(next http.Handler, logger logger.Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
+				/* Deliberately dropped connections, net/http closes them without logging. */
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
 				logger.PanicRecovered(r.URL.Path, err)
 				http.Error(w, "Internal server error", http.StatusInternalServerError)
 			}
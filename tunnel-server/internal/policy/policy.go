@@ -0,0 +1,297 @@
+/*
+Package policy evaluates traffic policies: header rewrites, CORS, redirects and denies applied at the
+edge before a request reaches the tunnel.
+*/
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/igneel64/iskandar/shared/pathmatch"
+	"github.com/igneel64/iskandar/shared/protocol"
+	"github.com/igneel64/iskandar/shared/webhook"
+)
+
+const (
+	defaultDenyStatus     = http.StatusForbidden
+	defaultDenyMessage    = "Request denied by the tunnel's policy"
+	defaultRedirectStatus = http.StatusFound
+)
+
+type Engine struct {
+	rules []rule
+	cors  *protocol.CORSPolicy
+}
+
+type rule struct {
+	protocol.PolicyRule
+	methods map[string]bool
+	/* Set for patterns ending in /**, the glob the leading segments have to match. */
+	prefix   string
+	isPrefix bool
+	verifier *webhook.Verifier
+}
+
+/*
+New compiles the policies into one engine. Rules of later policies are evaluated after those of earlier
+ones and their CORS settings replace earlier ones. Nil means there is nothing to apply.
+*/
+func New(policies ...protocol.TrafficPolicy) (*Engine, error) {
+	e := &Engine{}
+	for _, policy := range policies {
+		for idx, r := range policy.Rules {
+			compiled, err := compile(r)
+			if err != nil {
+				return nil, fmt.Errorf("invalid policy rule %d: %w", idx+1, err)
+			}
+			e.rules = append(e.rules, compiled)
+		}
+		if policy.CORS != nil {
+			if len(policy.CORS.AllowOrigins) == 0 {
+				return nil, errors.New("invalid cors policy: allow_origins is empty")
+			}
+			e.cors = policy.CORS
+		}
+	}
+	if len(e.rules) == 0 && e.cors == nil {
+		return nil, nil
+	}
+	return e, nil
+}
+
+func compile(r protocol.PolicyRule) (rule, error) {
+	if r.Deny == nil && r.Redirect == nil && r.RequestHeaders == nil && r.ResponseHeaders == nil && r.Webhook == nil {
+		return rule{}, errors.New("no action, expected deny, redirect, request_headers, response_headers or webhook")
+	}
+	if r.Deny != nil && r.Deny.Status != 0 && (r.Deny.Status < 400 || r.Deny.Status > 599) {
+		return rule{}, fmt.Errorf("deny status %d is not an error status", r.Deny.Status)
+	}
+	if r.Redirect != nil {
+		if r.Redirect.To == "" {
+			return rule{}, errors.New("redirect without a target")
+		}
+		switch r.Redirect.Status {
+		case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return rule{}, fmt.Errorf("redirect status %d is not a redirect", r.Redirect.Status)
+		}
+	}
+
+	compiled := rule{PolicyRule: r}
+	if r.Webhook != nil {
+		if r.Webhook.SecretEnv != "" {
+			return rule{}, errors.New("webhook secret_env is only supported in policy files")
+		}
+		verifier, err := webhook.NewVerifier(webhook.Options{Scheme: r.Webhook.Scheme, Secret: r.Webhook.Secret, Header: r.Webhook.Header})
+		if err != nil {
+			return rule{}, err
+		}
+		compiled.verifier = verifier
+	}
+	if len(r.Methods) > 0 {
+		compiled.methods = make(map[string]bool, len(r.Methods))
+		for _, method := range r.Methods {
+			compiled.methods[strings.ToUpper(method)] = true
+		}
+	}
+
+	pattern := r.Path
+	if strings.HasSuffix(pattern, "/**") {
+		compiled.isPrefix = true
+		compiled.prefix = strings.TrimSuffix(pattern, "/**")
+		pattern = compiled.prefix
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return rule{}, fmt.Errorf("invalid path %q: %w", r.Path, err)
+	}
+	return compiled, nil
+}
+
+/* Reports whether the rule applies and, for /** patterns, the rest of the path below the prefix. */
+func (r *rule) match(method, requestPath string) (string, bool) {
+	if r.methods != nil && !r.methods[method] {
+		return "", false
+	}
+	if r.isPrefix {
+		return pathmatch.MatchPrefix(r.prefix, requestPath)
+	}
+	if r.Path == "" {
+		return "", true
+	}
+	ok, _ := path.Match(r.Path, requestPath)
+	return "", ok
+}
+
+/* Evaluation is the outcome of the policy for one request. */
+type Evaluation struct {
+	/* Deny, Redirect or Preflight are set when the policy answers the request itself. */
+	Deny      *protocol.PolicyDeny
+	Redirect  *protocol.PolicyRedirect
+	Preflight bool
+
+	requestHeaders  []*protocol.HeaderRules
+	responseHeaders []*protocol.HeaderRules
+	cors            http.Header
+	webhooks        []*webhook.Verifier
+}
+
+/* Evaluate runs the rules in order until one denies or redirects the request. */
+func (e *Engine) Evaluate(r *http.Request) *Evaluation {
+	evaluation := &Evaluation{}
+	if e == nil {
+		return evaluation
+	}
+
+	for idx := range e.rules {
+		rule := &e.rules[idx]
+		rest, ok := rule.match(r.Method, r.URL.Path)
+		if !ok {
+			continue
+		}
+		if rule.RequestHeaders != nil {
+			evaluation.requestHeaders = append(evaluation.requestHeaders, rule.RequestHeaders)
+		}
+		if rule.ResponseHeaders != nil {
+			evaluation.responseHeaders = append(evaluation.responseHeaders, rule.ResponseHeaders)
+		}
+		if rule.verifier != nil {
+			evaluation.webhooks = append(evaluation.webhooks, rule.verifier)
+		}
+		if rule.Deny != nil {
+			evaluation.Deny = &protocol.PolicyDeny{Status: rule.Deny.Status, Message: rule.Deny.Message}
+			if evaluation.Deny.Status == 0 {
+				evaluation.Deny.Status = defaultDenyStatus
+			}
+			if evaluation.Deny.Message == "" {
+				evaluation.Deny.Message = defaultDenyMessage
+			}
+			break
+		}
+		if rule.Redirect != nil {
+			evaluation.Redirect = &protocol.PolicyRedirect{To: redirectTarget(rule.Redirect.To, rest, r.URL.RawQuery), Status: rule.Redirect.Status}
+			if evaluation.Redirect.Status == 0 {
+				evaluation.Redirect.Status = defaultRedirectStatus
+			}
+			break
+		}
+	}
+
+	if e.cors != nil {
+		evaluation.cors, evaluation.Preflight = corsHeaders(e.cors, r)
+		if evaluation.Deny != nil || evaluation.Redirect != nil {
+			evaluation.Preflight = false
+		}
+	}
+	return evaluation
+}
+
+func redirectTarget(to, rest, rawQuery string) string {
+	if rest != "" {
+		to = strings.TrimSuffix(to, "/") + rest
+	}
+	if rawQuery != "" && !strings.Contains(to, "?") {
+		to += "?" + rawQuery
+	}
+	return to
+}
+
+/* VerifyWebhooks checks the signatures of the matching webhook rules against the request body. */
+func (e *Evaluation) VerifyWebhooks(header http.Header, body []byte) error {
+	for _, verifier := range e.webhooks {
+		if err := verifier.Verify(header, body); err != nil {
+			return fmt.Errorf("%s webhook: %w", verifier.Scheme(), err)
+		}
+	}
+	return nil
+}
+
+/* RewriteRequest applies the request header rules to the headers forwarded to the tunnel. */
+func (e *Evaluation) RewriteRequest(header http.Header) {
+	for _, rules := range e.requestHeaders {
+		rewrite(header, rules)
+	}
+}
+
+/* RewriteResponse applies the response header rules and CORS headers to the response to the public client. */
+func (e *Evaluation) RewriteResponse(header http.Header) {
+	for _, rules := range e.responseHeaders {
+		rewrite(header, rules)
+	}
+	for k, v := range e.cors {
+		if k == "Vary" {
+			header.Add(k, v[0])
+			continue
+		}
+		header[k] = v
+	}
+}
+
+func rewrite(header http.Header, rules *protocol.HeaderRules) {
+	for _, name := range rules.Remove {
+		header.Del(name)
+	}
+	for name, value := range rules.Set {
+		header.Set(name, value)
+	}
+	for name, value := range rules.Add {
+		header.Add(name, value)
+	}
+}
+
+/* Returns the CORS headers for an allowed origin and whether the request is a preflight to answer right away. */
+func corsHeaders(cors *protocol.CORSPolicy, r *http.Request) (http.Header, bool) {
+	origin := r.Header.Get("Origin")
+	if origin == "" || !originAllowed(cors.AllowOrigins, origin) {
+		return nil, false
+	}
+
+	header := http.Header{}
+	if slices.Contains(cors.AllowOrigins, "*") && !cors.AllowCredentials {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Set("Vary", "Origin")
+	}
+	if cors.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	requestedMethod := r.Header.Get("Access-Control-Request-Method")
+	if r.Method != http.MethodOptions || requestedMethod == "" {
+		if len(cors.ExposeHeaders) > 0 {
+			header.Set("Access-Control-Expose-Headers", strings.Join(cors.ExposeHeaders, ", "))
+		}
+		return header, false
+	}
+
+	/* Without configured lists the preflight allows what the browser asked for. */
+	if len(cors.AllowMethods) > 0 {
+		header.Set("Access-Control-Allow-Methods", strings.Join(cors.AllowMethods, ", "))
+	} else {
+		header.Set("Access-Control-Allow-Methods", requestedMethod)
+	}
+	if len(cors.AllowHeaders) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(cors.AllowHeaders, ", "))
+	} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		header.Set("Access-Control-Allow-Headers", requested)
+	}
+	if cors.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(cors.MaxAge))
+	}
+	return header, true
+}
+
+func originAllowed(allowed []string, origin string) bool {
+	for _, candidate := range allowed {
+		if candidate == "*" || strings.EqualFold(candidate, origin) {
+			return true
+		}
+	}
+	return false
+}
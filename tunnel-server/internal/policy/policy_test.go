@@ -0,0 +1,185 @@
+package policy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/igneel64/iskandar/shared/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	t.Run("returns nil without rules or CORS", func(t *testing.T) {
+		engine, err := New(protocol.TrafficPolicy{}, protocol.TrafficPolicy{})
+		require.NoError(t, err)
+		assert.Nil(t, engine)
+		assert.Equal(t, &Evaluation{}, engine.Evaluate(httptest.NewRequest("GET", "/", nil)))
+	})
+
+	t.Run("rejects invalid rules", func(t *testing.T) {
+		for name, rule := range map[string]protocol.PolicyRule{
+			"no action":         {Path: "/admin"},
+			"bad pattern":       {Path: "/[", Deny: &protocol.PolicyDeny{}},
+			"deny success":      {Deny: &protocol.PolicyDeny{Status: http.StatusOK}},
+			"redirect target":   {Redirect: &protocol.PolicyRedirect{}},
+			"redirect status":   {Redirect: &protocol.PolicyRedirect{To: "/new", Status: http.StatusOK}},
+			"bad prefix glob":   {Path: "/[/**", Deny: &protocol.PolicyDeny{}},
+			"methods no action": {Methods: []string{"GET"}},
+			"webhook scheme":    {Webhook: &protocol.WebhookVerification{Scheme: "gitlab", Secret: "s"}},
+			"webhook secret":    {Webhook: &protocol.WebhookVerification{Scheme: "github"}},
+			"webhook env":       {Webhook: &protocol.WebhookVerification{Scheme: "github", SecretEnv: "SECRET"}},
+		} {
+			_, err := New(protocol.TrafficPolicy{Rules: []protocol.PolicyRule{rule}})
+			assert.Error(t, err, name)
+		}
+
+		_, err := New(protocol.TrafficPolicy{CORS: &protocol.CORSPolicy{}})
+		assert.Error(t, err, "CORS without origins")
+	})
+}
+
+func TestEvaluate(t *testing.T) {
+	t.Run("denies by method and path", func(t *testing.T) {
+		engine, err := New(protocol.TrafficPolicy{Rules: []protocol.PolicyRule{
+			{Methods: []string{"delete"}, Path: "/orders/*", Deny: &protocol.PolicyDeny{}},
+			{Path: "/admin/**", Deny: &protocol.PolicyDeny{Status: http.StatusNotFound, Message: "Not here"}},
+		}})
+		require.NoError(t, err)
+
+		assert.Equal(t, &protocol.PolicyDeny{Status: http.StatusForbidden, Message: defaultDenyMessage}, engine.Evaluate(httptest.NewRequest("DELETE", "/orders/1", nil)).Deny)
+		assert.Nil(t, engine.Evaluate(httptest.NewRequest("GET", "/orders/1", nil)).Deny)
+		assert.Nil(t, engine.Evaluate(httptest.NewRequest("DELETE", "/orders/1/items", nil)).Deny, "* doesn't cross segments")
+
+		assert.Equal(t, http.StatusNotFound, engine.Evaluate(httptest.NewRequest("GET", "/admin", nil)).Deny.Status)
+		assert.Equal(t, "Not here", engine.Evaluate(httptest.NewRequest("GET", "/admin/users/1", nil)).Deny.Message)
+		assert.Nil(t, engine.Evaluate(httptest.NewRequest("GET", "/administrator", nil)).Deny)
+	})
+
+	t.Run("redirects and keeps the rest of the path and query", func(t *testing.T) {
+		engine, err := New(protocol.TrafficPolicy{Rules: []protocol.PolicyRule{
+			{Path: "/old/**", Redirect: &protocol.PolicyRedirect{To: "/new/", Status: http.StatusPermanentRedirect}},
+			{Path: "/docs", Redirect: &protocol.PolicyRedirect{To: "https://docs.example.com?ref=tunnel"}},
+		}})
+		require.NoError(t, err)
+
+		redirect := engine.Evaluate(httptest.NewRequest("GET", "/old/a/b?page=2", nil)).Redirect
+		assert.Equal(t, &protocol.PolicyRedirect{To: "/new/a/b?page=2", Status: http.StatusPermanentRedirect}, redirect)
+
+		redirect = engine.Evaluate(httptest.NewRequest("GET", "/docs?page=2", nil)).Redirect
+		assert.Equal(t, &protocol.PolicyRedirect{To: "https://docs.example.com?ref=tunnel", Status: http.StatusFound}, redirect)
+	})
+
+	t.Run("rewrites headers of every matching rule until a deny", func(t *testing.T) {
+		engine, err := New(
+			protocol.TrafficPolicy{Rules: []protocol.PolicyRule{
+				{RequestHeaders: &protocol.HeaderRules{Remove: []string{"Cookie"}, Set: map[string]string{"X-Env": "staging"}}},
+			}},
+			protocol.TrafficPolicy{Rules: []protocol.PolicyRule{
+				{Path: "/api/**", RequestHeaders: &protocol.HeaderRules{Add: map[string]string{"X-Env": "api"}}, ResponseHeaders: &protocol.HeaderRules{Set: map[string]string{"Cache-Control": "no-store"}, Remove: []string{"Server"}}},
+				{Path: "/api/internal/**", Deny: &protocol.PolicyDeny{}},
+				{Path: "/api/**", RequestHeaders: &protocol.HeaderRules{Set: map[string]string{"X-Unreached": "true"}}},
+			}},
+		)
+		require.NoError(t, err)
+
+		evaluation := engine.Evaluate(httptest.NewRequest("GET", "/api/orders", nil))
+		request := http.Header{"Cookie": {"session=1"}, "X-Env": {"prod"}}
+		evaluation.RewriteRequest(request)
+		assert.Equal(t, http.Header{"X-Env": {"staging", "api"}, "X-Unreached": {"true"}}, request)
+
+		response := http.Header{"Server": {"local"}}
+		evaluation.RewriteResponse(response)
+		assert.Equal(t, http.Header{"Cache-Control": {"no-store"}}, response)
+
+		evaluation = engine.Evaluate(httptest.NewRequest("GET", "/api/internal/keys", nil))
+		request = http.Header{}
+		evaluation.RewriteRequest(request)
+		assert.NotNil(t, evaluation.Deny)
+		assert.Empty(t, request.Get("X-Unreached"), "rules after a deny are not evaluated")
+	})
+}
+
+func TestVerifyWebhooks(t *testing.T) {
+	engine, err := New(protocol.TrafficPolicy{Rules: []protocol.PolicyRule{
+		{Path: "/hooks/**", Webhook: &protocol.WebhookVerification{Scheme: "hmac", Secret: "s", Header: "X-Signature"}},
+	}})
+	require.NoError(t, err)
+
+	/* HMAC-SHA256 of "{}" with the secret "s". */
+	signed := http.Header{"X-Signature": {"143ca8d517ba1b181025d732b1cf275d90104fca57bb02a565542978aa18c4b6"}}
+	hook := engine.Evaluate(httptest.NewRequest("POST", "/hooks/orders", nil))
+
+	assert.NoError(t, hook.VerifyWebhooks(signed, []byte("{}")))
+	assert.ErrorContains(t, hook.VerifyWebhooks(signed, []byte("{ }")), "signature doesn't match")
+	assert.ErrorContains(t, hook.VerifyWebhooks(http.Header{}, []byte("{}")), "hmac webhook: missing signature")
+	assert.NoError(t, engine.Evaluate(httptest.NewRequest("POST", "/orders", nil)).VerifyWebhooks(http.Header{}, []byte("{}")))
+}
+
+func TestCORS(t *testing.T) {
+	engine, err := New(protocol.TrafficPolicy{CORS: &protocol.CORSPolicy{
+		AllowOrigins:     []string{"https://partner.example.com"},
+		AllowHeaders:     []string{"Content-Type", "Authorization"},
+		ExposeHeaders:    []string{"X-Request-Id"},
+		AllowCredentials: true,
+		MaxAge:           600,
+	}})
+	require.NoError(t, err)
+
+	t.Run("answers preflights of allowed origins", func(t *testing.T) {
+		r := httptest.NewRequest("OPTIONS", "/orders", nil)
+		r.Header.Set("Origin", "https://partner.example.com")
+		r.Header.Set("Access-Control-Request-Method", "PUT")
+
+		evaluation := engine.Evaluate(r)
+		assert.True(t, evaluation.Preflight)
+
+		header := http.Header{}
+		evaluation.RewriteResponse(header)
+		assert.Equal(t, "https://partner.example.com", header.Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "true", header.Get("Access-Control-Allow-Credentials"))
+		assert.Equal(t, "PUT", header.Get("Access-Control-Allow-Methods"))
+		assert.Equal(t, "Content-Type, Authorization", header.Get("Access-Control-Allow-Headers"))
+		assert.Equal(t, "600", header.Get("Access-Control-Max-Age"))
+	})
+
+	t.Run("adds headers to responses and keeps Vary", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/orders", nil)
+		r.Header.Set("Origin", "https://partner.example.com")
+
+		evaluation := engine.Evaluate(r)
+		assert.False(t, evaluation.Preflight)
+
+		header := http.Header{"Vary": {"Accept-Encoding"}, "Access-Control-Allow-Origin": {"*"}}
+		evaluation.RewriteResponse(header)
+		assert.Equal(t, "https://partner.example.com", header.Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "X-Request-Id", header.Get("Access-Control-Expose-Headers"))
+		assert.Equal(t, []string{"Accept-Encoding", "Origin"}, header.Values("Vary"))
+	})
+
+	t.Run("ignores other origins", func(t *testing.T) {
+		r := httptest.NewRequest("OPTIONS", "/orders", nil)
+		r.Header.Set("Origin", "https://evil.example.com")
+		r.Header.Set("Access-Control-Request-Method", "PUT")
+
+		evaluation := engine.Evaluate(r)
+		assert.False(t, evaluation.Preflight, "the preflight goes to the local application")
+
+		header := http.Header{}
+		evaluation.RewriteResponse(header)
+		assert.Empty(t, header)
+	})
+
+	t.Run("allows any origin without credentials", func(t *testing.T) {
+		engine, err := New(protocol.TrafficPolicy{CORS: &protocol.CORSPolicy{AllowOrigins: []string{"*"}}})
+		require.NoError(t, err)
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Origin", "https://anyone.example.com")
+		header := http.Header{}
+		engine.Evaluate(r).RewriteResponse(header)
+		assert.Equal(t, "*", header.Get("Access-Control-Allow-Origin"))
+		assert.Empty(t, header.Get("Vary"))
+	})
+}
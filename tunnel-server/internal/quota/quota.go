@@ -0,0 +1,260 @@
+package quota
+
+import (
+	"crypto/rand"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+var ErrMaxTunnelsPerToken = errors.New("maximum number of tunnels for token reached")
+
+/* Zero values mean unlimited. */
+type Limits struct {
+	RequestsPerSecond float64
+	/* Requests allowed in a burst above the rate, defaults to one second worth of requests. */
+	Burst       int
+	BytesPerDay int64
+}
+
+type Policy struct {
+	Tunnel             Limits
+	Token              Limits
+	MaxTunnelsPerToken int
+}
+
+/*
+Manager enforces the policy for every tunnel and API token. Token usage outlives the tunnels,
+so reconnecting doesn't reset a token's daily bandwidth.
+*/
+type Manager struct {
+	mu      sync.Mutex
+	policy  Policy
+	tunnels map[string]*Tunnel
+	tokens  map[string]*usage
+	now     func() time.Time
+}
+
+func NewManager(policy Policy) *Manager {
+	return &Manager{
+		policy:  policy,
+		tunnels: make(map[string]*Tunnel),
+		tokens:  make(map[string]*usage),
+		now:     time.Now,
+	}
+}
+
+/* Tunnel is the quota handle of a single tunnel, obtained with Open and released with Close. */
+type Tunnel struct {
+	manager   *Manager
+	subdomain string
+	token     string
+	usage     *usage
+	tokenUsed *usage
+
+	maxVisitors int64
+	visitors    map[string]struct{}
+}
+
+/* Open reserves a tunnel for token, an empty token is anonymous and only gets the per-tunnel limits. */
+func (m *Manager) Open(token string) (*Tunnel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	t := &Tunnel{manager: m, token: token, usage: newUsage(m.policy.Tunnel, now)}
+	if token == "" {
+		return t, nil
+	}
+
+	tokenUsed, ok := m.tokens[token]
+	if !ok {
+		tokenUsed = newUsage(m.policy.Token, now)
+		m.tokens[token] = tokenUsed
+	}
+	if m.policy.MaxTunnelsPerToken > 0 && tokenUsed.tunnels >= m.policy.MaxTunnelsPerToken {
+		return nil, ErrMaxTunnelsPerToken
+	}
+	tokenUsed.tunnels++
+	t.tokenUsed = tokenUsed
+
+	return t, nil
+}
+
+/* Attach makes the tunnel available to Get once its subdomain is known. */
+func (m *Manager) Attach(subdomain string, t *Tunnel) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t.subdomain = subdomain
+	m.tunnels[subdomain] = t
+}
+
+/* Get returns the quota handle of a tunnel, nil if it isn't tracked. */
+func (m *Manager) Get(subdomain string) *Tunnel {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.tunnels[subdomain]
+}
+
+func (t *Tunnel) Close() {
+	m := t.manager
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t.subdomain != "" && m.tunnels[t.subdomain] == t {
+		delete(m.tunnels, t.subdomain)
+	}
+	if t.tokenUsed != nil {
+		t.tokenUsed.tunnels--
+		t.tokenUsed = nil
+	}
+}
+
+/*
+Allow takes one request from the tunnel and token budgets. When a limit is hit it returns false
+and how long the caller should wait, suitable for a Retry-After header. A rejected request takes
+nothing from any budget.
+*/
+func (t *Tunnel) Allow() (retryAfter time.Duration, ok bool) {
+	m := t.manager
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	for _, u := range t.usages() {
+		if retryAfter, exceeded := u.bandwidthExceeded(now); exceeded {
+			return retryAfter, false
+		}
+	}
+	for _, u := range t.usages() {
+		if retryAfter, ok := u.requestAvailable(now); !ok {
+			return retryAfter, false
+		}
+	}
+	for _, u := range t.usages() {
+		u.takeRequest()
+	}
+	return 0, true
+}
+
+/* AddBytes counts transferred body bytes against the daily bandwidth of the tunnel and token. */
+func (t *Tunnel) AddBytes(n int64) {
+	m := t.manager
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	for _, u := range t.usages() {
+		u.addBytes(now, n)
+	}
+}
+
+/* LimitVisitors restricts the public URL to n distinct visitors, for one-time or N-use links. */
+func (t *Tunnel) LimitVisitors(n int64) {
+	m := t.manager
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t.maxVisitors = n
+	t.visitors = make(map[string]struct{})
+}
+
+/*
+Visit admits a request from visitorID, an empty or unknown ID is a new visitor that uses up
+one of the tunnel's visits. It returns the ID the visitor should present from now on, false
+once every visit is used up.
+*/
+func (t *Tunnel) Visit(visitorID string) (string, bool) {
+	m := t.manager
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t.maxVisitors <= 0 {
+		return visitorID, true
+	}
+	if _, ok := t.visitors[visitorID]; ok {
+		return visitorID, true
+	}
+	if int64(len(t.visitors)) >= t.maxVisitors {
+		return "", false
+	}
+	visitorID = rand.Text()
+	t.visitors[visitorID] = struct{}{}
+	return visitorID, true
+}
+
+func (t *Tunnel) usages() []*usage {
+	if t.tokenUsed != nil {
+		return []*usage{t.usage, t.tokenUsed}
+	}
+	return []*usage{t.usage}
+}
+
+/* usage is a token bucket for the request rate plus a byte counter that resets at midnight UTC. */
+type usage struct {
+	limits  Limits
+	tokens  float64
+	last    time.Time
+	day     time.Time
+	bytes   int64
+	tunnels int
+}
+
+func newUsage(limits Limits, now time.Time) *usage {
+	u := &usage{limits: limits, last: now, day: startOfDay(now)}
+	u.tokens = u.burst()
+	return u
+}
+
+func (u *usage) burst() float64 {
+	if u.limits.Burst > 0 {
+		return float64(u.limits.Burst)
+	}
+	return math.Max(1, math.Ceil(u.limits.RequestsPerSecond))
+}
+
+/* requestAvailable refills the bucket up to now and reports how long until it holds a request. */
+func (u *usage) requestAvailable(now time.Time) (time.Duration, bool) {
+	rate := u.limits.RequestsPerSecond
+	if rate <= 0 {
+		return 0, true
+	}
+
+	u.tokens = math.Min(u.burst(), u.tokens+now.Sub(u.last).Seconds()*rate)
+	u.last = now
+	if u.tokens >= 1 {
+		return 0, true
+	}
+	return time.Duration((1 - u.tokens) / rate * float64(time.Second)), false
+}
+
+/* takeRequest spends a request, after requestAvailable agreed. */
+func (u *usage) takeRequest() {
+	if u.limits.RequestsPerSecond > 0 {
+		u.tokens--
+	}
+}
+
+func (u *usage) bandwidthExceeded(now time.Time) (time.Duration, bool) {
+	u.rollDay(now)
+	if u.limits.BytesPerDay > 0 && u.bytes >= u.limits.BytesPerDay {
+		return u.day.Add(24 * time.Hour).Sub(now), true
+	}
+	return 0, false
+}
+
+func (u *usage) addBytes(now time.Time, n int64) {
+	u.rollDay(now)
+	u.bytes += n
+}
+
+func (u *usage) rollDay(now time.Time) {
+	if day := startOfDay(now); day.After(u.day) {
+		u.day = day
+		u.bytes = 0
+	}
+}
+
+func startOfDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
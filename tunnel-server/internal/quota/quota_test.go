@@ -0,0 +1,190 @@
+package quota
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestManager(policy Policy, now *time.Time) *Manager {
+	m := NewManager(policy)
+	m.now = func() time.Time { return *now }
+	return m
+}
+
+func TestTunnelAllow(t *testing.T) {
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	t.Run("allows everything without limits", func(t *testing.T) {
+		m := newTestManager(Policy{}, &now)
+		tunnel, err := m.Open("")
+		require.NoError(t, err)
+
+		for range 100 {
+			_, ok := tunnel.Allow()
+			assert.True(t, ok)
+		}
+	})
+
+	t.Run("limits the request rate with a burst", func(t *testing.T) {
+		clock := now
+		m := newTestManager(Policy{Tunnel: Limits{RequestsPerSecond: 2, Burst: 3}}, &clock)
+		tunnel, err := m.Open("")
+		require.NoError(t, err)
+
+		for range 3 {
+			_, ok := tunnel.Allow()
+			assert.True(t, ok)
+		}
+
+		retryAfter, ok := tunnel.Allow()
+		assert.False(t, ok)
+		assert.Equal(t, 500*time.Millisecond, retryAfter)
+
+		clock = clock.Add(500 * time.Millisecond)
+		_, ok = tunnel.Allow()
+		assert.True(t, ok)
+	})
+
+	t.Run("requests rejected by the token limit don't spend the tunnel rate", func(t *testing.T) {
+		clock := now
+		m := newTestManager(Policy{
+			Tunnel: Limits{RequestsPerSecond: 0.001, Burst: 3},
+			Token:  Limits{RequestsPerSecond: 1, Burst: 1},
+		}, &clock)
+		tunnel, err := m.Open("token-a")
+		require.NoError(t, err)
+
+		_, ok := tunnel.Allow()
+		assert.True(t, ok)
+		for range 5 {
+			_, ok = tunnel.Allow()
+			assert.False(t, ok)
+		}
+
+		/* The token refilled, the tunnel still has the two requests the rejections didn't take. */
+		clock = clock.Add(time.Second)
+		_, ok = tunnel.Allow()
+		assert.True(t, ok)
+		assert.InDelta(t, 1, tunnel.usage.tokens, 0.01)
+	})
+
+	t.Run("blocks after the daily bandwidth until midnight UTC", func(t *testing.T) {
+		clock := now
+		m := newTestManager(Policy{Tunnel: Limits{BytesPerDay: 1000}}, &clock)
+		tunnel, err := m.Open("")
+		require.NoError(t, err)
+
+		tunnel.AddBytes(1000)
+		retryAfter, ok := tunnel.Allow()
+		assert.False(t, ok)
+		assert.Equal(t, 12*time.Hour, retryAfter)
+
+		clock = clock.Add(12 * time.Hour)
+		_, ok = tunnel.Allow()
+		assert.True(t, ok)
+	})
+
+	t.Run("shares token limits across tunnels", func(t *testing.T) {
+		m := newTestManager(Policy{Token: Limits{BytesPerDay: 1000}}, &now)
+		first, err := m.Open("token-a")
+		require.NoError(t, err)
+		second, err := m.Open("token-a")
+		require.NoError(t, err)
+		other, err := m.Open("token-b")
+		require.NoError(t, err)
+
+		first.AddBytes(600)
+		second.AddBytes(600)
+
+		_, ok := first.Allow()
+		assert.False(t, ok)
+		_, ok = second.Allow()
+		assert.False(t, ok)
+		_, ok = other.Allow()
+		assert.True(t, ok)
+	})
+
+	t.Run("keeps token usage after the tunnel closes", func(t *testing.T) {
+		m := newTestManager(Policy{Token: Limits{BytesPerDay: 1000}}, &now)
+		tunnel, err := m.Open("token-a")
+		require.NoError(t, err)
+		tunnel.AddBytes(1000)
+		tunnel.Close()
+
+		reopened, err := m.Open("token-a")
+		require.NoError(t, err)
+		_, ok := reopened.Allow()
+		assert.False(t, ok)
+	})
+}
+
+func TestManagerTunnels(t *testing.T) {
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	t.Run("caps tunnels per token", func(t *testing.T) {
+		m := newTestManager(Policy{MaxTunnelsPerToken: 1}, &now)
+
+		first, err := m.Open("token-a")
+		require.NoError(t, err)
+
+		_, err = m.Open("token-a")
+		assert.ErrorIs(t, err, ErrMaxTunnelsPerToken)
+
+		_, err = m.Open("")
+		assert.NoError(t, err, "anonymous tunnels are not counted")
+
+		first.Close()
+		_, err = m.Open("token-a")
+		assert.NoError(t, err)
+	})
+
+	t.Run("tracks attached tunnels until closed", func(t *testing.T) {
+		m := newTestManager(Policy{}, &now)
+		tunnel, err := m.Open("")
+		require.NoError(t, err)
+
+		m.Attach("abc123", tunnel)
+		assert.Same(t, tunnel, m.Get("abc123"))
+
+		tunnel.Close()
+		assert.Nil(t, m.Get("abc123"))
+	})
+}
+
+func TestTunnelVisit(t *testing.T) {
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	t.Run("admits everyone without a visitor limit", func(t *testing.T) {
+		tunnel, err := newTestManager(Policy{}, &now).Open("")
+		require.NoError(t, err)
+
+		for range 10 {
+			_, ok := tunnel.Visit("")
+			assert.True(t, ok)
+		}
+	})
+
+	t.Run("admits returning visitors once all visits are used", func(t *testing.T) {
+		tunnel, err := newTestManager(Policy{}, &now).Open("")
+		require.NoError(t, err)
+		tunnel.LimitVisitors(2)
+
+		first, ok := tunnel.Visit("")
+		require.True(t, ok)
+		assert.NotEmpty(t, first)
+
+		second, ok := tunnel.Visit("forged")
+		require.True(t, ok)
+		assert.NotEqual(t, first, second)
+
+		_, ok = tunnel.Visit("")
+		assert.False(t, ok)
+
+		id, ok := tunnel.Visit(first)
+		assert.True(t, ok)
+		assert.Equal(t, first, id)
+	})
+}
@@ -0,0 +1,126 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	AccessFormatCombined = "combined"
+	AccessFormatJSON     = "json"
+)
+
+/* AccessEntry describes one proxied public request. */
+type AccessEntry struct {
+	Time       time.Time
+	RemoteAddr string
+	Method     string
+	URI        string
+	Proto      string
+	Status     int
+	Bytes      int64
+	Duration   time.Duration
+	Referer    string
+	UserAgent  string
+	Subdomain  string
+	RequestID  string
+}
+
+type AccessLogger interface {
+	Log(entry AccessEntry)
+}
+
+type accessLogger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	format string
+}
+
+/*
+NewAccessLogger writes one line per request to out, either in the Apache/nginx Combined format
+followed by the subdomain, request ID and duration in seconds, or as JSON.
+*/
+func NewAccessLogger(format string, out io.Writer) (AccessLogger, error) {
+	if format != AccessFormatCombined && format != AccessFormatJSON {
+		return nil, fmt.Errorf("invalid access log format %q: must be %q or %q", format, AccessFormatCombined, AccessFormatJSON)
+	}
+	return &accessLogger{out: out, format: format}, nil
+}
+
+func (a *accessLogger) Log(entry AccessEntry) {
+	var line []byte
+	if a.format == AccessFormatJSON {
+		line = jsonAccessLine(entry)
+	} else {
+		line = combinedAccessLine(entry)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, _ = a.out.Write(line)
+}
+
+func combinedAccessLine(e AccessEntry) []byte {
+	bytesSent := "-"
+	if e.Bytes > 0 {
+		bytesSent = strconv.FormatInt(e.Bytes, 10)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s - - [%s] %s %d %s %s %s %s %s %.3f\n",
+		orDash(e.RemoteAddr),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.Method+" "+e.URI+" "+e.Proto),
+		e.Status,
+		bytesSent,
+		strconv.Quote(orDash(e.Referer)),
+		strconv.Quote(orDash(e.UserAgent)),
+		orDash(e.Subdomain),
+		orDash(e.RequestID),
+		e.Duration.Seconds(),
+	)
+	return b.Bytes()
+}
+
+func jsonAccessLine(e AccessEntry) []byte {
+	line, _ := json.Marshal(struct {
+		Time       string  `json:"time"`
+		RemoteAddr string  `json:"remote_addr"`
+		Method     string  `json:"method"`
+		URI        string  `json:"uri"`
+		Proto      string  `json:"proto"`
+		Status     int     `json:"status"`
+		Bytes      int64   `json:"bytes"`
+		DurationMs float64 `json:"duration_ms"`
+		Referer    string  `json:"referer,omitempty"`
+		UserAgent  string  `json:"user_agent,omitempty"`
+		Subdomain  string  `json:"subdomain,omitempty"`
+		RequestID  string  `json:"request_id"`
+	}{
+		Time:       e.Time.Format(time.RFC3339Nano),
+		RemoteAddr: e.RemoteAddr,
+		Method:     e.Method,
+		URI:        e.URI,
+		Proto:      e.Proto,
+		Status:     e.Status,
+		Bytes:      e.Bytes,
+		DurationMs: float64(e.Duration.Microseconds()) / 1000,
+		Referer:    e.Referer,
+		UserAgent:  e.UserAgent,
+		Subdomain:  e.Subdomain,
+		RequestID:  e.RequestID,
+	})
+	return append(line, '\n')
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
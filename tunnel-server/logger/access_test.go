@@ -0,0 +1,84 @@
+package logger
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testAccessEntry = AccessEntry{
+	Time:       time.Date(2026, 3, 1, 14, 5, 9, 0, time.UTC),
+	RemoteAddr: "203.0.113.7",
+	Method:     "GET",
+	URI:        "/search?q=\"tunnel\"",
+	Proto:      "HTTP/1.1",
+	Status:     200,
+	Bytes:      512,
+	Duration:   1250 * time.Millisecond,
+	UserAgent:  "curl/8.5.0",
+	Subdomain:  "abc123",
+	RequestID:  "req-1",
+}
+
+func TestAccessLogger(t *testing.T) {
+	t.Run("writes the combined format", func(t *testing.T) {
+		var out bytes.Buffer
+		accessLogger, err := NewAccessLogger(AccessFormatCombined, &out)
+		require.NoError(t, err)
+
+		accessLogger.Log(testAccessEntry)
+		assert.Equal(t, `203.0.113.7 - - [01/Mar/2026:14:05:09 +0000] "GET /search?q=\"tunnel\" HTTP/1.1" 200 512 "-" "curl/8.5.0" abc123 req-1 1.250`+"\n", out.String())
+	})
+
+	t.Run("writes JSON lines", func(t *testing.T) {
+		var out bytes.Buffer
+		accessLogger, err := NewAccessLogger(AccessFormatJSON, &out)
+		require.NoError(t, err)
+
+		accessLogger.Log(testAccessEntry)
+		assert.JSONEq(t, `{
+			"time": "2026-03-01T14:05:09Z",
+			"remote_addr": "203.0.113.7",
+			"method": "GET",
+			"uri": "/search?q=\"tunnel\"",
+			"proto": "HTTP/1.1",
+			"status": 200,
+			"bytes": 512,
+			"duration_ms": 1250,
+			"user_agent": "curl/8.5.0",
+			"subdomain": "abc123",
+			"request_id": "req-1"
+		}`, out.String())
+	})
+
+	t.Run("rejects unknown formats", func(t *testing.T) {
+		_, err := NewAccessLogger("common", &bytes.Buffer{})
+		assert.Error(t, err)
+	})
+}
+
+func TestNew(t *testing.T) {
+	t.Run("writes JSON at the configured level", func(t *testing.T) {
+		var out bytes.Buffer
+		logger, err := New(Options{Format: FormatJSON, Level: "warn", Output: &out})
+		require.NoError(t, err)
+
+		logger.TunnelConnected("abc123", "203.0.113.7:5000")
+		assert.Empty(t, out.String())
+
+		logger.TunnelUnauthorized("203.0.113.7:5000")
+		assert.Contains(t, out.String(), `"level":"warn"`)
+		assert.Contains(t, out.String(), `"remote_addr":"203.0.113.7:5000"`)
+	})
+
+	t.Run("rejects invalid options", func(t *testing.T) {
+		_, err := New(Options{Format: "xml"})
+		assert.Error(t, err)
+
+		_, err = New(Options{Level: "loud"})
+		assert.Error(t, err)
+	})
+}
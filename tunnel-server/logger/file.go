@@ -0,0 +1,30 @@
+package logger
+
+import (
+	"io"
+	"os"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+/* Rotation of a log file, a MaxSizeMB of 0 appends to the file without ever rotating it. */
+type Rotation struct {
+	MaxSizeMB  int
+	MaxBackups int
+	MaxAgeDays int
+}
+
+/* OpenFile opens path for appending log lines, rotated files are gzipped next to it. */
+func OpenFile(path string, rotation Rotation) (io.WriteCloser, error) {
+	if rotation.MaxSizeMB <= 0 {
+		return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	}
+
+	return &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    rotation.MaxSizeMB,
+		MaxBackups: rotation.MaxBackups,
+		MaxAge:     rotation.MaxAgeDays,
+		Compress:   true,
+	}, nil
+}
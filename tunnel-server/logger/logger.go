@@ -1,16 +1,23 @@
 package logger
 
 import (
+	"fmt"
+	"io"
 	"os"
 	"time"
 
+	"github.com/igneel64/iskandar/shared"
+	"github.com/igneel64/iskandar/shared/protocol"
 	"github.com/rs/zerolog"
 )
 
 type Logger interface {
 	ServerStarted(port int)
 	TunnelConnected(subdomain, remoteAddr string)
+	TunnelLimitsApplied(subdomain string, limits protocol.TunnelLimits)
 	TunnelDisconnected(subdomain string, err error)
+	TunnelTraffic(subdomain string, stats shared.TrafficStats)
+	TunnelExpired(subdomain string, ttl time.Duration)
 	TunnelRegistrationFailed(err error)
 	HTTPRequestReceived(subdomain, method, path, remoteAddr string)
 	TunnelNotFound(subdomain, host string)
@@ -22,9 +29,20 @@ type Logger interface {
 	StreamingCompleted(requestID string, totalDuration time.Duration)
 	ChannelClosed(requestID string, duration time.Duration)
 	RequestTimeout(requestID, subdomain, path string)
+	StreamIdleTimeout(requestID, subdomain, path string)
 	ResponseWriteFailed(requestID string, bytesExpected, bytesWritten int, err error)
 	WebSocketCloseFailed(subdomain string, err error)
 	MaxTunnelsReached()
+	MaxTunnelsPerTokenReached(remoteAddr string)
+	TunnelUnauthorized(remoteAddr string)
+	RequestRateLimited(subdomain, path string, retryAfter time.Duration)
+	VisitorRejected(subdomain, remoteAddr string)
+	RequestDenied(subdomain, path string, status int)
+	ConnectionDropped(requestId, subdomain string)
+	RequestRedirected(subdomain, path, location string)
+	WebhookRejected(subdomain, path string, err error)
+	TunnelHealthChanged(subdomain, health string)
+	TunnelUnhealthy(subdomain, path string)
 	MaxRequestsPerTunnelReached(subdomain string)
 	RequestRegistrationFailed(requestId, subdomain string, err error)
 	RequestBodyTooLarge(subdomain, path string)
@@ -35,20 +53,56 @@ type ZerologLogger struct {
 	log zerolog.Logger
 }
 
+/* NewLogger logs at info level to stderr in a human readable format, or nothing when disabled. */
 func NewLogger(enabled bool) Logger {
-	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-
-	var logger zerolog.Logger
-	if enabled {
-		logger = zerolog.New(zerolog.ConsoleWriter{
-			Out:        os.Stderr,
-			TimeFormat: time.RFC3339,
-		}).With().Timestamp().Logger().Level(zerolog.InfoLevel)
-	} else {
-		logger = zerolog.New(os.Stderr).Level(zerolog.Disabled)
+	if !enabled {
+		return &ZerologLogger{log: zerolog.New(os.Stderr).Level(zerolog.Disabled)}
 	}
 
-	return &ZerologLogger{log: logger}
+	logger, _ := New(Options{})
+	return logger
+}
+
+const (
+	FormatConsole = "console"
+	FormatJSON    = "json"
+)
+
+/* Zero values log at info level to stderr in the console format. */
+type Options struct {
+	Format string
+	/* One of zerolog's levels: trace, debug, info, warn, error, fatal, panic, disabled. */
+	Level  string
+	Output io.Writer
+}
+
+/* New creates a logger writing JSON lines for log pipelines, or the console format for humans. */
+func New(opts Options) (Logger, error) {
+	/* Sub-second timestamps keep JSON lines of one request in order, the console format shows RFC3339 either way. */
+	zerolog.TimeFieldFormat = time.RFC3339Nano
+
+	level := zerolog.InfoLevel
+	if opts.Level != "" {
+		var err error
+		if level, err = zerolog.ParseLevel(opts.Level); err != nil {
+			return nil, fmt.Errorf("invalid log level %q", opts.Level)
+		}
+	}
+
+	out := opts.Output
+	if out == nil {
+		out = os.Stderr
+	}
+
+	switch opts.Format {
+	case "", FormatConsole:
+		out = zerolog.ConsoleWriter{Out: out, TimeFormat: time.RFC3339}
+	case FormatJSON:
+	default:
+		return nil, fmt.Errorf("invalid log format %q: must be %q or %q", opts.Format, FormatConsole, FormatJSON)
+	}
+
+	return &ZerologLogger{log: zerolog.New(out).With().Timestamp().Logger().Level(level)}, nil
 }
 
 func (l *ZerologLogger) ServerStarted(port int) {
@@ -64,6 +118,18 @@ func (l *ZerologLogger) TunnelConnected(subdomain, remoteAddr string) {
 		Msg("Tunnel connected")
 }
 
+func (l *ZerologLogger) TunnelLimitsApplied(subdomain string, limits protocol.TunnelLimits) {
+	l.log.Info().
+		Str("subdomain", subdomain).
+		Int64("max_body_size", limits.MaxBodySize).
+		Dur("response_timeout", limits.ResponseTimeout).
+		Dur("stream_idle_timeout", limits.StreamIdleTimeout).
+		Dur("event_stream_idle_timeout", limits.EventStreamIdleTimeout).
+		Dur("ttl", limits.TTL).
+		Int64("max_uses", limits.MaxUses).
+		Msg("Tunnel limits applied")
+}
+
 func (l *ZerologLogger) TunnelDisconnected(subdomain string, err error) {
 	l.log.Info().
 		Str("subdomain", subdomain).
@@ -71,6 +137,24 @@ func (l *ZerologLogger) TunnelDisconnected(subdomain string, err error) {
 		Msg("Tunnel disconnected")
 }
 
+func (l *ZerologLogger) TunnelTraffic(subdomain string, stats shared.TrafficStats) {
+	l.log.Info().
+		Str("subdomain", subdomain).
+		Int64("payload_bytes_sent", stats.PayloadWritten).
+		Int64("payload_bytes_received", stats.PayloadRead).
+		Int64("wire_bytes_sent", stats.WireWritten).
+		Int64("wire_bytes_received", stats.WireRead).
+		Int64("bytes_saved", stats.BytesSaved()).
+		Msg("Tunnel traffic")
+}
+
+func (l *ZerologLogger) TunnelExpired(subdomain string, ttl time.Duration) {
+	l.log.Info().
+		Str("subdomain", subdomain).
+		Dur("ttl", ttl).
+		Msg("Tunnel expired")
+}
+
 func (l *ZerologLogger) TunnelRegistrationFailed(err error) {
 	l.log.Error().
 		Err(err).
@@ -158,6 +242,14 @@ func (l *ZerologLogger) RequestTimeout(requestID, subdomain, path string) {
 		Msg("Request timeout")
 }
 
+func (l *ZerologLogger) StreamIdleTimeout(requestID, subdomain, path string) {
+	l.log.Warn().
+		Str("request_id", requestID).
+		Str("subdomain", subdomain).
+		Str("path", path).
+		Msg("Streaming response idle timeout")
+}
+
 func (l *ZerologLogger) ResponseWriteFailed(requestID string, bytesExpected, bytesWritten int, err error) {
 	l.log.Info().
 		Str("request_id", requestID).
@@ -179,6 +271,78 @@ func (l *ZerologLogger) MaxTunnelsReached() {
 		Msg("Maximum number of tunnels reached")
 }
 
+func (l *ZerologLogger) MaxTunnelsPerTokenReached(remoteAddr string) {
+	l.log.Warn().
+		Str("remote_addr", remoteAddr).
+		Msg("Max tunnels per token reached")
+}
+
+func (l *ZerologLogger) TunnelUnauthorized(remoteAddr string) {
+	l.log.Warn().
+		Str("remote_addr", remoteAddr).
+		Msg("Tunnel connection with missing or invalid token")
+}
+
+func (l *ZerologLogger) RequestRateLimited(subdomain, path string, retryAfter time.Duration) {
+	l.log.Warn().
+		Str("subdomain", subdomain).
+		Str("path", path).
+		Dur("retry_after", retryAfter).
+		Msg("Request rate limited")
+}
+
+func (l *ZerologLogger) VisitorRejected(subdomain, remoteAddr string) {
+	l.log.Warn().
+		Str("subdomain", subdomain).
+		Str("remote_addr", remoteAddr).
+		Msg("Visitor rejected, link used up")
+}
+
+func (l *ZerologLogger) RequestDenied(subdomain, path string, status int) {
+	l.log.Info().
+		Str("subdomain", subdomain).
+		Str("path", path).
+		Int("status", status).
+		Msg("Request denied by policy")
+}
+
+func (l *ZerologLogger) ConnectionDropped(requestId, subdomain string) {
+	l.log.Info().
+		Str("request_id", requestId).
+		Str("subdomain", subdomain).
+		Msg("Connection dropped on request of the CLI")
+}
+
+func (l *ZerologLogger) WebhookRejected(subdomain, path string, err error) {
+	l.log.Warn().
+		Err(err).
+		Str("subdomain", subdomain).
+		Str("path", path).
+		Msg("Webhook signature verification failed")
+}
+
+func (l *ZerologLogger) TunnelHealthChanged(subdomain, health string) {
+	l.log.Info().
+		Str("subdomain", subdomain).
+		Str("health", health).
+		Msg("Tunnel health changed")
+}
+
+func (l *ZerologLogger) TunnelUnhealthy(subdomain, path string) {
+	l.log.Info().
+		Str("subdomain", subdomain).
+		Str("path", path).
+		Msg("Request answered for unhealthy application")
+}
+
+func (l *ZerologLogger) RequestRedirected(subdomain, path, location string) {
+	l.log.Info().
+		Str("subdomain", subdomain).
+		Str("path", path).
+		Str("location", location).
+		Msg("Request redirected by policy")
+}
+
 func (l *ZerologLogger) MaxRequestsPerTunnelReached(subdomain string) {
 	l.log.Error().
 		Str("subdomain", subdomain).
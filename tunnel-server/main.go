@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
-	"net/http"
 	"net/url"
+	"os"
 
 	"github.com/igneel64/iskandar/server/internal/config"
-	"github.com/igneel64/iskandar/server/internal/logger"
+	"github.com/igneel64/iskandar/server/logger"
+	"github.com/igneel64/iskandar/server/tunnelserver"
+	"github.com/igneel64/iskandar/shared/tracing"
 	"github.com/joho/godotenv"
+	"go.opentelemetry.io/otel"
 )
 
 func main() {
@@ -18,17 +23,86 @@ func main() {
 		log.Fatalf("Failed to load environment config: %v", err)
 	}
 
-	appLogger := logger.NewLogger(cfg.Logging)
+	appLogger, accessLogger, err := newLoggers(cfg)
+	if err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+
+	/* Spans are exported in batches every few seconds, the server only stops when it is killed so there's nothing to flush. */
+	if _, err := tracing.Setup(context.Background(), tracing.Options{
+		ServiceName: "iskndr-server",
+		Endpoint:    cfg.OTLPEndpoint,
+		SampleRatio: cfg.TraceSampleRatio,
+	}); err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
 
 	publicURLBase, err := url.Parse(cfg.BaseScheme + "://" + cfg.BaseDomain)
 	if err != nil {
 		log.Fatalf("Failed to parse public URL base: %v", err)
 	}
-	connectionStore := NewInMemoryConnectionStore(cfg.MaxTunnels)
-	requestManager := NewInMemoryRequestManager(cfg.MaxRequestsPerTunnel)
 
-	server := NewIskndrServer(publicURLBase, connectionStore, requestManager, appLogger)
+	limitsPolicy := cfg.LimitsPolicy()
+	quotaPolicy := cfg.QuotaPolicy()
+	server, err := tunnelserver.NewIskndrServer(publicURLBase,
+		tunnelserver.WithConnectionStore(tunnelserver.NewInMemoryConnectionStore(cfg.MaxTunnels, cfg.MaxMessageSize)),
+		tunnelserver.WithRequestManager(tunnelserver.NewInMemoryRequestManager(cfg.MaxRequestsPerTunnel)),
+		tunnelserver.WithLimits(limitsPolicy.Defaults, limitsPolicy.Ceilings),
+		tunnelserver.WithTrustedProxies(cfg.TrustedProxies...),
+		tunnelserver.WithRequestIdHeader(cfg.RequestIdHeader),
+		tunnelserver.WithCompression(cfg.Compression),
+		tunnelserver.WithEventStreamKeepAlive(cfg.EventStreamKeepAlive),
+		tunnelserver.WithTokens(cfg.Tokens...),
+		tunnelserver.WithQuotas(quotaPolicy.Tunnel, quotaPolicy.Token, quotaPolicy.MaxTunnelsPerToken),
+		tunnelserver.WithErrorPages(cfg.ErrorPagesDir),
+		tunnelserver.WithInterstitial(cfg.Interstitial),
+		tunnelserver.WithPolicyFile(cfg.PolicyFile),
+		tunnelserver.WithLogger(appLogger),
+		tunnelserver.WithAccessLog(accessLogger),
+		tunnelserver.WithTracerProvider(otel.GetTracerProvider()),
+	)
+	if err != nil {
+		log.Fatalf("Failed to create tunnel server: %v", err)
+	}
+
+	httpServer := tunnelserver.NewHTTPServer(fmt.Sprintf(":%d", cfg.Port), server, cfg.H2C)
 
 	appLogger.ServerStarted(cfg.Port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), server))
+	if cfg.TLSCertFile != "" {
+		log.Fatal(httpServer.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile))
+	}
+	log.Fatal(httpServer.ListenAndServe())
+}
+
+func newLoggers(cfg *config.Config) (logger.Logger, logger.AccessLogger, error) {
+	appLogger := logger.NewLogger(false)
+	if cfg.Logging {
+		out, err := logOutput(cfg.LogFile, os.Stderr, cfg.LogRotation())
+		if err != nil {
+			return nil, nil, err
+		}
+		if appLogger, err = logger.New(logger.Options{Format: cfg.LogFormat, Level: cfg.LogLevel, Output: out}); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if cfg.AccessLog == "" {
+		return appLogger, nil, nil
+	}
+	out, err := logOutput(cfg.AccessLogFile, os.Stdout, cfg.LogRotation())
+	if err != nil {
+		return nil, nil, err
+	}
+	accessLogger, err := logger.NewAccessLogger(cfg.AccessLog, out)
+	if err != nil {
+		return nil, nil, err
+	}
+	return appLogger, accessLogger, nil
+}
+
+func logOutput(file string, fallback io.Writer, rotation logger.Rotation) (io.Writer, error) {
+	if file == "" {
+		return fallback, nil
+	}
+	return logger.OpenFile(file, rotation)
 }
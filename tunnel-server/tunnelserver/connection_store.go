@@ -1,4 +1,4 @@
-package main
+package tunnelserver
 
 import (
 	"crypto/rand"
@@ -6,38 +6,47 @@ import (
 	"fmt"
 	"math/big"
 	"sync"
+	"sync/atomic"
 
 	"github.com/gorilla/websocket"
 	"github.com/igneel64/iskandar/shared"
+	"github.com/igneel64/iskandar/shared/protocol"
 )
 
-const ConReadLimit = 4 * 1024 * 1024 // 4 MB
+type TunnelConnection struct {
+	Conn   *shared.SafeWebSocketConn
+	Limits protocol.TunnelLimits
+	/* Reported by the CLI's health checks, requests get a 503 without a round trip while set. */
+	Unhealthy atomic.Bool
+}
 
 type ConnectionStore interface {
-	RegisterConnection(conn *websocket.Conn) (string, error)
-	GetConnection(subdomainKey string) (*shared.SafeWebSocketConn, error)
+	RegisterConnection(conn *websocket.Conn, limits protocol.TunnelLimits) (string, error)
+	GetConnection(subdomainKey string) (*TunnelConnection, error)
 	RemoveConnection(subdomainKey string)
 }
 
 var ErrMaxTunnelsReached = errors.New("maximum number of tunnels reached")
 
 type InMemoryConnectionStore struct {
-	connMap    map[string]*shared.SafeWebSocketConn
+	connMap    map[string]*TunnelConnection
 	mu         sync.RWMutex
 	maxTunnels int
+	readLimit  int64
 }
 
-func NewInMemoryConnectionStore(maxTunnels int) *InMemoryConnectionStore {
+func NewInMemoryConnectionStore(maxTunnels int, readLimit int64) *InMemoryConnectionStore {
 	return &InMemoryConnectionStore{
-		connMap:    make(map[string]*shared.SafeWebSocketConn),
+		connMap:    make(map[string]*TunnelConnection),
 		maxTunnels: maxTunnels,
+		readLimit:  readLimit,
 	}
 }
 
-func (i *InMemoryConnectionStore) RegisterConnection(conn *websocket.Conn) (string, error) {
+func (i *InMemoryConnectionStore) RegisterConnection(conn *websocket.Conn, limits protocol.TunnelLimits) (string, error) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
-	conn.SetReadLimit(ConReadLimit)
+	conn.SetReadLimit(i.readLimit)
 
 	if len(i.connMap) >= i.maxTunnels {
 		return "", ErrMaxTunnelsReached
@@ -47,11 +56,14 @@ func (i *InMemoryConnectionStore) RegisterConnection(conn *websocket.Conn) (stri
 	if err != nil {
 		return "", err
 	}
-	i.connMap[subdomainKey] = shared.NewSafeWebSocketConn(conn)
+	i.connMap[subdomainKey] = &TunnelConnection{
+		Conn:   shared.NewSafeWebSocketConn(conn),
+		Limits: limits,
+	}
 	return subdomainKey, nil
 }
 
-func (i *InMemoryConnectionStore) GetConnection(subdomainKey string) (*shared.SafeWebSocketConn, error) {
+func (i *InMemoryConnectionStore) GetConnection(subdomainKey string) (*TunnelConnection, error) {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
 	conn, exists := i.connMap[subdomainKey]
@@ -1,4 +1,4 @@
-package main
+package tunnelserver
 
 import (
 	"net/http"
@@ -7,6 +7,7 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/igneel64/iskandar/shared"
+	"github.com/igneel64/iskandar/shared/protocol"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -40,40 +41,40 @@ func TestInMemoryConnectionStore(t *testing.T) {
 	maxConnections := 10
 	t.Run("registers connection", func(t *testing.T) {
 		t.Parallel()
-		connectionStore := NewInMemoryConnectionStore(maxConnections)
+		connectionStore := NewInMemoryConnectionStore(maxConnections, 4*1024*1024)
 		conn := createWSServerConnection(t)
-		subdomain, err := connectionStore.RegisterConnection(conn)
+		subdomain, err := connectionStore.RegisterConnection(conn, protocol.TunnelLimits{})
 		assert.NoError(t, err)
 		assert.Len(t, connectionStore.connMap, 1)
 		assert.NotNil(t, connectionStore.connMap[subdomain])
-		assert.IsType(t, &shared.SafeWebSocketConn{}, connectionStore.connMap[subdomain])
+		assert.IsType(t, &shared.SafeWebSocketConn{}, connectionStore.connMap[subdomain].Conn)
 	})
 
 	t.Run("gets registered connection", func(t *testing.T) {
 		t.Parallel()
-		connectionStore := NewInMemoryConnectionStore(maxConnections)
+		connectionStore := NewInMemoryConnectionStore(maxConnections, 4*1024*1024)
 		conn := createWSServerConnection(t)
-		subdomain, err := connectionStore.RegisterConnection(conn)
+		subdomain, err := connectionStore.RegisterConnection(conn, protocol.TunnelLimits{})
 		require.NoError(t, err)
 
 		retrievedConn, err := connectionStore.GetConnection(subdomain)
 		assert.NoError(t, err)
 		assert.NotNil(t, retrievedConn)
-		assert.IsType(t, &shared.SafeWebSocketConn{}, retrievedConn)
+		assert.IsType(t, &shared.SafeWebSocketConn{}, retrievedConn.Conn)
 	})
 
 	t.Run("returns error for non-existent connection", func(t *testing.T) {
 		t.Parallel()
-		connectionStore := NewInMemoryConnectionStore(maxConnections)
+		connectionStore := NewInMemoryConnectionStore(maxConnections, 4*1024*1024)
 		_, err := connectionStore.GetConnection("nonexistent")
 		assert.Error(t, err)
 	})
 
 	t.Run("removes registered connection", func(t *testing.T) {
 		t.Parallel()
-		connectionStore := NewInMemoryConnectionStore(maxConnections)
+		connectionStore := NewInMemoryConnectionStore(maxConnections, 4*1024*1024)
 		conn := createWSServerConnection(t)
-		subdomain, err := connectionStore.RegisterConnection(conn)
+		subdomain, err := connectionStore.RegisterConnection(conn, protocol.TunnelLimits{})
 		require.NoError(t, err)
 
 		connectionStore.RemoveConnection(subdomain)
@@ -84,9 +85,9 @@ func TestInMemoryConnectionStore(t *testing.T) {
 
 	t.Run("enforces maximum connections", func(t *testing.T) {
 		t.Parallel()
-		connectionStore := NewInMemoryConnectionStore(0)
+		connectionStore := NewInMemoryConnectionStore(0, 4*1024*1024)
 		conn := createWSServerConnection(t)
-		_, err := connectionStore.RegisterConnection(conn)
+		_, err := connectionStore.RegisterConnection(conn, protocol.TunnelLimits{})
 		assert.Error(t, err)
 		assert.ErrorIs(t, err, ErrMaxTunnelsReached)
 	})
@@ -0,0 +1,24 @@
+package tunnelserver
+
+import (
+	"net/http"
+	"time"
+)
+
+/*
+NewHTTPServer serves handler over HTTP/1.1 and, with TLS, HTTP/2. h2c adds HTTP/2 with prior knowledge
+on plain connections, which is what gRPC clients use against http:// URLs.
+*/
+func NewHTTPServer(addr string, handler http.Handler, h2c bool) *http.Server {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(h2c)
+
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		Protocols:         protocols,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
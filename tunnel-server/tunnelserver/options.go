@@ -0,0 +1,201 @@
+package tunnelserver
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/igneel64/iskandar/server/internal/config"
+	"github.com/igneel64/iskandar/server/internal/errorpage"
+	"github.com/igneel64/iskandar/server/internal/forwarded"
+	"github.com/igneel64/iskandar/server/internal/policy"
+	"github.com/igneel64/iskandar/server/internal/quota"
+	"github.com/igneel64/iskandar/server/logger"
+	"github.com/igneel64/iskandar/shared/protocol"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	DefaultMaxTunnels           = 100
+	DefaultMaxRequestsPerTunnel = 50
+	DefaultMaxMessageSize       = 4 * 1024 * 1024 // 4 MB
+	DefaultRequestIdHeader      = "X-Request-Id"
+)
+
+var DefaultLimits = protocol.TunnelLimits{
+	MaxBodySize:            4 * 1024 * 1024, // 4 MB
+	ResponseTimeout:        30 * time.Second,
+	StreamIdleTimeout:      30 * time.Second,
+	EventStreamIdleTimeout: 10 * time.Minute,
+}
+
+var DefaultLimitCeilings = protocol.TunnelLimits{
+	MaxBodySize:            32 * 1024 * 1024, // 32 MB
+	ResponseTimeout:        5 * time.Minute,
+	StreamIdleTimeout:      10 * time.Minute,
+	EventStreamIdleTimeout: 24 * time.Hour,
+}
+
+const tracerName = "github.com/igneel64/iskandar/server/tunnelserver"
+
+type Option func(*IskndrServer) error
+
+func WithConnectionStore(store ConnectionStore) Option {
+	return func(i *IskndrServer) error {
+		i.connStore = store
+		return nil
+	}
+}
+
+func WithRequestManager(requestManager RequestManager) Option {
+	return func(i *IskndrServer) error {
+		i.requestManager = requestManager
+		return nil
+	}
+}
+
+func WithLogger(logger logger.Logger) Option {
+	return func(i *IskndrServer) error {
+		i.logger = logger
+		return nil
+	}
+}
+
+/* WithLimits sets the per-tunnel defaults and the ceilings up to which a CLI may raise them. */
+func WithLimits(defaults, ceilings protocol.TunnelLimits) Option {
+	return func(i *IskndrServer) error {
+		i.limitsPolicy = config.LimitsPolicy{Defaults: defaults, Ceilings: ceilings}
+		return nil
+	}
+}
+
+/* WithTrustedProxies accepts IPs or CIDR ranges of proxies whose X-Forwarded-* headers are kept. */
+func WithTrustedProxies(proxies ...string) Option {
+	return func(i *IskndrServer) error {
+		trustedProxies, err := forwarded.ParseTrustedProxies(proxies)
+		if err != nil {
+			return err
+		}
+		i.trustedProxies = trustedProxies
+		return nil
+	}
+}
+
+/* WithCompression toggles permessage-deflate for CLIs that offer it, it is enabled by default. */
+func WithCompression(enabled bool) Option {
+	return func(i *IskndrServer) error {
+		i.compression = enabled
+		return nil
+	}
+}
+
+/* WithEventStreamKeepAlive sends a comment on text/event-stream responses that were quiet for interval. */
+func WithEventStreamKeepAlive(interval time.Duration) Option {
+	return func(i *IskndrServer) error {
+		i.eventStreamKeepAlive = interval
+		return nil
+	}
+}
+
+/* WithTokens requires CLIs to connect with one of the given API tokens. */
+func WithTokens(tokens ...string) Option {
+	return func(i *IskndrServer) error {
+		i.tokens = nil
+		for _, token := range tokens {
+			if token != "" {
+				i.tokens = append(i.tokens, token)
+			}
+		}
+		return nil
+	}
+}
+
+/* QuotaLimits are a requests per second rate (with burst) and a daily bandwidth, zero values mean unlimited. */
+type QuotaLimits = quota.Limits
+
+/*
+WithQuotas limits every tunnel and, shared by all its tunnels, every API token.
+Requests over a limit get a 429 with Retry-After.
+*/
+func WithQuotas(tunnel, token QuotaLimits, maxTunnelsPerToken int) Option {
+	return func(i *IskndrServer) error {
+		i.quotas = quota.NewManager(quota.Policy{Tunnel: tunnel, Token: token, MaxTunnelsPerToken: maxTunnelsPerToken})
+		return nil
+	}
+}
+
+/*
+WithErrorPages renders the pages public visitors see from the templates in dir: <status>.html,
+error.html as the fallback and interstitial.html. Missing templates keep the built-in pages.
+*/
+func WithErrorPages(dir string) Option {
+	return func(i *IskndrServer) error {
+		if dir == "" {
+			return nil
+		}
+		errorPages, err := errorpage.Load(dir)
+		if err != nil {
+			return err
+		}
+		i.errorPages = errorPages
+		return nil
+	}
+}
+
+/* WithInterstitial warns browsers on their first visit of a tunnel that its content isn't vetted, to deter phishing. */
+func WithInterstitial(enabled bool) Option {
+	return func(i *IskndrServer) error {
+		i.interstitial = enabled
+		return nil
+	}
+}
+
+/* WithAccessLog logs every public request, e.g. with logger.NewAccessLogger. */
+func WithAccessLog(accessLog logger.AccessLogger) Option {
+	return func(i *IskndrServer) error {
+		i.accessLog = accessLog
+		return nil
+	}
+}
+
+/* WithTracerProvider records a span per public request, the global provider set up by tracing.Setup is used by default. */
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(i *IskndrServer) error {
+		i.tracer = provider.Tracer(tracerName)
+		return nil
+	}
+}
+
+/*
+WithRequestIdHeader sets the header carrying the request ID to the local application and back to the
+public client, X-Request-Id by default. IDs sent by trusted proxies in this header are kept.
+*/
+func WithRequestIdHeader(name string) Option {
+	return func(i *IskndrServer) error {
+		if name != "" {
+			i.requestIdHeader = http.CanonicalHeaderKey(name)
+		}
+		return nil
+	}
+}
+
+/*
+WithPolicyFile applies the JSON traffic policy in path to every tunnel, before the rules a CLI sends
+with its tunnel. An empty path applies no policy.
+*/
+func WithPolicyFile(path string) Option {
+	return func(i *IskndrServer) error {
+		if path == "" {
+			return nil
+		}
+		trafficPolicy, err := protocol.LoadTrafficPolicy(path)
+		if err != nil {
+			return err
+		}
+		if _, err := policy.New(trafficPolicy); err != nil {
+			return fmt.Errorf("invalid policy %s: %w", path, err)
+		}
+		i.trafficPolicy = trafficPolicy
+		return nil
+	}
+}
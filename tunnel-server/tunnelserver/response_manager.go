@@ -1,4 +1,4 @@
-package main
+package tunnelserver
 
 import (
 	"errors"
@@ -16,6 +16,7 @@ type RequestManager interface {
 }
 
 var ErrMaxRequestsPerTunnel = errors.New("maximum number of concurrent requests per tunnel reached")
+var ErrDuplicateRequestId = errors.New("request ID already in flight")
 
 type InMemoryRequestManager struct {
 	requestChannelMap map[string]MessageChannel
@@ -43,6 +44,9 @@ func (i *InMemoryRequestManager) RegisterRequest(requestId, subdomain string) (M
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
+	if _, ok := i.requestChannelMap[requestId]; ok {
+		return nil, ErrDuplicateRequestId
+	}
 	if i.requestCounts[subdomain] >= i.maxPerTunnel {
 		return nil, ErrMaxRequestsPerTunnel
 	}
@@ -1,4 +1,4 @@
-package main
+package tunnelserver
 
 import (
 	"testing"
@@ -26,6 +26,21 @@ func TestInMemoryRequestManager(t *testing.T) {
 		assert.Equal(t, ch, retrievedCh)
 	})
 
+	t.Run("rejects a request ID already in flight", func(t *testing.T) {
+		t.Parallel()
+		manager := NewInMemoryRequestManager(10)
+
+		ch, err := manager.RegisterRequest("req-1", "subdomain-a")
+		require.NoError(t, err)
+
+		_, err = manager.RegisterRequest("req-1", "subdomain-b")
+		assert.ErrorIs(t, err, ErrDuplicateRequestId)
+		retrievedCh, ok := manager.GetRequestChannel("req-1")
+		assert.True(t, ok)
+		assert.Equal(t, ch, retrievedCh, "the first request keeps its channel")
+		assert.Zero(t, manager.requestCounts["subdomain-b"])
+	})
+
 	t.Run("gets registered request channel", func(t *testing.T) {
 		t.Parallel()
 		manager := NewInMemoryRequestManager(10)
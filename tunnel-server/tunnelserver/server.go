@@ -0,0 +1,866 @@
+package tunnelserver
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/igneel64/iskandar/server/internal/config"
+	"github.com/igneel64/iskandar/server/internal/errorpage"
+	cerrors "github.com/igneel64/iskandar/server/internal/errors"
+	"github.com/igneel64/iskandar/server/internal/forwarded"
+	"github.com/igneel64/iskandar/server/internal/middleware"
+	"github.com/igneel64/iskandar/server/internal/policy"
+	"github.com/igneel64/iskandar/server/internal/quota"
+	"github.com/igneel64/iskandar/server/logger"
+	"github.com/igneel64/iskandar/shared"
+	"github.com/igneel64/iskandar/shared/protocol"
+	"github.com/igneel64/iskandar/shared/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type IskndrServer struct {
+	http.Handler
+	publicURLBase   *url.URL
+	connStore       ConnectionStore
+	requestManager  RequestManager
+	limitsPolicy    config.LimitsPolicy
+	trustedProxies  *forwarded.TrustedProxies
+	compression     bool
+	upgrader        websocket.Upgrader
+	tokens          []string
+	quotas          *quota.Manager
+	errorPages      *errorpage.Renderer
+	accessLog       logger.AccessLogger
+	tracer          trace.Tracer
+	requestIdHeader string
+	trafficPolicy   protocol.TrafficPolicy
+	/* Compiled server and CLI policy of each tunnel. */
+	policies     map[string]*policy.Engine
+	policiesMu   sync.RWMutex
+	interstitial bool
+	logger       logger.Logger
+
+	eventStreamKeepAlive time.Duration
+}
+
+/*
+NewIskndrServer creates a tunnel server handing out subdomains of publicURLBase
+(e.g. http://localhost.direct:8080). Without options it keeps tunnels in memory,
+uses the default limits and doesn't log.
+*/
+func NewIskndrServer(publicURLBase *url.URL, opts ...Option) (*IskndrServer, error) {
+	i := &IskndrServer{
+		publicURLBase: publicURLBase,
+		limitsPolicy: config.LimitsPolicy{
+			Defaults: DefaultLimits,
+			Ceilings: DefaultLimitCeilings,
+		},
+		compression:     true,
+		requestIdHeader: DefaultRequestIdHeader,
+		policies:        make(map[string]*policy.Engine),
+	}
+
+	for _, opt := range opts {
+		if err := opt(i); err != nil {
+			return nil, err
+		}
+	}
+
+	if i.connStore == nil {
+		i.connStore = NewInMemoryConnectionStore(DefaultMaxTunnels, DefaultMaxMessageSize)
+	}
+	if i.requestManager == nil {
+		i.requestManager = NewInMemoryRequestManager(DefaultMaxRequestsPerTunnel)
+	}
+	if i.logger == nil {
+		i.logger = logger.NewLogger(false)
+	}
+	if i.quotas == nil {
+		i.quotas = quota.NewManager(quota.Policy{})
+	}
+	if i.errorPages == nil {
+		i.errorPages = errorpage.Default()
+	}
+	if i.tracer == nil {
+		i.tracer = otel.GetTracerProvider().Tracer(tracerName)
+	}
+
+	i.upgrader = upgrader
+	i.upgrader.EnableCompression = i.compression
+
+	router := http.NewServeMux()
+	router.HandleFunc("/health", i.handleHealth)
+	router.HandleFunc("/tunnel/connect", i.handleTunnelConnect)
+	router.HandleFunc("/", i.handleRequest)
+
+	i.Handler = middleware.PanicRecoveryMiddleware(router, i.logger)
+
+	return i, nil
+}
+
+const (
+	visitorCookie = "iskndr_visitor"
+	/* Remembers that a visitor has seen the first-visit warning. */
+	interstitialCookie = "iskndr_warning_ack"
+	interstitialPath   = "/__iskndr/continue"
+	/* Requests with this header (e.g. from scripts) never get the warning page. */
+	skipInterstitialHeader = "Iskndr-Skip-Warning"
+	/* Time the CLI gets to acknowledge the close of an expired tunnel. */
+	tunnelShutdownGrace = 5 * time.Second
+	maxRequestIdLength  = 128
+	/* Logged for connections dropped on the CLI's request, as nginx does for its "return 444". */
+	statusNoResponse = 444
+)
+
+var errConnectionDropped = errors.New("connection dropped by the CLI")
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin:     func(r *http.Request) bool { return true },
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+/* Hands the upgrader a byte counting connection, so compression savings can be reported per tunnel. */
+type countingHijacker struct {
+	http.ResponseWriter
+}
+
+func (c countingHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(c.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return shared.NewCountingConn(conn), rw, nil
+}
+
+func (i *IskndrServer) handleTunnelConnect(w http.ResponseWriter, r *http.Request) {
+	requestedLimits, err := protocol.ParseTunnelLimits(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limits := i.limitsPolicy.Resolve(requestedLimits)
+
+	requestedPolicy, err := protocol.ParseTrafficPolicy(r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	/* The server's rules come first, so a tunnel can't lift a deny of the operator. */
+	tunnelPolicy, err := policy.New(i.trafficPolicy, requestedPolicy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, ok := i.authenticate(r)
+	if !ok {
+		i.logger.TunnelUnauthorized(r.RemoteAddr)
+		http.Error(w, "Missing or invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	tunnelQuota, err := i.quotas.Open(token)
+	if err != nil {
+		i.logger.MaxTunnelsPerTokenReached(r.RemoteAddr)
+		http.Error(w, "Tunnel limit for token reached", http.StatusTooManyRequests)
+		return
+	}
+	defer tunnelQuota.Close()
+	tunnelQuota.LimitVisitors(limits.MaxUses)
+
+	con, err := i.upgrader.Upgrade(countingHijacker{w}, r, nil)
+	if err != nil {
+		http.Error(w, "Failed to upgrade to websocket", http.StatusInternalServerError)
+		return
+	}
+
+	var subdomainKey string
+
+	defer func() {
+		if err := con.Close(); err != nil {
+			i.logger.WebSocketCloseFailed(subdomainKey, err)
+		}
+	}()
+
+	subdomainKey, err = i.connStore.RegisterConnection(con, limits)
+	if err != nil {
+		if errors.Is(err, ErrMaxTunnelsReached) {
+			i.logger.MaxTunnelsReached()
+			http.Error(w, "Server tunnel capacity reached", http.StatusServiceUnavailable)
+			return
+		}
+		i.logger.TunnelRegistrationFailed(err)
+		http.Error(w, "Failed to register connection", http.StatusInternalServerError)
+		return
+	}
+
+	tunnel, err := i.connStore.GetConnection(subdomainKey)
+	if err != nil {
+		i.logger.TunnelRegistrationFailed(err)
+		return
+	}
+	i.quotas.Attach(subdomainKey, tunnelQuota)
+	i.attachPolicy(subdomainKey, tunnelPolicy)
+	defer i.detachPolicy(subdomainKey)
+
+	i.logger.TunnelConnected(subdomainKey, r.RemoteAddr)
+	i.logger.TunnelLimitsApplied(subdomainKey, limits)
+
+	subdomainURL := config.ExtractSubdomainURL(i.publicURLBase, subdomainKey)
+
+	err = tunnel.Conn.WriteRegistrationMsg(&protocol.RegisterTunnelMessage{Subdomain: subdomainURL, Limits: &limits})
+	if err != nil {
+		http.Error(w, "Failed to send register tunnel message", http.StatusInternalServerError)
+		return
+	}
+
+	if limits.TTL > 0 {
+		expiry := time.AfterFunc(limits.TTL, func() {
+			i.logger.TunnelExpired(subdomainKey, limits.TTL)
+			if err := tunnel.Conn.Shutdown(fmt.Sprintf("Tunnel expired after %s", limits.TTL), tunnelShutdownGrace); err != nil {
+				i.logger.WebSocketCloseFailed(subdomainKey, err)
+			}
+		})
+		defer expiry.Stop()
+	}
+
+	for {
+		var msg protocol.Message
+		if err = tunnel.Conn.ReadJSON(&msg); err != nil {
+			i.logger.TunnelDisconnected(subdomainKey, err)
+			if stats, ok := tunnel.Conn.Stats(); ok {
+				i.logger.TunnelTraffic(subdomainKey, stats)
+			}
+			i.connStore.RemoveConnection(subdomainKey)
+			return
+		}
+
+		if msg.Type == "health" {
+			unhealthy := msg.Health == protocol.HealthUnhealthy
+			if tunnel.Unhealthy.Swap(unhealthy) != unhealthy {
+				i.logger.TunnelHealthChanged(subdomainKey, msg.Health)
+			}
+			continue
+		}
+
+		if ch, ok := i.requestManager.GetRequestChannel(msg.Id); ok {
+			ch <- msg
+		}
+	}
+}
+
+func (i *IskndrServer) handleRequest(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	requestId := i.newRequestId(r)
+	subdomain, err := config.ExtractAssignedSubdomain(r.Host)
+	w.Header().Set(i.requestIdHeader, requestId)
+
+	recorder := &accessResponseWriter{ResponseWriter: w}
+	w = recorder
+
+	/* Only proxies we trust may continue a trace, visitors could otherwise force every request to be sampled. */
+	ctx := r.Context()
+	if forwarded.FromTrustedProxy(r, i.trustedProxies) {
+		ctx = tracing.Propagator.Extract(ctx, propagation.HeaderCarrier(r.Header))
+	}
+	ctx, span := i.tracer.Start(ctx, r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.URLPath(r.URL.Path),
+			semconv.ServerAddress(r.Host),
+			semconv.ClientAddress(forwarded.ClientIP(r, i.trustedProxies)),
+			attribute.String("iskndr.subdomain", subdomain),
+			attribute.String("iskndr.request_id", requestId),
+		),
+	)
+	defer endRequestSpan(span, recorder)
+
+	if i.accessLog != nil {
+		/* The ID may still change when the request is registered. */
+		defer func() { i.logAccess(r, recorder, subdomain, requestId, startTime) }()
+	}
+
+	if err != nil {
+		i.errorPages.WriteError(w, r, http.StatusBadRequest, "Invalid subdomain")
+		return
+	}
+
+	i.logger.HTTPRequestReceived(subdomain, r.Method, r.RequestURI, r.RemoteAddr)
+
+	tunnel, err := i.connStore.GetConnection(subdomain)
+	if err != nil {
+		i.logger.TunnelNotFound(subdomain, r.Host)
+		i.errorPages.WriteError(w, r, http.StatusNotFound, "No tunnel found for subdomain")
+		return
+	}
+
+	evaluation := i.tunnelPolicy(subdomain).Evaluate(r)
+	w = &policyResponseWriter{ResponseWriter: w, evaluation: evaluation}
+	switch {
+	case evaluation.Deny != nil:
+		i.logger.RequestDenied(subdomain, r.RequestURI, evaluation.Deny.Status)
+		i.errorPages.WriteError(w, r, evaluation.Deny.Status, evaluation.Deny.Message)
+		return
+	case evaluation.Redirect != nil:
+		i.logger.RequestRedirected(subdomain, r.RequestURI, evaluation.Redirect.To)
+		http.Redirect(w, r, evaluation.Redirect.To, evaluation.Redirect.Status)
+		return
+	case evaluation.Preflight:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if i.interstitial {
+		if r.URL.Path == interstitialPath {
+			i.acknowledgeInterstitial(w, r)
+			return
+		}
+		if needsInterstitial(r) {
+			i.errorPages.WriteInterstitial(w, r.Host, interstitialPath+"?next="+url.QueryEscape(r.URL.RequestURI()))
+			return
+		}
+	}
+
+	/* Answered before the quota, a visit that can't reach the application shouldn't use up a link. */
+	if tunnel.Unhealthy.Load() {
+		i.logger.TunnelUnhealthy(subdomain, r.RequestURI)
+		i.errorPages.WriteError(w, r, http.StatusServiceUnavailable, "The application behind this tunnel is not available right now")
+		return
+	}
+
+	tunnelQuota := i.quotas.Get(subdomain)
+	if tunnelQuota != nil {
+		if !i.admitVisitor(w, r, tunnelQuota) {
+			i.logger.VisitorRejected(subdomain, r.RemoteAddr)
+			i.errorPages.WriteError(w, r, http.StatusGone, "This link has expired")
+			return
+		}
+		if retryAfter, ok := tunnelQuota.Allow(); !ok {
+			i.logger.RequestRateLimited(subdomain, r.RequestURI, retryAfter)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			i.errorPages.WriteError(w, r, http.StatusTooManyRequests, "Tunnel rate limit exceeded")
+			return
+		}
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, tunnel.Limits.MaxBodySize)
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		if errors.As(err, new(*http.MaxBytesError)) {
+			i.logger.RequestBodyTooLarge(subdomain, r.RequestURI)
+			i.errorPages.WriteError(w, r, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		}
+		i.errorPages.WriteError(w, r, http.StatusInternalServerError, "Failed to read request body")
+		return
+	}
+
+	//nolint:errcheck
+	defer r.Body.Close()
+
+	if err := evaluation.VerifyWebhooks(r.Header, bodyBytes); err != nil {
+		i.logger.WebhookRejected(subdomain, r.RequestURI, err)
+		i.errorPages.WriteError(w, r, http.StatusUnauthorized, "Invalid webhook signature")
+		return
+	}
+
+	if tunnelQuota != nil {
+		tunnelQuota.AddBytes(int64(len(bodyBytes)))
+		w = &quotaResponseWriter{ResponseWriter: w, quota: tunnelQuota}
+	}
+
+	/* Registered before the request is forwarded, the tunnel may answer right away. */
+	ch, err := i.requestManager.RegisterRequest(requestId, subdomain)
+	if errors.Is(err, ErrDuplicateRequestId) {
+		requestId = uuid.New().String()
+		w.Header().Set(i.requestIdHeader, requestId)
+		span.SetAttributes(attribute.String("iskndr.request_id", requestId))
+		ch, err = i.requestManager.RegisterRequest(requestId, subdomain)
+	}
+	if err != nil {
+		if errors.Is(err, ErrMaxRequestsPerTunnel) {
+			i.logger.MaxRequestsPerTunnelReached(subdomain)
+			i.errorPages.WriteError(w, r, http.StatusServiceUnavailable, "Tunnel request capacity reached")
+			return
+		}
+		i.logger.RequestRegistrationFailed(requestId, subdomain, err)
+		i.errorPages.WriteError(w, r, http.StatusInternalServerError, "Failed to register request")
+		return
+	}
+	defer i.requestManager.RemoveRequest(requestId, subdomain)
+
+	headers := r.Header.Clone()
+	removeCookie(headers, visitorCookie)
+	removeCookie(headers, interstitialCookie)
+	forwarded.Apply(headers, r, i.trustedProxies)
+	headers.Set(i.requestIdHeader, requestId)
+	evaluation.RewriteRequest(headers)
+
+	message := &protocol.Message{
+		Type:    "request",
+		Id:      requestId,
+		Body:    bodyBytes,
+		Method:  r.Method,
+		Headers: shared.SerializeHeaders(headers),
+		Path:    r.RequestURI,
+
+		TraceContext: tracing.Inject(ctx),
+	}
+
+	if shared.IsCompressible(r.Header.Get("Content-Encoding"), r.Header.Get("Content-Type")) {
+		err = tunnel.Conn.WriteJSON(message)
+	} else {
+		err = tunnel.Conn.WriteJSONUncompressed(message)
+	}
+	if err != nil {
+		i.logger.RequestForwardFailed(requestId, subdomain, err)
+		i.errorPages.WriteError(w, r, http.StatusBadGateway, "Failed to forward request to tunnel")
+		return
+	}
+
+	i.logger.RequestForwarded(requestId, r.RequestURI, subdomain)
+
+	if err := i.writeProxiedResponse(w, ch, tunnel.Limits, requestId, subdomain, r.RequestURI, r.Method, startTime); err != nil {
+		if errors.Is(err, errConnectionDropped) {
+			if recorder.status == 0 {
+				recorder.status = statusNoResponse
+			}
+			panic(http.ErrAbortHandler)
+		}
+		if httpErr, ok := err.(cerrors.SendableHTTPError); ok {
+			i.errorPages.WriteError(w, r, httpErr.StatusCode(), httpErr.Error())
+		}
+		return
+	}
+}
+
+/*
+The first message is bounded by the tunnel's response timeout (time to first byte), every following
+chunk by the stream idle timeout. Server-Sent Events and responses the CLI marks as chunked use the event
+stream idle timeout instead, only Server-Sent Events get keep-alive comments.
+*/
+func (i *IskndrServer) writeProxiedResponse(w http.ResponseWriter, ch MessageChannel, limits protocol.TunnelLimits, requestId, subdomain, requestURI, requestMethod string, startTime time.Time) error {
+	var response protocol.Message
+	var ok bool
+
+	select {
+	case response, ok = <-ch:
+		if !ok {
+			i.logger.ChannelClosed(requestId, time.Since(startTime))
+			return &cerrors.TunnelNotRespondingError{}
+		}
+	case <-time.After(limits.ResponseTimeout):
+		i.logger.RequestTimeout(requestId, subdomain, requestURI)
+		return &cerrors.TimeoutError{Message: "timeout waiting for tunnel response"}
+	}
+
+	if response.Abort {
+		i.logger.ConnectionDropped(requestId, subdomain)
+		return errConnectionDropped
+	}
+	i.logger.HTTPResponse(subdomain, requestMethod, requestURI, response.Status, time.Since(startTime), requestId)
+	if response.Error != "" {
+		return &cerrors.LocalAppError{Status: response.Status, Message: response.Error}
+	}
+
+	eventStream := isEventStream(response.Headers)
+	idleTimeout := limits.StreamIdleTimeout
+	if eventStream || response.Chunked {
+		idleTimeout = limits.EventStreamIdleTimeout
+	}
+
+	for k, v := range response.Headers {
+		w.Header().Set(k, v)
+	}
+	if len(response.SetCookies) > 0 {
+		w.Header()["Set-Cookie"] = response.SetCookies
+	}
+	/* The local application may answer with its own ID, the public client gets the one in our logs. */
+	w.Header().Set(i.requestIdHeader, requestId)
+	if eventStream {
+		/* Stops nginx from buffering the stream in front of the server. */
+		w.Header().Set("X-Accel-Buffering", "no")
+	}
+	w.WriteHeader(response.Status)
+	if !i.writeChunk(w, requestId, response) {
+		return nil
+	}
+
+	if response.Done {
+		return nil
+	}
+	i.logger.StreamingStarted(requestId, response.Status, len(response.Body))
+
+	idle := time.NewTimer(idleTimeout)
+	defer idle.Stop()
+
+	var keepAlive <-chan time.Time
+	if eventStream && i.eventStreamKeepAlive > 0 {
+		ticker := time.NewTicker(i.eventStreamKeepAlive)
+		defer ticker.Stop()
+		keepAlive = ticker.C
+	}
+	atLineStart := len(response.Body) == 0 || response.Body[len(response.Body)-1] == '\n'
+
+	for !response.Done {
+		select {
+		case response, ok = <-ch:
+			if !ok {
+				i.logger.ChannelClosed(requestId, time.Since(startTime))
+				return nil
+			}
+			if response.Abort {
+				i.logger.ConnectionDropped(requestId, subdomain)
+				return errConnectionDropped
+			}
+
+			if !i.writeChunk(w, requestId, response) {
+				return nil
+			}
+			if len(response.Body) > 0 {
+				atLineStart = response.Body[len(response.Body)-1] == '\n'
+			}
+
+			if response.Done {
+				i.logger.StreamingCompleted(requestId, time.Since(startTime))
+			} else {
+				i.logger.StreamingChunk(requestId, len(response.Body), time.Since(startTime))
+			}
+			idle.Reset(idleTimeout)
+
+		case <-keepAlive:
+			/* A comment line is ignored by EventSource clients, but must not split a line of an event. */
+			if atLineStart {
+				if !i.writeChunk(w, requestId, protocol.Message{Body: []byte(": keep-alive\n")}) {
+					return nil
+				}
+			}
+
+		case <-idle.C:
+			i.logger.StreamIdleTimeout(requestId, subdomain, requestURI)
+			return nil
+		}
+	}
+
+	return nil
+}
+
+/* Writes and flushes a response chunk, false means the public client is gone. */
+func (i *IskndrServer) writeChunk(w http.ResponseWriter, requestId string, response protocol.Message) bool {
+	n, err := w.Write(response.Body)
+	if err != nil {
+		i.logger.ResponseWriteFailed(requestId, len(response.Body), n, err)
+		return false
+	}
+	writeTrailers(w, response.Trailers)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return true
+}
+
+func isEventStream(headers map[string]string) bool {
+	mediaType, _, _ := mime.ParseMediaType(headers["Content-Type"])
+	return mediaType == "text/event-stream"
+}
+
+/* Returns the API token of a tunnel connection, always accepting anonymous ones when no tokens are configured. */
+func (i *IskndrServer) authenticate(r *http.Request) (string, bool) {
+	if len(i.tokens) == 0 {
+		return "", true
+	}
+
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return "", false
+	}
+	for _, known := range i.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+			return known, true
+		}
+	}
+	return "", false
+}
+
+/*
+Remembers visitors of one-time or N-use links with a cookie, so the assets of a page and
+reloads don't count as new visits.
+*/
+func (i *IskndrServer) admitVisitor(w http.ResponseWriter, r *http.Request, tunnelQuota *quota.Tunnel) bool {
+	var presented string
+	if cookie, err := r.Cookie(visitorCookie); err == nil {
+		presented = cookie.Value
+	}
+
+	visitorID, ok := tunnelQuota.Visit(presented)
+	if !ok {
+		return false
+	}
+	if visitorID != presented {
+		http.SetCookie(w, &http.Cookie{
+			Name:     visitorCookie,
+			Value:    visitorID,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   i.publicURLBase.Scheme == "https",
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return true
+}
+
+/* Only browsers navigating to a page are warned, API clients and assets pass through. */
+func needsInterstitial(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.Header.Get(skipInterstitialHeader) != "" {
+		return false
+	}
+	if _, err := r.Cookie(interstitialCookie); err == nil {
+		return false
+	}
+	return errorpage.Negotiate(r.Header.Get("Accept")) == errorpage.FormatHTML
+}
+
+/* Remembers the warning was seen and sends the visitor on to the page they asked for. */
+func (i *IskndrServer) acknowledgeInterstitial(w http.ResponseWriter, r *http.Request) {
+	next := r.URL.Query().Get("next")
+	/* Only same-site paths, "//evil.example" would be an open redirect. */
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/"
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     interstitialCookie,
+		Value:    "1",
+		Path:     "/",
+		MaxAge:   int((7 * 24 * time.Hour).Seconds()),
+		HttpOnly: true,
+		Secure:   i.publicURLBase.Scheme == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+/* Cookies of the server itself are never seen by the local application. */
+func removeCookie(headers http.Header, name string) {
+	cookies, err := http.ParseCookie(strings.Join(headers.Values("Cookie"), "; "))
+	if err != nil {
+		return
+	}
+
+	kept := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			kept = append(kept, cookie.String())
+		}
+	}
+	if len(kept) == len(cookies) {
+		return
+	}
+	if len(kept) == 0 {
+		headers.Del("Cookie")
+		return
+	}
+	headers.Set("Cookie", strings.Join(kept, "; "))
+}
+
+/* Counts response bytes against the tunnel's bandwidth quota as they are written. */
+type quotaResponseWriter struct {
+	http.ResponseWriter
+	quota *quota.Tunnel
+}
+
+func (q *quotaResponseWriter) Write(b []byte) (int, error) {
+	n, err := q.ResponseWriter.Write(b)
+	q.quota.AddBytes(int64(n))
+	return n, err
+}
+
+func (q *quotaResponseWriter) Flush() {
+	if flusher, ok := q.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (q *quotaResponseWriter) Unwrap() http.ResponseWriter {
+	return q.ResponseWriter
+}
+
+/*
+Requests keep the ID a trusted proxy assigned (e.g. nginx's $request_id) so its logs line up with ours.
+Anyone else gets a fresh ID, as does a trusted one that is malformed. An ID that turns out to be in
+flight already is replaced when the request is registered, since the ID also routes the response back.
+*/
+func (i *IskndrServer) newRequestId(r *http.Request) string {
+	if forwarded.FromTrustedProxy(r, i.trustedProxies) {
+		if id := r.Header.Get(i.requestIdHeader); validRequestId(id) {
+			return id
+		}
+	}
+	return uuid.New().String()
+}
+
+func validRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLength {
+		return false
+	}
+	for _, c := range []byte(id) {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func (i *IskndrServer) attachPolicy(subdomain string, engine *policy.Engine) {
+	if engine == nil {
+		return
+	}
+	i.policiesMu.Lock()
+	defer i.policiesMu.Unlock()
+	i.policies[subdomain] = engine
+}
+
+func (i *IskndrServer) detachPolicy(subdomain string) {
+	i.policiesMu.Lock()
+	defer i.policiesMu.Unlock()
+	delete(i.policies, subdomain)
+}
+
+func (i *IskndrServer) tunnelPolicy(subdomain string) *policy.Engine {
+	i.policiesMu.RLock()
+	defer i.policiesMu.RUnlock()
+	return i.policies[subdomain]
+}
+
+/* Applies the policy's response header rules and CORS headers right before the headers are sent. */
+type policyResponseWriter struct {
+	http.ResponseWriter
+	evaluation  *policy.Evaluation
+	wroteHeader bool
+}
+
+func (p *policyResponseWriter) WriteHeader(status int) {
+	if !p.wroteHeader {
+		p.wroteHeader = true
+		p.evaluation.RewriteResponse(p.Header())
+	}
+	p.ResponseWriter.WriteHeader(status)
+}
+
+func (p *policyResponseWriter) Write(b []byte) (int, error) {
+	if !p.wroteHeader {
+		p.WriteHeader(http.StatusOK)
+	}
+	return p.ResponseWriter.Write(b)
+}
+
+func (p *policyResponseWriter) Flush() {
+	if flusher, ok := p.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (p *policyResponseWriter) Unwrap() http.ResponseWriter {
+	return p.ResponseWriter
+}
+
+/* Records the status and body size of a response for the access log and the request span. */
+type accessResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (a *accessResponseWriter) WriteHeader(status int) {
+	if a.status == 0 {
+		a.status = status
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *accessResponseWriter) Write(b []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	n, err := a.ResponseWriter.Write(b)
+	a.bytes += int64(n)
+	return n, err
+}
+
+func (a *accessResponseWriter) Flush() {
+	if flusher, ok := a.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (a *accessResponseWriter) Unwrap() http.ResponseWriter {
+	return a.ResponseWriter
+}
+
+func (i *IskndrServer) logAccess(r *http.Request, recorder *accessResponseWriter, subdomain, requestId string, startTime time.Time) {
+	status := recorder.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	i.accessLog.Log(logger.AccessEntry{
+		Time:       startTime,
+		RemoteAddr: forwarded.ClientIP(r, i.trustedProxies),
+		Method:     r.Method,
+		URI:        r.RequestURI,
+		Proto:      r.Proto,
+		Status:     status,
+		Bytes:      recorder.bytes,
+		Duration:   time.Since(startTime),
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+		Subdomain:  subdomain,
+		RequestID:  requestId,
+	})
+}
+
+/* Server errors mark the span as failed, client errors are the visitor's problem and leave it unset. */
+func endRequestSpan(span trace.Span, recorder *accessResponseWriter) {
+	status := recorder.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+/* Trailers arrive with the final message, TrailerPrefix lets them be set after the body was written. */
+func writeTrailers(w http.ResponseWriter, trailers map[string]string) {
+	for k, v := range trailers {
+		w.Header().Set(http.TrailerPrefix+k, v)
+	}
+}
+
+func (i *IskndrServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("OK"))
+}
@@ -0,0 +1,1379 @@
+package tunnelserver
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/igneel64/iskandar/server/internal/config"
+	cerrors "github.com/igneel64/iskandar/server/internal/errors"
+	"github.com/igneel64/iskandar/server/logger"
+	"github.com/igneel64/iskandar/shared/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type MockConnectionStore struct {
+	mock.Mock
+}
+
+func (m *MockConnectionStore) RegisterConnection(conn *websocket.Conn, limits protocol.TunnelLimits) (string, error) {
+	args := m.Called(conn, limits)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockConnectionStore) GetConnection(subdomain string) (*TunnelConnection, error) {
+	args := m.Called(subdomain)
+	return args.Get(0).(*TunnelConnection), args.Error(1)
+}
+
+func (m *MockConnectionStore) RemoveConnection(subdomain string) {
+	m.Called(subdomain)
+}
+
+type MockRequestManager struct {
+	mock.Mock
+}
+
+func (m *MockRequestManager) GetRequestChannel(requestId string) (MessageChannel, bool) {
+	args := m.Called(requestId)
+	return args.Get(0).(MessageChannel), args.Bool(1)
+}
+
+func (m *MockRequestManager) RegisterRequest(requestId string, subdomain string) (MessageChannel, error) {
+	args := m.Called(requestId, subdomain)
+	return args.Get(0).(MessageChannel), args.Error(1)
+}
+
+func (m *MockRequestManager) RemoveRequest(requestId string, subdomain string) {
+	m.Called(requestId, subdomain)
+}
+
+var testLimitsPolicy = config.LimitsPolicy{
+	Defaults: protocol.TunnelLimits{
+		MaxBodySize:            4 * 1024 * 1024,
+		ResponseTimeout:        30 * time.Second,
+		StreamIdleTimeout:      30 * time.Second,
+		EventStreamIdleTimeout: 10 * time.Minute,
+	},
+	Ceilings: protocol.TunnelLimits{
+		MaxBodySize:            32 * 1024 * 1024,
+		ResponseTimeout:        5 * time.Minute,
+		StreamIdleTimeout:      10 * time.Minute,
+		EventStreamIdleTimeout: 24 * time.Hour,
+	},
+}
+
+func newTestServer(t *testing.T, publicURLBase *url.URL, connectionStore ConnectionStore, requestManager RequestManager) *IskndrServer {
+	t.Helper()
+	server, err := NewIskndrServer(publicURLBase,
+		WithConnectionStore(connectionStore),
+		WithRequestManager(requestManager),
+		WithLimits(testLimitsPolicy.Defaults, testLimitsPolicy.Ceilings),
+		WithLogger(logger.NewLogger(false)),
+	)
+	require.NoError(t, err)
+	return server
+}
+
+func TestNewIskndrServer(t *testing.T) {
+	publicURLBase, err := url.Parse("http://localhost.direct:8080")
+	require.NoError(t, err)
+
+	t.Run("uses in-memory defaults without options", func(t *testing.T) {
+		server, err := NewIskndrServer(publicURLBase)
+		require.NoError(t, err)
+
+		assert.IsType(t, &InMemoryConnectionStore{}, server.connStore)
+		assert.IsType(t, &InMemoryRequestManager{}, server.requestManager)
+		assert.Equal(t, DefaultLimits, server.limitsPolicy.Defaults)
+		assert.Equal(t, DefaultLimitCeilings, server.limitsPolicy.Ceilings)
+		assert.NotNil(t, server.logger)
+	})
+
+	t.Run("returns error for invalid trusted proxies", func(t *testing.T) {
+		_, err := NewIskndrServer(publicURLBase, WithTrustedProxies("not-an-ip"))
+		assert.Error(t, err)
+	})
+}
+
+func TestServer(t *testing.T) {
+	publicURLBase, err := url.Parse("http://localhost.direct:8080")
+	require.NoError(t, err)
+
+	t.Run("accepts websocket connection at /tunnel/connect", func(t *testing.T) {
+		connectionStore := NewInMemoryConnectionStore(10, 4*1024*1024)
+		requestManager := NewInMemoryRequestManager(10)
+		server := newTestServer(t, publicURLBase, connectionStore, requestManager)
+
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/tunnel/connect"
+
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		require.NoError(t, err, "should connect to websocket")
+		//nolint:errcheck
+		defer conn.Close()
+
+		var regMsg protocol.RegisterTunnelMessage
+		err = conn.ReadJSON(&regMsg)
+		require.NoError(t, err)
+
+		assert.NotEmpty(t, regMsg.Subdomain)
+		assert.Contains(t, regMsg.Subdomain, "http://")
+		require.NotNil(t, regMsg.Limits)
+		assert.Equal(t, testLimitsPolicy.Defaults, *regMsg.Limits)
+	})
+
+	t.Run("applies limits requested by the client within ceilings", func(t *testing.T) {
+		connectionStore := NewInMemoryConnectionStore(10, 4*1024*1024)
+		requestManager := NewInMemoryRequestManager(10)
+		server := newTestServer(t, publicURLBase, connectionStore, requestManager)
+
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/tunnel/connect?response_timeout=3m&stream_idle_timeout=1h"
+
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		require.NoError(t, err, "should connect to websocket")
+		//nolint:errcheck
+		defer conn.Close()
+
+		var regMsg protocol.RegisterTunnelMessage
+		err = conn.ReadJSON(&regMsg)
+		require.NoError(t, err)
+
+		require.NotNil(t, regMsg.Limits)
+		assert.Equal(t, testLimitsPolicy.Defaults.MaxBodySize, regMsg.Limits.MaxBodySize)
+		assert.Equal(t, 3*time.Minute, regMsg.Limits.ResponseTimeout)
+		assert.Equal(t, testLimitsPolicy.Ceilings.StreamIdleTimeout, regMsg.Limits.StreamIdleTimeout)
+	})
+
+	t.Run("negotiates compression unless disabled", func(t *testing.T) {
+		dialer := websocket.Dialer{EnableCompression: true}
+
+		for _, enabled := range []bool{true, false} {
+			server, err := NewIskndrServer(publicURLBase, WithCompression(enabled))
+			require.NoError(t, err)
+
+			ts := httptest.NewServer(server)
+			conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/tunnel/connect", nil)
+			require.NoError(t, err)
+
+			assert.Equal(t, enabled, strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate"))
+
+			//nolint:errcheck
+			conn.Close()
+			ts.Close()
+		}
+	})
+
+	t.Run("rejects invalid requested limits", func(t *testing.T) {
+		connectionStore := NewInMemoryConnectionStore(10, 4*1024*1024)
+		requestManager := NewInMemoryRequestManager(10)
+		server := newTestServer(t, publicURLBase, connectionStore, requestManager)
+
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/tunnel/connect?response_timeout=forever"
+
+		_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		require.Error(t, err)
+		require.NotNil(t, resp)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestHandleRequest(t *testing.T) {
+	t.Run("error on request without subdomain", func(t *testing.T) {
+		publicURLBase, err := url.Parse("http://localhost.direct:8080")
+		require.NoError(t, err)
+
+		mockConnectionStore := new(MockConnectionStore)
+		mockRequestManager := new(MockRequestManager)
+
+		server := newTestServer(t, publicURLBase, mockConnectionStore, mockRequestManager)
+
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		req, err := http.NewRequest("GET", ts.URL+"/test-path", nil)
+		require.NoError(t, err)
+		req.Host = "localhost"
+
+		response := httptest.NewRecorder()
+
+		server.handleRequest(response, req)
+
+		result := response.Result()
+		//nolint:errcheck
+		defer result.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, result.StatusCode)
+		assert.Equal(t, "Invalid subdomain\n", response.Body.String())
+	})
+
+	t.Run("error on request to unassigned subdomain", func(t *testing.T) {
+		publicURLBase, err := url.Parse("http://localhost.direct:8080")
+		require.NoError(t, err)
+
+		mockConnectionStore := new(MockConnectionStore)
+		mockRequestManager := new(MockRequestManager)
+		mockConnectionStore.On("GetConnection", "test").Return((*TunnelConnection)(nil), errors.New("not found"))
+
+		server := newTestServer(t, publicURLBase, mockConnectionStore, mockRequestManager)
+
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		req, err := http.NewRequest("GET", ts.URL+"/test-path", nil)
+		require.NoError(t, err)
+		req.Host = "test.localhost"
+
+		response := httptest.NewRecorder()
+
+		server.handleRequest(response, req)
+
+		result := response.Result()
+		//nolint:errcheck
+		defer result.Body.Close()
+
+		assert.Equal(t, http.StatusNotFound, result.StatusCode)
+		assert.Equal(t, "No tunnel found for subdomain\n", response.Body.String())
+	})
+}
+
+func connectTestTunnel(t *testing.T, ts *httptest.Server) (*websocket.Conn, string) {
+	t.Helper()
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/tunnel/connect"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		//nolint:errcheck
+		conn.Close()
+	})
+
+	var regMsg protocol.RegisterTunnelMessage
+	require.NoError(t, conn.ReadJSON(&regMsg))
+
+	publicURL, err := url.Parse(regMsg.Subdomain)
+	require.NoError(t, err)
+
+	return conn, publicURL.Host
+}
+
+func TestHandleRequestForwarding(t *testing.T) {
+	publicURLBase, err := url.Parse("http://localhost.direct:8080")
+	require.NoError(t, err)
+
+	t.Run("forwards request with proxy headers to the tunnel", func(t *testing.T) {
+		server := newTestServer(t, publicURLBase, NewInMemoryConnectionStore(10, 4*1024*1024), NewInMemoryRequestManager(10))
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		conn, publicHost := connectTestTunnel(t, ts)
+
+		received := make(chan protocol.Message, 1)
+		go func() {
+			var msg protocol.Message
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			received <- msg
+			_ = conn.WriteJSON(&protocol.Message{Type: "response", Id: msg.Id, Status: http.StatusOK, Body: []byte("ok"), Done: true})
+		}()
+
+		req, err := http.NewRequest("GET", ts.URL+"/callback?code=1", nil)
+		require.NoError(t, err)
+		req.Host = publicHost
+		req.Header.Set("X-Forwarded-For", "1.2.3.4")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		//nolint:errcheck
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		msg := <-received
+		assert.Equal(t, "/callback?code=1", msg.Path)
+		assert.Equal(t, "127.0.0.1", msg.Headers["X-Forwarded-For"])
+		assert.Equal(t, "http", msg.Headers["X-Forwarded-Proto"])
+		assert.Equal(t, publicHost, msg.Headers["X-Forwarded-Host"])
+		assert.Contains(t, msg.Headers["Forwarded"], "for=127.0.0.1")
+	})
+
+	t.Run("serves h2c requests and forwards trailers", func(t *testing.T) {
+		server := newTestServer(t, publicURLBase, NewInMemoryConnectionStore(10, 4*1024*1024), NewInMemoryRequestManager(10))
+		ts := httptest.NewUnstartedServer(server)
+		ts.Config = NewHTTPServer("", server, true)
+		ts.Start()
+		defer ts.Close()
+
+		conn, publicHost := connectTestTunnel(t, ts)
+
+		go func() {
+			var msg protocol.Message
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			_ = conn.WriteJSON(&protocol.Message{Type: "response", Id: msg.Id, Status: http.StatusOK, Headers: map[string]string{"Content-Type": "application/grpc"}, Body: []byte("payload")})
+			_ = conn.WriteJSON(&protocol.Message{Type: "response", Id: msg.Id, Done: true, Trailers: map[string]string{"Grpc-Status": "0", "Grpc-Message": "OK"}})
+		}()
+
+		protocols := new(http.Protocols)
+		protocols.SetUnencryptedHTTP2(true)
+		client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+
+		req, err := http.NewRequest("POST", ts.URL+"/helloworld.Greeter/SayHello", strings.NewReader("request"))
+		require.NoError(t, err)
+		req.Host = publicHost
+
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		//nolint:errcheck
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, resp.ProtoMajor)
+		assert.Equal(t, "payload", string(body))
+		assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+		assert.Equal(t, "OK", resp.Trailer.Get("Grpc-Message"))
+	})
+}
+
+type trackingResponseWriter struct {
+	*httptest.ResponseRecorder
+	writeTimestamps []time.Time
+	flushCount      int
+}
+
+func newTrackingResponseWriter() *trackingResponseWriter {
+	return &trackingResponseWriter{
+		ResponseRecorder: httptest.NewRecorder(),
+		writeTimestamps:  []time.Time{},
+		flushCount:       0,
+	}
+}
+
+func (trw *trackingResponseWriter) Write(b []byte) (int, error) {
+	trw.writeTimestamps = append(trw.writeTimestamps, time.Now())
+	return trw.ResponseRecorder.Write(b)
+}
+
+func (trw *trackingResponseWriter) Flush() {
+	trw.flushCount++
+	trw.ResponseRecorder.Flush()
+}
+
+func TestWriteProxiedResponse(t *testing.T) {
+	publicURLBase, err := url.Parse("http://localhost.direct:8080")
+	require.NoError(t, err)
+
+	server := newTestServer(t, publicURLBase, new(MockConnectionStore), new(MockRequestManager))
+
+	t.Run("send back response from channel", func(t *testing.T) {
+		ch := make(chan protocol.Message, 1)
+		defer close(ch)
+
+		responseMessage := protocol.Message{
+			Type:   "response",
+			Id:     "req-123",
+			Status: 200,
+			Body:   []byte("Hello, World!"),
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+			Done: true,
+		}
+		ch <- responseMessage
+
+		response := httptest.NewRecorder()
+
+		err := server.writeProxiedResponse(response, ch, testLimitsPolicy.Defaults, "req-123", "subdomain", "/test", "GET", time.Now())
+		require.NoError(t, err)
+
+		result := response.Result()
+		//nolint:errcheck
+		defer result.Body.Close()
+
+		assert.Equal(t, 200, result.StatusCode)
+		assert.Equal(t, "text/plain", result.Header.Get("Content-Type"))
+		assert.Equal(t, "Hello, World!", response.Body.String())
+	})
+
+	t.Run("send back every Set-Cookie", func(t *testing.T) {
+		ch := make(chan protocol.Message, 1)
+		defer close(ch)
+
+		ch <- protocol.Message{
+			Type:       "response",
+			Id:         "req-123",
+			Status:     200,
+			Headers:    map[string]string{"Set-Cookie": "a=1, b=2"},
+			SetCookies: []string{"a=1", "b=2"},
+			Done:       true,
+		}
+
+		response := httptest.NewRecorder()
+		err := server.writeProxiedResponse(response, ch, testLimitsPolicy.Defaults, "req-123", "subdomain", "/test", "GET", time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a=1", "b=2"}, response.Header().Values("Set-Cookie"))
+	})
+
+	t.Run("send back stream response from channel", func(t *testing.T) {
+		ch := make(chan protocol.Message)
+		defer close(ch)
+
+		responseFirstMessage := protocol.Message{
+			Type:   "response",
+			Id:     "req-123",
+			Status: 200,
+			Body:   []byte("Hello"),
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+			Done: false,
+		}
+
+		responseFinalMessage := protocol.Message{
+			Type: "response",
+			Id:   "req-123",
+			Body: []byte(", World!"),
+			Done: true,
+		}
+
+		go func() {
+			ch <- responseFirstMessage
+			time.Sleep(10 * time.Millisecond)
+			ch <- responseFinalMessage
+		}()
+
+		response := httptest.NewRecorder()
+
+		err := server.writeProxiedResponse(response, ch, testLimitsPolicy.Defaults, "req-123", "subdomain", "/test", "GET", time.Now())
+		require.NoError(t, err)
+
+		result := response.Result()
+		//nolint:errcheck
+		defer result.Body.Close()
+
+		assert.Equal(t, 200, result.StatusCode)
+		assert.Equal(t, "text/plain", result.Header.Get("Content-Type"))
+		assert.Equal(t, "Hello, World!", response.Body.String())
+	})
+
+	t.Run("sends channel not responding error", func(t *testing.T) {
+		ch := make(chan protocol.Message)
+		close(ch)
+		response := httptest.NewRecorder()
+
+		err := server.writeProxiedResponse(response, ch, testLimitsPolicy.Defaults, "req-123", "subdomain", "/test", "GET", time.Now())
+		require.Error(t, err)
+		assert.IsType(t, &cerrors.TunnelNotRespondingError{}, err)
+	})
+
+	t.Run("drops the connection when the CLI aborts the response", func(t *testing.T) {
+		ch := make(chan protocol.Message, 1)
+		defer close(ch)
+		ch <- protocol.Message{Type: "response", Id: "req-123", Abort: true, Done: true}
+		response := httptest.NewRecorder()
+
+		err := server.writeProxiedResponse(response, ch, testLimitsPolicy.Defaults, "req-123", "subdomain", "/test", "GET", time.Now())
+		assert.ErrorIs(t, err, errConnectionDropped)
+		assert.Empty(t, response.Body.String())
+	})
+
+	t.Run("sends timeout error when no response arrives within the response timeout", func(t *testing.T) {
+		ch := make(chan protocol.Message)
+		defer close(ch)
+		response := httptest.NewRecorder()
+
+		limits := testLimitsPolicy.Defaults
+		limits.ResponseTimeout = 10 * time.Millisecond
+
+		err := server.writeProxiedResponse(response, ch, limits, "req-123", "subdomain", "/test", "GET", time.Now())
+		require.Error(t, err)
+		assert.IsType(t, &cerrors.TimeoutError{}, err)
+	})
+
+	t.Run("stops streaming after the stream idle timeout", func(t *testing.T) {
+		ch := make(chan protocol.Message, 1)
+		defer close(ch)
+		ch <- protocol.Message{
+			Type:    "response",
+			Id:      "req-123",
+			Status:  200,
+			Headers: map[string]string{"Content-Length": "10"},
+			Body:    []byte("Hello"),
+			Done:    false,
+		}
+		response := httptest.NewRecorder()
+
+		limits := testLimitsPolicy.Defaults
+		limits.StreamIdleTimeout = 10 * time.Millisecond
+
+		err := server.writeProxiedResponse(response, ch, limits, "req-123", "subdomain", "/test", "GET", time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, "Hello", response.Body.String())
+	})
+
+	t.Run("keeps other streamed responses to the stream idle timeout", func(t *testing.T) {
+		ch := make(chan protocol.Message, 1)
+		defer close(ch)
+		ch <- protocol.Message{Type: "response", Id: "req-123", Status: 200, Headers: map[string]string{"Content-Type": "application/json", "Content-Length": "6"}, Body: []byte("[1,")}
+		response := httptest.NewRecorder()
+
+		limits := testLimitsPolicy.Defaults
+		limits.StreamIdleTimeout = 10 * time.Millisecond
+		limits.EventStreamIdleTimeout = time.Hour
+
+		err := server.writeProxiedResponse(response, ch, limits, "req-123", "subdomain", "/download", "GET", time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, "[1,", response.Body.String())
+	})
+
+	t.Run("uses the event stream idle timeout for chunked responses without keep-alive comments", func(t *testing.T) {
+		keepAliveServer, err := NewIskndrServer(publicURLBase, WithEventStreamKeepAlive(10*time.Millisecond))
+		require.NoError(t, err)
+
+		ch := make(chan protocol.Message, 1)
+		defer close(ch)
+		ch <- protocol.Message{Type: "response", Id: "req-123", Status: 200, Headers: map[string]string{"Content-Type": "application/json"}, Body: []byte("[1,"), Chunked: true}
+		response := httptest.NewRecorder()
+
+		limits := testLimitsPolicy.Defaults
+		limits.StreamIdleTimeout = 10 * time.Millisecond
+		limits.EventStreamIdleTimeout = 50 * time.Millisecond
+
+		start := time.Now()
+		err = keepAliveServer.writeProxiedResponse(response, ch, limits, "req-123", "subdomain", "/download", "GET", start)
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+		assert.Equal(t, "[1,", response.Body.String())
+	})
+
+	t.Run("stops event streams after the event stream idle timeout", func(t *testing.T) {
+		ch := make(chan protocol.Message, 1)
+		defer close(ch)
+		ch <- protocol.Message{Type: "response", Id: "req-123", Status: 200, Headers: map[string]string{"Content-Type": "text/event-stream"}, Body: []byte("data: hello\n\n")}
+		response := httptest.NewRecorder()
+
+		limits := testLimitsPolicy.Defaults
+		limits.EventStreamIdleTimeout = 10 * time.Millisecond
+
+		err := server.writeProxiedResponse(response, ch, limits, "req-123", "subdomain", "/events", "GET", time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, "data: hello\n\n", response.Body.String())
+		assert.Equal(t, "no", response.Header().Get("X-Accel-Buffering"))
+	})
+
+	t.Run("sends keep-alive comments on quiet event streams", func(t *testing.T) {
+		keepAliveServer, err := NewIskndrServer(publicURLBase, WithEventStreamKeepAlive(10*time.Millisecond))
+		require.NoError(t, err)
+
+		ch := make(chan protocol.Message)
+		defer close(ch)
+		go func() {
+			ch <- protocol.Message{Type: "response", Id: "req-123", Status: 200, Headers: map[string]string{"Content-Type": "text/event-stream; charset=utf-8"}, Body: []byte("data: first\n\n")}
+			time.Sleep(50 * time.Millisecond)
+			ch <- protocol.Message{Type: "response", Id: "req-123", Body: []byte("data: second\n\n"), Done: true}
+		}()
+		response := httptest.NewRecorder()
+
+		err = keepAliveServer.writeProxiedResponse(response, ch, testLimitsPolicy.Defaults, "req-123", "subdomain", "/events", "GET", time.Now())
+		require.NoError(t, err)
+
+		body := response.Body.String()
+		assert.True(t, strings.HasPrefix(body, "data: first\n\n: keep-alive\n"), body)
+		assert.True(t, strings.HasSuffix(body, "data: second\n\n"), body)
+	})
+
+	t.Run("does not split an event line with keep-alive comments", func(t *testing.T) {
+		keepAliveServer, err := NewIskndrServer(publicURLBase, WithEventStreamKeepAlive(10*time.Millisecond))
+		require.NoError(t, err)
+
+		ch := make(chan protocol.Message)
+		defer close(ch)
+		go func() {
+			ch <- protocol.Message{Type: "response", Id: "req-123", Status: 200, Headers: map[string]string{"Content-Type": "text/event-stream"}, Body: []byte("data: par")}
+			time.Sleep(50 * time.Millisecond)
+			ch <- protocol.Message{Type: "response", Id: "req-123", Body: []byte("tial\n\n"), Done: true}
+		}()
+		response := httptest.NewRecorder()
+
+		err = keepAliveServer.writeProxiedResponse(response, ch, testLimitsPolicy.Defaults, "req-123", "subdomain", "/events", "GET", time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, "data: partial\n\n", response.Body.String())
+	})
+
+	t.Run("streams chunks immediately before completion", func(t *testing.T) {
+		ch := make(chan protocol.Message)
+		defer close(ch)
+
+		responseFirstMessage := protocol.Message{
+			Type:   "response",
+			Id:     "req-123",
+			Status: 200,
+			Body:   []byte("Hello"),
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+			Done: false,
+		}
+
+		responseFinalMessage := protocol.Message{
+			Type: "response",
+			Id:   "req-123",
+			Body: []byte(", World!"),
+			Done: true,
+		}
+
+		response := newTrackingResponseWriter()
+		delay := 50 * time.Millisecond
+		go func() {
+			ch <- responseFirstMessage
+			time.Sleep(delay)
+			ch <- responseFinalMessage
+		}()
+
+		err := server.writeProxiedResponse(response, ch, testLimitsPolicy.Defaults, "req-123", "subdomain", "/test", "GET", time.Now())
+		require.NoError(t, err)
+
+		result := response.Result()
+		//nolint:errcheck
+		defer result.Body.Close()
+
+		assert.Equal(t, 200, result.StatusCode)
+		assert.Equal(t, "text/plain", result.Header.Get("Content-Type"))
+		assert.Equal(t, "Hello, World!", response.Body.String())
+		assert.Equal(t, response.flushCount, 2, "should have flushed at least twice")
+
+		assert.Len(t, response.writeTimestamps, 2)
+		timeBetweenWrites := response.writeTimestamps[1].Sub(response.writeTimestamps[0])
+		assert.GreaterOrEqual(t, timeBetweenWrites, delay,
+			"second write should be delayed (proves first write happened immediately)")
+	})
+}
+
+func TestTunnelQuotas(t *testing.T) {
+	publicURLBase, err := url.Parse("http://localhost.direct:8080")
+	require.NoError(t, err)
+
+	bearer := func(token string) http.Header {
+		return http.Header{"Authorization": []string{"Bearer " + token}}
+	}
+
+	t.Run("requires a valid token when tokens are configured", func(t *testing.T) {
+		server, err := NewIskndrServer(publicURLBase, WithTokens("secret"))
+		require.NoError(t, err)
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+		wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/tunnel/connect"
+
+		_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		require.Error(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		_, resp, err = websocket.DefaultDialer.Dial(wsURL, bearer("wrong"))
+		require.Error(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, bearer("secret"))
+		require.NoError(t, err)
+		//nolint:errcheck
+		conn.Close()
+	})
+
+	t.Run("caps tunnels per token", func(t *testing.T) {
+		server, err := NewIskndrServer(publicURLBase, WithTokens("secret"), WithQuotas(QuotaLimits{}, QuotaLimits{}, 1))
+		require.NoError(t, err)
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+		wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/tunnel/connect"
+
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, bearer("secret"))
+		require.NoError(t, err)
+		//nolint:errcheck
+		defer conn.Close()
+		var regMsg protocol.RegisterTunnelMessage
+		require.NoError(t, conn.ReadJSON(&regMsg))
+
+		_, resp, err := websocket.DefaultDialer.Dial(wsURL, bearer("secret"))
+		require.Error(t, err)
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	})
+
+	t.Run("rejects requests over the tunnel rate limit with Retry-After", func(t *testing.T) {
+		server, err := NewIskndrServer(publicURLBase, WithQuotas(QuotaLimits{RequestsPerSecond: 0.5, Burst: 1}, QuotaLimits{}, 0))
+		require.NoError(t, err)
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		conn, publicHost := connectTestTunnel(t, ts)
+		go func() {
+			for {
+				var msg protocol.Message
+				if err := conn.ReadJSON(&msg); err != nil {
+					return
+				}
+				_ = conn.WriteJSON(&protocol.Message{Type: "response", Id: msg.Id, Status: http.StatusOK, Body: []byte("ok"), Done: true})
+			}
+		}()
+
+		doRequest := func() *http.Response {
+			req, err := http.NewRequest("GET", ts.URL+"/", nil)
+			require.NoError(t, err)
+			req.Host = publicHost
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			//nolint:errcheck
+			resp.Body.Close()
+			return resp
+		}
+
+		assert.Equal(t, http.StatusOK, doRequest().StatusCode)
+
+		limited := doRequest()
+		assert.Equal(t, http.StatusTooManyRequests, limited.StatusCode)
+		assert.Equal(t, "2", limited.Header.Get("Retry-After"))
+	})
+}
+
+func TestTunnelExpiry(t *testing.T) {
+	publicURLBase, err := url.Parse("http://localhost.direct:8080")
+	require.NoError(t, err)
+
+	dialTunnel := func(t *testing.T, ts *httptest.Server, query string) (*websocket.Conn, protocol.RegisterTunnelMessage) {
+		t.Helper()
+		wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/tunnel/connect?" + query
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			//nolint:errcheck
+			conn.Close()
+		})
+
+		var regMsg protocol.RegisterTunnelMessage
+		require.NoError(t, conn.ReadJSON(&regMsg))
+		return conn, regMsg
+	}
+
+	t.Run("closes the tunnel with a reason after its TTL", func(t *testing.T) {
+		server := newTestServer(t, publicURLBase, NewInMemoryConnectionStore(10, 4*1024*1024), NewInMemoryRequestManager(10))
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		conn, regMsg := dialTunnel(t, ts, "ttl=50ms")
+		assert.Equal(t, 50*time.Millisecond, regMsg.Limits.TTL)
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		var msg protocol.Message
+		err := conn.ReadJSON(&msg)
+
+		var closeErr *websocket.CloseError
+		require.ErrorAs(t, err, &closeErr)
+		assert.Equal(t, websocket.CloseNormalClosure, closeErr.Code)
+		assert.Equal(t, "Tunnel expired after 50ms", closeErr.Text)
+	})
+
+	t.Run("caps the TTL at the server maximum", func(t *testing.T) {
+		ceilings := testLimitsPolicy.Ceilings
+		ceilings.TTL = time.Hour
+		server, err := NewIskndrServer(publicURLBase, WithLimits(testLimitsPolicy.Defaults, ceilings))
+		require.NoError(t, err)
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		_, regMsg := dialTunnel(t, ts, "")
+		assert.Equal(t, time.Hour, regMsg.Limits.TTL)
+
+		_, regMsg = dialTunnel(t, ts, "ttl=48h")
+		assert.Equal(t, time.Hour, regMsg.Limits.TTL)
+	})
+
+	t.Run("admits only the first visitor of a one-time link", func(t *testing.T) {
+		server := newTestServer(t, publicURLBase, NewInMemoryConnectionStore(10, 4*1024*1024), NewInMemoryRequestManager(10))
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		conn, regMsg := dialTunnel(t, ts, "max_uses=1")
+		publicURL, err := url.Parse(regMsg.Subdomain)
+		require.NoError(t, err)
+
+		received := make(chan protocol.Message, 10)
+		go func() {
+			for {
+				var msg protocol.Message
+				if err := conn.ReadJSON(&msg); err != nil {
+					return
+				}
+				received <- msg
+				_ = conn.WriteJSON(&protocol.Message{Type: "response", Id: msg.Id, Status: http.StatusOK, Body: []byte("ok"), Done: true})
+			}
+		}()
+
+		doRequest := func(cookies ...*http.Cookie) *http.Response {
+			req, err := http.NewRequest("GET", ts.URL+"/", nil)
+			require.NoError(t, err)
+			req.Host = publicURL.Host
+			for _, cookie := range cookies {
+				req.AddCookie(cookie)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			//nolint:errcheck
+			resp.Body.Close()
+			return resp
+		}
+
+		first := doRequest(&http.Cookie{Name: "session", Value: "abc"})
+		assert.Equal(t, http.StatusOK, first.StatusCode)
+		require.Len(t, first.Cookies(), 1)
+		visitor := first.Cookies()[0]
+		assert.Equal(t, visitorCookie, visitor.Name)
+		assert.Equal(t, "session=abc", (<-received).Headers["Cookie"])
+
+		assert.Equal(t, http.StatusGone, doRequest().StatusCode)
+
+		returning := doRequest(visitor, &http.Cookie{Name: "session", Value: "abc"})
+		assert.Equal(t, http.StatusOK, returning.StatusCode)
+		assert.Empty(t, returning.Cookies())
+		assert.Equal(t, "session=abc", (<-received).Headers["Cookie"])
+	})
+}
+
+func TestErrorPages(t *testing.T) {
+	publicURLBase, err := url.Parse("http://localhost.direct:8080")
+	require.NoError(t, err)
+
+	serveTunnel := func(t *testing.T, conn *websocket.Conn, respond func(msg protocol.Message) protocol.Message) chan protocol.Message {
+		received := make(chan protocol.Message, 10)
+		go func() {
+			for {
+				var msg protocol.Message
+				if err := conn.ReadJSON(&msg); err != nil {
+					return
+				}
+				received <- msg
+				response := respond(msg)
+				_ = conn.WriteJSON(&response)
+			}
+		}()
+		return received
+	}
+
+	get := func(t *testing.T, ts *httptest.Server, host, path string, header http.Header) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest("GET", ts.URL+path, nil)
+		require.NoError(t, err)
+		req.Host = host
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		//nolint:errcheck
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+	browser := http.Header{"Accept": []string{"text/html,application/xhtml+xml,*/*;q=0.8"}}
+
+	t.Run("renders an HTML page for browsers", func(t *testing.T) {
+		server := newTestServer(t, publicURLBase, NewInMemoryConnectionStore(10, 4*1024*1024), NewInMemoryRequestManager(10))
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		resp, body := get(t, ts, "missing.localhost.direct:8080", "/", browser)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Contains(t, body, "No tunnel found for subdomain")
+	})
+
+	t.Run("renders errors reported by the CLI", func(t *testing.T) {
+		server := newTestServer(t, publicURLBase, NewInMemoryConnectionStore(10, 4*1024*1024), NewInMemoryRequestManager(10))
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		conn, publicHost := connectTestTunnel(t, ts)
+		serveTunnel(t, conn, func(msg protocol.Message) protocol.Message {
+			return protocol.Message{Type: "response", Id: msg.Id, Status: http.StatusBadGateway, Body: []byte("App is restarting"), Error: "App is restarting", Done: true}
+		})
+
+		resp, body := get(t, ts, publicHost, "/", http.Header{"Accept": []string{"application/json"}})
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		assert.JSONEq(t, `{"error":{"status":502,"title":"Bad Gateway","message":"App is restarting"}}`, body)
+	})
+
+	t.Run("answers for an unhealthy application without a round trip", func(t *testing.T) {
+		server := newTestServer(t, publicURLBase, NewInMemoryConnectionStore(10, 4*1024*1024), NewInMemoryRequestManager(10))
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		conn, publicHost := connectTestTunnel(t, ts)
+		require.NoError(t, conn.WriteJSON(&protocol.Message{Type: "health", Health: protocol.HealthUnhealthy}))
+		received := serveTunnel(t, conn, func(msg protocol.Message) protocol.Message {
+			return protocol.Message{Type: "response", Id: msg.Id, Status: http.StatusOK, Done: true}
+		})
+
+		assert.Eventually(t, func() bool {
+			resp, _ := get(t, ts, publicHost, "/", browser)
+			return resp.StatusCode == http.StatusServiceUnavailable
+		}, time.Second, 10*time.Millisecond)
+		_, body := get(t, ts, publicHost, "/", browser)
+		assert.Contains(t, body, "The application behind this tunnel is not available right now")
+		assert.Empty(t, received)
+
+		require.NoError(t, conn.WriteJSON(&protocol.Message{Type: "health", Health: protocol.HealthHealthy}))
+		assert.Eventually(t, func() bool {
+			resp, _ := get(t, ts, publicHost, "/", browser)
+			return resp.StatusCode == http.StatusOK
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("uses custom templates", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "404.html"), []byte("<p>Acme: {{.Message}}</p>"), 0o644))
+		server, err := NewIskndrServer(publicURLBase, WithErrorPages(dir))
+		require.NoError(t, err)
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		_, body := get(t, ts, "missing.localhost.direct:8080", "/", browser)
+		assert.Equal(t, "<p>Acme: No tunnel found for subdomain</p>", body)
+	})
+
+	t.Run("warns browsers on their first visit", func(t *testing.T) {
+		server, err := NewIskndrServer(publicURLBase, WithInterstitial(true))
+		require.NoError(t, err)
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		conn, publicHost := connectTestTunnel(t, ts)
+		received := serveTunnel(t, conn, func(msg protocol.Message) protocol.Message {
+			return protocol.Message{Type: "response", Id: msg.Id, Status: http.StatusOK, Body: []byte("app"), Done: true}
+		})
+
+		resp, body := get(t, ts, publicHost, "/dashboard?tab=1", browser)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, body, "You are about to visit")
+		assert.Contains(t, body, `href="/__iskndr/continue?next=%2Fdashboard%3Ftab%3D1"`)
+		assert.Empty(t, received)
+
+		resp, _ = get(t, ts, publicHost, "/__iskndr/continue?next=%2Fdashboard%3Ftab%3D1", browser)
+		assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+		assert.Equal(t, "/dashboard?tab=1", resp.Header.Get("Location"))
+		require.Len(t, resp.Cookies(), 1)
+		ack := resp.Cookies()[0]
+
+		withCookie := browser.Clone()
+		withCookie.Set("Cookie", ack.Name+"="+ack.Value)
+		_, body = get(t, ts, publicHost, "/dashboard?tab=1", withCookie)
+		assert.Equal(t, "app", body)
+		assert.Empty(t, (<-received).Headers["Cookie"])
+
+		_, body = get(t, ts, publicHost, "/api", http.Header{"Accept": []string{"application/json"}})
+		assert.Equal(t, "app", body)
+		<-received
+
+		_, body = get(t, ts, publicHost, "/", http.Header{"Accept": []string{"text/html"}, "Iskndr-Skip-Warning": []string{"1"}})
+		assert.Equal(t, "app", body)
+		<-received
+	})
+
+	t.Run("only continues to paths of the tunnel", func(t *testing.T) {
+		server, err := NewIskndrServer(publicURLBase, WithInterstitial(true))
+		require.NoError(t, err)
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		_, publicHost := connectTestTunnel(t, ts)
+
+		for _, next := range []string{"https://evil.example", "//evil.example", "/\\evil.example"} {
+			resp, _ := get(t, ts, publicHost, "/__iskndr/continue?next="+url.QueryEscape(next), nil)
+			assert.Equal(t, "/", resp.Header.Get("Location"), next)
+		}
+	})
+}
+
+type recordingAccessLogger struct {
+	entries chan logger.AccessEntry
+}
+
+func (r *recordingAccessLogger) Log(entry logger.AccessEntry) {
+	r.entries <- entry
+}
+
+func TestAccessLog(t *testing.T) {
+	publicURLBase, err := url.Parse("http://localhost.direct:8080")
+	require.NoError(t, err)
+
+	accessLog := &recordingAccessLogger{entries: make(chan logger.AccessEntry, 10)}
+	server, err := NewIskndrServer(publicURLBase, WithAccessLog(accessLog))
+	require.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	conn, publicHost := connectTestTunnel(t, ts)
+	go func() {
+		var msg protocol.Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		_ = conn.WriteJSON(&protocol.Message{Type: "response", Id: msg.Id, Status: http.StatusCreated, Body: []byte("created"), Done: true})
+	}()
+
+	req, err := http.NewRequest("POST", ts.URL+"/items?id=1", nil)
+	require.NoError(t, err)
+	req.Host = publicHost
+	req.Header.Set("User-Agent", "test-agent")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	//nolint:errcheck
+	resp.Body.Close()
+
+	entry := <-accessLog.entries
+	assert.Equal(t, "POST", entry.Method)
+	assert.Equal(t, "/items?id=1", entry.URI)
+	assert.Equal(t, http.StatusCreated, entry.Status)
+	assert.Equal(t, int64(len("created")), entry.Bytes)
+	assert.Equal(t, "127.0.0.1", entry.RemoteAddr)
+	assert.Equal(t, "test-agent", entry.UserAgent)
+	assert.Equal(t, strings.Split(publicHost, ".")[0], entry.Subdomain)
+	assert.NotEmpty(t, entry.RequestID)
+
+	req, err = http.NewRequest("GET", ts.URL+"/", nil)
+	require.NoError(t, err)
+	req.Host = "missing.localhost.direct:8080"
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	//nolint:errcheck
+	resp.Body.Close()
+
+	entry = <-accessLog.entries
+	assert.Equal(t, http.StatusNotFound, entry.Status)
+	assert.Equal(t, "missing", entry.Subdomain)
+}
+
+func TestTracing(t *testing.T) {
+	publicURLBase, err := url.Parse("http://localhost.direct:8080")
+	require.NoError(t, err)
+
+	const visitorTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	/* Sends a request with visitorTraceparent and returns the span of the server and the message the tunnel got. */
+	tracedRequest := func(t *testing.T, opts ...Option) (sdktrace.ReadOnlySpan, protocol.Message) {
+		t.Helper()
+		spans := tracetest.NewSpanRecorder()
+		server, err := NewIskndrServer(publicURLBase, append(opts, WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))))...)
+		require.NoError(t, err)
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		conn, publicHost := connectTestTunnel(t, ts)
+		messages := make(chan protocol.Message, 1)
+		go func() {
+			var msg protocol.Message
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			messages <- msg
+			_ = conn.WriteJSON(&protocol.Message{Type: "response", Id: msg.Id, Status: http.StatusBadGateway, Error: "Local application is unreachable", Done: true})
+		}()
+
+		req, err := http.NewRequest("GET", ts.URL+"/orders?id=1", nil)
+		require.NoError(t, err)
+		req.Host = publicHost
+		req.Header.Set("traceparent", visitorTraceparent)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		//nolint:errcheck
+		resp.Body.Close()
+
+		require.Eventually(t, func() bool { return len(spans.Ended()) == 1 }, time.Second, 10*time.Millisecond)
+		return spans.Ended()[0], <-messages
+	}
+
+	t.Run("continues the trace of a trusted proxy", func(t *testing.T) {
+		span, msg := tracedRequest(t, WithTrustedProxies("127.0.0.1"))
+		assert.Equal(t, "GET", span.Name())
+		assert.Equal(t, trace.SpanKindServer, span.SpanKind())
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String())
+		assert.Equal(t, "00f067aa0ba902b7", span.Parent().SpanID().String())
+		assert.Equal(t, codes.Error, span.Status().Code)
+		assert.Contains(t, span.Attributes(), semconv.HTTPResponseStatusCode(http.StatusBadGateway))
+		assert.Contains(t, span.Attributes(), semconv.URLPath("/orders"))
+
+		assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+span.SpanContext().SpanID().String()+"-01", msg.TraceContext["traceparent"])
+		assert.Equal(t, msg.Id, attributeValue(span.Attributes(), "iskndr.request_id"))
+		assert.Equal(t, visitorTraceparent, msg.Headers["Traceparent"], "the visitor's headers are forwarded untouched")
+	})
+
+	t.Run("starts a new trace for other clients", func(t *testing.T) {
+		span, msg := tracedRequest(t)
+		assert.False(t, span.Parent().IsValid())
+		assert.NotEqual(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String())
+		assert.Contains(t, msg.TraceContext["traceparent"], span.SpanContext().TraceID().String())
+	})
+}
+
+func attributeValue(attributes []attribute.KeyValue, key attribute.Key) string {
+	for _, kv := range attributes {
+		if kv.Key == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestRequestId(t *testing.T) {
+	publicURLBase, err := url.Parse("http://localhost.direct:8080")
+	require.NoError(t, err)
+
+	/* Answers every request with the ID the local application received and an ID of its own. */
+	serveTunnel := func(conn *websocket.Conn, header string) chan protocol.Message {
+		requests := make(chan protocol.Message, 10)
+		go func() {
+			for {
+				var msg protocol.Message
+				if err := conn.ReadJSON(&msg); err != nil {
+					return
+				}
+				requests <- msg
+				_ = conn.WriteJSON(&protocol.Message{Type: "response", Id: msg.Id, Status: http.StatusOK, Headers: map[string]string{header: "app-generated"}, Body: []byte(msg.Headers[header]), Done: true})
+			}
+		}()
+		return requests
+	}
+
+	get := func(t *testing.T, ts *httptest.Server, host string, headers map[string]string) (*http.Response, string) {
+		req, err := http.NewRequest("GET", ts.URL+"/", nil)
+		require.NoError(t, err)
+		req.Host = host
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		//nolint:errcheck
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	t.Run("generates an ID and replaces the one of an untrusted client", func(t *testing.T) {
+		server, err := NewIskndrServer(publicURLBase)
+		require.NoError(t, err)
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		conn, publicHost := connectTestTunnel(t, ts)
+		requests := serveTunnel(conn, "X-Request-Id")
+
+		resp, body := get(t, ts, publicHost, map[string]string{"X-Request-Id": "spoofed"})
+		msg := <-requests
+		assert.NotEqual(t, "spoofed", msg.Id)
+		assert.Equal(t, msg.Id, body, "the local application gets the ID")
+		assert.Equal(t, msg.Id, resp.Header.Get("X-Request-Id"), "the public client gets the same ID back")
+	})
+
+	t.Run("keeps the ID of a trusted proxy", func(t *testing.T) {
+		server, err := NewIskndrServer(publicURLBase, WithTrustedProxies("127.0.0.1"))
+		require.NoError(t, err)
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		conn, publicHost := connectTestTunnel(t, ts)
+		requests := serveTunnel(conn, "X-Request-Id")
+
+		resp, body := get(t, ts, publicHost, map[string]string{"X-Request-Id": "nginx-4f2a"})
+		assert.Equal(t, "nginx-4f2a", (<-requests).Id)
+		assert.Equal(t, "nginx-4f2a", body)
+		assert.Equal(t, "nginx-4f2a", resp.Header.Get("X-Request-Id"))
+
+		resp, _ = get(t, ts, publicHost, map[string]string{"X-Request-Id": "has spaces"})
+		assert.NotEqual(t, "has spaces", (<-requests).Id)
+		assert.NotEqual(t, "has spaces", resp.Header.Get("X-Request-Id"))
+
+		/* Two requests in flight with the same ID would get each other's responses. */
+		_, err = server.requestManager.RegisterRequest("nginx-busy", "other")
+		require.NoError(t, err)
+		resp, body = get(t, ts, publicHost, map[string]string{"X-Request-Id": "nginx-busy"})
+		msg := <-requests
+		assert.NotEqual(t, "nginx-busy", msg.Id)
+		assert.Equal(t, msg.Id, body)
+		assert.Equal(t, msg.Id, resp.Header.Get("X-Request-Id"))
+	})
+
+	t.Run("uses a custom header and sets it on error pages", func(t *testing.T) {
+		server, err := NewIskndrServer(publicURLBase, WithRequestIdHeader("x-correlation-id"))
+		require.NoError(t, err)
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		conn, publicHost := connectTestTunnel(t, ts)
+		requests := serveTunnel(conn, "X-Correlation-Id")
+
+		resp, body := get(t, ts, publicHost, nil)
+		msg := <-requests
+		assert.Equal(t, msg.Id, body)
+		assert.Equal(t, msg.Id, resp.Header.Get("X-Correlation-Id"))
+		assert.Empty(t, resp.Header.Get("X-Request-Id"))
+
+		resp, _ = get(t, ts, "missing.localhost.direct:8080", nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assert.NotEmpty(t, resp.Header.Get("X-Correlation-Id"))
+	})
+}
+
+func TestTrafficPolicy(t *testing.T) {
+	publicURLBase, err := url.Parse("http://localhost.direct:8080")
+	require.NoError(t, err)
+
+	policyFile := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, os.WriteFile(policyFile, []byte(`{"rules": [{"path": "/admin/**", "deny": {"status": 404, "message": "Not found"}}]}`), 0o600))
+
+	server, err := NewIskndrServer(publicURLBase, WithPolicyFile(policyFile))
+	require.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	dialWithPolicy := func(trafficPolicy protocol.TrafficPolicy) (*websocket.Conn, *http.Response, error) {
+		header := http.Header{}
+		require.NoError(t, trafficPolicy.EncodeHeader(header))
+		return websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/tunnel/connect", header)
+	}
+
+	t.Run("rejects invalid tunnel policies", func(t *testing.T) {
+		_, resp, err := dialWithPolicy(protocol.TrafficPolicy{Rules: []protocol.PolicyRule{{Path: "/nothing"}}})
+		require.ErrorIs(t, err, websocket.ErrBadHandshake)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	conn, _, err := dialWithPolicy(protocol.TrafficPolicy{
+		Rules: []protocol.PolicyRule{
+			{Path: "/admin/**", RequestHeaders: &protocol.HeaderRules{Set: map[string]string{"X-Admin": "true"}}},
+			{Path: "/old/**", Redirect: &protocol.PolicyRedirect{To: "/new"}},
+			{Path: "/hooks/github", Webhook: &protocol.WebhookVerification{Scheme: "github", Secret: "It's a Secret to Everybody"}},
+			{RequestHeaders: &protocol.HeaderRules{Set: map[string]string{"X-Env": "staging"}}, ResponseHeaders: &protocol.HeaderRules{Remove: []string{"Server"}}},
+		},
+		CORS: &protocol.CORSPolicy{AllowOrigins: []string{"https://partner.example.com"}},
+	})
+	require.NoError(t, err)
+	//nolint:errcheck
+	defer conn.Close()
+	var regMsg protocol.RegisterTunnelMessage
+	require.NoError(t, conn.ReadJSON(&regMsg))
+	publicURL, err := url.Parse(regMsg.Subdomain)
+	require.NoError(t, err)
+
+	requests := make(chan protocol.Message, 10)
+	go func() {
+		for {
+			var msg protocol.Message
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			requests <- msg
+			_ = conn.WriteJSON(&protocol.Message{Type: "response", Id: msg.Id, Status: http.StatusOK, Headers: map[string]string{"Server": "local"}, Body: []byte("ok"), Done: true})
+		}
+	}()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	do := func(method, path string, headers map[string]string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		require.NoError(t, err)
+		req.Host = publicURL.Host
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		//nolint:errcheck
+		resp.Body.Close()
+		return resp
+	}
+
+	t.Run("forwards with rewritten headers", func(t *testing.T) {
+		resp := do("GET", "/orders", map[string]string{"Origin": "https://partner.example.com"})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("Server"))
+		assert.Equal(t, "https://partner.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "staging", (<-requests).Headers["X-Env"])
+	})
+
+	t.Run("the server policy is evaluated first", func(t *testing.T) {
+		resp := do("GET", "/admin/users", nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("redirects and answers preflights at the edge", func(t *testing.T) {
+		resp := do("GET", "/old/orders/1", nil)
+		assert.Equal(t, http.StatusFound, resp.StatusCode)
+		assert.Equal(t, "/new/orders/1", resp.Header.Get("Location"))
+
+		resp = do("OPTIONS", "/orders", map[string]string{"Origin": "https://partner.example.com", "Access-Control-Request-Method": "PUT"})
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		assert.Equal(t, "PUT", resp.Header.Get("Access-Control-Allow-Methods"))
+		assert.Empty(t, requests, "nothing reaches the tunnel")
+	})
+
+	t.Run("verifies webhook signatures before forwarding", func(t *testing.T) {
+		post := func(signature string) *http.Response {
+			req, err := http.NewRequest("POST", ts.URL+"/hooks/github", strings.NewReader("Hello, World!"))
+			require.NoError(t, err)
+			req.Host = publicURL.Host
+			req.Header.Set("X-Hub-Signature-256", signature)
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			//nolint:errcheck
+			resp.Body.Close()
+			return resp
+		}
+
+		assert.Equal(t, http.StatusUnauthorized, post("sha256=00").StatusCode)
+		assert.Empty(t, requests, "nothing reaches the tunnel")
+
+		assert.Equal(t, http.StatusOK, post("sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17").StatusCode)
+		assert.Equal(t, "Hello, World!", string((<-requests).Body))
+	})
+
+	t.Run("rejects an invalid policy file", func(t *testing.T) {
+		invalid := filepath.Join(t.TempDir(), "policy.json")
+		require.NoError(t, os.WriteFile(invalid, []byte(`{"rules": [{"path": "/", "deny": {"status": 200}}]}`), 0o600))
+		_, err := NewIskndrServer(publicURLBase, WithPolicyFile(invalid))
+		assert.Error(t, err)
+
+		require.NoError(t, os.WriteFile(invalid, []byte(`{"rule": []}`), 0o600))
+		_, err = NewIskndrServer(publicURLBase, WithPolicyFile(invalid))
+		assert.ErrorContains(t, err, "unknown field")
+
+		require.NoError(t, os.WriteFile(invalid, []byte(`{"rules": [{"webhook": {"scheme": "stripe", "secret_env": "ISKNDR_TEST_UNSET_SECRET"}}]}`), 0o600))
+		_, err = NewIskndrServer(publicURLBase, WithPolicyFile(invalid))
+		assert.ErrorContains(t, err, "ISKNDR_TEST_UNSET_SECRET")
+	})
+}